@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// publicDomains holds the base URLs short links are served from. Every link
+// resolves on all of them; the one matching a request's host is used in
+// responses and analytics, falling back to the first.
+type publicDomains struct {
+	urls   []string
+	byHost map[string]string // Lowercase host, with the port if the URL has one
+}
+
+func newPublicDomains(urls []string) (publicDomains, error) {
+	d := publicDomains{byHost: make(map[string]string, len(urls))}
+	for _, raw := range urls {
+		raw = strings.TrimSuffix(raw, "/")
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return publicDomains{}, fmt.Errorf("invalid public URL %q", raw)
+		}
+		host := strings.ToLower(u.Host)
+		if _, ok := d.byHost[host]; ok {
+			return publicDomains{}, fmt.Errorf("public URL %q is listed twice", raw)
+		}
+		d.byHost[host] = raw
+		d.urls = append(d.urls, raw)
+	}
+	return d, nil
+}
+
+// lookup returns the base URL served under host, which may carry a port.
+func (d publicDomains) lookup(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if u, ok := d.byHost[host]; ok {
+		return u, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		u, ok := d.byHost[h]
+		return u, ok
+	}
+	return "", false
+}
+
+// forRequest returns the base URL of the domain a request was made to.
+func (d publicDomains) forRequest(r *http.Request) string {
+	if u, ok := d.lookup(r.Host); ok {
+		return u
+	}
+	if len(d.urls) == 0 {
+		return ""
+	}
+	return d.urls[0]
+}
+
+// publicURL returns the base URL for links created by r: the one for domain
+// when it's given, else the one r was made to. Unknown domains fail with an
+// error meant for the client.
+func (app *App) publicURL(r *http.Request, domain string) (string, error) {
+	if domain == "" {
+		return app.domains.forRequest(r), nil
+	}
+	u, ok := app.domains.lookup(domain)
+	if !ok {
+		return "", fmt.Errorf("Unknown domain %q", domain)
+	}
+	return u, nil
+}
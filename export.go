@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// exportColumns is the header row of the CSV export. Device URLs, headers and
+// other per-link settings aren't exported.
+var exportColumns = []string{"short_code", "url", "title", "created_at", "expires_at", "click_count"}
+
+// handleExportCSV streams every URL as CSV, oldest first. Timestamps are
+// RFC 3339 in UTC and expires_at is empty for links that don't expire.
+func (app *App) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="urls.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+
+	err := app.store.StreamURLs(r.Context(), func(u models.URLData) error {
+		var expiresAt string
+		if u.ExpiresAt != nil {
+			expiresAt = u.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		return cw.Write([]string{
+			u.ShortCode,
+			u.URL,
+			u.Title,
+			u.CreatedAt.UTC().Format(time.RFC3339),
+			expiresAt,
+			strconv.FormatInt(u.ClickCount, 10),
+		})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// The response has started, so the export is cut short instead of
+		// turning into an error response
+		app.logger.Error("Failed to export URLs", "error", err)
+	}
+}
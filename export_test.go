@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/lil/internal/store"
+)
+
+func TestHandleExportCSV(t *testing.T) {
+	app := newTestApp(t)
+	first := mustCreate(t, app, store.CreateParams{
+		URL:        "https://example.com/a",
+		Title:      "Quotes, \"commas\" and more",
+		Slug:       "first",
+		DeviceURLs: map[string]string{"ios": "https://apps.example/app"},
+	})
+	second := mustCreate(t, app, store.CreateParams{URL: "https://example.com/b", Slug: "second", Expiry: time.Hour})
+	for i := 0; i < 2; i++ {
+		serve(app.handleRedirect, http.MethodGet, "/first", "", "shortCode", "first")
+	}
+
+	w := serve(app.handleExportCSV, http.MethodGet, "/api/v1/urls/export", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/csv", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="urls.csv"` {
+		t.Errorf("Content-Disposition = %q, want an attachment", got)
+	}
+	if strings.Contains(w.Body.String(), "apps.example") {
+		t.Errorf("export has device URLs: %s", w.Body)
+	}
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	want := [][]string{
+		{"short_code", "url", "title", "created_at", "expires_at", "click_count"},
+		{"first", "https://example.com/a", "Quotes, \"commas\" and more", first.CreatedAt.UTC().Format(time.RFC3339), "", "2"},
+		{"second", "https://example.com/b", "", second.CreatedAt.UTC().Format(time.RFC3339), second.ExpiresAt.UTC().Format(time.RFC3339), "0"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("export = %q, want %q", rows, want)
+	}
+}
+
+func TestHandleExportCSVEmpty(t *testing.T) {
+	app := newTestApp(t)
+	w := serve(app.handleExportCSV, http.MethodGet, "/api/v1/urls/export", "")
+	if got := w.Body.String(); got != strings.Join(exportColumns, ",")+"\n" {
+		t.Errorf("empty export = %q, want the header alone", got)
+	}
+}
@@ -2,27 +2,158 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mileusna/useragent"
 	"github.com/mr-karan/lil/internal/analytics"
 	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/internal/middleware"
 	"github.com/mr-karan/lil/internal/store"
+	"github.com/mr-karan/lil/models"
 )
 
 type shortenURLRequest struct {
 	URL          string            `json:"url"`
 	Title        string            `json:"title,omitempty"`
 	Slug         string            `json:"slug,omitempty"`
+	AutoSuffix   bool              `json:"auto_suffix,omitempty"` // a taken slug gets a suffix instead of failing
 	ExpiryInSecs *int64            `json:"expiry_in_secs,omitempty"`
+	Expiry       string            `json:"expiry,omitempty"`      // relative expiry like "24h" or "7d", ignored when expiry_in_secs is set
+	StartsAt     *time.Time        `json:"starts_at,omitempty"`   // the link doesn't redirect before this time
 	DeviceURLs   map[string]string `json:"device_urls,omitempty"` // platform -> url mapping
+	Headers      map[string]string `json:"headers,omitempty"`     // extra headers sent on redirect
+	CodeLength   int               `json:"code_length,omitempty"` // length of the generated code when no slug is given
+	Domain       string            `json:"domain,omitempty"`      // configured public domain the link is shared under
+
+	// Analytics providers redirect events are sent to, all when empty
+	AnalyticsProviders []string `json:"analytics_providers,omitempty"`
+
+	// Password required to follow the link, which is public when empty
+	Password string `json:"password,omitempty"`
+
+	// bcrypt hash of the password, for links migrated with their password
+	// already hashed. Can't be combined with Password.
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	// "permanent", "temporary" or one of the redirectStatuses codes
+	RedirectType json.RawMessage `json:"redirect_type,omitempty"`
+
+	// Labels for organizing and filtering URLs
+	Tags []string `json:"tags,omitempty"`
+
+	// UTM parameters added to the destination on redirect
+	UTM *models.UTM `json:"utm,omitempty"`
+
+	// Redirects the link allows before it stops working, unlimited when 0
+	MaxClicks int64 `json:"max_clicks,omitempty"`
+}
+
+// shortenURLResponse is the created URL along with the base URL it's served
+// from.
+type shortenURLResponse struct {
+	models.URLData
+	PublicURL string   `json:"public_url"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// shortenDryRunResponse reports on a shorten request that was validated but
+// not created. SlugAvailable is only set for requests with a slug.
+type shortenDryRunResponse struct {
+	URL           string   `json:"url"`
+	Slug          string   `json:"slug,omitempty"`
+	SlugAvailable *bool    `json:"slug_available,omitempty"`
+	Suggestions   []string `json:"suggestions,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+// updateURLRequest holds the fields of a URL to change. Omitted fields are
+// left as they are.
+type updateURLRequest struct {
+	URL        *string           `json:"url"`
+	Title      *string           `json:"title"`
+	Slug       *string           `json:"slug"`                  // renames the short code
+	DeviceURLs map[string]string `json:"device_urls,omitempty"` // replaces all device URLs
+	Tags       *[]string         `json:"tags"`                  // replaces all tags, [] removes them
+
+	// Seconds from now the link expires in. Zero or null removes the expiry.
+	ExpiryInSecs nullableInt64 `json:"expiry_in_secs"`
+}
+
+// addAliasRequest names another code for an existing URL.
+type addAliasRequest struct {
+	Alias string `json:"alias"`
 }
 
+// purgeRequest selects the URLs to purge. Set fields are combined, and at
+// least one is required.
+type purgeRequest struct {
+	Expired bool   `json:"expired"`
+	Prefix  string `json:"prefix"`
+	Tag     string `json:"tag"`
+}
+
+// nullableInt64 tells apart a JSON field that's null from one that's absent.
+type nullableInt64 struct {
+	Set   bool
+	Value *int64
+}
+
+func (n *nullableInt64) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		return nil
+	}
+	return json.Unmarshal(b, &n.Value)
+}
+
+// reservedRedirectHeaders can't be set through static or per-link redirect
+// headers as the redirect itself depends on them.
+var reservedRedirectHeaders = map[string]bool{
+	"Location":      true,
+	"Cache-Control": true,
+}
+
+// redirectStatuses are the status codes a link may redirect with.
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// maxPerPage is the largest page size accepted when listing URLs.
+const maxPerPage = 1000
+
+// maxBulkURLs is the largest number of URLs a bulk shorten request may create.
+const maxBulkURLs = 1000
+
+// maxStatsTop is the largest number of most clicked URLs stats may list.
+const maxStatsTop = 100
+
+// maxBulkStatsCodes is the largest number of short codes bulk stats may ask
+// for.
+const maxBulkStatsCodes = 1000
+
+// Limits on the tags of a URL.
+const (
+	maxTags      = 20
+	maxTagLength = 64
+)
+
+const lowEntropyWarning = "slug is below the configured minimum entropy and may be guessable"
+
 // httpResp represents the structure of the JSON response envelope
 type httpResp struct {
 	Status  string      `json:"status"`
@@ -41,6 +172,41 @@ func (app *App) sendResponse(w http.ResponseWriter, data interface{}) {
 	w.Write(out)
 }
 
+// sendCachedResponse sends a JSON envelope with an ETag hashed from its body,
+// or a bodyless 304 when the request's If-None-Match already has it, so
+// pollers only download what changed.
+func (app *App) sendCachedResponse(w http.ResponseWriter, r *http.Request, data interface{}) {
+	out, err := json.Marshal(httpResp{Status: "success", Data: data})
+	if err != nil {
+		app.sendErrorResponse(w, "Internal Server Error.", http.StatusInternalServerError, nil)
+		return
+	}
+
+	sum := sha256.Sum256(out)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(out)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 asks for If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 // sendErrorResponse sends an error response to the HTTP response.
 func (app *App) sendErrorResponse(w http.ResponseWriter, message string, code int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -53,58 +219,496 @@ func (app *App) sendErrorResponse(w http.ResponseWriter, message string, code in
 	w.Write(out)
 }
 
+// sendBodyError responds to a request body that couldn't be read or decoded,
+// with HTTP 413 when it's over the route's size limit.
+func (app *App) sendBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		app.sendBodyTooLarge(w, nil)
+		return
+	}
+	app.logger.Error("Invalid request body", "error", err)
+	app.sendErrorResponse(w, "Invalid request body", http.StatusBadRequest, nil)
+}
+
+// sendBodyTooLarge responds to a request body over the route's size limit.
+func (app *App) sendBodyTooLarge(w http.ResponseWriter, _ *http.Request) {
+	app.sendErrorResponse(w, "Request body too large", http.StatusRequestEntityTooLarge, nil)
+}
+
+// sendStoreError responds to a failed store call. Calls cut short by the
+// route's timeout get a 504 so clients can tell them apart from failures and
+// retry, anything else a 500 with message.
+func (app *App) sendStoreError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		app.sendErrorResponse(w, "Request timed out", http.StatusGatewayTimeout, nil)
+		return
+	}
+	app.sendErrorResponse(w, message, http.StatusInternalServerError, nil)
+}
+
 func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) {
 	app.sendResponse(w, map[string]interface{}{
-		"version": buildString,
+		"version":                 buildString,
+		"short_code_entropy_bits": app.store.EntropyBits(ko.MustInt("app.short_url_length")),
 	})
 }
 
 func (app *App) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	if err := app.store.Ping(context.TODO()); err != nil {
+	if err := app.store.Ping(r.Context()); err != nil {
 		app.sendErrorResponse(w, "Database is not healthy", http.StatusServiceUnavailable, nil)
 		return
 	}
 	app.sendResponse(w, "healthy")
 }
 
+// saturationThresholds are the fractions of each queue's capacity at which it
+// counts as saturated.
+type saturationThresholds struct {
+	writeBuffer    float64
+	flushQueue     float64
+	analyticsQueue float64
+}
+
+// queueHealth is how full one of the queues in the detailed health check is.
+type queueHealth struct {
+	Length    int  `json:"length"`
+	Capacity  int  `json:"capacity"`
+	Saturated bool `json:"saturated"`
+}
+
+func newQueueHealth(length, capacity int, threshold float64) queueHealth {
+	return queueHealth{
+		Length:    length,
+		Capacity:  capacity,
+		Saturated: threshold > 0 && capacity > 0 && float64(length) >= threshold*float64(capacity),
+	}
+}
+
+type detailedHealth struct {
+	Status         string      `json:"status"`
+	Database       string      `json:"database"`
+	WriteBuffer    queueHealth `json:"write_buffer"`
+	FlushQueue     queueHealth `json:"flush_queue"`
+	AnalyticsQueue queueHealth `json:"analytics_queue"`
+	Cache          struct {
+		Size     int `json:"size"`
+		Capacity int `json:"capacity"`
+	} `json:"cache"`
+}
+
+// handleDetailedHealthCheck reports the database status along with how full
+// the write buffer, flush queue and analytics queue are, answering 503 when
+// the database is down or any queue is past its saturation threshold. Under
+// load backpressure on these queues shows up well before a failing ping.
+func (app *App) handleDetailedHealthCheck(w http.ResponseWriter, r *http.Request) {
+	usage := app.store.Usage()
+	events, eventsCap := app.analytics.QueueUsage()
+
+	health := detailedHealth{
+		Status:         "healthy",
+		Database:       "ok",
+		WriteBuffer:    newQueueHealth(usage.WriteBuffer, usage.WriteBufferCap, app.saturation.writeBuffer),
+		FlushQueue:     newQueueHealth(usage.FlushQueue, usage.FlushQueueCap, app.saturation.flushQueue),
+		AnalyticsQueue: newQueueHealth(events, eventsCap, app.saturation.analyticsQueue),
+	}
+	health.Cache.Size, health.Cache.Capacity = usage.Cache, usage.CacheCap
+
+	message := ""
+	if err := app.store.Ping(r.Context()); err != nil {
+		health.Database = "unreachable"
+		message = "Database is not healthy"
+	} else if health.WriteBuffer.Saturated || health.FlushQueue.Saturated || health.AnalyticsQueue.Saturated {
+		message = "Service is saturated"
+	}
+	if message != "" {
+		health.Status = "degraded"
+		app.sendErrorResponse(w, message, http.StatusServiceUnavailable, health)
+		return
+	}
+	app.sendResponse(w, health)
+}
+
+// handleReadiness reports whether the service can serve traffic. With
+// app.readiness_write_check enabled it also verifies the database is writable.
+func (app *App) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	if err := app.store.Ping(r.Context()); err != nil {
+		app.sendErrorResponse(w, "Database is not healthy", http.StatusServiceUnavailable, nil)
+		return
+	}
+	if app.readinessWriteCheck {
+		if err := app.store.CheckWritable(r.Context()); err != nil {
+			app.logger.Error("Database write check failed", "error", err)
+			app.sendErrorResponse(w, "Database is not writable", http.StatusServiceUnavailable, nil)
+			return
+		}
+	}
+	app.sendResponse(w, "ready")
+}
+
 func (app *App) handleShortenURL(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if !dryRun {
+		defer metrics.CreateDuration.UpdateDuration(time.Now())
+	}
+
 	// Parse request body
 	var req shortenURLRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		app.logger.Error("Invalid request body", "error", err)
-		app.sendErrorResponse(w, "Invalid request body", http.StatusBadRequest, nil)
+		app.sendBodyError(w, err)
 		return
 	}
 
-	// Basic validation
-	if req.URL == "" {
-		app.sendErrorResponse(w, "URL is required", http.StatusBadRequest, nil)
+	params, err := app.createParams(req)
+	if err != nil {
+		app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
 		return
 	}
-
-	// Calculate expiry time if provided
-	var expiry time.Duration
-	if req.ExpiryInSecs != nil && *req.ExpiryInSecs > 0 {
-		expiry = time.Duration(*req.ExpiryInSecs) * time.Second
+	publicURL, err := app.publicURL(r, req.Domain)
+	if err != nil {
+		app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+	if dryRun {
+		app.validateShorten(w, r, req, params)
+		return
 	}
 
 	// Call store method to create short URL with device URLs
-	shortCode, err := app.store.CreateShortURL(context.TODO(), req.URL, req.Title, req.Slug, expiry, req.DeviceURLs)
+	urlData, err := app.store.CreateShortURL(r.Context(), params)
 	if err != nil {
+		if errors.Is(err, store.ErrInvalidCodeLength) || errors.Is(err, store.ErrInvalidSlug) || errors.Is(err, store.ErrHostNotAllowed) || errors.Is(err, store.ErrInvalidPasswordHash) {
+			app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+			return
+		}
+		if errors.Is(err, store.ErrNoFreeCode) {
+			app.logger.Error("Failed to create short URL", "error", err, "url", req.URL)
+			app.sendErrorResponse(w, "No free short code available, try a longer code_length", http.StatusServiceUnavailable, nil)
+			return
+		}
+		if errors.Is(err, store.ErrExists) {
+			var data interface{}
+			if app.slugSuggestions > 0 && req.Slug != "" {
+				data = map[string]interface{}{
+					"suggestions": app.store.SuggestSlugs(req.Slug, app.slugSuggestionStrategy, app.slugSuggestions),
+				}
+			}
+			app.sendErrorResponse(w, "Short code already exists", http.StatusConflict, data)
+			return
+		}
 		app.logger.Error("Failed to create short URL", "error", err, "url", req.URL)
 		metrics.URLsShortenedTotal.Inc()
-		app.sendErrorResponse(w, "Failed to create short URL", http.StatusInternalServerError, nil)
+		app.sendStoreError(w, "Failed to create short URL", err)
+		return
+	}
+
+	// Return the created URL with the public base URL
+	resp := shortenURLResponse{
+		URLData:   urlData,
+		PublicURL: publicURL,
+	}
+	if req.Slug != "" && app.store.IsLowEntropy(urlData.ShortCode) {
+		resp.Warnings = []string{lowEntropyWarning}
+	}
+	app.sendResponse(w, resp)
+}
+
+// validateShorten answers a dry run of a shorten request, running the checks
+// of a create and reporting whether the slug is free without storing anything.
+func (app *App) validateShorten(w http.ResponseWriter, r *http.Request, req shortenURLRequest, params store.CreateParams) {
+	if err := app.store.ValidateCreate(params); err != nil {
+		app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
 		return
 	}
 
-	// Return the shortened URL with public base URL
+	resp := shortenDryRunResponse{URL: params.URL}
+	if req.Slug != "" {
+		available, err := app.store.IsSlugAvailable(r.Context(), req.Slug)
+		if err != nil {
+			app.logger.Error("Failed to check slug", "error", err, "slug", req.Slug)
+			app.sendStoreError(w, "Internal server error", err)
+			return
+		}
+		resp.Slug = req.Slug
+		resp.SlugAvailable = &available
+		if !available && app.slugSuggestions > 0 {
+			resp.Suggestions = app.store.SuggestSlugs(req.Slug, app.slugSuggestionStrategy, app.slugSuggestions)
+		}
+		if app.store.IsLowEntropy(req.Slug) {
+			resp.Warnings = []string{lowEntropyWarning}
+		}
+	}
+	app.sendResponse(w, resp)
+}
+
+// createParams validates a shorten request and converts it to store params.
+// The returned error is meant for the client.
+func (app *App) createParams(req shortenURLRequest) (store.CreateParams, error) {
+	if req.URL == "" {
+		return store.CreateParams{}, errors.New("URL is required")
+	}
+	targetURL, err := normalizeTargetURL(req.URL)
+	if err != nil {
+		return store.CreateParams{}, err
+	}
+	deviceURLs, err := normalizeDeviceURLs(req.DeviceURLs)
+	if err != nil {
+		return store.CreateParams{}, err
+	}
+
+	if req.Slug != "" {
+		if err := app.store.ValidateSlug(req.Slug); err != nil {
+			return store.CreateParams{}, err
+		}
+	}
+
+	if len(req.Password) > maxPasswordLength {
+		return store.CreateParams{}, fmt.Errorf("Password must be at most %d bytes", maxPasswordLength)
+	}
+	if req.PasswordHash != "" {
+		if req.Password != "" {
+			return store.CreateParams{}, errors.New("Only one of password and password_hash can be set")
+		}
+		if err := store.ValidatePasswordHash(req.PasswordHash); err != nil {
+			return store.CreateParams{}, err
+		}
+	}
+
+	redirectStatus, err := parseRedirectType(req.RedirectType)
+	if err != nil {
+		return store.CreateParams{}, err
+	}
+
+	for name := range req.Headers {
+		if reservedRedirectHeaders[http.CanonicalHeaderKey(name)] {
+			return store.CreateParams{}, fmt.Errorf("Header %s can't be overridden", name)
+		}
+	}
+
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return store.CreateParams{}, err
+	}
+
+	for _, name := range req.AnalyticsProviders {
+		if !app.analytics.HasProvider(name) {
+			return store.CreateParams{}, fmt.Errorf("Unknown analytics provider: %s", name)
+		}
+	}
+
+	// Calculate expiry time if provided, preferring the explicit seconds
+	var expiry time.Duration
+	if req.ExpiryInSecs != nil {
+		if *req.ExpiryInSecs > 0 {
+			expiry = time.Duration(*req.ExpiryInSecs) * time.Second
+		}
+	} else if req.Expiry != "" {
+		if expiry, err = parseExpiry(req.Expiry); err != nil {
+			return store.CreateParams{}, err
+		}
+	}
+
+	if req.StartsAt != nil && expiry > 0 && !req.StartsAt.Before(time.Now().Add(expiry)) {
+		return store.CreateParams{}, errors.New("starts_at must be before the expiry")
+	}
+
+	if req.MaxClicks < 0 {
+		return store.CreateParams{}, errors.New("max_clicks can't be negative")
+	}
+
+	return store.CreateParams{
+		URL:        targetURL,
+		Title:      req.Title,
+		Slug:       req.Slug,
+		AutoSuffix: req.AutoSuffix,
+		Expiry:     expiry,
+		StartsAt:   req.StartsAt,
+		DeviceURLs: deviceURLs,
+		Headers:    req.Headers,
+		CodeLength: req.CodeLength,
+
+		AnalyticsProviders: req.AnalyticsProviders,
+		Password:           req.Password,
+		PasswordHash:       req.PasswordHash,
+		RedirectStatus:     redirectStatus,
+		Tags:               tags,
+		UTM:                normalizeUTM(req.UTM),
+		MaxClicks:          req.MaxClicks,
+	}, nil
+}
+
+// parseExpiry parses a relative expiry such as "30m", "24h" or "7d". On top of
+// the units time.ParseDuration knows it accepts a leading number of days, as
+// in "1d12h".
+func parseExpiry(s string) (time.Duration, error) {
+	errInvalid := fmt.Errorf("Invalid expiry %q, use a positive duration such as 30m, 24h or 7d", s)
+
+	var days, rest time.Duration
+	if i := strings.IndexByte(s, 'd'); i >= 0 {
+		// 16 bits of days keeps the total well within a time.Duration
+		n, err := strconv.ParseUint(s[:i], 10, 16)
+		if err != nil {
+			return 0, errInvalid
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		s = s[i+1:]
+	}
+	if s != "" {
+		var err error
+		if rest, err = time.ParseDuration(s); err != nil || rest < 0 {
+			return 0, errInvalid
+		}
+	}
+
+	if days+rest <= 0 {
+		return 0, errInvalid
+	}
+	return days + rest, nil
+}
+
+// normalizeTags trims tags and drops empty and repeated ones, checking them
+// against maxTags and maxTagLength.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	out := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("Tags must be at most %d characters", maxTagLength)
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("A URL can have at most %d tags", maxTags)
+	}
+	return out, nil
+}
+
+// parseRedirectType reads redirect_type, which is either "permanent" (301),
+// "temporary" (302) or a supported status code given as a number. It returns
+// 0 when it isn't set, leaving the default of 302.
+func parseRedirectType(raw json.RawMessage) (int, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		switch name {
+		case "permanent":
+			return http.StatusMovedPermanently, nil
+		case "temporary":
+			return http.StatusFound, nil
+		}
+		return 0, fmt.Errorf("Unknown redirect_type: %s", name)
+	}
+
+	var code int
+	if err := json.Unmarshal(raw, &code); err != nil || !redirectStatuses[code] {
+		return 0, errors.New("redirect_type must be permanent, temporary, 301, 302, 307 or 308")
+	}
+	return code, nil
+}
+
+// bulkShortenResult is the outcome of one entry of a bulk shorten request.
+// Index is the entry's position in the request, so failed entries can be
+// retried on their own.
+type bulkShortenResult struct {
+	Index     int      `json:"index"`
+	ShortCode string   `json:"short_code,omitempty"`
+	PublicURL string   `json:"public_url,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func (app *App) handleBulkShortenURL(w http.ResponseWriter, r *http.Request) {
+	var reqs []shortenURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		app.sendBodyError(w, err)
+		return
+	}
+	if len(reqs) == 0 || len(reqs) > maxBulkURLs {
+		app.sendErrorResponse(w, fmt.Sprintf("Request must contain between 1 and %d URLs", maxBulkURLs), http.StatusBadRequest, nil)
+		return
+	}
+
+	results := make([]bulkShortenResult, len(reqs))
+	params := make([]store.CreateParams, 0, len(reqs))
+	indexes := make([]int, 0, len(reqs))       // Position in reqs of each entry in params
+	publicURLs := make([]string, 0, len(reqs)) // public_url of each entry in params
+	for i, req := range reqs {
+		results[i].Index = i
+		p, err := app.createParams(req)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		publicURL, err := app.publicURL(r, req.Domain)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		params = append(params, p)
+		indexes = append(indexes, i)
+		publicURLs = append(publicURLs, publicURL)
+	}
+
+	for j, res := range app.store.CreateShortURLs(r.Context(), params) {
+		i := indexes[j]
+		if res.Err != nil {
+			results[i].Error = app.createErrorMessage(res.Err, reqs[i].URL)
+			continue
+		}
+		results[i].ShortCode = res.ShortCode
+		results[i].PublicURL = publicURLs[j]
+		if reqs[i].Slug != "" && app.store.IsLowEntropy(res.ShortCode) {
+			results[i].Warnings = []string{lowEntropyWarning}
+		}
+	}
+
+	failed := 0
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+
 	app.sendResponse(w, map[string]interface{}{
-		"short_code": shortCode,
-		"public_url": ko.String("app.public_url"),
+		"results": results,
+		"created": len(results) - failed,
+		"failed":  failed,
 	})
 }
 
+// createErrorMessage describes why creating one entry of a batch failed, in
+// terms fit for the client. Unexpected errors are logged.
+func (app *App) createErrorMessage(err error, url string) string {
+	switch {
+	case errors.Is(err, store.ErrInvalidCodeLength), errors.Is(err, store.ErrInvalidSlug), errors.Is(err, store.ErrHostNotAllowed),
+		errors.Is(err, store.ErrInvalidPasswordHash):
+		return err.Error()
+	case errors.Is(err, store.ErrExists):
+		return "Short code already exists"
+	case errors.Is(err, store.ErrNoFreeCode):
+		app.logger.Error("Failed to create short URL", "error", err, "url", url)
+		return "No free short code available, try a longer code_length"
+	default:
+		app.logger.Error("Failed to create short URL", "error", err, "url", url)
+		return "Failed to create short URL"
+	}
+}
+
 func (app *App) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	defer metrics.RedirectDuration.UpdateDuration(time.Now())
+
 	// Extract shortCode from path
 	shortCode := r.PathValue("shortCode")
 	if shortCode == "" {
@@ -112,66 +716,75 @@ func (app *App) handleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Protected links need their password before anything else. Unknown
+	// codes are left to GetRedirectData, which may read them through.
+	if err := app.store.VerifyPassword(r.Context(), shortCode, linkPassword(r)); err == store.ErrWrongPassword {
+		metrics.RedirectFailuresTotal.Inc()
+		app.sendPasswordPrompt(w, r)
+		return
+	}
+
+	// HEAD requests come from link checkers and unfurlers rather than
+	// visitors, so they get the redirect without counting a click or
+	// sending analytics events
+	lookup := app.store.GetRedirectData
+	isHead := r.Method == http.MethodHead
+	if isHead {
+		lookup = app.store.PeekRedirectData
+	}
+
 	// Get URL data from store
-	urlData, err := app.store.GetRedirectData(context.TODO(), shortCode)
+	urlData, err := lookup(r.Context(), shortCode)
 	if err != nil {
 		if err == store.ErrNotExist {
 			metrics.RedirectFailuresTotal.Inc()
 			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
 			return
 		}
+		if err == store.ErrExpired {
+			metrics.RedirectFailuresTotal.Inc()
+			app.sendErrorResponse(w, "URL has expired", http.StatusGone, nil)
+			return
+		}
+		if err == store.ErrClickLimit {
+			metrics.RedirectFailuresTotal.Inc()
+			app.sendErrorResponse(w, "URL has reached its click limit", http.StatusGone, nil)
+			return
+		}
+		if err == store.ErrNotYetActive {
+			metrics.RedirectFailuresTotal.Inc()
+			if app.comingSoonURL != "" {
+				w.Header().Set("Cache-Control", "no-store")
+				http.Redirect(w, r, app.comingSoonURL, http.StatusFound)
+				return
+			}
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+			return
+		}
 		app.logger.Error("Failed to get URL data", "error", err, "shortCode", shortCode)
-		app.sendErrorResponse(w, "Internal server error", http.StatusInternalServerError, nil)
+		app.sendStoreError(w, "Internal server error", err)
 		return
 	}
 
-	// Parse User-Agent
+	// Parse User-Agent and pick the device URL for the client, if any
 	ua := useragent.Parse(r.UserAgent())
-	targetURL := urlData.URL // default URL
+	targetURL := appendUTM(resolveTargetURL(urlData, ua), urlData.UTM)
 
-	// Check for device-specific URLs
-	if urlData.DeviceURLs != nil {
-		// Try to match platform
-		switch {
-		case ua.IsAndroid():
-			if deviceURL, ok := urlData.DeviceURLs["android"]; ok {
-				targetURL = deviceURL.URL
-			}
-		case ua.IsIOS():
-			if deviceURL, ok := urlData.DeviceURLs["ios"]; ok {
-				targetURL = deviceURL.URL
-			}
-		case ua.IsMacOS():
-			if deviceURL, ok := urlData.DeviceURLs["macos"]; ok {
-				targetURL = deviceURL.URL
-			}
-		default:
-			// Web/Desktop
-			if deviceURL, ok := urlData.DeviceURLs["web"]; ok {
-				targetURL = deviceURL.URL
-			}
-		}
-	}
+	// Forward allowlisted query parameters from the short URL to the target
+	targetURL = forwardQuery(targetURL, r.URL.Query(), app.forwardParams)
 
-	metrics.RedirectsTotal.Inc()
-	if app.analytics != nil {
-		// Extract real IP address from headers
-		var userIP string
-		if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
-			userIP = cfIP
-		} else if fwdIP := r.Header.Get("X-Forwarded-For"); fwdIP != "" {
-			// Use the first IP in the chain which is typically the original client
-			if firstIP := strings.Split(fwdIP, ",")[0]; firstIP != "" {
-				userIP = strings.TrimSpace(firstIP)
-			}
-		} else {
-			userIP = r.RemoteAddr
-		}
+	platform := detectPlatform(ua)
+	if !isHead {
+		metrics.RedirectsTotal.Inc()
+		metrics.RedirectsByPlatform(platform).Inc()
+	}
+	if app.analytics != nil && !isHead {
+		userIP := clientIP(r, app.trustedProxies)
 
 		app.analytics.Track(analytics.Event{
 			Name:       "pageview",
 			Domain:     r.Host,
-			URL:        fmt.Sprintf("%s/%s", ko.String("app.public_url"), shortCode),
+			URL:        fmt.Sprintf("%s/%s", app.domains.forRequest(r), shortCode),
 			Referrer:   r.Header.Get("Referer"),
 			UserAgent:  r.UserAgent(),
 			UserIP:     userIP,
@@ -179,13 +792,225 @@ func (app *App) handleRedirect(w http.ResponseWriter, r *http.Request) {
 			Timestamp:  time.Now().UTC().Format(time.RFC3339),
 			ShortCode:  shortCode,
 			TargetURL:  targetURL,
+			Platform:   platform,
+			Providers:  urlData.AnalyticsProviders,
 		})
 	}
 
+	// Static headers first so per-link headers can override them
+	for name, value := range app.redirectHeaders {
+		w.Header().Set(name, value)
+	}
+	for name, value := range urlData.Headers {
+		if !reservedRedirectHeaders[http.CanonicalHeaderKey(name)] {
+			w.Header().Set(name, value)
+		}
+	}
+
 	// Ensure browsers don't cache the redirect response
 	w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
 	w.Header().Set("Location", targetURL)
-	w.WriteHeader(http.StatusFound)
+	status := http.StatusFound
+	if urlData.RedirectStatus != 0 {
+		status = urlData.RedirectStatus
+	}
+	w.WriteHeader(status)
+}
+
+// expandResponse is where a short URL leads for the client that asked.
+type expandResponse struct {
+	ShortCode string     `json:"short_code"`
+	URL       string     `json:"url"`
+	TargetURL string     `json:"target_url"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// handleExpand resolves a short code to the URL handleRedirect would send the
+// client to, picking the device URL from its user agent, without redirecting,
+// counting a click or sending analytics events.
+func (app *App) handleExpand(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	if err := app.store.VerifyPassword(r.Context(), shortCode, linkPassword(r)); err == store.ErrWrongPassword {
+		msg := "Password required"
+		if linkPassword(r) != "" {
+			msg = "Invalid password"
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		app.sendErrorResponse(w, msg, http.StatusUnauthorized, nil)
+		return
+	}
+
+	urlData, err := app.store.PeekRedirectData(r.Context(), shortCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotExist), errors.Is(err, store.ErrNotYetActive):
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+		case errors.Is(err, store.ErrExpired):
+			app.sendErrorResponse(w, "URL has expired", http.StatusGone, nil)
+		case errors.Is(err, store.ErrClickLimit):
+			app.sendErrorResponse(w, "URL has reached its click limit", http.StatusGone, nil)
+		default:
+			app.logger.Error("Failed to get URL data", "error", err, "shortCode", shortCode)
+			app.sendStoreError(w, "Internal server error", err)
+		}
+		return
+	}
+
+	targetURL := appendUTM(resolveTargetURL(urlData, useragent.Parse(r.UserAgent())), urlData.UTM)
+	app.sendResponse(w, expandResponse{
+		ShortCode: urlData.ShortCode,
+		URL:       urlData.URL,
+		TargetURL: forwardQuery(targetURL, r.URL.Query(), app.forwardParams),
+		ExpiresAt: urlData.ExpiresAt,
+	})
+}
+
+// restrict only lets requests through with one of tokens or from one of
+// networks, matching the client address as clientIP sees it.
+func (app *App) restrict(tokens []string, networks []*net.IPNet) func(http.Handler) http.Handler {
+	return middleware.Restrict(tokens, networks,
+		func(r *http.Request) string { return clientIP(r, app.trustedProxies) },
+		func(w http.ResponseWriter, r *http.Request) {
+			app.sendErrorResponse(w, "Forbidden", http.StatusForbidden, nil)
+		})
+}
+
+// clientIP returns the address of the client that made the request. The
+// CF-Connecting-IP and X-Forwarded-For headers are only honored when the
+// connection comes from one of the trusted proxies, as anyone else can set
+// them. X-Forwarded-For is walked from the nearest hop back, skipping trusted
+// proxies, so entries a client prepended itself are ignored. Header values
+// that aren't IP addresses are ignored too.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+	if !isTrustedProxy(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+
+	if cfIP, ok := parseHop(r.Header.Get("CF-Connecting-IP")); ok {
+		return cfIP
+	}
+	if fwdIP := r.Header.Get("X-Forwarded-For"); fwdIP != "" {
+		hops := strings.Split(fwdIP, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			if strings.TrimSpace(hops[i]) == "" {
+				continue
+			}
+			hop, ok := parseHop(hops[i])
+			if !ok {
+				// Whatever came before a hop that can't be read can't be
+				// trusted either
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop, trustedProxies) {
+				return hop
+			}
+		}
+	}
+	return remoteIP
+}
+
+// parseHop returns the IP address in a forwarding header value, which some
+// proxies send with a port.
+func parseHop(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardQuery merges the allowed incoming query parameters into target. Values
+// are encoded through url.Values so they can't inject extra parameters, and
+// parameters already present on the target are left as they are. Target is
+// returned unchanged when it can't be parsed or nothing is forwarded.
+func forwardQuery(target string, incoming url.Values, allowed []string) string {
+	if len(allowed) == 0 || len(incoming) == 0 {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	query := u.Query()
+	forwarded := false
+	for _, name := range allowed {
+		values, ok := incoming[name]
+		if !ok || query.Has(name) {
+			continue
+		}
+		query[name] = values
+		forwarded = true
+	}
+	if !forwarded {
+		return target
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// resolveTargetURL returns the URL a client with the given user agent is
+// redirected to: the device URL for the platform detectPlatform reports, then
+// the "web" one, then the link's base URL. Device URLs can only be stored for
+// the configured platforms, so those are the ones that can match.
+func resolveTargetURL(urlData models.URLData, ua useragent.UserAgent) string {
+	if len(urlData.DeviceURLs) == 0 {
+		return urlData.URL
+	}
+
+	for _, platform := range []string{detectPlatform(ua), "web"} {
+		if deviceURL, ok := urlData.DeviceURLs[platform]; ok && deviceURL.URL != "" {
+			return deviceURL.URL
+		}
+	}
+	return urlData.URL
+}
+
+// detectPlatform maps the client's OS to the platform reported in analytics
+// and used to pick a device URL.
+func detectPlatform(ua useragent.UserAgent) string {
+	switch {
+	case ua.IsAndroid():
+		return "android"
+	case ua.IsIOS():
+		return "ios"
+	case ua.IsMacOS():
+		return "macos"
+	case ua.IsWindows():
+		return "windows"
+	case ua.IsLinux():
+		return "linux"
+	default:
+		return "other"
+	}
 }
 
 func (app *App) handleGetURLs(w http.ResponseWriter, r *http.Request) {
@@ -196,35 +1021,286 @@ func (app *App) handleGetURLs(w http.ResponseWriter, r *http.Request) {
 	// Convert to int64 with defaults
 	pageNum := int64(1)
 	if page != "" {
-		if p, err := strconv.ParseInt(page, 10, 64); err == nil {
-			pageNum = p
+		p, err := strconv.ParseInt(page, 10, 64)
+		if err != nil || p < 1 {
+			app.sendErrorResponse(w, "page must be a positive integer", http.StatusBadRequest, nil)
+			return
 		}
+		pageNum = p
 	}
 
 	perPageNum := int64(10)
 	if perPage != "" {
-		if pp, err := strconv.ParseInt(perPage, 10, 64); err == nil {
-			perPageNum = pp
+		pp, err := strconv.ParseInt(perPage, 10, 64)
+		if err != nil || pp < 1 || pp > maxPerPage {
+			app.sendErrorResponse(w, fmt.Sprintf("per_page must be between 1 and %d", maxPerPage), http.StatusBadRequest, nil)
+			return
 		}
+		perPageNum = pp
+	}
+
+	// The offset of pages this far out would overflow, wrapping around to
+	// earlier pages
+	if pageNum > math.MaxInt64/perPageNum {
+		app.sendErrorResponse(w, "page is out of range", http.StatusBadRequest, nil)
+		return
 	}
 
-	// Fetch URLs from store
-	urls, total, err := app.store.GetURLs(context.TODO(), pageNum, perPageNum)
+	// Fetch URLs from store, only the ones with the tag if one is given
+	urls, total, err := app.store.GetURLs(r.Context(), pageNum, perPageNum, r.URL.Query().Get("tag"))
 	if err != nil {
 		app.logger.Error("Failed to fetch URLs", "error", err)
-		app.sendErrorResponse(w, "Failed to fetch URLs", http.StatusInternalServerError, nil)
+		app.sendStoreError(w, "Failed to fetch URLs", err)
 		return
 	}
 
-	// Return the URLs
-	app.sendResponse(w, map[string]interface{}{
-		"urls":     urls,
-		"page":     pageNum,
-		"per_page": perPageNum,
-		"count":    total,
+	totalPages := (total + perPageNum - 1) / perPageNum
+
+	// Return the URLs, with an ETag for clients polling the list
+	app.sendCachedResponse(w, r, map[string]interface{}{
+		"urls":        urls,
+		"page":        pageNum,
+		"per_page":    perPageNum,
+		"count":       total,
+		"total_pages": totalPages,
+		"has_next":    pageNum < totalPages,
+		"has_prev":    pageNum > 1,
 	})
 }
 
+func (app *App) handleGetURL(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	urlData, err := app.store.GetURL(r.Context(), shortCode)
+	if err != nil {
+		if err == store.ErrNotExist {
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+			return
+		}
+		app.logger.Error("Failed to get URL", "error", err, "shortCode", shortCode)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	app.sendResponse(w, urlData)
+}
+
+func (app *App) handleUpdateURL(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	var req updateURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		app.sendBodyError(w, err)
+		return
+	}
+
+	params, err := updateParams(req)
+	if err != nil {
+		app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	urlData, err := app.store.UpdateURL(r.Context(), shortCode, params)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotExist):
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+		case errors.Is(err, store.ErrInvalidSlug), errors.Is(err, store.ErrHostNotAllowed):
+			app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		case errors.Is(err, store.ErrExists):
+			app.sendErrorResponse(w, "Short code already exists", http.StatusConflict, nil)
+		default:
+			app.logger.Error("Failed to update URL", "error", err, "shortCode", shortCode)
+			app.sendStoreError(w, "Internal server error", err)
+		}
+		return
+	}
+
+	app.sendResponse(w, urlData)
+}
+
+// handleAddAlias adds an alias redirecting to the same destination as a short
+// code.
+func (app *App) handleAddAlias(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	var req addAliasRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		app.sendBodyError(w, err)
+		return
+	}
+	if req.Alias == "" {
+		app.sendErrorResponse(w, "Alias is required", http.StatusBadRequest, nil)
+		return
+	}
+
+	urlData, err := app.store.AddAlias(r.Context(), shortCode, req.Alias)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotExist):
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+		case errors.Is(err, store.ErrInvalidSlug):
+			app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		case errors.Is(err, store.ErrExists):
+			app.sendErrorResponse(w, "Short code already exists", http.StatusConflict, nil)
+		default:
+			app.logger.Error("Failed to add alias", "error", err, "shortCode", shortCode)
+			app.sendStoreError(w, "Internal server error", err)
+		}
+		return
+	}
+
+	app.sendResponse(w, urlData)
+}
+
+// handleResetClicks sets a short code's click count back to zero, renewing
+// links whose max_clicks are used up.
+func (app *App) handleResetClicks(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	urlData, err := app.store.ResetClicks(r.Context(), shortCode)
+	if err != nil {
+		if errors.Is(err, store.ErrNotExist) {
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+			return
+		}
+		app.logger.Error("Failed to reset clicks", "error", err, "shortCode", shortCode)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	app.sendResponse(w, urlData)
+}
+
+// handleGetDeviceURLs returns the platform -> url mapping of a short code's
+// device URLs.
+func (app *App) handleGetDeviceURLs(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	deviceURLs, err := app.store.GetDeviceURLs(r.Context(), shortCode)
+	if err != nil {
+		if errors.Is(err, store.ErrNotExist) {
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+			return
+		}
+		app.logger.Error("Failed to get device URLs", "error", err, "shortCode", shortCode)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	app.sendResponse(w, deviceURLMap(deviceURLs))
+}
+
+// handleSetDeviceURLs replaces the device URLs of a short code with the
+// platform -> url mapping in the body, an empty one removing them all.
+func (app *App) handleSetDeviceURLs(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		app.sendBodyError(w, err)
+		return
+	}
+	req, err := normalizeDeviceURLs(req)
+	if err != nil {
+		app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	deviceURLs, err := app.store.SetDeviceURLs(r.Context(), shortCode, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotExist):
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+		case errors.Is(err, store.ErrInvalidPlatform), errors.Is(err, store.ErrHostNotAllowed):
+			app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		default:
+			app.logger.Error("Failed to set device URLs", "error", err, "shortCode", shortCode)
+			app.sendStoreError(w, "Internal server error", err)
+		}
+		return
+	}
+
+	app.sendResponse(w, deviceURLMap(deviceURLs))
+}
+
+// deviceURLMap flattens device URLs into a platform -> url mapping.
+func deviceURLMap(deviceURLs map[string]models.DeviceURLData) map[string]string {
+	out := make(map[string]string, len(deviceURLs))
+	for platform, deviceURL := range deviceURLs {
+		out[platform] = deviceURL.URL
+	}
+	return out
+}
+
+// updateParams validates an update request and converts it to store params.
+// The returned error is meant for the client.
+func updateParams(req updateURLRequest) (store.UpdateParams, error) {
+	if req.URL != nil && *req.URL == "" {
+		return store.UpdateParams{}, errors.New("URL can't be empty")
+	}
+
+	params := store.UpdateParams{
+		Title: req.Title,
+		Slug:  req.Slug,
+	}
+	if req.URL != nil {
+		targetURL, err := normalizeTargetURL(*req.URL)
+		if err != nil {
+			return store.UpdateParams{}, err
+		}
+		params.URL = &targetURL
+	}
+	deviceURLs, err := normalizeDeviceURLs(req.DeviceURLs)
+	if err != nil {
+		return store.UpdateParams{}, err
+	}
+	params.DeviceURLs = deviceURLs
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return store.UpdateParams{}, err
+		}
+		params.Tags = &tags
+	}
+
+	if req.ExpiryInSecs.Set {
+		var expiry time.Duration
+		if v := req.ExpiryInSecs.Value; v != nil {
+			if *v < 0 {
+				return store.UpdateParams{}, errors.New("expiry_in_secs can't be negative")
+			}
+			expiry = time.Duration(*v) * time.Second
+		}
+		params.Expiry = &expiry
+	}
+	return params, nil
+}
+
 func (app *App) handleDeleteURL(w http.ResponseWriter, r *http.Request) {
 	// Extract shortCode from path
 	shortCode := r.PathValue("shortCode")
@@ -234,16 +1310,130 @@ func (app *App) handleDeleteURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Delete URL from store
-	if err := app.store.DeleteURL(context.TODO(), shortCode); err != nil {
+	if err := app.store.DeleteURL(r.Context(), shortCode); err != nil {
 		if err == store.ErrNotExist {
 			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
 			return
 		}
 		app.logger.Error("Failed to delete URL", "error", err, "shortCode", shortCode)
-		app.sendErrorResponse(w, "Internal server error", http.StatusInternalServerError, nil)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	if app.mutationResponseBody {
+		app.sendResponse(w, map[string]interface{}{
+			"short_code": shortCode,
+			"deleted":    true,
+		})
 		return
 	}
 
 	// Return success with no content
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// handlePurge deletes every URL matching the request's criteria and returns
+// how many were deleted.
+func (app *App) handlePurge(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		app.sendBodyError(w, err)
+		return
+	}
+
+	deleted, err := app.store.Purge(r.Context(), store.PurgeCriteria{
+		Expired: req.Expired,
+		Prefix:  req.Prefix,
+		Tag:     req.Tag,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNoPurgeCriteria) {
+			app.sendErrorResponse(w, "One of expired, prefix or tag is required", http.StatusBadRequest, nil)
+			return
+		}
+		app.logger.Error("Failed to purge URLs", "error", err, "deleted", deleted)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	app.sendResponse(w, map[string]interface{}{
+		"deleted": deleted,
+	})
+}
+
+type statsTopURL struct {
+	ShortCode  string `json:"short_code"`
+	URL        string `json:"url"`
+	ClickCount int64  `json:"click_count"`
+}
+
+// urlStats is the entry of a short code in bulk stats. Found is false for
+// codes that don't exist, which have no clicks. LastAccessedAt is nil for
+// codes that never redirected.
+type urlStats struct {
+	ShortCode      string     `json:"short_code"`
+	Found          bool       `json:"found"`
+	ClickCount     int64      `json:"click_count"`
+	LastAccessedAt *time.Time `json:"last_accessed_at"`
+}
+
+// handleBulkStats returns the click counts and last accesses of a JSON array
+// of short codes, in the order they were given.
+func (app *App) handleBulkStats(w http.ResponseWriter, r *http.Request) {
+	var shortCodes []string
+	if err := json.NewDecoder(r.Body).Decode(&shortCodes); err != nil {
+		app.sendBodyError(w, err)
+		return
+	}
+	if len(shortCodes) == 0 || len(shortCodes) > maxBulkStatsCodes {
+		app.sendErrorResponse(w, fmt.Sprintf("Request must contain between 1 and %d short codes", maxBulkStatsCodes), http.StatusBadRequest, nil)
+		return
+	}
+
+	found, err := app.store.BulkStats(r.Context(), shortCodes)
+	if err != nil {
+		app.logger.Error("Failed to get click counts", "error", err, "count", len(shortCodes))
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	stats := make([]urlStats, len(shortCodes))
+	for i, shortCode := range shortCodes {
+		st, ok := found[shortCode]
+		stats[i] = urlStats{ShortCode: shortCode, Found: ok, ClickCount: st.ClickCount, LastAccessedAt: st.LastAccessedAt}
+	}
+	app.sendResponse(w, stats)
+}
+
+// handleStats returns an approximate overview of the stored URLs and their
+// clicks, with the top most clicked URLs (10 by default).
+func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxStatsTop {
+			app.sendErrorResponse(w, fmt.Sprintf("top must be between 0 and %d", maxStatsTop), http.StatusBadRequest, nil)
+			return
+		}
+		top = n
+	}
+
+	stats, err := app.store.Stats(r.Context(), top)
+	if err != nil {
+		app.logger.Error("Failed to compute stats", "error", err)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	topURLs := make([]statsTopURL, len(stats.Top))
+	for i, t := range stats.Top {
+		topURLs[i] = statsTopURL{ShortCode: t.ShortCode, URL: t.URL, ClickCount: t.ClickCount}
+	}
+	app.sendResponse(w, map[string]interface{}{
+		"urls":          stats.URLs,
+		"expiring_soon": stats.Expiring,
+		"expired":       stats.Expired,
+		"clicks":        stats.Clicks,
+		"top_urls":      topURLs,
+	})
+}
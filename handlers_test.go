@@ -0,0 +1,1813 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mileusna/useragent"
+	"github.com/mr-karan/lil/internal/analytics"
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/internal/middleware"
+	"github.com/mr-karan/lil/internal/store"
+	"github.com/mr-karan/lil/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestApp returns an app backed by a SQLite store in a temporary
+// directory, serving links from https://lil.test. Writes go straight to the
+// database unless conf changes that.
+func newTestApp(t testing.TB, conf ...func(*store.Conf)) *App {
+	t.Helper()
+
+	cfg := store.Conf{
+		DBPath:         filepath.Join(t.TempDir(), "urls.db"),
+		MaxOpenConns:   4,
+		MaxIdleConns:   4,
+		ShortURLLength: 6,
+		FlushInterval:  time.Hour,
+	}
+	for _, fn := range conf {
+		fn(&cfg)
+	}
+	s, err := store.New(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("store.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	domains, err := newPublicDomains([]string{"https://lil.test"})
+	if err != nil {
+		t.Fatalf("newPublicDomains: %v", err)
+	}
+	return &App{store: s, logger: testLogger, domains: domains}
+}
+
+// serve calls handler with a request for target, setting the path values
+// given as name, value pairs.
+func serve(handler http.HandlerFunc, method, target, body string, pathValues ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// decodeData decodes the data of a JSON envelope into v, failing the test
+// unless the response has the wanted status.
+func decodeData(t testing.TB, w *httptest.ResponseRecorder, wantCode int, v any) {
+	t.Helper()
+	if w.Code != wantCode {
+		t.Fatalf("status = %d, want %d: %s", w.Code, wantCode, w.Body)
+	}
+	if v == nil {
+		return
+	}
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s: %v", w.Body, err)
+	}
+	if err := json.Unmarshal(resp.Data, v); err != nil {
+		t.Fatalf("decode data %s: %v", resp.Data, err)
+	}
+}
+
+func mustCreate(t testing.TB, app *App, p store.CreateParams) models.URLData {
+	t.Helper()
+	urlData, err := app.store.CreateShortURL(context.Background(), p)
+	if err != nil {
+		t.Fatalf("CreateShortURL(%+v): %v", p, err)
+	}
+	return urlData
+}
+
+// trackEvents sends the app's analytics events to a webhook, returning a
+// function that drains the queue and returns the events delivered. Events
+// stay queued until then, as no workers are started.
+func trackEvents(t testing.TB, app *App) func() []analytics.Event {
+	t.Helper()
+	var (
+		mu     sync.Mutex
+		events []analytics.Event
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var evt analytics.Event
+		if err := json.NewDecoder(r.Body).Decode(&evt); err != nil {
+			t.Errorf("decode webhook event: %v", err)
+		}
+		mu.Lock()
+		events = append(events, evt)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	m, err := analytics.NewManager(analytics.Config{
+		Enabled:   true,
+		Providers: map[string]map[string]interface{}{"webhook": {"endpoint": srv.URL}},
+	}, testLogger)
+	if err != nil {
+		t.Fatalf("analytics.NewManager: %v", err)
+	}
+	app.analytics = m
+	return func() []analytics.Event {
+		t.Helper()
+		if err := m.Shutdown(context.Background()); err != nil {
+			t.Fatalf("analytics shutdown: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+}
+
+func TestHandleUpdateURL(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/a", Slug: "first", Title: "First", Tags: []string{"x", "y"}})
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/b", Slug: "second"})
+
+	tests := []struct {
+		name      string
+		code      string
+		body      string
+		wantCode  int
+		wantShort string
+		wantURL   string
+		wantTitle string
+		wantTags  []string
+	}{
+		{
+			name:      "title only",
+			code:      "first",
+			body:      `{"title": "Renamed title"}`,
+			wantCode:  http.StatusOK,
+			wantShort: "first",
+			wantURL:   "https://example.com/a",
+			wantTitle: "Renamed title",
+			wantTags:  []string{"x", "y"},
+		},
+		{
+			name:      "url only",
+			code:      "first",
+			body:      `{"url": "https://example.com/new"}`,
+			wantCode:  http.StatusOK,
+			wantShort: "first",
+			wantURL:   "https://example.com/new",
+			wantTitle: "Renamed title",
+			wantTags:  []string{"x", "y"},
+		},
+		{
+			name:      "tags replaced",
+			code:      "first",
+			body:      `{"tags": [" z ", "x", "z"]}`,
+			wantCode:  http.StatusOK,
+			wantShort: "first",
+			wantURL:   "https://example.com/new",
+			wantTitle: "Renamed title",
+			wantTags:  []string{"z", "x"},
+		},
+		{
+			name:      "tags null",
+			code:      "first",
+			body:      `{"tags": null}`,
+			wantCode:  http.StatusOK,
+			wantShort: "first",
+			wantURL:   "https://example.com/new",
+			wantTitle: "Renamed title",
+			wantTags:  []string{"z", "x"},
+		},
+		{
+			name:      "tags removed",
+			code:      "first",
+			body:      `{"tags": []}`,
+			wantCode:  http.StatusOK,
+			wantShort: "first",
+			wantURL:   "https://example.com/new",
+			wantTitle: "Renamed title",
+		},
+		{
+			name:     "tag too long",
+			code:     "first",
+			body:     `{"tags": ["` + strings.Repeat("t", maxTagLength+1) + `"]}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "rename to taken code",
+			code:     "first",
+			body:     `{"slug": "second"}`,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "empty url",
+			code:     "first",
+			body:     `{"url": ""}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "not found",
+			code:     "missing",
+			body:     `{"title": "Nope"}`,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:      "renamed",
+			code:      "first",
+			body:      `{"slug": "third"}`,
+			wantCode:  http.StatusOK,
+			wantShort: "third",
+			wantURL:   "https://example.com/new",
+			wantTitle: "Renamed title",
+		},
+		{
+			name:     "old code after rename",
+			code:     "first",
+			body:     `{"title": "Gone"}`,
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		w := serve(app.handleUpdateURL, http.MethodPatch, "/api/v1/urls/"+tt.code, tt.body, "shortCode", tt.code)
+		if tt.wantCode != http.StatusOK {
+			if w.Code != tt.wantCode {
+				t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.wantCode, w.Body)
+			}
+			continue
+		}
+
+		var got models.URLData
+		decodeData(t, w, tt.wantCode, &got)
+		if got.ShortCode != tt.wantShort || got.URL != tt.wantURL || got.Title != tt.wantTitle || !slices.Equal(got.Tags, tt.wantTags) {
+			t.Errorf("%s: got %s -> %s %q %v, want %s -> %s %q %v", tt.name,
+				got.ShortCode, got.URL, got.Title, got.Tags,
+				tt.wantShort, tt.wantURL, tt.wantTitle, tt.wantTags)
+		}
+	}
+
+	// The unchanged URL was left alone by the failed rename
+	second, err := app.store.GetURL(context.Background(), "second")
+	if err != nil {
+		t.Fatalf("GetURL(second): %v", err)
+	}
+	if second.URL != "https://example.com/b" {
+		t.Errorf("second points to %s, want https://example.com/b", second.URL)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("parseCIDRs: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.1:5000",
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "untrusted peer spoofing headers",
+			remoteAddr: "203.0.113.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7", "CF-Connecting-IP": "198.51.100.8"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy chain",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.66, 198.51.100.7, 10.0.0.2, 10.0.0.3"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.5, 10.0.0.2"},
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "cloudflare",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7", "CF-Connecting-IP": " 198.51.100.8 "},
+			want:       "198.51.100.8",
+		},
+		{
+			name:       "hop with port",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7:4711"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "empty hops",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": " , 198.51.100.7,, "},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "ipv6 peer",
+			remoteAddr: "[2001:db8::1]:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "ipv6 trusted proxy",
+			remoteAddr: "[fd00::1]:5000",
+			headers:    map[string]string{"X-Forwarded-For": "2001:DB8::2, fd00::2"},
+			want:       "2001:db8::2",
+		},
+		{
+			name:       "ipv6 hop with port",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "[2001:db8::3]:4711"},
+			want:       "2001:db8::3",
+		},
+		{
+			name:       "malformed forwarded for",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "<script>"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "malformed hop before a trusted one",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7, unknown, 10.0.0.2"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "malformed cloudflare header",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7", "CF-Connecting-IP": "999.1.1.1"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "remote address without port",
+			remoteAddr: "203.0.113.1",
+			want:       "203.0.113.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/code", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The metrics guard matches networks against the client address, so a
+// trusted proxy can forward it but anyone else claiming one is ignored.
+func TestRestrictForwardedClients(t *testing.T) {
+	app := newTestApp(t)
+	var err error
+	if app.trustedProxies, err = parseCIDRs([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("parseCIDRs: %v", err)
+	}
+	networks, err := parseCIDRs([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("parseCIDRs: %v", err)
+	}
+	guard := app.restrict([]string{"scrape"}, networks)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       int
+	}{
+		{name: "direct from allowed network", remoteAddr: "192.0.2.7:1234", want: http.StatusOK},
+		{name: "direct from elsewhere", remoteAddr: "198.51.100.7:1234", want: http.StatusForbidden},
+		{
+			name:       "allowed client through trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.7"},
+			want:       http.StatusOK,
+		},
+		{
+			name:       "other client through trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "client prepending an allowed address",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.7, 198.51.100.7"},
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "spoofed header from untrusted peer",
+			remoteAddr: "198.51.100.7:1234",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.7"},
+			want:       http.StatusForbidden,
+		},
+		{
+			name:       "token from elsewhere",
+			remoteAddr: "198.51.100.7:1234",
+			headers:    map[string]string{"Authorization": "Bearer scrape"},
+			want:       http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			guard.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusForbidden && !strings.Contains(w.Body.String(), `"Forbidden"`) {
+				t.Errorf("body = %s, want the JSON error", w.Body)
+			}
+		})
+	}
+}
+
+// User agents of the clients device targeting tells apart.
+const (
+	androidUA = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Mobile Safari/537.36"
+	iphoneUA  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+	macUA     = "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15"
+	windowsUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36"
+	curlUA    = "curl/8.7.1"
+)
+
+func TestResolveTargetURL(t *testing.T) {
+	deviceURLs := func(platforms ...string) map[string]models.DeviceURLData {
+		out := make(map[string]models.DeviceURLData, len(platforms))
+		for _, platform := range platforms {
+			out[platform] = models.DeviceURLData{Platform: platform, URL: "https://example.com/" + platform}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		userAgent  string
+		deviceURLs map[string]models.DeviceURLData
+		want       string
+	}{
+		{name: "no device URLs", userAgent: androidUA, want: "https://example.com/base"},
+		{name: "android", userAgent: androidUA, deviceURLs: deviceURLs("android", "ios", "web"), want: "https://example.com/android"},
+		{name: "ios", userAgent: iphoneUA, deviceURLs: deviceURLs("android", "ios", "web"), want: "https://example.com/ios"},
+		{name: "macos", userAgent: macUA, deviceURLs: deviceURLs("ios", "macos"), want: "https://example.com/macos"},
+		{name: "custom platform", userAgent: windowsUA, deviceURLs: deviceURLs("windows", "web"), want: "https://example.com/windows"},
+		{name: "web fallback", userAgent: macUA, deviceURLs: deviceURLs("android", "ios", "web"), want: "https://example.com/web"},
+		{name: "unknown client", userAgent: curlUA, deviceURLs: deviceURLs("android", "web"), want: "https://example.com/web"},
+		{name: "empty user agent", deviceURLs: deviceURLs("android", "web"), want: "https://example.com/web"},
+		{name: "base fallback", userAgent: androidUA, deviceURLs: deviceURLs("ios"), want: "https://example.com/base"},
+		{
+			name:       "empty device URL",
+			userAgent:  androidUA,
+			deviceURLs: map[string]models.DeviceURLData{"android": {Platform: "android"}},
+			want:       "https://example.com/base",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urlData := models.URLData{URL: "https://example.com/base", DeviceURLs: tt.deviceURLs}
+			if got := resolveTargetURL(urlData, useragent.Parse(tt.userAgent)); got != tt.want {
+				t.Errorf("resolveTargetURL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShortenWithPasswordHash(t *testing.T) {
+	app := newTestApp(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten",
+		`{"url": "https://example.com/protected", "slug": "migrated", "password_hash": "`+string(hash)+`"}`)
+	decodeData(t, w, http.StatusOK, nil)
+	if strings.Contains(w.Body.String(), string(hash)) {
+		t.Errorf("response includes the password hash: %s", w.Body)
+	}
+
+	// The link asks for the password the hash was made from
+	for _, tc := range []struct {
+		password string
+		want     int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusFound},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/migrated", nil)
+		r.SetPathValue("shortCode", "migrated")
+		if tc.password != "" {
+			r.Header.Set("X-Link-Password", tc.password)
+		}
+		w := httptest.NewRecorder()
+		app.handleRedirect(w, r)
+		if w.Code != tc.want {
+			t.Errorf("redirect with password %q: status = %d, want %d", tc.password, w.Code, tc.want)
+		}
+	}
+
+	valid := string(hash)
+	for name, body := range map[string]string{
+		"not bcrypt":      `{"url": "https://example.com", "password_hash": "5f4dcc3b5aa765d61d8327deb882cf99"}`,
+		"truncated":       `{"url": "https://example.com", "password_hash": "` + valid[:len(valid)-1] + `"}`,
+		"bad characters":  `{"url": "https://example.com", "password_hash": "` + valid[:len(valid)-1] + `!"}`,
+		"cost too high":   `{"url": "https://example.com", "password_hash": "$2b$32$` + valid[7:] + `"}`,
+		"unknown version": `{"url": "https://example.com", "password_hash": "$3a$` + valid[4:] + `"}`,
+		"with a password": `{"url": "https://example.com", "password": "s3cret", "password_hash": "` + valid + `"}`,
+	} {
+		w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "password") {
+			t.Errorf("%s: status = %d, want 400 about the password hash: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestHandleBulkStats(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/a", Slug: "a"})
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/fresh", Slug: "fresh"})
+	for i := 0; i < 2; i++ {
+		if _, err := app.store.GetRedirectData(context.Background(), "a"); err != nil {
+			t.Fatalf("GetRedirectData(a): %v", err)
+		}
+	}
+
+	clicked, err := app.store.GetURL(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("GetURL(a): %v", err)
+	}
+
+	var got []urlStats
+	w := serve(app.handleBulkStats, http.MethodPost, "/api/v1/urls/stats", `["fresh", "unknown", "a"]`)
+	decodeData(t, w, http.StatusOK, &got)
+	want := []urlStats{
+		{ShortCode: "fresh", Found: true},
+		{ShortCode: "unknown"},
+		{ShortCode: "a", Found: true, ClickCount: 2, LastAccessedAt: clicked.LastAccessedAt},
+	}
+	if clicked.LastAccessedAt == nil {
+		t.Fatal("clicked URL has no last access")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("stats = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ShortCode != w.ShortCode || g.Found != w.Found || g.ClickCount != w.ClickCount ||
+			(g.LastAccessedAt == nil) != (w.LastAccessedAt == nil) ||
+			g.LastAccessedAt != nil && !g.LastAccessedAt.Equal(*w.LastAccessedAt) {
+			t.Errorf("stats[%d] = %+v, want %+v", i, g, w)
+		}
+	}
+	// Codes that were never clicked have an explicit null
+	if !strings.Contains(w.Body.String(), `{"short_code":"fresh","found":true,"click_count":0,"last_accessed_at":null}`) {
+		t.Errorf("body %s doesn't have a null last access for fresh", w.Body)
+	}
+
+	for _, body := range []string{`[]`, `{"short_codes": ["a"]}`, `["` + strings.Repeat(`a", "`, maxBulkStatsCodes) + `a"]`} {
+		if w := serve(app.handleBulkStats, http.MethodPost, "/api/v1/urls/stats", body); w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d for a body of %d bytes, want 400", w.Code, len(body))
+		}
+	}
+}
+
+func TestResetClicksThenRedirect(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/once", Slug: "once", MaxClicks: 1})
+
+	redirect := func(want int) {
+		t.Helper()
+		if w := serve(app.handleRedirect, http.MethodGet, "/once", "", "shortCode", "once"); w.Code != want {
+			t.Fatalf("redirect status = %d, want %d", w.Code, want)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		redirect(http.StatusFound)
+		redirect(http.StatusGone)
+
+		var urlData models.URLData
+		w := serve(app.handleResetClicks, http.MethodPost, "/api/v1/urls/once/reset-clicks", "", "shortCode", "once")
+		decodeData(t, w, http.StatusOK, &urlData)
+		if urlData.ClickCount != 0 {
+			t.Errorf("reset response has %d clicks, want 0", urlData.ClickCount)
+		}
+	}
+	redirect(http.StatusFound)
+
+	w := serve(app.handleResetClicks, http.MethodPost, "/api/v1/urls/missing/reset-clicks", "", "shortCode", "missing")
+	decodeData(t, w, http.StatusNotFound, nil)
+}
+
+func TestHandleBulkShortenURL(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/taken", Slug: "taken"})
+
+	type result struct {
+		Index     int    `json:"index"`
+		ShortCode string `json:"short_code"`
+		PublicURL string `json:"public_url"`
+		Error     string `json:"error"`
+	}
+	var resp struct {
+		Results []result `json:"results"`
+		Created int      `json:"created"`
+		Failed  int      `json:"failed"`
+	}
+	w := serve(app.handleBulkShortenURL, http.MethodPost, "/api/v1/urls/bulk", `[
+		{"url": "https://example.com/one", "slug": "one"},
+		{"url": "javascript:alert(1)"},
+		{"url": "https://example.com/other-domain", "domain": "other.test"},
+		{"url": "https://example.com/dup", "slug": "taken"},
+		{"url": "https://example.com/two", "domain": "lil.test"}
+	]`)
+	decodeData(t, w, http.StatusOK, &resp)
+
+	if resp.Created != 2 || resp.Failed != 3 || len(resp.Results) != 5 {
+		t.Fatalf("created %d and failed %d of %d, want 2 and 3 of 5", resp.Created, resp.Failed, len(resp.Results))
+	}
+	for i, res := range resp.Results {
+		if res.Index != i {
+			t.Errorf("result %d has index %d", i, res.Index)
+		}
+		succeeded := i == 0 || i == 4
+		if succeeded != (res.Error == "") {
+			t.Errorf("result %d: error %q", i, res.Error)
+		}
+		// Only created entries have a short code and public URL
+		if succeeded != (res.ShortCode != "") || succeeded != (res.PublicURL != "") {
+			t.Errorf("result %d = %+v, want a short code and public_url only when created", i, res)
+		}
+	}
+	if res := resp.Results[0]; res.ShortCode != "one" || res.PublicURL != "https://lil.test" {
+		t.Errorf("first result = %+v, want one at https://lil.test", res)
+	}
+
+	for _, body := range []string{`[]`, `[` + strings.Repeat(`{"url": "https://example.com"},`, maxBulkURLs) + `{"url": "https://example.com"}]`, `{}`} {
+		if w := serve(app.handleBulkShortenURL, http.MethodPost, "/api/v1/urls/bulk", body); w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d for a body of %d bytes, want 400", w.Code, len(body))
+		}
+	}
+}
+
+// Bodies over the route's limit get a JSON 413, whether they declare their
+// length up front or are streamed past it.
+func TestBodyLimit(t *testing.T) {
+	app := newTestApp(t)
+	const limit = 256
+	limited := func(h http.HandlerFunc) http.Handler {
+		return middleware.BodyLimit(limit, app.sendBodyTooLarge)(h)
+	}
+
+	longURL := `{"url": "https://example.com/` + strings.Repeat("a", limit) + `"}`
+	longCSV := "url\nhttps://example.com/" + strings.Repeat("a", limit) + "\n"
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		target      string
+		contentType string
+		body        string
+	}{
+		{"create", limited(app.handleShortenURL), "/api/v1/shorten", "application/json", longURL},
+		{"import JSON", limited(app.handleImport), "/api/v1/urls/import", "application/json", "[" + longURL + "]"},
+		{"import CSV", limited(app.handleImport), "/api/v1/urls/import", "text/csv", longCSV},
+	}
+	for _, tt := range tests {
+		for _, streamed := range []bool{false, true} {
+			name := tt.name
+			if streamed {
+				name += " streamed"
+			}
+			t.Run(name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+				r.Header.Set("Content-Type", tt.contentType)
+				if streamed {
+					r.ContentLength = -1
+				}
+				w := httptest.NewRecorder()
+				tt.handler.ServeHTTP(w, r)
+
+				if w.Code != http.StatusRequestEntityTooLarge {
+					t.Fatalf("status = %d, want 413: %s", w.Code, w.Body)
+				}
+				var resp httpResp
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("decode response %s: %v", w.Body, err)
+				}
+				if resp.Status != "error" || resp.Message != "Request body too large" {
+					t.Errorf("response = %+v, want the body too large error", resp)
+				}
+			})
+		}
+	}
+
+	if _, total, err := app.store.GetURLs(context.Background(), 1, 10, ""); err != nil || total != 0 {
+		t.Errorf("GetURLs = %d links, %v; want none created from oversized bodies", total, err)
+	}
+}
+
+// HEAD requests come from link checkers, so they neither count a click nor
+// send analytics events, and leave expired links for redirects to delete.
+func TestHeadRedirect(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	events := trackEvents(t, app)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/a", Slug: "a"})
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/brief", Slug: "brief", Expiry: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		w := serve(app.handleRedirect, http.MethodHead, "/a", "", "shortCode", "a")
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/a" {
+			t.Fatalf("HEAD = %d to %q, want 302 to https://example.com/a", w.Code, w.Header().Get("Location"))
+		}
+		if w := serve(app.handleRedirect, http.MethodHead, "/brief", "", "shortCode", "brief"); w.Code != http.StatusGone {
+			t.Fatalf("HEAD of an expired link = %d, want 410", w.Code)
+		}
+	}
+	if w := serve(app.handleRedirect, http.MethodGet, "/a", "", "shortCode", "a"); w.Code != http.StatusFound {
+		t.Fatalf("GET = %d, want 302", w.Code)
+	}
+
+	urlData, err := app.store.GetURL(ctx, "a")
+	if err != nil {
+		t.Fatalf("GetURL(a): %v", err)
+	}
+	if urlData.ClickCount != 1 {
+		t.Errorf("click count = %d after three HEADs and a GET, want 1", urlData.ClickCount)
+	}
+	if got := events(); len(got) != 1 || got[0].ShortCode != "a" {
+		t.Errorf("events = %+v, want one for the GET", got)
+	}
+
+	if _, err := app.store.GetURL(ctx, "brief"); err != nil {
+		t.Errorf("expired link after HEADs: %v, want it kept", err)
+	}
+	if w := serve(app.handleRedirect, http.MethodGet, "/brief", "", "shortCode", "brief"); w.Code != http.StatusGone {
+		t.Errorf("GET of an expired link = %d, want 410", w.Code)
+	}
+	if _, err := app.store.GetURL(ctx, "brief"); !errors.Is(err, store.ErrNotExist) {
+		t.Errorf("expired link after a GET: %v, want ErrNotExist", err)
+	}
+}
+
+func TestCheckForwardParams(t *testing.T) {
+	if err := checkForwardParams([]string{"utm_source", "ref"}); err != nil {
+		t.Errorf("checkForwardParams: %v", err)
+	}
+	if err := checkForwardParams([]string{"ref", "password"}); err == nil {
+		t.Error("forwarding password accepted")
+	}
+}
+
+func TestRedirectExpiredAndUnknown(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "brief", Expiry: time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		code    string
+		want    int
+		message string
+	}{
+		{"expand expired", app.handleExpand, "/api/v1/expand/brief", "brief", http.StatusGone, "URL has expired"},
+		// Redirecting deletes it, so it's unknown afterwards
+		{"expired", app.handleRedirect, "/brief", "brief", http.StatusGone, "URL has expired"},
+		{"deleted after expiring", app.handleRedirect, "/brief", "brief", http.StatusNotFound, "URL not found"},
+		{"unknown", app.handleRedirect, "/missing", "missing", http.StatusNotFound, "URL not found"},
+		{"expand unknown", app.handleExpand, "/api/v1/expand/missing", "missing", http.StatusNotFound, "URL not found"},
+	}
+	for _, tt := range tests {
+		w := serve(tt.handler, http.MethodGet, tt.target, "", "shortCode", tt.code)
+		var resp httpResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: decode response %s: %v", tt.name, w.Body, err)
+		}
+		if w.Code != tt.want || resp.Message != tt.message {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, resp.Message, tt.want, tt.message)
+		}
+	}
+}
+
+func TestShortenRejectsInvalidSlugs(t *testing.T) {
+	app := newTestApp(t)
+	for slug, want := range map[string]string{
+		"a/b":                   "must match",
+		strings.Repeat("a", 65): "between 1 and 64",
+		"health":                "reserved",
+	} {
+		var resp httpResp
+		w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com", "slug": "`+slug+`"}`)
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response %s: %v", w.Body, err)
+		}
+		if w.Code != http.StatusBadRequest || !strings.Contains(resp.Message, want) {
+			t.Errorf("slug %q: %d %q, want 400 about %q", slug, w.Code, resp.Message, want)
+		}
+	}
+}
+
+func TestForwardQuery(t *testing.T) {
+	allowed := []string{"utm_source", "ref", "q"}
+	tests := []struct {
+		name     string
+		target   string
+		incoming string
+		want     string
+	}{
+		{name: "nothing incoming", target: "https://example.com/p?a=1", want: "https://example.com/p?a=1"},
+		{name: "allowed parameter", target: "https://example.com/p", incoming: "ref=news", want: "https://example.com/p?ref=news"},
+		{name: "other parameters dropped", target: "https://example.com/p", incoming: "ref=news&session=abc", want: "https://example.com/p?ref=news"},
+		{name: "nothing allowed", target: "https://example.com/p?a=1", incoming: "session=abc", want: "https://example.com/p?a=1"},
+		{name: "merged with the target's query", target: "https://example.com/p?a=1", incoming: "ref=news", want: "https://example.com/p?a=1&ref=news"},
+		{name: "target's value kept", target: "https://example.com/p?ref=site", incoming: "ref=news&q=go", want: "https://example.com/p?q=go&ref=site"},
+		{name: "ampersand can't add a parameter", target: "https://example.com/p", incoming: "ref=a%26admin%3D1", want: "https://example.com/p?ref=a%26admin%3D1"},
+		{name: "equals kept in the value", target: "https://example.com/p", incoming: "q=a%3Db", want: "https://example.com/p?q=a%3Db"},
+		{name: "percent-encoded value", target: "https://example.com/p", incoming: "q=caf%C3%A9+au+lait%21", want: "https://example.com/p?q=caf%C3%A9+au+lait%21"},
+		{name: "repeated values", target: "https://example.com/p", incoming: "q=a&q=b", want: "https://example.com/p?q=a&q=b"},
+		{name: "fragment kept", target: "https://example.com/p#top", incoming: "ref=news", want: "https://example.com/p?ref=news#top"},
+		{name: "unparseable target", target: "https://exa mple.com/%zz", incoming: "ref=news", want: "https://exa mple.com/%zz"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			incoming, err := url.ParseQuery(tc.incoming)
+			if err != nil {
+				t.Fatalf("ParseQuery(%s): %v", tc.incoming, err)
+			}
+			if got := forwardQuery(tc.target, incoming, allowed); got != tc.want {
+				t.Errorf("forwardQuery(%s, %s) = %s, want %s", tc.target, tc.incoming, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetURLsPagination(t *testing.T) {
+	app := newTestApp(t)
+	for i := 0; i < 5; i++ {
+		mustCreate(t, app, store.CreateParams{URL: fmt.Sprintf("https://example.com/%d", i)})
+	}
+
+	type page struct {
+		Page       int64 `json:"page"`
+		PerPage    int64 `json:"per_page"`
+		Count      int64 `json:"count"`
+		TotalPages int64 `json:"total_pages"`
+		HasNext    bool  `json:"has_next"`
+		HasPrev    bool  `json:"has_prev"`
+	}
+	var resp struct {
+		URLs []models.URLData `json:"urls"`
+		page
+	}
+	tests := []struct {
+		query string
+		want  page
+	}{
+		{query: "", want: page{Page: 1, PerPage: 10, Count: 5, TotalPages: 1}},
+		{query: "page=1&per_page=2", want: page{Page: 1, PerPage: 2, Count: 5, TotalPages: 3, HasNext: true}},
+		{query: "page=2&per_page=2", want: page{Page: 2, PerPage: 2, Count: 5, TotalPages: 3, HasNext: true, HasPrev: true}},
+		{query: "page=3&per_page=2", want: page{Page: 3, PerPage: 2, Count: 5, TotalPages: 3, HasPrev: true}},
+		{query: "page=9&per_page=2", want: page{Page: 9, PerPage: 2, Count: 5, TotalPages: 3, HasPrev: true}},
+	}
+	for _, tc := range tests {
+		resp.URLs = nil
+		decodeData(t, serve(app.handleGetURLs, http.MethodGet, "/api/v1/urls?"+tc.query, ""), http.StatusOK, &resp)
+		wantURLs := tc.want.PerPage
+		if rest := tc.want.Count - (tc.want.Page-1)*tc.want.PerPage; rest < wantURLs {
+			wantURLs = max(rest, 0)
+		}
+		if int64(len(resp.URLs)) != wantURLs {
+			t.Errorf("%q: %d URLs, want %d", tc.query, len(resp.URLs), wantURLs)
+		}
+		if resp.page != tc.want {
+			t.Errorf("%q: page = %+v, want %+v", tc.query, resp.page, tc.want)
+		}
+	}
+
+	for _, query := range []string{"per_page=0", "per_page=-1", "per_page=1001", "per_page=ten", "page=0", "page=-1", "page=x", "page=9223372036854775807&per_page=2"} {
+		w := serve(app.handleGetURLs, http.MethodGet, "/api/v1/urls?"+query, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want 400", query, w.Code)
+		}
+	}
+}
+
+// A request queued behind a slow store call returns a 504 once the route's
+// timeout is spent, rather than hanging until the store frees up.
+func TestSlowStoreTimesOut(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "urls.db")
+	app := newTestApp(t, func(c *store.Conf) {
+		c.DBPath = dbPath
+		c.MaxOpenConns = 1
+	})
+
+	// Hold the database's write lock from another connection, so a create
+	// waits on SQLite's busy timeout while holding the store's only
+	// connection
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("open %s: %v", dbPath, err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("conn: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("lock database: %v", err)
+	}
+	slow := make(chan error)
+	go func() {
+		_, err := app.store.CreateShortURL(context.Background(), store.CreateParams{URL: "https://example.com/slow"})
+		slow <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	handler := middleware.Timeout(50 * time.Millisecond)(http.HandlerFunc(app.handleShortenURL))
+	shorten := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(`{"url": "https://example.com"}`)))
+		return w
+	}
+
+	start := time.Now()
+	w := shorten()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s with a 50ms timeout", elapsed)
+	}
+	var resp httpResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s: %v", w.Body, err)
+	}
+	if w.Code != http.StatusGatewayTimeout || resp.Message != "Request timed out" {
+		t.Errorf("slow store: %d %q, want 504 %q", w.Code, resp.Message, "Request timed out")
+	}
+
+	if _, err := conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+		t.Fatalf("unlock database: %v", err)
+	}
+	if err := <-slow; err != nil {
+		t.Fatalf("slow create: %v", err)
+	}
+	if w := shorten(); w.Code != http.StatusOK {
+		t.Errorf("after the store freed up: status = %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestExpandDeviceTargeting(t *testing.T) {
+	app := newTestApp(t)
+	events := trackEvents(t, app)
+	mustCreate(t, app, store.CreateParams{
+		URL:  "https://example.com/base",
+		Slug: "app",
+		DeviceURLs: map[string]string{
+			"android": "https://play.example/app",
+			"ios":     "https://apps.example/app",
+			"web":     "https://example.com/web",
+		},
+	})
+	mustCreate(t, app, store.CreateParams{
+		URL:        "https://example.com/base",
+		Slug:       "mobile",
+		DeviceURLs: map[string]string{"ios": "https://apps.example/app"},
+	})
+
+	tests := []struct {
+		name      string
+		code      string
+		userAgent string
+		want      string
+	}{
+		{name: "android", code: "app", userAgent: androidUA, want: "https://play.example/app"},
+		{name: "ios", code: "app", userAgent: iphoneUA, want: "https://apps.example/app"},
+		{name: "desktop", code: "app", userAgent: macUA, want: "https://example.com/web"},
+		{name: "unknown client", code: "app", userAgent: curlUA, want: "https://example.com/web"},
+		{name: "fallback to the base URL", code: "mobile", userAgent: windowsUA, want: "https://example.com/base"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/expand/"+tt.code, nil)
+			r.Header.Set("User-Agent", tt.userAgent)
+			r.SetPathValue("shortCode", tt.code)
+			w := httptest.NewRecorder()
+			app.handleExpand(w, r)
+
+			var got expandResponse
+			decodeData(t, w, http.StatusOK, &got)
+			if got.ShortCode != tt.code || got.URL != "https://example.com/base" || got.TargetURL != tt.want {
+				t.Errorf("expand = %+v, want %s resolved to %s", got, tt.code, tt.want)
+			}
+			if loc := w.Header().Get("Location"); loc != "" {
+				t.Errorf("Location = %s, want no redirect", loc)
+			}
+		})
+	}
+
+	// Expanding isn't a visit
+	urlData, err := app.store.GetURL(context.Background(), "app")
+	if err != nil {
+		t.Fatalf("GetURL(app): %v", err)
+	}
+	if urlData.ClickCount != 0 {
+		t.Errorf("click count = %d after expanding, want 0", urlData.ClickCount)
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("events = %+v after expanding, want none", got)
+	}
+}
+
+func TestDetectPlatform(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{androidUA, "android"},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", "android"},
+		{iphoneUA, "ios"},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1", "ios"},
+		{macUA, "macos"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:125.0) Gecko/20100101 Firefox/125.0", "macos"},
+		{windowsUA, "windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0", "windows"},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36", "linux"},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0", "linux"},
+		{curlUA, "other"},
+		{"Googlebot/2.1 (+http://www.google.com/bot.html)", "other"},
+		{"", "other"},
+	}
+	for _, tt := range tests {
+		if got := detectPlatform(useragent.Parse(tt.userAgent)); got != tt.want {
+			t.Errorf("detectPlatform(%q) = %s, want %s", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+// The platform is reported from the client's OS even when the link has no
+// device URLs to pick from.
+func TestRedirectReportsPlatform(t *testing.T) {
+	app := newTestApp(t)
+	events := trackEvents(t, app)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "plain"})
+
+	userAgents := []string{androidUA, windowsUA, "Mozilla/5.0 (X11; Linux x86_64) Gecko/20100101 Firefox/125.0", curlUA}
+	want := []string{"android", "windows", "linux", "other"}
+	before := make([]uint64, len(want))
+	for i, platform := range want {
+		before[i] = metrics.RedirectsByPlatform(platform).Get()
+	}
+	for _, userAgent := range userAgents {
+		r := httptest.NewRequest(http.MethodGet, "/plain", nil)
+		r.Header.Set("User-Agent", userAgent)
+		r.SetPathValue("shortCode", "plain")
+		w := httptest.NewRecorder()
+		app.handleRedirect(w, r)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com" {
+			t.Fatalf("redirect for %q = %d to %q, want 302 to the base URL", userAgent, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	got := events()
+	if len(got) != len(want) {
+		t.Fatalf("%d events, want %d", len(got), len(want))
+	}
+	for i, platform := range want {
+		if got[i].Platform != platform {
+			t.Errorf("event for %q: platform = %s, want %s", userAgents[i], got[i].Platform, platform)
+		}
+		if n := metrics.RedirectsByPlatform(platform).Get() - before[i]; n != 1 {
+			t.Errorf("%s redirects counted = %d, want 1", platform, n)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration // Zero when invalid
+	}{
+		{"7d", 7 * 24 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"24h", 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+		{"45s", 45 * time.Second},
+		{"", 0},
+		{"0d", 0},
+		{"0s", 0},
+		{"-5m", 0},
+		{"1d-1h", 0},
+		{"d", 0},
+		{"7 days", 0},
+		{"1w", 0},
+		{"abc", 0},
+		{"99999d", 0},
+	}
+	for _, tt := range tests {
+		got, err := parseExpiry(tt.in)
+		switch {
+		case tt.want == 0 && err == nil:
+			t.Errorf("parseExpiry(%q) = %s, want it rejected", tt.in, got)
+		case tt.want != 0 && err != nil:
+			t.Errorf("parseExpiry(%q) failed: %v", tt.in, err)
+		case got != tt.want:
+			t.Errorf("parseExpiry(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestShortenWithRelativeExpiry(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		body string
+		want time.Duration
+	}{
+		{`{"url": "https://example.com", "expiry": "7d"}`, 7 * 24 * time.Hour},
+		{`{"url": "https://example.com", "expiry": "90m"}`, 90 * time.Minute},
+		// The explicit seconds win
+		{`{"url": "https://example.com", "expiry": "7d", "expiry_in_secs": 60}`, time.Minute},
+	}
+	for _, tt := range tests {
+		var got models.URLData
+		start := time.Now()
+		decodeData(t, serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", tt.body), http.StatusOK, &got)
+		if got.ExpiresAt == nil {
+			t.Errorf("%s: no expiry set", tt.body)
+			continue
+		}
+		if d := got.ExpiresAt.Sub(start); d < tt.want-time.Second || d > tt.want+time.Second {
+			t.Errorf("%s: expires in %s, want %s", tt.body, d, tt.want)
+		}
+	}
+
+	w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com", "expiry": "soon"}`)
+	var resp httpResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s: %v", w.Body, err)
+	}
+	if w.Code != http.StatusBadRequest || !strings.Contains(resp.Message, `Invalid expiry "soon"`) {
+		t.Errorf("invalid expiry: %d %q, want 400 naming the value", w.Code, resp.Message)
+	}
+}
+
+func TestGetURLsETag(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/a"})
+
+	list := func(handler http.Handler, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/urls", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	handler := http.HandlerFunc(app.handleGetURLs)
+
+	w := list(handler, nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("first request: %d with ETag %q, want 200 with a strong ETag", w.Code, etag)
+	}
+	w = list(handler, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("conditional request: %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("304 ETag = %q, want %q", got, etag)
+	}
+	if w := list(handler, map[string]string{"If-None-Match": `"stale", ` + etag}); w.Code != http.StatusNotModified {
+		t.Errorf("ETag among others: status = %d, want 304", w.Code)
+	}
+
+	// Behind compression the ETag is weak, and clients send that back
+	compressed := middleware.Compress(0)(handler)
+	w = list(compressed, map[string]string{"Accept-Encoding": "gzip"})
+	if got := w.Header().Get("ETag"); got != "W/"+etag {
+		t.Fatalf("compressed ETag = %q, want W/%s", got, etag)
+	}
+	w = list(compressed, map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "W/" + etag})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("conditional request with the weak ETag: %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("ETag"); got != "W/"+etag {
+		t.Errorf("compressed 304 ETag = %q, want W/%s", got, etag)
+	}
+
+	// A change to the list changes the ETag
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/b"})
+	w = list(handler, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after a create: %d with ETag %q, want 200 with a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestGetURLsGzip(t *testing.T) {
+	app := newTestApp(t)
+	for i := 0; i < 50; i++ {
+		mustCreate(t, app, store.CreateParams{URL: fmt.Sprintf("https://example.com/page/%d", i)})
+	}
+	handler := middleware.Compress(1024)(http.HandlerFunc(app.handleGetURLs))
+
+	plain := httptest.NewRecorder()
+	handler.ServeHTTP(plain, httptest.NewRequest(http.MethodGet, "/api/v1/urls?per_page=50", nil))
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("compressed for a client not accepting gzip")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/urls?per_page=50", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status = %d, Content-Encoding = %q, want a gzipped 200", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", got)
+	}
+	if w.Body.Len() >= plain.Body.Len() {
+		t.Errorf("compressed body is %d bytes, plain %d", w.Body.Len(), plain.Body.Len())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Errorf("decompressed body differs from the plain one")
+	}
+
+	// Redirects go through untouched
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "go"})
+	redirect := middleware.Compress(0)(http.HandlerFunc(app.handleRedirect))
+	r = httptest.NewRequest(http.MethodGet, "/go", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.SetPathValue("shortCode", "go")
+	w = httptest.NewRecorder()
+	redirect.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com" {
+		t.Errorf("redirect through compression = %d to %q, want 302 to https://example.com", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestShortenDryRun(t *testing.T) {
+	app := newTestApp(t, func(c *store.Conf) { c.DeniedHosts = []string{"evil.example"} })
+	app.slugSuggestions = 2
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "taken"})
+
+	dryRun := func(body string) *httptest.ResponseRecorder {
+		return serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten?dry_run=true", body)
+	}
+
+	var got shortenDryRunResponse
+	decodeData(t, dryRun(`{"url": "example.com/page", "slug": "free"}`), http.StatusOK, &got)
+	if got.URL != "https://example.com/page" || got.Slug != "free" || got.SlugAvailable == nil || !*got.SlugAvailable {
+		t.Errorf("available slug: %+v, want the normalized URL and the slug free", got)
+	}
+
+	got = shortenDryRunResponse{}
+	decodeData(t, dryRun(`{"url": "https://example.com", "slug": "taken"}`), http.StatusOK, &got)
+	if got.SlugAvailable == nil || *got.SlugAvailable || len(got.Suggestions) != 2 {
+		t.Errorf("taken slug: %+v, want it taken with 2 suggestions", got)
+	}
+
+	got = shortenDryRunResponse{}
+	decodeData(t, dryRun(`{"url": "https://example.com"}`), http.StatusOK, &got)
+	if got.Slug != "" || got.SlugAvailable != nil {
+		t.Errorf("no slug: %+v, want no slug check", got)
+	}
+
+	for body, message := range map[string]string{
+		`{"url": "javascript:alert(1)", "slug": "free"}`:  "",
+		`{"url": "https://example.com", "slug": "a/b"}`:   "must match",
+		`{"url": "https://evil.example", "slug": "free"}`: "not allowed",
+		`{"url": ""}`: "URL is required",
+	} {
+		w := dryRun(body)
+		var resp httpResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response %s: %v", w.Body, err)
+		}
+		if w.Code != http.StatusBadRequest || !strings.Contains(resp.Message, message) {
+			t.Errorf("%s: %d %q, want 400 with %q", body, w.Code, resp.Message, message)
+		}
+	}
+
+	// Nothing was stored
+	urls, total, err := app.store.GetURLs(context.Background(), 1, 10, "")
+	if err != nil {
+		t.Fatalf("GetURLs: %v", err)
+	}
+	if total != 1 || len(urls) != 1 || urls[0].ShortCode != "taken" {
+		t.Errorf("%d URLs stored after dry runs, want only the one created", total)
+	}
+	if available, err := app.store.IsSlugAvailable(context.Background(), "free"); err != nil || !available {
+		t.Errorf("IsSlugAvailable(free) = %v, %v after dry runs, want it still free", available, err)
+	}
+}
+
+func TestPublicURLPerHost(t *testing.T) {
+	app := newTestApp(t)
+	events := trackEvents(t, app)
+	domains, err := newPublicDomains([]string{"https://lil.test", "https://Short.Example/", "http://go.example:8080"})
+	if err != nil {
+		t.Fatalf("newPublicDomains: %v", err)
+	}
+	app.domains = domains
+
+	tests := []struct {
+		host   string
+		domain string
+		want   string
+	}{
+		{host: "lil.test", want: "https://lil.test"},
+		{host: "short.example", want: "https://Short.Example"},
+		{host: "SHORT.example:443", want: "https://Short.Example"},
+		{host: "go.example:8080", want: "http://go.example:8080"},
+		{host: "unknown.example", want: "https://lil.test"},
+		{host: "lil.test", domain: "short.example", want: "https://Short.Example"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/shorten", strings.NewReader(`{"url": "https://example.com", "domain": "`+tt.domain+`"}`))
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		app.handleShortenURL(w, r)
+
+		var got shortenURLResponse
+		decodeData(t, w, http.StatusOK, &got)
+		if got.PublicURL != tt.want {
+			t.Errorf("host %s, domain %q: public_url = %s, want %s", tt.host, tt.domain, got.PublicURL, tt.want)
+		}
+	}
+
+	w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com", "domain": "other.example"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown domain: status = %d, want 400", w.Code)
+	}
+
+	// Redirect events carry the short URL on the domain it was visited at
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "go"})
+	r := httptest.NewRequest(http.MethodGet, "/go", nil)
+	r.Host = "short.example"
+	r.SetPathValue("shortCode", "go")
+	app.handleRedirect(httptest.NewRecorder(), r)
+	if got := events(); len(got) != 1 || got[0].URL != "https://Short.Example/go" {
+		t.Errorf("events = %+v, want one for https://Short.Example/go", got)
+	}
+
+	for _, urls := range [][]string{{"lil.test"}, {"https://"}, {"https://lil.test", "https://LIL.test/"}} {
+		if _, err := newPublicDomains(urls); err == nil {
+			t.Errorf("newPublicDomains(%q) accepted", urls)
+		}
+	}
+}
+
+func TestShortenAutoSuffix(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "promo"})
+
+	var got shortenURLResponse
+	decodeData(t, serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com/b", "slug": "promo", "auto_suffix": true}`), http.StatusOK, &got)
+	if got.ShortCode != "promo-2" {
+		t.Errorf("short_code = %s, want promo-2", got.ShortCode)
+	}
+
+	w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com/b", "slug": "promo"}`)
+	var resp httpResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s: %v", w.Body, err)
+	}
+	if w.Code != http.StatusConflict || resp.Message != "Short code already exists" {
+		t.Errorf("without auto_suffix: %d %q, want 409", w.Code, resp.Message)
+	}
+}
+
+func TestHandleDeviceURLs(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "app", DeviceURLs: map[string]string{"android": "https://play.example/app"}})
+
+	get := func(code string) *httptest.ResponseRecorder {
+		return serve(app.handleGetDeviceURLs, http.MethodGet, "/api/v1/urls/"+code+"/devices", "", "shortCode", code)
+	}
+	put := func(code, body string) *httptest.ResponseRecorder {
+		return serve(app.handleSetDeviceURLs, http.MethodPut, "/api/v1/urls/"+code+"/devices", body, "shortCode", code)
+	}
+	wantDevices := func(w *httptest.ResponseRecorder, want map[string]string) {
+		t.Helper()
+		var got map[string]string
+		decodeData(t, w, http.StatusOK, &got)
+		if !maps.Equal(got, want) {
+			t.Errorf("device URLs = %v, want %v", got, want)
+		}
+	}
+
+	wantDevices(get("app"), map[string]string{"android": "https://play.example/app"})
+
+	// Replacing drops the platforms left out, and redirects follow
+	wantDevices(put("app", `{"ios": "apps.example/app", "web": "https://example.com/web"}`), map[string]string{"ios": "https://apps.example/app", "web": "https://example.com/web"})
+	wantDevices(get("app"), map[string]string{"ios": "https://apps.example/app", "web": "https://example.com/web"})
+	r := httptest.NewRequest(http.MethodGet, "/app", nil)
+	r.Header.Set("User-Agent", iphoneUA)
+	r.SetPathValue("shortCode", "app")
+	w := httptest.NewRecorder()
+	app.handleRedirect(w, r)
+	if got := w.Header().Get("Location"); got != "https://apps.example/app" {
+		t.Errorf("iOS redirect to %s after replacing, want https://apps.example/app", got)
+	}
+
+	for body, message := range map[string]string{
+		`{"windows": "https://example.com/win"}`: "invalid device platform",
+		`{"ios": "javascript:alert(1)"}`:         "Device URL for ios",
+		`["https://example.com"]`:                "",
+	} {
+		w := put("app", body)
+		var resp httpResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response %s: %v", w.Body, err)
+		}
+		if w.Code != http.StatusBadRequest || !strings.Contains(resp.Message, message) {
+			t.Errorf("PUT %s: %d %q, want 400 with %q", body, w.Code, resp.Message, message)
+		}
+	}
+	wantDevices(get("app"), map[string]string{"ios": "https://apps.example/app", "web": "https://example.com/web"})
+
+	wantDevices(put("app", `{}`), map[string]string{})
+	wantDevices(get("app"), map[string]string{})
+
+	if w := get("missing"); w.Code != http.StatusNotFound {
+		t.Errorf("GET for an unknown code: status = %d, want 404", w.Code)
+	}
+	if w := put("missing", `{"ios": "https://apps.example/app"}`); w.Code != http.StatusNotFound {
+		t.Errorf("PUT for an unknown code: status = %d, want 404", w.Code)
+	}
+}
+
+func TestDetailedHealthSaturation(t *testing.T) {
+	app := newTestApp(t, func(c *store.Conf) { c.BufferSize = 10 })
+	app.saturation = saturationThresholds{writeBuffer: 0.8, flushQueue: 0.8}
+
+	check := func(wantCode int) detailedHealth {
+		t.Helper()
+		w := serve(app.handleDetailedHealthCheck, http.MethodGet, "/api/v1/health/detailed", "")
+		var resp struct {
+			Message string         `json:"message"`
+			Data    detailedHealth `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response %s: %v", w.Body, err)
+		}
+		if w.Code != wantCode {
+			t.Fatalf("status = %d, want %d: %s", w.Code, wantCode, w.Body)
+		}
+		if wantCode == http.StatusServiceUnavailable && resp.Message != "Service is saturated" {
+			t.Errorf("message = %q, want Service is saturated", resp.Message)
+		}
+		return resp.Data
+	}
+
+	health := check(http.StatusOK)
+	if health.Status != "healthy" || health.Database != "ok" || health.WriteBuffer != (queueHealth{Length: 0, Capacity: 10}) {
+		t.Errorf("idle health = %+v", health)
+	}
+
+	// Buffered writes below the threshold don't count as saturated
+	for i := 0; i < 7; i++ {
+		mustCreate(t, app, store.CreateParams{URL: fmt.Sprintf("https://example.com/%d", i)})
+	}
+	if health := check(http.StatusOK); health.WriteBuffer != (queueHealth{Length: 7, Capacity: 10}) {
+		t.Errorf("write buffer = %+v, want 7 of 10 unsaturated", health.WriteBuffer)
+	}
+
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com/8"})
+	health = check(http.StatusServiceUnavailable)
+	if health.Status != "degraded" || health.WriteBuffer != (queueHealth{Length: 8, Capacity: 10, Saturated: true}) || health.FlushQueue.Saturated {
+		t.Errorf("saturated health = %+v, want the write buffer alone saturated", health)
+	}
+}
+
+func TestRedirectStatusPerType(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		redirectType string // JSON value, empty to leave it out
+		want         int
+	}{
+		{"", http.StatusFound},
+		{`"permanent"`, http.StatusMovedPermanently},
+		{`"temporary"`, http.StatusFound},
+		{"301", http.StatusMovedPermanently},
+		{"302", http.StatusFound},
+		{"307", http.StatusTemporaryRedirect},
+		{"308", http.StatusPermanentRedirect},
+	}
+	for i, tt := range tests {
+		slug := fmt.Sprintf("link%d", i)
+		body := `{"url": "https://example.com", "slug": "` + slug + `"`
+		if tt.redirectType != "" {
+			body += `, "redirect_type": ` + tt.redirectType
+		}
+		decodeData(t, serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", body+"}"), http.StatusOK, nil)
+
+		w := serve(app.handleRedirect, http.MethodGet, "/"+slug, "", "shortCode", slug)
+		if w.Code != tt.want || w.Header().Get("Location") != "https://example.com" {
+			t.Errorf("redirect_type %s: %d to %q, want %d to https://example.com", tt.redirectType, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+
+	for _, redirectType := range []string{`"forever"`, `"301"`, "303", "200", "true"} {
+		w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com", "redirect_type": `+redirectType+`}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("redirect_type %s: status = %d, want 400", redirectType, w.Code)
+		}
+	}
+}
+
+func TestAccessLogRecordsHandlerStatus(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "go"})
+
+	var logs strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	handler := middleware.AccessLog(logger, func(r *http.Request) string {
+		return clientIP(r, app.trustedProxies)
+	})(http.HandlerFunc(app.handleRedirect))
+
+	type entry struct {
+		Msg      string  `json:"msg"`
+		Method   string  `json:"method"`
+		Path     string  `json:"path"`
+		Status   int     `json:"status"`
+		Size     int     `json:"size"`
+		Duration float64 `json:"duration_ms"`
+		ClientIP string  `json:"client_ip"`
+	}
+	for _, tt := range []struct {
+		method, code string
+		want         int
+	}{
+		{http.MethodGet, "go", http.StatusFound},
+		{http.MethodHead, "go", http.StatusFound},
+		{http.MethodGet, "missing", http.StatusNotFound},
+	} {
+		logs.Reset()
+		r := httptest.NewRequest(tt.method, "/"+tt.code, nil)
+		r.RemoteAddr = "198.51.100.7:4321"
+		r.SetPathValue("shortCode", tt.code)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		var got entry
+		if err := json.Unmarshal([]byte(logs.String()), &got); err != nil {
+			t.Fatalf("decode log %q: %v", logs.String(), err)
+		}
+		want := entry{Msg: "request", Method: tt.method, Path: "/" + tt.code, Status: tt.want, Size: w.Body.Len(), Duration: got.Duration, ClientIP: "198.51.100.7"}
+		if got != want || w.Code != tt.want {
+			t.Errorf("%s /%s: logged %+v for a %d, want %+v", tt.method, tt.code, got, w.Code, want)
+		}
+	}
+}
+
+// histogramCount returns the number of observations in a histogram.
+func histogramCount(h interface {
+	VisitNonZeroBuckets(func(vmrange string, count uint64))
+}) uint64 {
+	var n uint64
+	h.VisitNonZeroBuckets(func(_ string, count uint64) { n += count })
+	return n
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	app := newTestApp(t, func(c *store.Conf) { c.BufferSize = 1 })
+
+	creates, redirects, flushes := histogramCount(metrics.CreateDuration), histogramCount(metrics.RedirectDuration), histogramCount(metrics.FlushDuration)
+	decodeData(t, serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "https://example.com", "slug": "go"}`), http.StatusOK, nil)
+	if n := histogramCount(metrics.CreateDuration) - creates; n != 1 {
+		t.Errorf("create observations = %d after a create, want 1", n)
+	}
+	// Dry runs aren't creates
+	decodeData(t, serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten?dry_run=true", `{"url": "https://example.com"}`), http.StatusOK, nil)
+	if n := histogramCount(metrics.CreateDuration) - creates; n != 1 {
+		t.Errorf("create observations = %d after a dry run, want 1", n)
+	}
+
+	serve(app.handleRedirect, http.MethodGet, "/go", "", "shortCode", "go")
+	serve(app.handleRedirect, http.MethodGet, "/missing", "", "shortCode", "missing")
+	if n := histogramCount(metrics.RedirectDuration) - redirects; n != 2 {
+		t.Errorf("redirect observations = %d after two redirects, want 2", n)
+	}
+
+	// The full write buffer is flushed in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for histogramCount(metrics.FlushDuration) == flushes {
+		if time.Now().After(deadline) {
+			t.Fatal("no flush observed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedirectDropsEventsWhenQueueFull(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "go"})
+	webhook := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer webhook.Close()
+
+	// Without workers nothing takes events off the queue
+	m, err := analytics.NewManager(analytics.Config{
+		Enabled:   true,
+		QueueSize: 2,
+		Providers: map[string]map[string]interface{}{"webhook": {"endpoint": webhook.URL}},
+	}, testLogger)
+	if err != nil {
+		t.Fatalf("analytics.NewManager: %v", err)
+	}
+	app.analytics = m
+	defer m.Shutdown(context.Background())
+
+	dropped := metrics.AnalyticsEventsDroppedTotal.Get()
+	for i := 0; i < 5; i++ {
+		if w := serve(app.handleRedirect, http.MethodGet, "/go", "", "shortCode", "go"); w.Code != http.StatusFound {
+			t.Fatalf("redirect %d: status = %d, want 302 whatever happens to its event", i+1, w.Code)
+		}
+	}
+	if n := metrics.AnalyticsEventsDroppedTotal.Get() - dropped; n != 3 {
+		t.Errorf("dropped events = %d, want the 3 past the queue size", n)
+	}
+	if depth := metrics.AnalyticsQueueDepth.Get(); depth != 2 {
+		t.Errorf("queue depth = %v, want 2", depth)
+	}
+	if depth, capacity := m.QueueUsage(); depth != 2 || capacity != 2 {
+		t.Errorf("queue usage = %d of %d, want 2 of 2", depth, capacity)
+	}
+}
+
+func TestHandlePurge(t *testing.T) {
+	app := newTestApp(t)
+	for _, p := range []store.CreateParams{
+		{URL: "https://example.com/1", Slug: "promo-1"},
+		{URL: "https://example.com/2", Slug: "promo-2", Expiry: time.Millisecond},
+		{URL: "https://example.com/3", Slug: "promotion"},
+		{URL: "https://example.com/4", Slug: "old", Expiry: time.Millisecond},
+		{URL: "https://example.com/5", Slug: "kept", Expiry: time.Hour},
+	} {
+		mustCreate(t, app, p)
+		// Load them into the cache, which the purge has to follow. A redirect
+		// would delete the short lived ones once they expire.
+		if _, err := app.store.GetURL(context.Background(), p.Slug); err != nil {
+			t.Fatalf("GetURL(%q): %v", p.Slug, err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	purge := func(body string) int {
+		t.Helper()
+		var got struct {
+			Deleted int `json:"deleted"`
+		}
+		decodeData(t, serve(app.handlePurge, http.MethodPost, "/api/v1/urls/purge", body), http.StatusOK, &got)
+		return got.Deleted
+	}
+	remaining := func() []string {
+		t.Helper()
+		urls, _, err := app.store.GetURLs(context.Background(), 1, 10, "")
+		if err != nil {
+			t.Fatalf("GetURLs: %v", err)
+		}
+		codes := make([]string, 0, len(urls))
+		for _, u := range urls {
+			codes = append(codes, u.ShortCode)
+		}
+		slices.Sort(codes)
+		return codes
+	}
+
+	// Criteria are combined
+	if n := purge(`{"expired": true, "prefix": "promo-"}`); n != 1 {
+		t.Errorf("expired promo- links deleted = %d, want 1", n)
+	}
+	if n := purge(`{"expired": true}`); n != 1 {
+		t.Errorf("expired links deleted = %d, want 1", n)
+	}
+	if got, want := remaining(), []string{"kept", "promo-1", "promotion"}; !slices.Equal(got, want) {
+		t.Errorf("after purging expired links: %v, want %v", got, want)
+	}
+	if n := purge(`{"prefix": "promo-"}`); n != 1 {
+		t.Errorf("promo- links deleted = %d, want 1", n)
+	}
+	if got, want := remaining(), []string{"kept", "promotion"}; !slices.Equal(got, want) {
+		t.Errorf("after purging by prefix: %v, want %v", got, want)
+	}
+	if w := serve(app.handleRedirect, http.MethodGet, "/promo-1", "", "shortCode", "promo-1"); w.Code != http.StatusNotFound {
+		t.Errorf("redirect of a purged link: status = %d, want 404", w.Code)
+	}
+	if n := purge(`{"prefix": "nothing-"}`); n != 0 {
+		t.Errorf("unmatched prefix deleted %d links", n)
+	}
+
+	w := serve(app.handlePurge, http.MethodPost, "/api/v1/urls/purge", `{"expired": false}`)
+	var resp httpResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s: %v", w.Body, err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Message != "One of expired, prefix or tag is required" {
+		t.Errorf("no criteria: %d %q, want 400", w.Code, resp.Message)
+	}
+}
+
+func TestGetURLsEdgePages(t *testing.T) {
+	app := newTestApp(t)
+	type meta struct {
+		Count      int64 `json:"count"`
+		TotalPages int64 `json:"total_pages"`
+		HasNext    bool  `json:"has_next"`
+		HasPrev    bool  `json:"has_prev"`
+	}
+	list := func(query string) meta {
+		t.Helper()
+		var got meta
+		decodeData(t, serve(app.handleGetURLs, http.MethodGet, "/api/v1/urls?"+query, ""), http.StatusOK, &got)
+		return got
+	}
+
+	if got := list(""); got != (meta{}) {
+		t.Errorf("empty list = %+v, want no pages", got)
+	}
+
+	for i := 0; i < 4; i++ {
+		mustCreate(t, app, store.CreateParams{URL: fmt.Sprintf("https://example.com/%d", i)})
+	}
+	for query, want := range map[string]meta{
+		"page=2&per_page=2": {Count: 4, TotalPages: 2, HasPrev: true},
+		"page=1&per_page=4": {Count: 4, TotalPages: 1},
+		"page=1&per_page=3": {Count: 4, TotalPages: 2, HasNext: true},
+		"per_page=1000":     {Count: 4, TotalPages: 1},
+	} {
+		if got := list(query); got != want {
+			t.Errorf("%s: %+v, want %+v", query, got, want)
+		}
+	}
+
+	w := serve(app.handleGetURLs, http.MethodGet, "/api/v1/urls?per_page=100000", "")
+	var resp httpResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s: %v", w.Body, err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Message != "per_page must be between 1 and 1000" {
+		t.Errorf("per_page=100000: %d %q, want 400 naming the limit", w.Code, resp.Message)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mr-karan/lil/internal/store"
+)
+
+// maxImportURLs is the largest number of URLs an import may contain.
+const maxImportURLs = 10000
+
+// importError reports a row of an import that wasn't created. Row is the
+// 1-based position of the entry in a JSON array, or its row in a CSV file
+// counting the header as row 1.
+type importError struct {
+	Row       int    `json:"row"`
+	ShortCode string `json:"short_code,omitempty"`
+	Error     string `json:"error"`
+}
+
+// importRow is an entry of an import, along with the row number it's reported
+// with and the error it failed to parse with, if any.
+type importRow struct {
+	row int
+	req shortenURLRequest
+	err error
+}
+
+// handleImport creates URLs from a CSV or JSON upload, or from the export of
+// another shortener named by the format parameter (see importFormats). Without
+// it, the format is taken from the Content-Type, or sniffed from the body when
+// it's neither. JSON bodies are an array of shorten requests. CSV files need a
+// header row naming their columns: url is required, and short_code (or slug),
+// title, expires_at and password_hash are read when present, so exports can be
+// imported as is. Other columns are ignored. Rows whose code is taken are
+// skipped, and failed rows don't stop the others. Rows of another shortener's
+// export that can't be mapped to a URL are reported apart as unmapped.
+func (app *App) handleImport(w http.ResponseWriter, r *http.Request) {
+	body := bufio.NewReader(r.Body)
+
+	var (
+		rows []importRow
+		err  error
+	)
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+		if isCSVImport(r.Header.Get("Content-Type"), body) {
+			rows, err = readCSVImport(body)
+		} else {
+			rows, err = readJSONImport(body)
+		}
+	case "csv":
+		rows, err = readCSVImport(body)
+	case "json":
+		rows, err = readJSONImport(body)
+	default:
+		read, ok := importFormats[format]
+		if !ok {
+			app.sendErrorResponse(w, fmt.Sprintf("Unknown import format %q", format), http.StatusBadRequest, nil)
+			return
+		}
+		rows, err = read(body)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		app.sendBodyTooLarge(w, r)
+		return
+	}
+	if err != nil {
+		app.logger.Error("Invalid import", "error", err)
+		app.sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+	if len(rows) == 0 || len(rows) > maxImportURLs {
+		app.sendErrorResponse(w, fmt.Sprintf("Import must contain between 1 and %d URLs", maxImportURLs), http.StatusBadRequest, nil)
+		return
+	}
+
+	var (
+		errs         = []importError{}
+		unmappedRows = []importError{}
+		params       = make([]store.CreateParams, 0, len(rows))
+		indexes      = make([]int, 0, len(rows)) // Position in rows of each entry in params
+	)
+	for i, row := range rows {
+		err := row.err
+		var notMapped *unmappedError
+		if errors.As(err, &notMapped) {
+			unmappedRows = append(unmappedRows, importError{Row: row.row, ShortCode: row.req.Slug, Error: err.Error()})
+			continue
+		}
+		if err == nil {
+			var p store.CreateParams
+			if p, err = app.createParams(row.req); err == nil {
+				params = append(params, p)
+				indexes = append(indexes, i)
+				continue
+			}
+		}
+		errs = append(errs, importError{Row: row.row, ShortCode: row.req.Slug, Error: err.Error()})
+	}
+
+	created, skipped := 0, 0
+	for j, res := range app.store.CreateShortURLs(r.Context(), params) {
+		i := indexes[j]
+		if res.Err == nil {
+			created++
+			continue
+		}
+		if errors.Is(res.Err, store.ErrExists) {
+			skipped++
+		}
+		errs = append(errs, importError{
+			Row:       rows[i].row,
+			ShortCode: rows[i].req.Slug,
+			Error:     app.createErrorMessage(res.Err, rows[i].req.URL),
+		})
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Row < errs[j].Row })
+
+	app.sendResponse(w, map[string]interface{}{
+		"created":  created,
+		"skipped":  skipped,
+		"failed":   len(errs) - skipped,
+		"errors":   errs,
+		"unmapped": unmappedRows,
+	})
+}
+
+// isCSVImport tells apart CSV and JSON imports by their Content-Type, falling
+// back to checking whether the body starts like JSON.
+func isCSVImport(contentType string, body *bufio.Reader) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv", "application/csv":
+		return true
+	case "application/json":
+		return false
+	}
+
+	for {
+		b, err := body.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			body.ReadByte()
+			continue
+		}
+		return b[0] != '[' && b[0] != '{'
+	}
+}
+
+func readJSONImport(body io.Reader) ([]importRow, error) {
+	var reqs []shortenURLRequest
+	if err := json.NewDecoder(body).Decode(&reqs); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		return nil, errors.New("Invalid request body")
+	}
+	rows := make([]importRow, len(reqs))
+	for i, req := range reqs {
+		rows[i] = importRow{row: i + 1, req: req}
+	}
+	return rows, nil
+}
+
+// readCSVImport reads the rows of a CSV import. Rows with the wrong number of
+// fields or an unparsable expires_at are returned with their error, while
+// anything else wrong with the file fails the import.
+func readCSVImport(body io.Reader) ([]importRow, error) {
+	f, err := openCSV(body)
+	if err != nil {
+		return nil, err
+	}
+	if !f.has("url") {
+		return nil, errors.New("CSV header must have a url column")
+	}
+
+	var rows []importRow
+	for {
+		record, err := f.next(len(rows))
+		if err == io.EOF {
+			break
+		}
+		var short *fieldCountError
+		if err != nil && !errors.As(err, &short) {
+			return nil, err
+		}
+
+		row := importRow{row: len(rows) + 2, req: shortenURLRequest{
+			URL:   f.field(record, "url"),
+			Slug:  f.field(record, "short_code", "slug"),
+			Title: f.field(record, "title"),
+
+			PasswordHash: f.field(record, "password_hash"),
+		}}
+		if err != nil {
+			row.err = err
+		} else if v := f.field(record, "expires_at"); v != "" {
+			row.err = setImportExpiry(&row.req, v)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// csvFile reads a CSV import whose first row names its columns.
+type csvFile struct {
+	r    *csv.Reader
+	cols map[string]int // Lowercased column name -> index
+}
+
+func openCSV(body io.Reader) (*csvFile, error) {
+	cr := csv.NewReader(body)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSV header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	return &csvFile{r: cr, cols: cols}, nil
+}
+
+// has tells whether the file has any of the named columns.
+func (f *csvFile) has(names ...string) bool {
+	for _, name := range names {
+		if _, ok := f.cols[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// field returns the value of the first of the named columns in record.
+func (f *csvFile) field(record []string, names ...string) string {
+	for _, name := range names {
+		if i, ok := f.cols[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+	}
+	return ""
+}
+
+// next reads the record after the read ones, returning io.EOF at the end of
+// the file. Records with the wrong number of fields are returned along with a
+// *fieldCountError.
+func (f *csvFile) next(read int) ([]string, error) {
+	record, err := f.r.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	if read == maxImportURLs {
+		return nil, fmt.Errorf("Import must contain between 1 and %d URLs", maxImportURLs)
+	}
+	if errors.Is(err, csv.ErrFieldCount) {
+		return record, &fieldCountError{want: f.r.FieldsPerRecord, got: len(record)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSV: %w", err)
+	}
+	return record, nil
+}
+
+// fieldCountError reports a CSV record with a different number of fields than
+// the header.
+type fieldCountError struct {
+	want, got int
+}
+
+func (e *fieldCountError) Error() string {
+	return fmt.Sprintf("Expected %d fields, got %d", e.want, e.got)
+}
+
+// setImportExpiry converts an RFC 3339 expires_at into the request's expiry.
+func setImportExpiry(req *shortenURLRequest, expiresAt string) error {
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return errors.New("expires_at must be an RFC 3339 timestamp")
+	}
+	until := time.Until(t)
+	if until <= 0 {
+		return errors.New("expires_at is in the past")
+	}
+	secs := int64(math.Ceil(until.Seconds()))
+	req.ExpiryInSecs = &secs
+	return nil
+}
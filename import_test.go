@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mr-karan/lil/internal/store"
+)
+
+type importSummary struct {
+	Created int           `json:"created"`
+	Skipped int           `json:"skipped"`
+	Failed  int           `json:"failed"`
+	Errors  []importError `json:"errors"`
+
+	Unmapped []importError `json:"unmapped"`
+}
+
+// importFile posts body to the import endpoint as contentType.
+func importFile(t *testing.T, app *App, contentType, body string) importSummary {
+	t.Helper()
+	return importTarget(t, app, "/api/v1/urls/import", contentType, body)
+}
+
+// importTarget posts body to target, the import endpoint with its parameters.
+func importTarget(t *testing.T, app *App, target, contentType, body string) importSummary {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	app.handleImport(w, r)
+
+	var summary importSummary
+	decodeData(t, w, http.StatusOK, &summary)
+	return summary
+}
+
+// errorRows returns the rows reported in errs.
+func errorRows(errs []importError) []int {
+	rows := make([]int, 0, len(errs))
+	for _, e := range errs {
+		rows = append(rows, e.Row)
+	}
+	return rows
+}
+
+func TestHandleImport(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		existing    []string // Slugs created before importing
+		want        importSummary
+		wantRows    []int    // Rows reported in errors
+		wantURLs    []string // Slugs that resolve after importing
+	}{
+		{
+			name:        "clean csv",
+			contentType: "text/csv",
+			body: "short_code,url,title,expires_at\n" +
+				"docs,https://example.com/docs,Docs,\n" +
+				"blog,https://example.com/blog,,2099-01-01T00:00:00Z\n",
+			want:     importSummary{Created: 2},
+			wantURLs: []string{"docs", "blog"},
+		},
+		{
+			name:        "clean json",
+			contentType: "application/json",
+			body:        `[{"url": "https://example.com/docs", "slug": "docs"}, {"url": "https://example.com/random"}]`,
+			want:        importSummary{Created: 2},
+			wantURLs:    []string{"docs"},
+		},
+		{
+			name:        "csv with a taken slug",
+			contentType: "text/csv",
+			body: "url,slug\n" +
+				"https://example.com/docs,docs\n" +
+				"https://example.com/taken,taken\n",
+			existing: []string{"taken"},
+			want:     importSummary{Created: 1, Skipped: 1},
+			wantRows: []int{3},
+			wantURLs: []string{"docs"},
+		},
+		{
+			name:        "json with a slug twice",
+			contentType: "application/json",
+			body:        `[{"url": "https://example.com/1", "slug": "twice"}, {"url": "https://example.com/2", "slug": "twice"}]`,
+			want:        importSummary{Created: 1, Skipped: 1},
+			wantRows:    []int{2},
+			wantURLs:    []string{"twice"},
+		},
+		{
+			name:        "malformed csv rows",
+			contentType: "text/csv",
+			body: "url,slug,expires_at\n" +
+				"https://example.com/ok,ok,\n" +
+				"https://example.com/short\n" +
+				"not a url,bad,\n" +
+				"https://example.com/expiry,expiry,tomorrow\n" +
+				"https://example.com/also-ok,also-ok,\n",
+			want:     importSummary{Created: 2, Failed: 3},
+			wantRows: []int{3, 4, 5},
+			wantURLs: []string{"ok", "also-ok"},
+		},
+		{
+			name:        "csv with password hashes",
+			contentType: "text/csv",
+			body: "url,slug,password_hash\n" +
+				"https://example.com/hashed,hashed,$2a$04$1LWMdnWOId1N34L4fLLrneYPbWsokK9Lm6/GKYq8zQwtJ3Tgei89G\n" +
+				"https://example.com/plain,plain,s3cret\n",
+			want:     importSummary{Created: 1, Failed: 1},
+			wantRows: []int{3},
+			wantURLs: []string{"hashed"},
+		},
+		{
+			name:        "malformed json entry",
+			contentType: "application/json",
+			body:        `[{"url": "https://example.com/ok", "slug": "ok"}, {"url": "", "slug": "empty"}]`,
+			want:        importSummary{Created: 1, Failed: 1},
+			wantRows:    []int{2},
+			wantURLs:    []string{"ok"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApp(t)
+			for _, slug := range tc.existing {
+				mustCreate(t, app, store.CreateParams{URL: "https://example.com/existing", Slug: slug})
+			}
+
+			got := importFile(t, app, tc.contentType, tc.body)
+			if got.Created != tc.want.Created || got.Skipped != tc.want.Skipped || got.Failed != tc.want.Failed {
+				t.Errorf("created %d, skipped %d, failed %d, want %d, %d, %d: %+v",
+					got.Created, got.Skipped, got.Failed, tc.want.Created, tc.want.Skipped, tc.want.Failed, got.Errors)
+			}
+			if rows := errorRows(got.Errors); !slices.Equal(rows, tc.wantRows) {
+				t.Errorf("errors for rows %v, want %v: %+v", rows, tc.wantRows, got.Errors)
+			}
+			for _, slug := range tc.wantURLs {
+				if _, err := app.store.GetURL(context.Background(), slug); err != nil {
+					t.Errorf("GetURL(%s) after importing: %v", slug, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleImportMalformedFile(t *testing.T) {
+	app := newTestApp(t)
+	for _, tc := range []struct{ contentType, body string }{
+		{"application/json", `{"url": "https://example.com"}`},
+		{"text/csv", "slug,title\ndocs,Docs\n"},
+		{"text/csv", "url\n"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/urls/import", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		app.handleImport(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("importing %q as %s: status = %d, want 400", tc.body, tc.contentType, w.Code)
+		}
+	}
+}
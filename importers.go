@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// importFormats maps the format parameter of an import to the reader of
+// exports from other shorteners.
+var importFormats = map[string]func(io.Reader) ([]importRow, error){
+	"yourls":     readYOURLSCSV,
+	"yourls-sql": readYOURLSSQL,
+	"bitly":      readBitlyCSV,
+}
+
+// unmappedError reports a row of an export that couldn't be turned into a
+// shorten request, such as one without a destination URL.
+type unmappedError struct {
+	reason string
+}
+
+func (e *unmappedError) Error() string { return e.reason }
+
+func unmapped(format string, a ...any) error {
+	return &unmappedError{reason: fmt.Sprintf(format, a...)}
+}
+
+// readYOURLSCSV reads a CSV export of the YOURLS url table, as made by
+// phpMyAdmin or the export plugins, with keyword, url and title columns.
+// Click counts, IPs and timestamps aren't imported.
+func readYOURLSCSV(body io.Reader) ([]importRow, error) {
+	f, err := openCSV(body)
+	if err != nil {
+		return nil, err
+	}
+	if !f.has("keyword") || !f.has("url") {
+		return nil, errors.New("YOURLS CSV header must have keyword and url columns")
+	}
+
+	var rows []importRow
+	for {
+		record, err := f.next(len(rows))
+		if err == io.EOF {
+			break
+		}
+		var short *fieldCountError
+		if err != nil && !errors.As(err, &short) {
+			return nil, err
+		}
+
+		row := importRow{row: len(rows) + 2, req: shortenURLRequest{
+			URL:   f.field(record, "url"),
+			Slug:  f.field(record, "keyword"),
+			Title: f.field(record, "title"),
+		}}
+		switch {
+		case err != nil:
+			row.err = unmapped("%s", err)
+		case row.req.URL == "":
+			row.err = unmapped("No url")
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// yourlsColumns are the columns of the YOURLS url table in the order of its
+// CREATE TABLE, used for INSERTs without a column list.
+var yourlsColumns = []string{"keyword", "url", "title", "timestamp", "ip", "clicks"}
+
+// readYOURLSSQL reads the rows inserted into the YOURLS url table by a SQL
+// dump such as mysqldump's. The table is the one named with any prefix and
+// ending in "url", so yourls_url by default. Other statements and tables are
+// skipped. Rows are numbered by their position among the inserted rows.
+func readYOURLSSQL(body io.Reader) ([]importRow, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := lexSQL(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SQL dump: %w", err)
+	}
+
+	var rows []importRow
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && !tokens[end].is(";") {
+			end++
+		}
+		stmt := tokens[:end]
+		tokens = tokens[min(end+1, len(tokens)):]
+
+		cols, values, ok := parseYOURLSInsert(stmt)
+		if !ok {
+			continue
+		}
+		for _, tuple := range values {
+			if len(rows) == maxImportURLs {
+				return nil, fmt.Errorf("Import must contain between 1 and %d URLs", maxImportURLs)
+			}
+			row := importRow{row: len(rows) + 1}
+			if len(tuple) != len(cols) {
+				row.err = unmapped("Expected %d values, got %d", len(cols), len(tuple))
+				rows = append(rows, row)
+				continue
+			}
+			for i, col := range cols {
+				switch col {
+				case "keyword":
+					row.req.Slug = tuple[i]
+				case "url":
+					row.req.URL = tuple[i]
+				case "title":
+					row.req.Title = tuple[i]
+				}
+			}
+			if row.req.URL == "" {
+				row.err = unmapped("No url")
+			}
+			rows = append(rows, row)
+		}
+	}
+	if rows == nil {
+		return nil, errors.New("SQL dump has no rows for the YOURLS url table")
+	}
+	return rows, nil
+}
+
+// parseYOURLSInsert returns the columns and values of an INSERT statement into
+// the YOURLS url table. NULL values are empty.
+func parseYOURLSInsert(stmt []sqlToken) (cols []string, values [][]string, ok bool) {
+	next := func() (sqlToken, bool) {
+		if len(stmt) == 0 {
+			return sqlToken{}, false
+		}
+		t := stmt[0]
+		stmt = stmt[1:]
+		return t, true
+	}
+	word := func(w string) bool {
+		t, ok := next()
+		return ok && t.kind == sqlWord && strings.EqualFold(t.text, w)
+	}
+
+	if !word("INSERT") {
+		return nil, nil, false
+	}
+	t, _ := next()
+	for t.kind == sqlWord && (strings.EqualFold(t.text, "IGNORE") || strings.EqualFold(t.text, "INTO")) {
+		t, _ = next()
+	}
+	table := t.text
+	for len(stmt) > 1 && stmt[0].is(".") { // database.table
+		stmt = stmt[1:]
+		t, _ = next()
+		table = t.text
+	}
+	if t.kind != sqlWord || !strings.HasSuffix(strings.ToLower(table), "url") {
+		return nil, nil, false
+	}
+
+	cols = yourlsColumns
+	if len(stmt) > 0 && stmt[0].is("(") {
+		stmt = stmt[1:]
+		cols = nil
+		for {
+			t, ok := next()
+			if !ok || t.kind != sqlWord {
+				return nil, nil, false
+			}
+			cols = append(cols, strings.ToLower(t.text))
+			if t, ok = next(); !ok || t.is(")") {
+				break
+			}
+			if !t.is(",") {
+				return nil, nil, false
+			}
+		}
+	}
+	if t, ok := next(); !ok || t.kind != sqlWord ||
+		!strings.EqualFold(t.text, "VALUES") && !strings.EqualFold(t.text, "VALUE") {
+		return nil, nil, false
+	}
+
+	for {
+		if t, ok := next(); !ok || !t.is("(") {
+			return nil, nil, false
+		}
+		var tuple []string
+		for {
+			t, ok := next()
+			if !ok || t.kind == sqlPunct {
+				return nil, nil, false
+			}
+			if t.kind == sqlWord && strings.EqualFold(t.text, "NULL") {
+				t.text = ""
+			}
+			tuple = append(tuple, t.text)
+			if t, ok = next(); !ok || t.is(")") {
+				break
+			}
+			if !t.is(",") {
+				return nil, nil, false
+			}
+		}
+		values = append(values, tuple)
+		if t, ok := next(); !ok {
+			return cols, values, true
+		} else if !t.is(",") {
+			// ON DUPLICATE KEY UPDATE and the like
+			return cols, values, true
+		}
+	}
+}
+
+type sqlTokenKind int
+
+const (
+	sqlWord   sqlTokenKind = iota // Keyword, identifier or number
+	sqlString                     // Unquoted string literal
+	sqlPunct                      // ( ) , ; .
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+}
+
+func (t sqlToken) is(punct string) bool {
+	return t.kind == sqlPunct && t.text == punct
+}
+
+// lexSQL splits a MySQL dump into tokens, dropping comments and unquoting
+// string literals and backquoted identifiers.
+func lexSQL(s string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || strings.HasPrefix(s[i:], "--") && (i+2 == len(s) || strings.IndexByte(" \t\r\n", s[i+2]) >= 0):
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				return tokens, nil
+			}
+			i += end + 1
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"':
+			str, n, err := unquoteSQL(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{kind: sqlString, text: str})
+			i += n
+		case c == '`':
+			end := strings.IndexByte(s[i+1:], '`')
+			if end < 0 {
+				return nil, errors.New("unterminated identifier")
+			}
+			tokens = append(tokens, sqlToken{kind: sqlWord, text: s[i+1 : i+1+end]})
+			i += end + 2
+		case strings.IndexByte("(),;.", c) >= 0:
+			tokens = append(tokens, sqlToken{kind: sqlPunct, text: string(c)})
+			i++
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\r\n(),;'\"`", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlWord, text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// sqlEscapes are the backslash escapes of MySQL string literals.
+var sqlEscapes = map[byte]string{
+	'0': "\x00", 'b': "\b", 'n': "\n", 'r': "\r", 't': "\t", 'Z': "\x1a",
+}
+
+// unquoteSQL unquotes the string literal s starts with, returning it and the
+// length of the literal.
+func unquoteSQL(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if esc, ok := sqlEscapes[s[i]]; ok {
+				b.WriteString(esc)
+			} else {
+				b.WriteByte(s[i])
+			}
+		case c == quote && i+1 < len(s) && s[i+1] == quote:
+			b.WriteByte(quote)
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// readBitlyCSV reads a CSV export of Bitly links. Links keep their back-half
+// as short code, preferring a custom back-half over the generated one, and
+// their title and tags. Engagement counts aren't imported.
+func readBitlyCSV(body io.Reader) ([]importRow, error) {
+	f, err := openCSV(body)
+	if err != nil {
+		return nil, err
+	}
+	if !f.has("long url", "long_url") {
+		return nil, errors.New("Bitly CSV header must have a long url column")
+	}
+
+	var rows []importRow
+	for {
+		record, err := f.next(len(rows))
+		if err == io.EOF {
+			break
+		}
+		var short *fieldCountError
+		if err != nil && !errors.As(err, &short) {
+			return nil, err
+		}
+
+		row := importRow{row: len(rows) + 2, req: shortenURLRequest{
+			URL:   f.field(record, "long url", "long_url"),
+			Title: f.field(record, "title"),
+		}}
+		link := f.field(record, "custom bitlinks", "custom_bitlinks")
+		if link, _, _ = strings.Cut(link, ","); link == "" {
+			link = f.field(record, "bitlink", "link")
+		}
+		for _, tag := range strings.Split(f.field(record, "tags"), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				row.req.Tags = append(row.req.Tags, tag)
+			}
+		}
+		switch {
+		case err != nil:
+			row.err = unmapped("%s", err)
+		case row.req.URL == "":
+			row.err = unmapped("No long url")
+		case link != "":
+			row.req.Slug, row.err = bitlinkCode(link)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// bitlinkCode returns the back-half of a Bitlink like bit.ly/3xYzAbC, which
+// is given with or without its scheme.
+func bitlinkCode(link string) (string, error) {
+	full := link
+	if !strings.Contains(link, "://") {
+		full = "https://" + link
+	}
+	u, err := url.Parse(full)
+	if err != nil {
+		return "", unmapped("Invalid Bitlink %q", link)
+	}
+	code := strings.Trim(u.EscapedPath(), "/")
+	if code == "" || strings.Contains(code, "/") {
+		return "", unmapped("Invalid Bitlink %q", link)
+	}
+	return code, nil
+}
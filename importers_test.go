@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// checkImported checks the summary of an import and returns the imported URLs
+// by short code.
+func checkImported(t *testing.T, app *App, got, want importSummary, wantErrors, wantUnmapped []int, codes ...string) map[string]models.URLData {
+	t.Helper()
+	if got.Created != want.Created || got.Skipped != want.Skipped || got.Failed != want.Failed {
+		t.Errorf("created %d, skipped %d, failed %d, want %d, %d, %d: %+v",
+			got.Created, got.Skipped, got.Failed, want.Created, want.Skipped, want.Failed, got.Errors)
+	}
+	if rows := errorRows(got.Errors); !slices.Equal(rows, wantErrors) {
+		t.Errorf("errors for rows %v, want %v: %+v", rows, wantErrors, got.Errors)
+	}
+	if rows := errorRows(got.Unmapped); !slices.Equal(rows, wantUnmapped) {
+		t.Errorf("unmapped rows %v, want %v: %+v", rows, wantUnmapped, got.Unmapped)
+	}
+
+	urls := make(map[string]models.URLData, len(codes))
+	for _, code := range codes {
+		u, err := app.store.GetURL(context.Background(), code)
+		if err != nil {
+			t.Fatalf("GetURL(%s) after importing: %v", code, err)
+		}
+		urls[code] = u
+	}
+	return urls
+}
+
+// yourlsCSV is the url table of YOURLS exported as CSV by phpMyAdmin.
+const yourlsCSV = `"keyword","url","title","timestamp","ip","clicks"
+"ozh","https://ozh.org/","Ozh Richard","2023-02-11 10:12:43","127.0.0.1","12"
+"yourls","https://yourls.org/","YOURLS: Your Own URL Shortener","2023-02-11 10:12:43","127.0.0.1","3"
+"blank","","","2023-02-12 09:00:00","10.0.0.1","0"
+"cut","https://example.com/cut"
+"api","https://example.com/api","Takes a reserved code","2023-02-12 09:00:00","10.0.0.1","0"
+`
+
+func TestImportYOURLSCSV(t *testing.T) {
+	app := newTestApp(t)
+	got := importTarget(t, app, "/api/v1/urls/import?format=yourls", "text/csv", yourlsCSV)
+
+	urls := checkImported(t, app, got, importSummary{Created: 2, Failed: 1}, []int{6}, []int{4, 5}, "ozh", "yourls")
+	if u := urls["yourls"]; u.URL != "https://yourls.org/" || u.Title != "YOURLS: Your Own URL Shortener" {
+		t.Errorf("yourls imported as %q titled %q", u.URL, u.Title)
+	}
+}
+
+// yourlsSQL is a mysqldump of a YOURLS database, trimmed to a few rows, with
+// an INSERT with a column list like phpMyAdmin's added.
+const yourlsSQL = "-- MySQL dump 10.13  Distrib 8.0.32, for Linux (x86_64)\n" +
+	"--\n" +
+	"-- Host: localhost    Database: yourls\n" +
+	"-- ------------------------------------------------------\n" +
+	"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+	"\n" +
+	"--\n" +
+	"-- Table structure for table `yourls_url`\n" +
+	"--\n" +
+	"\n" +
+	"DROP TABLE IF EXISTS `yourls_url`;\n" +
+	"CREATE TABLE `yourls_url` (\n" +
+	"  `keyword` varchar(100) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL DEFAULT '',\n" +
+	"  `url` text CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,\n" +
+	"  `title` text COLLATE utf8mb4_unicode_ci,\n" +
+	"  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,\n" +
+	"  `ip` varchar(41) COLLATE utf8mb4_unicode_ci NOT NULL,\n" +
+	"  `clicks` int unsigned NOT NULL,\n" +
+	"  PRIMARY KEY (`keyword`),\n" +
+	"  KEY `ip` (`ip`),\n" +
+	"  KEY `timestamp` (`timestamp`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;\n" +
+	"\n" +
+	"LOCK TABLES `yourls_url` WRITE;\n" +
+	"/*!40000 ALTER TABLE `yourls_url` DISABLE KEYS */;\n" +
+	"INSERT INTO `yourls_url` VALUES ('ozh','https://ozh.org/','Ozh\\'s blog','2023-02-11 10:12:43','127.0.0.1',12)," +
+	"('search','https://example.com/search?q=a;b&lang=en','Search; with \\\"quotes\\\"','2023-02-11 10:13:01','127.0.0.1',0)," +
+	"('nourl','',NULL,'2023-02-11 10:14:00','127.0.0.1',0);\n" +
+	"/*!40000 ALTER TABLE `yourls_url` ENABLE KEYS */;\n" +
+	"UNLOCK TABLES;\n" +
+	"\n" +
+	"LOCK TABLES `yourls_log` WRITE;\n" +
+	"INSERT INTO `yourls_log` VALUES (1,'2023-02-11 10:20:00','ozh','direct','Mozilla/5.0','127.0.0.1','US');\n" +
+	"UNLOCK TABLES;\n" +
+	"INSERT INTO `yourls_options` VALUES (1,'version','1.9.2','yes');\n" +
+	"INSERT INTO `yourls_url` (`keyword`, `url`, `title`, `timestamp`, `ip`, `clicks`) VALUES\n" +
+	"('gh', 'https://github.com/YOURLS/YOURLS', 'GitHub', '2023-02-12 08:00:00', '::1', 5),\n" +
+	"('short', 'https://example.com/short', 'Missing values');\n"
+
+func TestImportYOURLSSQL(t *testing.T) {
+	app := newTestApp(t)
+	got := importTarget(t, app, "/api/v1/urls/import?format=yourls-sql", "application/sql", yourlsSQL)
+
+	urls := checkImported(t, app, got, importSummary{Created: 3}, nil, []int{3, 5}, "ozh", "search", "gh")
+	if u := urls["ozh"]; u.Title != "Ozh's blog" {
+		t.Errorf("ozh titled %q, want the escaped quote unescaped", u.Title)
+	}
+	if u := urls["search"]; u.URL != "https://example.com/search?q=a;b&lang=en" || u.Title != `Search; with "quotes"` {
+		t.Errorf("search imported as %q titled %q", u.URL, u.Title)
+	}
+	if u := urls["gh"]; u.URL != "https://github.com/YOURLS/YOURLS" {
+		t.Errorf("gh imported as %q", u.URL)
+	}
+}
+
+// bitlyCSV is a CSV export of links from Bitly.
+const bitlyCSV = `Date Created,Title,Long URL,Bitlink,Custom Bitlinks,Tags,Total Engagements
+2023-03-01 10:00:00,Launch post,https://example.com/blog/launch?utm_source=bitly,bit.ly/3KpXz9Q,bit.ly/launch-post,"marketing, blog",152
+2023-03-02 11:30:00,,https://example.com/pricing,https://bit.ly/41aBcDe,,,7
+2023-03-03 09:15:00,Missing target,,bit.ly/3xYz123,,,0
+2023-03-04 16:45:00,Old tracker,ftp://example.com/file,bit.ly/3Ftp000,,,1
+`
+
+func TestImportBitlyCSV(t *testing.T) {
+	app := newTestApp(t)
+	got := importTarget(t, app, "/api/v1/urls/import?format=bitly", "text/csv", bitlyCSV)
+
+	urls := checkImported(t, app, got, importSummary{Created: 2, Failed: 1}, []int{5}, []int{4}, "launch-post", "41aBcDe")
+	u := urls["launch-post"]
+	if u.URL != "https://example.com/blog/launch?utm_source=bitly" || u.Title != "Launch post" {
+		t.Errorf("launch-post imported as %q titled %q", u.URL, u.Title)
+	}
+	if !slices.Equal(u.Tags, []string{"marketing", "blog"}) {
+		t.Errorf("launch-post tagged %q, want [marketing blog]", u.Tags)
+	}
+	if _, err := app.store.GetURL(context.Background(), "3KpXz9Q"); err == nil {
+		t.Error("generated Bitlink imported along with the custom one")
+	}
+}
+
+func TestImportUnknownFormat(t *testing.T) {
+	app := newTestApp(t)
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/urls/import?format=tinyurl", strings.NewReader(bitlyCSV))
+	w := httptest.NewRecorder()
+	app.handleImport(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
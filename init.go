@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/knadh/koanf/parsers/toml"
 	"github.com/knadh/koanf/providers/file"
@@ -11,10 +15,7 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
-func init() {
-	initConfig()
-}
-
+// initConfig loads the config file named by the --config flag into ko.
 func initConfig() {
 	f := flag.NewFlagSet("config", flag.ContinueOnError)
 
@@ -40,12 +41,108 @@ func initConfig() {
 	log.Println("Configuration loaded successfully")
 }
 
-func initLogger(debug bool) *slog.Logger {
-	var level slog.Level
-	if debug {
-		level = slog.LevelDebug
-	} else {
-		level = slog.LevelInfo
+// durationOr returns the duration configured at key, falling back to def when
+// the key isn't set.
+func durationOr(key string, def time.Duration) time.Duration {
+	if !ko.Exists(key) {
+		return def
+	}
+	return ko.Duration(key)
+}
+
+// floatOr returns the number configured at key, falling back to def when the
+// key isn't set.
+func floatOr(key string, def float64) float64 {
+	if !ko.Exists(key) {
+		return def
+	}
+	return ko.Float64(key)
+}
+
+// int64Or returns the integer configured at key, falling back to def when the
+// key isn't set.
+func int64Or(key string, def int64) int64 {
+	if !ko.Exists(key) {
+		return def
+	}
+	return ko.Int64(key)
+}
+
+// stringsOrNil returns the list configured at key, or nil when the key isn't
+// set so the default applies while an empty list still clears it.
+func stringsOrNil(key string) []string {
+	if !ko.Exists(key) {
+		return nil
+	}
+	return ko.Strings(key)
+}
+
+// parseCIDRs parses a list of networks in CIDR notation. Plain addresses are
+// taken as single host networks.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", s, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// checkForwardParams checks the query parameters forwarded to targets. The
+// password a protected link is unlocked with can't be one of them, or it
+// would end up in the destination's URL and logs.
+func checkForwardParams(names []string) error {
+	for _, name := range names {
+		if name == passwordParam {
+			return fmt.Errorf("%q can't be forwarded, it carries link passwords", name)
+		}
+	}
+	return nil
+}
+
+// initLogger builds the logger from the log format, "json" (default) or
+// "text", and level, one of "debug", "info", "warn" or "error". Without a
+// level it logs at debug with debug set, else at info.
+func initLogger(format, level string, debug bool) (*slog.Logger, error) {
+	lvl := slog.LevelInfo
+	switch strings.ToLower(level) {
+	case "":
+		if debug {
+			lvl = slog.LevelDebug
+		}
+	case "debug":
+		lvl = slog.LevelDebug
+	case "info":
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
 	}
-	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestInitLogger(t *testing.T) {
+	tests := []struct {
+		format, level string
+		debug         bool
+		json          bool
+		want          slog.Level // Lowest level logged
+	}{
+		{format: "", level: "", json: true, want: slog.LevelInfo},
+		{format: "", level: "", debug: true, json: true, want: slog.LevelDebug},
+		{format: "json", level: "warn", json: true, want: slog.LevelWarn},
+		{format: "JSON", level: "WARNING", json: true, want: slog.LevelWarn},
+		{format: "text", level: "error", want: slog.LevelError},
+		{format: "text", level: "debug", want: slog.LevelDebug},
+		// An explicit level wins over debug
+		{format: "text", level: "info", debug: true, want: slog.LevelInfo},
+	}
+	for _, tt := range tests {
+		logger, err := initLogger(tt.format, tt.level, tt.debug)
+		if err != nil {
+			t.Errorf("initLogger(%q, %q, %v): %v", tt.format, tt.level, tt.debug, err)
+			continue
+		}
+		switch h := logger.Handler().(type) {
+		case *slog.JSONHandler:
+			if !tt.json {
+				t.Errorf("initLogger(%q, %q): JSON handler, want text", tt.format, tt.level)
+			}
+		case *slog.TextHandler:
+			if tt.json {
+				t.Errorf("initLogger(%q, %q): text handler, want JSON", tt.format, tt.level)
+			}
+		default:
+			t.Errorf("initLogger(%q, %q): handler %T", tt.format, tt.level, h)
+		}
+		ctx := context.Background()
+		if !logger.Enabled(ctx, tt.want) || logger.Enabled(ctx, tt.want-1) {
+			t.Errorf("initLogger(%q, %q, %v) doesn't log from %s", tt.format, tt.level, tt.debug, tt.want)
+		}
+	}
+
+	for _, bad := range [][2]string{{"xml", "info"}, {"json", "verbose"}, {"text", "5"}} {
+		if _, err := initLogger(bad[0], bad[1], false); err == nil {
+			t.Errorf("initLogger(%q, %q) accepted", bad[0], bad[1])
+		}
+	}
+}
@@ -2,37 +2,55 @@ package analytics
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
-	"os"
-	"path/filepath"
 	"time"
 )
 
+// Access log formats.
+const (
+	AccessLogCombined = "combined" // Apache Combined Log Format
+	AccessLogJSONL    = "jsonl"    // one JSON object per event and line
+)
+
+type AccessLogConfig struct {
+	FilePath   string // Events are only printed to stdout when empty
+	Format     string // AccessLogCombined (default) or AccessLogJSONL
+	MaxSizeMB  int64  // Rotates the file once it would grow past this size, 0 never rotates
+	MaxAgeDays int64  // Deletes rotated files older than this, 0 keeps them
+}
+
 type AccessLogDispatcher struct {
 	logger     *slog.Logger
-	fileWriter *os.File
+	format     string
+	fileWriter *rotatingFile
 }
 
-func NewAccessLogDispatcher(cfg map[string]interface{}, logger *slog.Logger) (*AccessLogDispatcher, error) {
-	var fileWriter *os.File
-
-	if filePath, ok := cfg["file_path"].(string); ok && filePath != "" {
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-			return nil, fmt.Errorf("failed to create log directory: %w", err)
-		}
+func NewAccessLogDispatcher(cfg AccessLogConfig, logger *slog.Logger) (*AccessLogDispatcher, error) {
+	switch cfg.Format {
+	case "":
+		cfg.Format = AccessLogCombined
+	case AccessLogCombined, AccessLogJSONL:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+	if cfg.MaxSizeMB < 0 || cfg.MaxAgeDays < 0 {
+		return nil, fmt.Errorf("access log max_size_mb and max_age_days can't be negative")
+	}
 
-		// Open log file in append mode
-		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	var fileWriter *rotatingFile
+	if cfg.FilePath != "" {
+		f, err := openRotatingFile(cfg.FilePath, cfg.MaxSizeMB<<20, time.Duration(cfg.MaxAgeDays)*24*time.Hour, logger)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open log file: %w", err)
+			return nil, err
 		}
 		fileWriter = f
 	}
 
 	return &AccessLogDispatcher{
 		logger:     logger,
+		format:     cfg.Format,
 		fileWriter: fileWriter,
 	}, nil
 }
@@ -41,7 +59,15 @@ func (a *AccessLogDispatcher) Name() string {
 	return "accesslog"
 }
 
-func (a *AccessLogDispatcher) formatLogEntry(evt Event) string {
+func (a *AccessLogDispatcher) formatLogEntry(evt Event) (string, error) {
+	if a.format == AccessLogJSONL {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal event: %w", err)
+		}
+		return string(line) + "\n", nil
+	}
+
 	// Format timestamp in Apache log format
 	timestamp := time.Now().Format("02/Jan/2006:15:04:05 -0700")
 
@@ -56,18 +82,21 @@ func (a *AccessLogDispatcher) formatLogEntry(evt Event) string {
 		evt.UserAgent,
 	)
 
-	return logEntry
+	return logEntry, nil
 }
 
 func (a *AccessLogDispatcher) Send(ctx context.Context, evt Event) error {
-	logEntry := a.formatLogEntry(evt)
+	logEntry, err := a.formatLogEntry(evt)
+	if err != nil {
+		return err
+	}
 
 	// Write to stdout
 	fmt.Print(logEntry)
 
 	// Write to file if configured
 	if a.fileWriter != nil {
-		if _, err := a.fileWriter.WriteString(logEntry); err != nil {
+		if _, err := a.fileWriter.Write([]byte(logEntry)); err != nil {
 			return fmt.Errorf("failed to write to log file: %w", err)
 		}
 	}
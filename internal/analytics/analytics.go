@@ -4,7 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
 )
 
 // Event represents an analytics event
@@ -19,6 +23,11 @@ type Event struct {
 	Timestamp  string
 	ShortCode  string
 	TargetURL  string
+	Platform   string
+
+	// Providers restricts delivery to the named providers. The event is
+	// sent to every provider when empty.
+	Providers []string `json:"-"`
 }
 
 // Dispatcher interface that all providers must implement
@@ -31,16 +40,65 @@ type Dispatcher interface {
 // Manager handles multiple dispatchers and workers
 type Manager struct {
 	dispatchers []Dispatcher
+	byName      map[string]Dispatcher
 	eventChan   chan Event
 	logger      *slog.Logger
 	numWorkers  int
+
+	// Events for dispatchers that support batching are grouped per
+	// dispatcher and sent every batchSize events or batchInterval.
+	batchers      map[Dispatcher]*batcher
+	batchInterval time.Duration
+
+	retryAttempts  int
+	retryBaseDelay time.Duration
+
+	// Circuit breakers by provider name, empty when disabled
+	breakers map[string]*breaker
+
+	// Highest queue depth observed, exported as a high-water mark
+	maxDepth atomic.Int64
+
+	// closing is set by Shutdown, after which Track drops events. mu
+	// orders it with sends so none land after the queue is drained.
+	mu      sync.RWMutex
+	closing bool
+	done    chan struct{} // Closed to stop the workers
+	workers sync.WaitGroup
 }
 
+const (
+	// defaultProviderTimeout is used when a provider doesn't configure a timeout
+	defaultProviderTimeout = 5 * time.Second
+	// maxProviderTimeout bounds how long a single send may block a worker
+	maxProviderTimeout = 60 * time.Second
+
+	defaultQueueSize = 1000
+
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = 100 * time.Millisecond
+)
+
 // Config represents analytics configuration
 type Config struct {
 	Enabled    bool
 	NumWorkers int
-	Providers  map[string]map[string]interface{}
+	QueueSize  int // Number of events buffered for the workers, defaults to 1000
+	// BatchSize enables batching for providers that support it when above
+	// one. Partial batches are sent every BatchInterval, 5s by default.
+	BatchSize     int
+	BatchInterval time.Duration
+	// RetryAttempts is how many times a failed send is tried in total, 3 by
+	// default. Retries back off exponentially from RetryBaseDelay, 100ms by
+	// default.
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+	// CircuitThreshold is how many consecutive failed sends to a provider
+	// open its circuit, dropping its events without trying them for
+	// CircuitCooldown (30s by default). Zero disables the circuit breaker.
+	CircuitThreshold int
+	CircuitCooldown  time.Duration
+	Providers        map[string]map[string]interface{}
 }
 
 // NewManager creates a new analytics manager
@@ -49,11 +107,35 @@ func NewManager(cfg Config, logger *slog.Logger) (*Manager, error) {
 		return nil, nil
 	}
 
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+
 	m := &Manager{
-		eventChan:   make(chan Event, 1000), // buffered channel
+		eventChan:   make(chan Event, cfg.QueueSize),
 		logger:      logger,
 		numWorkers:  cfg.NumWorkers,
 		dispatchers: make([]Dispatcher, 0),
+		byName:      make(map[string]Dispatcher),
+		batchers:    make(map[Dispatcher]*batcher),
+		breakers:    make(map[string]*breaker),
+		done:        make(chan struct{}),
+	}
+
+	m.batchInterval = cfg.BatchInterval
+	if m.batchInterval <= 0 {
+		m.batchInterval = defaultBatchInterval
+	}
+	m.retryAttempts = cfg.RetryAttempts
+	if m.retryAttempts <= 0 {
+		m.retryAttempts = defaultRetryAttempts
+	}
+	m.retryBaseDelay = cfg.RetryBaseDelay
+	if m.retryBaseDelay <= 0 {
+		m.retryBaseDelay = defaultRetryBaseDelay
+	}
+	if cfg.CircuitCooldown <= 0 {
+		cfg.CircuitCooldown = defaultCircuitCooldown
 	}
 
 	// Initialize configured providers
@@ -63,12 +145,26 @@ func NewManager(cfg Config, logger *slog.Logger) (*Manager, error) {
 			return nil, fmt.Errorf("failed to initialize provider %s: %w", providerName, err)
 		}
 		logger.Info("initialized analytics provider", "provider", providerName)
-		m.dispatchers = append(m.dispatchers, dispatcher)
+		m.addDispatcher(providerName, dispatcher, cfg)
 	}
 
 	return m, nil
 }
 
+// addDispatcher registers a provider's dispatcher along with its batcher and
+// circuit breaker when cfg enables them.
+func (m *Manager) addDispatcher(name string, d Dispatcher, cfg Config) {
+	m.dispatchers = append(m.dispatchers, d)
+	m.byName[name] = d
+
+	if bd, ok := d.(BatchDispatcher); ok && cfg.BatchSize > 1 {
+		m.batchers[d] = &batcher{d: bd, size: cfg.BatchSize}
+	}
+	if cfg.CircuitThreshold > 0 {
+		m.breakers[name] = newBreaker(name, cfg.CircuitThreshold, cfg.CircuitCooldown, m.logger)
+	}
+}
+
 func initializeProvider(name string, config map[string]interface{}, logger *slog.Logger) (Dispatcher, error) {
 	switch name {
 	case "plausible":
@@ -76,15 +172,34 @@ func initializeProvider(name string, config map[string]interface{}, logger *slog
 		if !ok || endpoint == "" {
 			return nil, fmt.Errorf("plausible endpoint is required")
 		}
-		timeout, ok := config["timeout"].(int64)
-		if !ok || timeout == 0 {
-			return nil, fmt.Errorf("plausible timeout is required")
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
 		}
 		cfg := PlausibleConfig{
 			Endpoint: endpoint,
-			Timeout:  time.Duration(timeout) * time.Second,
+			Timeout:  timeout,
 		}
 		return NewPlausibleDispatcher(cfg, logger)
+	case "umami":
+		endpoint, ok := config["endpoint"].(string)
+		if !ok || endpoint == "" {
+			return nil, fmt.Errorf("umami endpoint is required")
+		}
+		websiteID, ok := config["website_id"].(string)
+		if !ok || websiteID == "" {
+			return nil, fmt.Errorf("umami website_id is required")
+		}
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
+		}
+		cfg := UmamiConfig{
+			Endpoint:  endpoint,
+			WebsiteID: websiteID,
+			Timeout:   timeout,
+		}
+		return NewUmamiDispatcher(cfg, logger)
 	case "matomo":
 		trackingURL, ok := config["tracking_url"].(string)
 		if !ok || trackingURL == "" {
@@ -94,28 +209,38 @@ func initializeProvider(name string, config map[string]interface{}, logger *slog
 		if !ok || siteID == 0 {
 			return nil, fmt.Errorf("matomo site_id is required")
 		}
-		timeout, ok := config["timeout"].(int64)
-		if !ok || timeout == 0 {
-			return nil, fmt.Errorf("matomo timeout is required")
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
 		}
 		authToken, _ := config["auth_token"].(string)
 		cfg := MatomoConfig{
 			TrackingURL: trackingURL,
 			SiteID:      int(siteID),
 			AuthToken:   authToken,
-			Timeout:     time.Duration(timeout) * time.Second,
+			Timeout:     timeout,
 		}
 		return NewMatomoDispatcher(cfg, logger)
 	case "accesslog":
-		return NewAccessLogDispatcher(config, logger)
+		filePath, _ := config["file_path"].(string)
+		format, _ := config["format"].(string)
+		maxSizeMB, _ := config["max_size_mb"].(int64)
+		maxAgeDays, _ := config["max_age_days"].(int64)
+		cfg := AccessLogConfig{
+			FilePath:   filePath,
+			Format:     format,
+			MaxSizeMB:  maxSizeMB,
+			MaxAgeDays: maxAgeDays,
+		}
+		return NewAccessLogDispatcher(cfg, logger)
 	case "webhook":
 		endpoint, ok := config["endpoint"].(string)
 		if !ok || endpoint == "" {
 			return nil, fmt.Errorf("webhook endpoint is required")
 		}
-		timeout, ok := config["timeout"].(int64)
-		if !ok || timeout == 0 {
-			return nil, fmt.Errorf("webhook timeout is required")
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
 		}
 		headers := make(map[string]string)
 		if h, ok := config["headers"].(map[string]interface{}); ok {
@@ -125,33 +250,209 @@ func initializeProvider(name string, config map[string]interface{}, logger *slog
 				}
 			}
 		}
+		secret, _ := config["secret"].(string)
 		cfg := WebhookConfig{
 			Endpoint: endpoint,
-			Timeout:  time.Duration(timeout) * time.Second,
+			Timeout:  timeout,
 			Headers:  headers,
+			Secret:   secret,
 		}
 		return NewWebhookDispatcher(cfg, logger)
+	case "segment":
+		writeKey, ok := config["write_key"].(string)
+		if !ok || writeKey == "" {
+			return nil, fmt.Errorf("segment write_key is required")
+		}
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
+		}
+		endpoint, _ := config["endpoint"].(string)
+		cfg := SegmentConfig{
+			WriteKey: writeKey,
+			Endpoint: endpoint,
+			Timeout:  timeout,
+		}
+		return NewSegmentDispatcher(cfg, logger)
+	case "fathom":
+		siteID, ok := config["site_id"].(string)
+		if !ok || siteID == "" {
+			return nil, fmt.Errorf("fathom site_id is required")
+		}
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
+		}
+		endpoint, _ := config["endpoint"].(string)
+		cfg := FathomConfig{
+			SiteID:   siteID,
+			Endpoint: endpoint,
+			Timeout:  timeout,
+		}
+		return NewFathomDispatcher(cfg, logger)
+	case "kafka":
+		var brokers []string
+		if b, ok := config["brokers"].([]interface{}); ok {
+			for _, v := range b {
+				if broker, ok := v.(string); ok && broker != "" {
+					brokers = append(brokers, broker)
+				}
+			}
+		}
+		if len(brokers) == 0 {
+			return nil, fmt.Errorf("kafka brokers are required")
+		}
+		topic, ok := config["topic"].(string)
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("kafka topic is required")
+		}
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
+		}
+		batchSize, _ := config["batch_size"].(int64)
+		batchTimeoutMs, _ := config["batch_timeout_ms"].(int64)
+		mechanism, _ := config["sasl_mechanism"].(string)
+		username, _ := config["username"].(string)
+		password, _ := config["password"].(string)
+		useTLS, _ := config["tls"].(bool)
+		cfg := KafkaConfig{
+			Brokers:       brokers,
+			Topic:         topic,
+			Timeout:       timeout,
+			BatchSize:     int(batchSize),
+			BatchTimeout:  time.Duration(batchTimeoutMs) * time.Millisecond,
+			SASLMechanism: mechanism,
+			Username:      username,
+			Password:      password,
+			TLS:           useTLS,
+		}
+		return NewKafkaDispatcher(cfg, logger)
+	case "nats":
+		var servers []string
+		if s, ok := config["servers"].([]interface{}); ok {
+			for _, v := range s {
+				if server, ok := v.(string); ok && server != "" {
+					servers = append(servers, server)
+				}
+			}
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("nats servers are required")
+		}
+		subject, ok := config["subject"].(string)
+		if !ok || subject == "" {
+			return nil, fmt.Errorf("nats subject is required")
+		}
+		timeout, err := providerTimeout(name, config)
+		if err != nil {
+			return nil, err
+		}
+		credsFile, _ := config["creds_file"].(string)
+		username, _ := config["username"].(string)
+		password, _ := config["password"].(string)
+		token, _ := config["token"].(string)
+		cfg := NATSConfig{
+			Servers:   servers,
+			Subject:   subject,
+			Timeout:   timeout,
+			CredsFile: credsFile,
+			Username:  username,
+			Password:  password,
+			Token:     token,
+		}
+		return NewNATSDispatcher(cfg, logger)
 	default:
 		return nil, fmt.Errorf("unknown provider: %s", name)
 	}
 }
 
+// providerTimeout reads a provider's timeout in seconds, falling back to
+// defaultProviderTimeout when it isn't set.
+func providerTimeout(name string, config map[string]interface{}) (time.Duration, error) {
+	raw, ok := config["timeout"]
+	if !ok {
+		return defaultProviderTimeout, nil
+	}
+	secs, ok := raw.(int64)
+	if !ok || secs <= 0 {
+		return 0, fmt.Errorf("%s timeout must be a positive number of seconds", name)
+	}
+	timeout := time.Duration(secs) * time.Second
+	if timeout > maxProviderTimeout {
+		return 0, fmt.Errorf("%s timeout must not exceed %s", name, maxProviderTimeout)
+	}
+	return timeout, nil
+}
+
 // Start begins the worker routines
 func (m *Manager) Start(ctx context.Context) {
+	if m == nil {
+		return
+	}
 	for i := 0; i < m.numWorkers; i++ {
+		m.workers.Add(1)
 		go m.worker(ctx, i)
 	}
+	if len(m.batchers) > 0 {
+		m.workers.Add(1)
+		go m.batchFlusher(ctx)
+	}
 }
 
 // Track sends an event to the analytics channel
 func (m *Manager) Track(evt Event) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closing {
+		metrics.AnalyticsEventsDroppedTotal.Inc()
+		return
+	}
+
 	select {
 	case m.eventChan <- evt:
+		m.observeDepth()
 	default:
+		metrics.AnalyticsEventsDroppedTotal.Inc()
 		m.logger.Warn("analytics channel full, dropping event")
 	}
 }
 
+// observeDepth records the current queue depth and raises the high-water
+// mark when it's exceeded.
+func (m *Manager) observeDepth() {
+	depth := int64(len(m.eventChan))
+	metrics.AnalyticsQueueDepth.Set(float64(depth))
+	for {
+		highest := m.maxDepth.Load()
+		if depth <= highest {
+			return
+		}
+		if m.maxDepth.CompareAndSwap(highest, depth) {
+			metrics.AnalyticsQueueDepthMax.Set(float64(depth))
+			return
+		}
+	}
+}
+
+// QueueUsage returns the number of events waiting for the workers and the
+// queue's capacity.
+func (m *Manager) QueueUsage() (int, int) {
+	if m == nil {
+		return 0, 0
+	}
+	return len(m.eventChan), cap(m.eventChan)
+}
+
+// HasProvider reports whether the named provider is configured.
+func (m *Manager) HasProvider(name string) bool {
+	if m == nil {
+		return false
+	}
+	_, ok := m.byName[name]
+	return ok
+}
+
 // Close cleans up resources
 func (m *Manager) Close() error {
 	for _, d := range m.dispatchers {
@@ -164,22 +465,141 @@ func (m *Manager) Close() error {
 	return nil
 }
 
+// Shutdown stops accepting events, waits for the workers to finish their
+// current event and sends whatever is still queued before closing the
+// dispatchers. Events left when ctx is done are dropped. It's a no-op on a
+// nil Manager.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	close(m.done)
+	stopped := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+
+	// Workers still busy when ctx ends may take events concurrently, which
+	// only means some are sent by them rather than here.
+	flushed, dropped := 0, 0
+drain:
+	for {
+		select {
+		case evt := <-m.eventChan:
+			if ctx.Err() != nil {
+				dropped++
+				continue
+			}
+			m.dispatch(ctx, evt)
+			flushed++
+		default:
+			break drain
+		}
+	}
+	m.flushBatches(ctx)
+	if dropped > 0 {
+		metrics.AnalyticsEventsDroppedTotal.Add(dropped)
+	}
+	metrics.AnalyticsQueueDepth.Set(0)
+	m.logger.Info("drained analytics events", "flushed", flushed, "dropped", dropped)
+
+	return m.Close()
+}
+
 // worker processes events from the channel
 func (m *Manager) worker(ctx context.Context, id int) {
+	defer m.workers.Done()
 	m.logger.Info("starting analytics worker", "worker_id", id)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-m.done:
+			return
 		case evt := <-m.eventChan:
-			for _, d := range m.dispatchers {
-				if err := d.Send(ctx, evt); err != nil {
-					m.logger.Error("failed to send event",
-						"provider", d.Name(),
-						"error", err)
-				}
-			}
+			m.observeDepth()
+			m.dispatch(ctx, evt)
+		}
+	}
+}
+
+// dispatch sends an event to each of its target providers
+func (m *Manager) dispatch(ctx context.Context, evt Event) {
+	for _, d := range m.targets(evt) {
+		if b, ok := m.batchers[d]; ok {
+			m.sendBatch(ctx, b, b.add(evt))
+			continue
+		}
+		m.sendWithRetry(ctx, d.Name(), 1, func() error {
+			return d.Send(ctx, evt)
+		})
+	}
+}
+
+// sendWithRetry calls send until it succeeds, backing off exponentially
+// between attempts. The count events sent are dropped once the attempts run
+// out, ctx is done or the provider's circuit is open.
+func (m *Manager) sendWithRetry(ctx context.Context, provider string, count int, send func() error) {
+	b := m.breakers[provider]
+	delay := m.retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		probe, ok := b.allow()
+		if !ok {
+			metrics.AnalyticsEventsDroppedTotal.Add(count)
+			return
+		}
+		err := send()
+		b.record(probe, err)
+		if err == nil {
+			return
+		}
+		if attempt == m.retryAttempts || ctx.Err() != nil {
+			m.logger.Error("failed to send event",
+				"provider", provider,
+				"attempts", attempt,
+				"count", count,
+				"error", err)
+			metrics.AnalyticsEventsDroppedTotal.Add(count)
+			return
+		}
+
+		m.logger.Warn("failed to send event, retrying",
+			"provider", provider,
+			"attempt", attempt,
+			"error", err)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// targets returns the dispatchers an event should be sent to
+func (m *Manager) targets(evt Event) []Dispatcher {
+	if len(evt.Providers) == 0 {
+		return m.dispatchers
+	}
+
+	dispatchers := make([]Dispatcher, 0, len(evt.Providers))
+	for _, name := range evt.Providers {
+		if d, ok := m.byName[name]; ok {
+			dispatchers = append(dispatchers, d)
 		}
 	}
+	return dispatchers
 }
@@ -0,0 +1,219 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// stubDispatcher records the events sent to it. fail, when set, is called
+// with the number of each send and fails the send with the error it returns.
+type stubDispatcher struct {
+	name string
+	fail func(call int) error
+
+	mu     sync.Mutex
+	calls  int
+	events []Event
+	closed bool
+}
+
+func (d *stubDispatcher) Name() string { return d.name }
+
+func (d *stubDispatcher) Send(_ context.Context, evt Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls++
+	if d.fail != nil {
+		if err := d.fail(d.calls); err != nil {
+			return err
+		}
+	}
+	d.events = append(d.events, evt)
+	return nil
+}
+
+func (d *stubDispatcher) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	return nil
+}
+
+func (d *stubDispatcher) stats() (calls, received int, closed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls, len(d.events), d.closed
+}
+
+// newTestManager returns a manager sending to the given dispatchers.
+func newTestManager(t *testing.T, cfg Config, ds ...Dispatcher) *Manager {
+	t.Helper()
+	cfg.Enabled = true
+	m, err := NewManager(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	for _, d := range ds {
+		m.addDispatcher(d.Name(), d, cfg)
+	}
+	return m
+}
+
+func droppedEvents() uint64 {
+	return metrics.AnalyticsEventsDroppedTotal.Get()
+}
+
+func TestShutdownDeliversQueuedEvents(t *testing.T) {
+	const events = 100
+
+	for _, workers := range []int{0, 1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			d := &stubDispatcher{name: "stub"}
+			m := newTestManager(t, Config{NumWorkers: workers, QueueSize: events}, d)
+			m.Start(context.Background())
+
+			dropped := droppedEvents()
+			for i := 0; i < events; i++ {
+				m.Track(Event{ShortCode: fmt.Sprint(i)})
+			}
+			if err := m.Shutdown(context.Background()); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+
+			_, received, closed := d.stats()
+			if received != events {
+				t.Errorf("dispatcher received %d events, want %d", received, events)
+			}
+			if !closed {
+				t.Error("dispatcher wasn't closed")
+			}
+			if n := droppedEvents() - dropped; n != 0 {
+				t.Errorf("%d events were dropped", n)
+			}
+
+			// Events tracked after shutdown are dropped
+			m.Track(Event{})
+			if n := droppedEvents() - dropped; n != 1 {
+				t.Errorf("%d events were dropped after shutdown, want 1", n)
+			}
+		})
+	}
+}
+
+func TestShutdownDropsEventsWhenCtxDone(t *testing.T) {
+	const events = 10
+
+	d := &stubDispatcher{name: "stub"}
+	m := newTestManager(t, Config{QueueSize: events}, d)
+
+	dropped := droppedEvents()
+	for i := 0; i < events; i++ {
+		m.Track(Event{})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	calls, _, closed := d.stats()
+	if calls != 0 {
+		t.Errorf("dispatcher was called %d times, want 0", calls)
+	}
+	if !closed {
+		t.Error("dispatcher wasn't closed")
+	}
+	if n := droppedEvents() - dropped; n != events {
+		t.Errorf("%d events were counted as dropped, want %d", n, events)
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+	errDown := errors.New("provider down")
+
+	tests := []struct {
+		name        string
+		fail        func(call int) error
+		wantCalls   int
+		wantDropped uint64
+	}{
+		{
+			name:      "succeeds first time",
+			wantCalls: 1,
+		},
+		{
+			name: "succeeds after two failures",
+			fail: func(call int) error {
+				if call <= 2 {
+					return errDown
+				}
+				return nil
+			},
+			wantCalls: 3,
+		},
+		{
+			name:        "attempts run out",
+			fail:        func(int) error { return errDown },
+			wantCalls:   3,
+			wantDropped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &stubDispatcher{name: "stub", fail: tt.fail}
+			m := newTestManager(t, Config{RetryAttempts: 3, RetryBaseDelay: 1}, d)
+
+			dropped := droppedEvents()
+			m.dispatch(context.Background(), Event{})
+
+			if calls, _, _ := d.stats(); calls != tt.wantCalls {
+				t.Errorf("dispatcher was called %d times, want %d", calls, tt.wantCalls)
+			}
+			if n := droppedEvents() - dropped; n != tt.wantDropped {
+				t.Errorf("%d events were counted as dropped, want %d", n, tt.wantDropped)
+			}
+		})
+	}
+}
+
+// providerConfigTest is a provider config initializeProvider should reject
+// with an error containing want, or accept when want is empty.
+type providerConfigTest struct {
+	name   string
+	config map[string]interface{}
+	want   string
+}
+
+func testProviderConfigs(t *testing.T, provider string, tests []providerConfigTest) {
+	t.Helper()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := initializeProvider(provider, tc.config, testLogger)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("initializeProvider(%s): %v", provider, err)
+				}
+				if d.Name() != provider {
+					t.Errorf("dispatcher name = %q, want %q", d.Name(), provider)
+				}
+				d.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("initializeProvider(%s) = %v, want an error about %q", provider, err, tc.want)
+			}
+		})
+	}
+}
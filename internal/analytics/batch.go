@@ -0,0 +1,96 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+const defaultBatchInterval = 5 * time.Second
+
+// BatchDispatcher is implemented by dispatchers whose provider accepts many
+// events in one request. When batching is enabled the manager groups events
+// for them and calls SendBatch instead of Send.
+type BatchDispatcher interface {
+	Dispatcher
+	SendBatch(context.Context, []Event) error
+}
+
+// batcher holds the events waiting to be sent to a BatchDispatcher.
+type batcher struct {
+	d    BatchDispatcher
+	size int
+
+	mu      sync.Mutex
+	pending []Event
+}
+
+// add queues an event and returns the pending batch once it's full.
+func (b *batcher) add(evt Event) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, evt)
+	if len(b.pending) < b.size {
+		return nil
+	}
+	batch := b.pending
+	b.pending = make([]Event, 0, b.size)
+	return batch
+}
+
+// take returns the pending events, leaving the batcher empty.
+func (b *batcher) take() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch := b.pending
+	b.pending = make([]Event, 0, b.size)
+	return batch
+}
+
+// sendBatch sends a batch to its dispatcher, retrying like single events.
+func (m *Manager) sendBatch(ctx context.Context, b *batcher, batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+	m.sendWithRetry(ctx, b.d.Name(), len(batch), func() error {
+		return b.d.SendBatch(ctx, batch)
+	})
+}
+
+// flushBatches sends every pending batch. Batches are dropped once ctx is done.
+func (m *Manager) flushBatches(ctx context.Context) {
+	for _, b := range m.batchers {
+		batch := b.take()
+		if ctx.Err() != nil {
+			if len(batch) > 0 {
+				metrics.AnalyticsEventsDroppedTotal.Add(len(batch))
+			}
+			continue
+		}
+		m.sendBatch(ctx, b, batch)
+	}
+}
+
+// batchFlusher sends partial batches every interval so events aren't held
+// back for long when traffic is low.
+func (m *Manager) batchFlusher(ctx context.Context) {
+	defer m.workers.Done()
+
+	ticker := time.NewTicker(m.batchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.flushBatches(ctx)
+		}
+	}
+}
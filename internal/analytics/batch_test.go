@@ -0,0 +1,96 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// stubBatchDispatcher records the batches it's sent.
+type stubBatchDispatcher struct {
+	stubDispatcher
+	batches chan []Event
+}
+
+func (d *stubBatchDispatcher) SendBatch(_ context.Context, events []Event) error {
+	d.batches <- events
+	return nil
+}
+
+func newStubBatchDispatcher() *stubBatchDispatcher {
+	return &stubBatchDispatcher{stubDispatcher: stubDispatcher{name: "batch"}, batches: make(chan []Event, 10)}
+}
+
+// waitBatch returns the next batch sent to d, failing after timeout.
+func waitBatch(t *testing.T, d *stubBatchDispatcher, timeout time.Duration) []Event {
+	t.Helper()
+	select {
+	case batch := <-d.batches:
+		return batch
+	case <-time.After(timeout):
+		t.Fatalf("no batch sent within %s", timeout)
+		return nil
+	}
+}
+
+func TestBatchSentAtSize(t *testing.T) {
+	d := newStubBatchDispatcher()
+	m := newTestManager(t, Config{NumWorkers: 1, QueueSize: 10, BatchSize: 3, BatchInterval: time.Hour}, d)
+	m.Start(context.Background())
+	defer m.Shutdown(context.Background())
+
+	for i := 0; i < 4; i++ {
+		m.Track(Event{ShortCode: fmt.Sprint(i)})
+	}
+	batch := waitBatch(t, d, 5*time.Second)
+	if len(batch) != 3 {
+		t.Fatalf("batch of %d events, want 3", len(batch))
+	}
+	for i, evt := range batch {
+		if evt.ShortCode != fmt.Sprint(i) {
+			t.Errorf("event %d = %s, want them in order", i, evt.ShortCode)
+		}
+	}
+	// The fourth event waits for the batch to fill or the interval
+	select {
+	case batch := <-d.batches:
+		t.Errorf("partial batch of %d sent before the interval", len(batch))
+	case <-time.After(100 * time.Millisecond):
+	}
+	if calls, _, _ := d.stats(); calls != 0 {
+		t.Errorf("Send called %d times, want batches only", calls)
+	}
+}
+
+func TestBatchSentAtInterval(t *testing.T) {
+	d := newStubBatchDispatcher()
+	m := newTestManager(t, Config{NumWorkers: 1, QueueSize: 10, BatchSize: 100, BatchInterval: 50 * time.Millisecond}, d)
+	m.Start(context.Background())
+	defer m.Shutdown(context.Background())
+
+	m.Track(Event{ShortCode: "a"})
+	m.Track(Event{ShortCode: "b"})
+	if batch := waitBatch(t, d, 5*time.Second); len(batch) != 2 {
+		t.Fatalf("batch of %d events, want the 2 pending", len(batch))
+	}
+
+	// Later events go out on a following tick
+	m.Track(Event{ShortCode: "c"})
+	if batch := waitBatch(t, d, 5*time.Second); len(batch) != 1 || batch[0].ShortCode != "c" {
+		t.Errorf("batch = %v, want just c", batch)
+	}
+}
+
+func TestShutdownFlushesPartialBatch(t *testing.T) {
+	d := newStubBatchDispatcher()
+	m := newTestManager(t, Config{QueueSize: 10, BatchSize: 100, BatchInterval: time.Hour}, d)
+
+	m.Track(Event{ShortCode: "a"})
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if batch := waitBatch(t, d, time.Second); len(batch) != 1 {
+		t.Errorf("batch of %d events on shutdown, want 1", len(batch))
+	}
+}
@@ -0,0 +1,113 @@
+package analytics
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+const defaultCircuitCooldown = 30 * time.Second
+
+// Circuit breaker states, as exported by the lil_analytics_circuit_state
+// gauge.
+const (
+	circuitClosed   = 0 // Sends go through
+	circuitOpen     = 1 // Sends fail fast until the cooldown passes
+	circuitHalfOpen = 2 // One send probes whether the provider is back
+)
+
+// breaker stops sends to a provider after threshold consecutive failures, so
+// a provider that's down doesn't hold up the workers. After cooldown a single
+// probe is let through, closing the circuit when it succeeds and opening it
+// again when it fails. A nil breaker lets every send through.
+type breaker struct {
+	provider  string
+	threshold int
+	cooldown  time.Duration
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool // A half-open probe is in flight
+}
+
+func newBreaker(provider string, threshold int, cooldown time.Duration, logger *slog.Logger) *breaker {
+	b := &breaker{
+		provider:  provider,
+		threshold: threshold,
+		cooldown:  cooldown,
+		logger:    logger,
+	}
+	b.setState(circuitClosed)
+	return b
+}
+
+// allow reports whether a send may be attempted and whether it's the
+// half-open probe. Every allowed send must be followed by a call to record.
+func (b *breaker) allow() (probe, ok bool) {
+	if b == nil {
+		return false, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return false, true
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.setState(circuitHalfOpen)
+	}
+	if b.probing {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// record updates the circuit with the outcome of an allowed send. Only the
+// probe moves a circuit out of half-open; sends let through before the
+// circuit opened may finish after, and their outcome says nothing about
+// whether the provider is back.
+func (b *breaker) record(probe bool, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	} else if b.state != circuitClosed {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.setState(circuitClosed)
+			b.logger.Info("analytics provider recovered, closing circuit", "provider", b.provider)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+		b.logger.Warn("analytics provider failing, opening circuit",
+			"provider", b.provider,
+			"failures", b.failures,
+			"cooldown", b.cooldown.String())
+	}
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	metrics.AnalyticsCircuitState(b.provider).Set(float64(state))
+}
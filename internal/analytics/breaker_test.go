@@ -0,0 +1,103 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const (
+		provider = "flaky"
+		cooldown = 20 * time.Millisecond
+	)
+	errDown := errors.New("provider down")
+	state := metrics.AnalyticsCircuitState(provider)
+
+	var (
+		down   bool
+		sentIn = -1.0 // The circuit state seen by the last send
+		flaky  = &stubDispatcher{name: provider}
+		steps  = []struct {
+			name      string
+			down      bool
+			afterWait bool // Wait out the cooldown first
+			wantSent  bool
+			wantIn    float64 // State the send happens in
+			wantAfter float64
+		}{
+			{name: "up", wantSent: true, wantIn: circuitClosed, wantAfter: circuitClosed},
+			{name: "first failure", down: true, wantSent: true, wantIn: circuitClosed, wantAfter: circuitClosed},
+			{name: "threshold reached", down: true, wantSent: true, wantIn: circuitClosed, wantAfter: circuitOpen},
+			{name: "cooling down", wantAfter: circuitOpen},
+			{name: "probe fails", down: true, afterWait: true, wantSent: true, wantIn: circuitHalfOpen, wantAfter: circuitOpen},
+			{name: "cooling down again", wantAfter: circuitOpen},
+			{name: "probe succeeds", afterWait: true, wantSent: true, wantIn: circuitHalfOpen, wantAfter: circuitClosed},
+			{name: "up again", wantSent: true, wantIn: circuitClosed, wantAfter: circuitClosed},
+		}
+	)
+	flaky.fail = func(int) error {
+		sentIn = state.Get()
+		if down {
+			return errDown
+		}
+		return nil
+	}
+	m := newTestManager(t, Config{RetryAttempts: 1, CircuitThreshold: 2, CircuitCooldown: cooldown}, flaky)
+
+	if got := state.Get(); got != circuitClosed {
+		t.Fatalf("initial state = %v, want %v", got, circuitClosed)
+	}
+	for _, step := range steps {
+		if step.afterWait {
+			time.Sleep(cooldown)
+		}
+		down, sentIn = step.down, -1
+		m.dispatch(context.Background(), Event{})
+
+		if sent := sentIn != -1; sent != step.wantSent {
+			t.Fatalf("%s: sent = %v, want %v", step.name, sent, step.wantSent)
+		}
+		if step.wantSent && sentIn != step.wantIn {
+			t.Errorf("%s: sent in state %v, want %v", step.name, sentIn, step.wantIn)
+		}
+		if got := state.Get(); got != step.wantAfter {
+			t.Errorf("%s: state = %v, want %v", step.name, got, step.wantAfter)
+		}
+	}
+}
+
+func TestCircuitBreakerIgnoresSendsFromBeforeProbe(t *testing.T) {
+	const cooldown = 10 * time.Millisecond
+	b := newBreaker("stale", 1, cooldown, testLogger)
+	state := metrics.AnalyticsCircuitState("stale")
+
+	// Two sends go out while the circuit is closed and the first to fail
+	// opens it
+	stale, _ := b.allow()
+	failing, _ := b.allow()
+	b.record(failing, errors.New("provider down"))
+	time.Sleep(cooldown)
+
+	probe, ok := b.allow()
+	if !probe || !ok {
+		t.Fatalf("allow() = %v, %v after the cooldown, want a probe", probe, ok)
+	}
+
+	// The other send finishing doesn't end the probe
+	b.record(stale, nil)
+	if got := state.Get(); got != circuitHalfOpen {
+		t.Errorf("state = %v after a send from before the probe, want %v", got, circuitHalfOpen)
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("a second send was allowed while the probe is in flight")
+	}
+
+	b.record(probe, nil)
+	if got := state.Get(); got != circuitClosed {
+		t.Errorf("state = %v after the probe succeeded, want %v", got, circuitClosed)
+	}
+}
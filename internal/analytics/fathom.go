@@ -0,0 +1,113 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const defaultFathomEndpoint = "https://cdn.usefathom.com/"
+
+type FathomConfig struct {
+	SiteID   string
+	Endpoint string // Defaults to Fathom's collection endpoint
+	Timeout  time.Duration
+}
+
+type FathomDispatcher struct {
+	config FathomConfig
+	client *http.Client
+	logger *slog.Logger
+}
+
+func NewFathomDispatcher(config FathomConfig, logger *slog.Logger) (*FathomDispatcher, error) {
+	if config.SiteID == "" {
+		return nil, fmt.Errorf("fathom site ID is required")
+	}
+	if config.Timeout == 0 {
+		return nil, fmt.Errorf("fathom timeout is required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = defaultFathomEndpoint
+	}
+
+	return &FathomDispatcher{
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+		},
+		logger: logger,
+	}, nil
+}
+
+func (f *FathomDispatcher) Name() string {
+	return "fathom"
+}
+
+func (f *FathomDispatcher) Send(ctx context.Context, evt Event) error {
+	trackingURL := f.config.Endpoint + "?" + f.pageviewParams(evt).Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", trackingURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Fathom counts unique visitors from a hash of the user agent and the
+	// forwarded IP
+	req.Header.Set("User-Agent", evt.UserAgent)
+	if evt.UserIP != "" {
+		req.Header.Set("X-Forwarded-For", evt.UserIP)
+	}
+
+	f.logger.Info("sending fathom request",
+		"url", trackingURL,
+		"user_agent", evt.UserAgent,
+		"user_ip", evt.UserIP)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("fathom request failed with status: %d, failed to read response body: %v", resp.StatusCode, err)
+		}
+		return fmt.Errorf("fathom request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// pageviewParams builds the query of a pageview for the short URL: its
+// scheme and host, its path and the referrer.
+func (f *FathomDispatcher) pageviewParams(evt Event) url.Values {
+	hostname := "https://" + evt.Domain
+	path := "/" + evt.ShortCode
+	if u, err := url.Parse(evt.URL); err == nil && u.Host != "" {
+		hostname = u.Scheme + "://" + u.Host
+		path = u.Path
+	}
+
+	params := url.Values{}
+	params.Set("sid", f.config.SiteID)
+	params.Set("h", hostname)
+	params.Set("p", path)
+	params.Set("r", evt.Referrer)
+	params.Set("qs", "{}")
+	// Cache buster, as the tracker sends
+	params.Set("cid", strconv.FormatInt(time.Now().UnixNano(), 10))
+	return params
+}
+
+// noop
+func (f *FathomDispatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package analytics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFathomSend(t *testing.T) {
+	endpoint, reqs := newProviderEndpoint(t, http.StatusOK)
+	d, err := NewFathomDispatcher(FathomConfig{SiteID: "ABCDEF", Endpoint: endpoint, Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewFathomDispatcher: %v", err)
+	}
+	if err := d.Send(context.Background(), testEvent); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	req := <-reqs
+	if req.method != http.MethodGet {
+		t.Errorf("method = %s, want GET", req.method)
+	}
+	if got := req.header.Get("X-Forwarded-For"); got != testEvent.UserIP {
+		t.Errorf("X-Forwarded-For = %q, want %q", got, testEvent.UserIP)
+	}
+	if got := req.header.Get("User-Agent"); got != testEvent.UserAgent {
+		t.Errorf("User-Agent = %q, want %q", got, testEvent.UserAgent)
+	}
+	for param, want := range map[string]string{
+		"sid": "ABCDEF",
+		"h":   "https://lil.test",
+		"p":   "/abc",
+		"r":   "https://news.example/post",
+		"qs":  "{}",
+	} {
+		if got := req.query.Get(param); got != want {
+			t.Errorf("%s = %q, want %q", param, got, want)
+		}
+	}
+	if req.query.Get("cid") == "" {
+		t.Error("no cache buster sent")
+	}
+
+	// Without a short URL the pageview is built from the domain and code
+	bare := testEvent
+	bare.URL = ""
+	if err := d.Send(context.Background(), bare); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	req = <-reqs
+	if h, p := req.query.Get("h"), req.query.Get("p"); h != "https://lil.test" || p != "/abc" {
+		t.Errorf("pageview = %s%s, want https://lil.test/abc", h, p)
+	}
+}
+
+func TestFathomSendFailure(t *testing.T) {
+	endpoint, _ := newProviderEndpoint(t, http.StatusForbidden)
+	d, err := NewFathomDispatcher(FathomConfig{SiteID: "ABCDEF", Endpoint: endpoint, Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewFathomDispatcher: %v", err)
+	}
+	if err := d.Send(context.Background(), testEvent); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Send = %v, want the failed status", err)
+	}
+}
+
+func TestFathomConfig(t *testing.T) {
+	testProviderConfigs(t, "fathom", []providerConfigTest{
+		{name: "valid", config: map[string]interface{}{"site_id": "ABCDEF"}},
+		{name: "no site", config: map[string]interface{}{"endpoint": "https://fathom.example/"}, want: "site_id is required"},
+		{name: "timeout not a number", config: map[string]interface{}{"site_id": "ABCDEF", "timeout": "5s"}, want: "timeout must be a positive number"},
+	})
+
+	d, err := NewFathomDispatcher(FathomConfig{SiteID: "ABCDEF", Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewFathomDispatcher: %v", err)
+	}
+	if d.config.Endpoint != defaultFathomEndpoint {
+		t.Errorf("endpoint = %s, want the default %s", d.config.Endpoint, defaultFathomEndpoint)
+	}
+}
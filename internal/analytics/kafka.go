@@ -0,0 +1,138 @@
+package analytics
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+type KafkaConfig struct {
+	Brokers []string
+	Topic   string
+	Timeout time.Duration
+
+	// Messages are batched up to BatchSize or for BatchTimeout, whichever
+	// comes first
+	BatchSize    int
+	BatchTimeout time.Duration
+
+	// SASLMechanism is "plain", "scram-sha-256" or "scram-sha-512", and
+	// SASL is disabled when empty
+	SASLMechanism string
+	Username      string
+	Password      string
+	TLS           bool
+}
+
+// kafkaProducer is the part of kafka.Writer the dispatcher uses.
+type kafkaProducer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type KafkaDispatcher struct {
+	config   KafkaConfig
+	producer kafkaProducer
+	logger   *slog.Logger
+}
+
+func NewKafkaDispatcher(config KafkaConfig, logger *slog.Logger) (*KafkaDispatcher, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers are required")
+	}
+	if config.Topic == "" {
+		return nil, fmt.Errorf("kafka topic is required")
+	}
+	if config.Timeout == 0 {
+		return nil, fmt.Errorf("kafka timeout is required")
+	}
+
+	mechanism, err := kafkaSASL(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := &kafka.Transport{
+		DialTimeout: config.Timeout,
+		SASL:        mechanism,
+	}
+	if config.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	// Writes are asynchronous so a worker doesn't wait out the batch
+	// timeout on every event. Delivery failures surface in Completion.
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Topic:        config.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    config.BatchSize,
+		BatchTimeout: config.BatchTimeout,
+		WriteTimeout: config.Timeout,
+		RequiredAcks: kafka.RequireOne,
+		Async:        true,
+		Transport:    transport,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				logger.Error("failed to deliver kafka messages",
+					"topic", config.Topic,
+					"count", len(messages),
+					"error", err)
+			}
+		},
+	}
+
+	return &KafkaDispatcher{
+		config:   config,
+		producer: writer,
+		logger:   logger,
+	}, nil
+}
+
+func kafkaSASL(config KafkaConfig) (sasl.Mechanism, error) {
+	switch config.SASLMechanism {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: config.Username, Password: config.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, config.Username, config.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, config.Username, config.Password)
+	default:
+		return nil, fmt.Errorf("unknown kafka sasl mechanism: %s", config.SASLMechanism)
+	}
+}
+
+func (k *KafkaDispatcher) Name() string {
+	return "kafka"
+}
+
+// Send queues the event on the topic, keyed by short code so a link's events
+// stay ordered within a partition.
+func (k *KafkaDispatcher) Send(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	if err := k.producer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.ShortCode),
+		Value: payload,
+	}); err != nil {
+		return fmt.Errorf("failed to produce message: %w", err)
+	}
+	return nil
+}
+
+// Close flushes pending messages and closes the producer
+func (k *KafkaDispatcher) Close() error {
+	return k.producer.Close()
+}
@@ -0,0 +1,87 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// stubProducer records the messages written to it, failing writes with err.
+type stubProducer struct {
+	err    error
+	msgs   []kafka.Message
+	closed bool
+}
+
+func (p *stubProducer) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func (p *stubProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestKafkaSend(t *testing.T) {
+	producer := &stubProducer{}
+	d := &KafkaDispatcher{config: KafkaConfig{Topic: "clicks"}, producer: producer, logger: testLogger}
+	evt := Event{Name: "pageview", ShortCode: "abc", TargetURL: "https://example.com", Platform: "ios", Providers: []string{"kafka"}}
+
+	if err := d.Send(context.Background(), evt); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(producer.msgs) != 1 {
+		t.Fatalf("%d messages produced, want 1", len(producer.msgs))
+	}
+	msg := producer.msgs[0]
+	// Keyed by short code so a link's events share a partition
+	if string(msg.Key) != "abc" {
+		t.Errorf("key = %q, want the short code", msg.Key)
+	}
+	var got Event
+	if err := json.Unmarshal(msg.Value, &got); err != nil {
+		t.Fatalf("decode message %s: %v", msg.Value, err)
+	}
+	want := evt
+	want.Providers = nil // Routing only, not part of the payload
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("message = %+v, want %+v", got, want)
+	}
+
+	producer.err = errors.New("broker down")
+	if err := d.Send(context.Background(), evt); !errors.Is(err, producer.err) {
+		t.Errorf("Send with a failing producer = %v, want its error", err)
+	}
+
+	if err := d.Close(); err != nil || !producer.closed {
+		t.Errorf("Close = %v, closed %t, want the producer closed", err, producer.closed)
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		config := map[string]interface{}{"brokers": []interface{}{"localhost:9092"}, "topic": "clicks"}
+		for k, v := range extra {
+			config[k] = v
+		}
+		return config
+	}
+	testProviderConfigs(t, "kafka", []providerConfigTest{
+		{name: "valid", config: valid(nil)},
+		{name: "scram", config: valid(map[string]interface{}{"sasl_mechanism": "scram-sha-512", "username": "u", "password": "p", "tls": true})},
+		{name: "no brokers", config: map[string]interface{}{"topic": "clicks"}, want: "brokers are required"},
+		{name: "empty broker", config: valid(map[string]interface{}{"brokers": []interface{}{""}}), want: "brokers are required"},
+		{name: "no topic", config: valid(map[string]interface{}{"topic": ""}), want: "topic is required"},
+		{name: "unknown sasl", config: valid(map[string]interface{}{"sasl_mechanism": "gssapi"}), want: "unknown kafka sasl mechanism"},
+		{name: "bad timeout", config: valid(map[string]interface{}{"timeout": int64(0)}), want: "timeout must be a positive number"},
+		{name: "timeout too long", config: valid(map[string]interface{}{"timeout": int64(3600)}), want: "must not exceed"},
+	})
+}
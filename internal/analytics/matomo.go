@@ -1,7 +1,9 @@
 package analytics
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
@@ -49,6 +51,58 @@ func (m *MatomoDispatcher) Name() string {
 }
 
 func (m *MatomoDispatcher) Send(ctx context.Context, evt Event) error {
+	params := m.trackingParams(evt)
+
+	// Set the client IP if auth token is available (required for IP tracking)
+	if m.config.AuthToken != "" {
+		if evt.UserIP != "" {
+			params.Set("cip", evt.UserIP)
+		}
+		params.Set("token_auth", m.config.AuthToken)
+	}
+
+	// Construct the final URL
+	trackingURL := fmt.Sprintf("%s?%s", m.config.TrackingURL, params.Encode())
+
+	// Create request
+	req, err := http.NewRequestWithContext(ctx, "GET", trackingURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add parameter to avoid receiving GIF image
+	params.Set("send_image", "0")
+
+	// Log all request parameters
+	m.logger.Info("sending matomo request",
+		"url", trackingURL,
+		"params", params,
+		"user_agent", evt.UserAgent,
+		"user_ip", evt.UserIP)
+
+	// Send request
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response
+	if resp.StatusCode >= 400 {
+		// Read response body for error details
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("matomo request failed with status: %d, failed to read response body: %v", resp.StatusCode, err)
+		}
+		return fmt.Errorf("matomo request failed with status: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// trackingParams builds the tracking API parameters for an event, without
+// the client IP and auth token.
+func (m *MatomoDispatcher) trackingParams(evt Event) url.Values {
 	params := url.Values{}
 
 	// Required parameters
@@ -73,48 +127,56 @@ func (m *MatomoDispatcher) Send(ctx context.Context, evt Event) error {
 	// Generate random value to avoid caching
 	params.Set("rand", strconv.FormatInt(time.Now().UnixNano(), 10))
 
-	// Set the client IP if auth token is available (required for IP tracking)
-	if m.config.AuthToken != "" {
-		if evt.UserIP != "" {
+	return params
+}
+
+// matomoBulkRequest is the body of a bulk tracking request. Each request is
+// the query string of a single tracking call.
+type matomoBulkRequest struct {
+	Requests  []string `json:"requests"`
+	TokenAuth string   `json:"token_auth,omitempty"`
+}
+
+// SendBatch sends the events in a single bulk tracking request.
+func (m *MatomoDispatcher) SendBatch(ctx context.Context, events []Event) error {
+	bulk := matomoBulkRequest{
+		Requests:  make([]string, 0, len(events)),
+		TokenAuth: m.config.AuthToken,
+	}
+	for _, evt := range events {
+		params := m.trackingParams(evt)
+		// The auth token in the body allows setting the client IP
+		if m.config.AuthToken != "" && evt.UserIP != "" {
 			params.Set("cip", evt.UserIP)
 		}
-		params.Set("token_auth", m.config.AuthToken)
+		bulk.Requests = append(bulk.Requests, "?"+params.Encode())
 	}
 
-	// Construct the final URL
-	trackingURL := fmt.Sprintf("%s?%s", m.config.TrackingURL, params.Encode())
+	jsonData, err := json.Marshal(bulk)
+	if err != nil {
+		return fmt.Errorf("failed to marshal events: %w", err)
+	}
 
-	// Create request
-	req, err := http.NewRequestWithContext(ctx, "GET", trackingURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", m.config.TrackingURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	// Add parameter to avoid receiving GIF image
-	params.Set("send_image", "0")
+	m.logger.Info("sending matomo bulk request", "count", len(events))
 
-	// Log all request parameters
-	m.logger.Info("sending matomo request",
-		"url", trackingURL,
-		"params", params,
-		"user_agent", evt.UserAgent,
-		"user_ip", evt.UserIP)
-
-	// Send request
 	resp, err := m.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Check response
 	if resp.StatusCode >= 400 {
-		// Read response body for error details
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return fmt.Errorf("matomo request failed with status: %d, failed to read response body: %v", resp.StatusCode, err)
+			return fmt.Errorf("matomo bulk request failed with status: %d, failed to read response body: %v", resp.StatusCode, err)
 		}
-		return fmt.Errorf("matomo request failed with status: %d, response: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("matomo bulk request failed with status: %d, response: %s", resp.StatusCode, string(body))
 	}
 
 	return nil
@@ -0,0 +1,124 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type NATSConfig struct {
+	Servers []string
+	Subject string
+	Timeout time.Duration
+
+	// Optional credentials: a .creds file, a user and password, or a token
+	CredsFile string
+	Username  string
+	Password  string
+	Token     string
+}
+
+// natsConn is the part of nats.Conn the dispatcher uses.
+type natsConn interface {
+	Publish(subject string, data []byte) error
+	Drain() error
+	Close()
+}
+
+type NATSDispatcher struct {
+	config NATSConfig
+	conn   natsConn
+	closed chan struct{}
+	logger *slog.Logger
+}
+
+func NewNATSDispatcher(config NATSConfig, logger *slog.Logger) (*NATSDispatcher, error) {
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("nats servers are required")
+	}
+	if config.Subject == "" {
+		return nil, fmt.Errorf("nats subject is required")
+	}
+	if config.Timeout == 0 {
+		return nil, fmt.Errorf("nats timeout is required")
+	}
+
+	d := &NATSDispatcher{
+		config: config,
+		closed: make(chan struct{}),
+		logger: logger,
+	}
+
+	// The connection is retried in the background rather than failing
+	// startup, with events published meanwhile held in the reconnect buffer
+	opts := []nats.Option{
+		nats.Name("lil"),
+		nats.Timeout(config.Timeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DrainTimeout(config.Timeout),
+		nats.ClosedHandler(func(*nats.Conn) { close(d.closed) }),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Warn("disconnected from nats", "error", err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			logger.Error("nats connection error", "error", err)
+		}),
+	}
+	switch {
+	case config.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(config.CredsFile))
+	case config.Username != "":
+		opts = append(opts, nats.UserInfo(config.Username, config.Password))
+	case config.Token != "":
+		opts = append(opts, nats.Token(config.Token))
+	}
+
+	conn, err := nats.Connect(strings.Join(config.Servers, ","), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	d.conn = conn
+	return d, nil
+}
+
+func (n *NATSDispatcher) Name() string {
+	return "nats"
+}
+
+// Send publishes the event to the subject. Publishing only buffers the
+// message, so it doesn't block the worker on the network.
+func (n *NATSDispatcher) Send(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	if err := n.conn.Publish(n.config.Subject, payload); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+// Close drains pending messages and closes the connection, waiting up to the
+// timeout for the drain to finish.
+func (n *NATSDispatcher) Close() error {
+	if err := n.conn.Drain(); err != nil {
+		n.conn.Close()
+		return err
+	}
+
+	select {
+	case <-n.closed:
+	case <-time.After(n.config.Timeout):
+		n.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stubNATSConn records the messages published on it, failing publishes with
+// err.
+type stubNATSConn struct {
+	err      error
+	subjects []string
+	payloads [][]byte
+	drained  bool
+	closed   bool
+}
+
+func (c *stubNATSConn) Publish(subject string, data []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.subjects = append(c.subjects, subject)
+	c.payloads = append(c.payloads, data)
+	return nil
+}
+
+func (c *stubNATSConn) Drain() error {
+	c.drained = true
+	return nil
+}
+
+func (c *stubNATSConn) Close() { c.closed = true }
+
+func TestNATSSend(t *testing.T) {
+	conn := &stubNATSConn{}
+	d := &NATSDispatcher{
+		config: NATSConfig{Subject: "lil.clicks", Timeout: 10 * time.Millisecond},
+		conn:   conn,
+		closed: make(chan struct{}),
+		logger: testLogger,
+	}
+	evt := Event{Name: "pageview", ShortCode: "abc", TargetURL: "https://example.com", Providers: []string{"nats"}}
+
+	if err := d.Send(context.Background(), evt); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(conn.payloads) != 1 || conn.subjects[0] != "lil.clicks" {
+		t.Fatalf("published on %v, want one message on lil.clicks", conn.subjects)
+	}
+	var got Event
+	if err := json.Unmarshal(conn.payloads[0], &got); err != nil {
+		t.Fatalf("decode message %s: %v", conn.payloads[0], err)
+	}
+	want := evt
+	want.Providers = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("message = %+v, want %+v", got, want)
+	}
+
+	conn.err = errors.New("connection closed")
+	if err := d.Send(context.Background(), evt); !errors.Is(err, conn.err) {
+		t.Errorf("Send with a failing connection = %v, want its error", err)
+	}
+
+	// Without the closed handler firing, Close gives up on the drain after
+	// the timeout and closes the connection
+	if err := d.Close(); err != nil || !conn.drained || !conn.closed {
+		t.Errorf("Close = %v, drained %t, closed %t, want both", err, conn.drained, conn.closed)
+	}
+}
+
+func TestNATSConfig(t *testing.T) {
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		config := map[string]interface{}{"servers": []interface{}{"nats://127.0.0.1:1"}, "subject": "lil.clicks", "timeout": int64(1)}
+		for k, v := range extra {
+			config[k] = v
+		}
+		return config
+	}
+	testProviderConfigs(t, "nats", []providerConfigTest{
+		// Unreachable servers are retried in the background
+		{name: "valid", config: valid(nil)},
+		{name: "no servers", config: map[string]interface{}{"subject": "lil.clicks"}, want: "servers are required"},
+		{name: "empty server", config: valid(map[string]interface{}{"servers": []interface{}{""}}), want: "servers are required"},
+		{name: "no subject", config: valid(map[string]interface{}{"subject": ""}), want: "subject is required"},
+		{name: "bad timeout", config: valid(map[string]interface{}{"timeout": "5s"}), want: "timeout must be a positive number"},
+	})
+}
@@ -0,0 +1,160 @@
+package analytics
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat stamps rotated files with the time they were rotated at.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// openFile opens log files, replaced in tests to make opening fail.
+var openFile = os.OpenFile
+
+// rotatingFile is an append-only log file that's rotated once a write would
+// take it past maxSize bytes. Rotated files keep the name with the rotation
+// time added, like access-2024-01-02T15-04-05.000.log, and are deleted once
+// they're older than maxAge. Zero maxSize or maxAge disables either.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	logger  *slog.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, logger *slog.Logger) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, logger: logger}
+	f, size, err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.file, r.size = f, size
+	// Files rotated before a restart expire too
+	r.removeExpired()
+	return r, nil
+}
+
+// open opens the log file in append mode along with the size it has.
+func (r *rotatingFile) open() (*os.File, int64, error) {
+	f, err := openFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	return f, info.Size(), nil
+}
+
+// Write appends p to the file, rotating it first when p would take it past
+// maxSize. A write is never split across files, so one larger than maxSize
+// still goes to a file of its own. When rotating fails the error is logged
+// and p goes to the current file, trying again on the next write.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			r.logger.Error("failed to rotate log file", "path", r.path, "error", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. The current file
+// is kept on failure. Callers hold mu.
+func (r *rotatingFile) rotate() error {
+	backup := r.backupName(time.Now().UTC())
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	f, size, err := r.open()
+	if err != nil {
+		// Writes carry on to the current file, which goes back to its
+		// name so the next rotation moves it aside again
+		if renameErr := os.Rename(backup, r.path); renameErr != nil {
+			r.logger.Error("failed to restore log file", "path", r.path, "backup", backup, "error", renameErr)
+		}
+		return err
+	}
+
+	if err := r.file.Close(); err != nil {
+		r.logger.Error("failed to close rotated log file", "path", backup, "error", err)
+	}
+	r.file, r.size = f, size
+
+	r.removeExpired()
+	return nil
+}
+
+// backupName returns a free name for the file rotated at t. A second rotation
+// within the same millisecond gets a counter after the time.
+func (r *rotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext) + "-" + t.Format(backupTimeFormat)
+	name := base + ext
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = base + "." + strconv.Itoa(n) + ext
+	}
+}
+
+// removeExpired deletes rotated files older than maxAge, going by the time in
+// their name.
+func (r *rotatingFile) removeExpired() {
+	if r.maxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(r.path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-r.maxAge)
+	for _, name := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if len(stamp) > len(backupTimeFormat) {
+			stamp = stamp[:len(backupTimeFormat)]
+		}
+		rotatedAt, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil || !rotatedAt.Before(cutoff) {
+			continue
+		}
+		os.Remove(name)
+	}
+}
+
+// Close flushes the file to disk and closes it.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.file.Sync(); err != nil {
+		r.file.Close()
+		return fmt.Errorf("failed to flush log file: %w", err)
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,191 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLines returns the lines in the file at path.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+// backups lists the rotated files next to path, oldest first. Files rotated
+// within the same millisecond sort by their counter.
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	ext := filepath.Ext(path)
+	matches, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	slices.SortFunc(matches, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, ext), strings.TrimSuffix(b, ext))
+	})
+	return matches
+}
+
+func TestAccessLogJSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	d, err := NewAccessLogDispatcher(AccessLogConfig{FilePath: path, Format: AccessLogJSONL}, testLogger)
+	if err != nil {
+		t.Fatalf("NewAccessLogDispatcher: %v", err)
+	}
+
+	sent := []Event{
+		{Name: "redirect", ShortCode: "a", TargetURL: "https://example.com/a", UserIP: "192.0.2.1"},
+		{Name: "redirect", ShortCode: "b", TargetURL: "https://example.com/b", Referrer: `say "hi"`, Providers: []string{"accesslog"}},
+	}
+	for _, evt := range sent {
+		if err := d.Send(context.Background(), evt); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	lines := readLines(t, path)
+	if len(lines) != len(sent) {
+		t.Fatalf("wrote %d lines, want %d", len(lines), len(sent))
+	}
+	for i, line := range lines {
+		var got Event
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d %q isn't JSON: %v", i+1, line, err)
+		}
+		want := sent[i]
+		want.Providers = nil // Not logged
+		if !slices.Equal(got.Providers, want.Providers) || got.Name != want.Name || got.ShortCode != want.ShortCode ||
+			got.TargetURL != want.TargetURL || got.UserIP != want.UserIP || got.Referrer != want.Referrer {
+			t.Errorf("line %d = %+v, want %+v", i+1, got, want)
+		}
+	}
+}
+
+func TestRotateOnSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(path, 20, 0, testLogger)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+
+	writes := []string{
+		"0123456789\n",            // 11 bytes, fits
+		"abcdefgh\n",              // 20, fits exactly
+		"x\n",                     // Would be 22, rotates
+		"this line is too long\n", // Would be 24, rotates and has a file of its own
+		"y\n",                     // Rotates again
+	}
+	for _, w := range writes {
+		if _, err := r.Write([]byte(w)); err != nil {
+			t.Fatalf("Write(%q): %v", w, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rotated := backups(t, path)
+	want := [][]string{
+		{"0123456789", "abcdefgh"},
+		{"x"},
+		{"this line is too long"},
+	}
+	if len(rotated) != len(want) {
+		t.Fatalf("rotated files %v, want %d", rotated, len(want))
+	}
+	for i, name := range rotated {
+		if got := readLines(t, name); !slices.Equal(got, want[i]) {
+			t.Errorf("%s has %q, want %q", filepath.Base(name), got, want[i])
+		}
+	}
+	if got := readLines(t, path); !slices.Equal(got, []string{"y"}) {
+		t.Errorf("current file has %q, want [y]", got)
+	}
+}
+
+func TestRemoveExpiredOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	now := time.Now().UTC()
+	old := filepath.Join(dir, "access-"+now.Add(-10*24*time.Hour).Format(backupTimeFormat)+".log")
+	recent := filepath.Join(dir, "access-"+now.Add(-24*time.Hour).Format(backupTimeFormat)+".log")
+	other := filepath.Join(dir, "access-notes.log")
+	for _, name := range []string{old, recent, other} {
+		if err := os.WriteFile(name, []byte("line\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	r, err := openRotatingFile(path, 0, 7*24*time.Hour, testLogger)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	defer r.Close()
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("backup from 10 days ago still there after opening (%v)", err)
+	}
+	for _, name := range []string{recent, other} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s removed: %v", filepath.Base(name), err)
+		}
+	}
+}
+
+func TestRotateFailureKeepsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(path, 10, 0, testLogger)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	defer r.Close()
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatalf("Write(%q): %v", s, err)
+		}
+	}
+
+	openFile = func(string, int, os.FileMode) (*os.File, error) {
+		return nil, errors.New("disk full")
+	}
+	t.Cleanup(func() { openFile = os.OpenFile })
+
+	write("aaaaaaaa\n")
+	write("bbbbbbbb\n") // Rotation fails, still written
+	if rotated := backups(t, path); len(rotated) != 0 {
+		t.Errorf("rotated files %v left behind after rotating failed", rotated)
+	}
+	if got := readLines(t, path); !slices.Equal(got, []string{"aaaaaaaa", "bbbbbbbb"}) {
+		t.Errorf("file has %q after rotating failed, want both lines", got)
+	}
+
+	// Rotation is tried again on the next write
+	openFile = os.OpenFile
+	write("cccccccc\n")
+	rotated := backups(t, path)
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files %v, want 1", rotated)
+	}
+	if got := readLines(t, rotated[0]); !slices.Equal(got, []string{"aaaaaaaa", "bbbbbbbb"}) {
+		t.Errorf("rotated file has %q, want the first two lines", got)
+	}
+	if got := readLines(t, path); !slices.Equal(got, []string{"cccccccc"}) {
+		t.Errorf("current file has %q, want [cccccccc]", got)
+	}
+}
@@ -0,0 +1,130 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const defaultSegmentEndpoint = "https://api.segment.io/v1/track"
+
+type SegmentConfig struct {
+	WriteKey string
+	Endpoint string // Defaults to Segment's track API
+	Timeout  time.Duration
+}
+
+type SegmentDispatcher struct {
+	config SegmentConfig
+	client *http.Client
+	logger *slog.Logger
+}
+
+type segmentTrack struct {
+	AnonymousID string            `json:"anonymousId"`
+	Event       string            `json:"event"`
+	Properties  segmentProperties `json:"properties"`
+	Context     segmentContext    `json:"context"`
+	Timestamp   string            `json:"timestamp,omitempty"`
+}
+
+type segmentProperties struct {
+	ShortCode string `json:"short_code"`
+	TargetURL string `json:"target_url"`
+	Referrer  string `json:"referrer,omitempty"`
+	UA        string `json:"ua,omitempty"`
+	Platform  string `json:"platform,omitempty"`
+}
+
+type segmentContext struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+func NewSegmentDispatcher(config SegmentConfig, logger *slog.Logger) (*SegmentDispatcher, error) {
+	if config.WriteKey == "" {
+		return nil, fmt.Errorf("segment write key is required")
+	}
+	if config.Timeout == 0 {
+		return nil, fmt.Errorf("segment timeout is required")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = defaultSegmentEndpoint
+	}
+
+	return &SegmentDispatcher{
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+		},
+		logger: logger,
+	}, nil
+}
+
+func (s *SegmentDispatcher) Name() string {
+	return "segment"
+}
+
+func (s *SegmentDispatcher) Send(ctx context.Context, evt Event) error {
+	track := segmentTrack{
+		AnonymousID: segmentAnonymousID(evt),
+		Event:       "Link Redirected",
+		Properties: segmentProperties{
+			ShortCode: evt.ShortCode,
+			TargetURL: evt.TargetURL,
+			Referrer:  evt.Referrer,
+			UA:        evt.UserAgent,
+			Platform:  evt.Platform,
+		},
+		Context: segmentContext{
+			IP:        evt.UserIP,
+			UserAgent: evt.UserAgent,
+		},
+		Timestamp: evt.Timestamp,
+	}
+
+	jsonData, err := json.Marshal(track)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.config.Endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Segment takes the write key as the basic auth username
+	req.SetBasicAuth(s.config.WriteKey, "")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("segment request failed with status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// segmentAnonymousID derives a stable anonymous ID for the visitor, since
+// Segment rejects track calls without a user or anonymous ID. The IP and user
+// agent are hashed so neither is sent as the ID itself.
+func segmentAnonymousID(evt Event) string {
+	sum := sha256.Sum256([]byte(evt.UserIP + "|" + evt.UserAgent))
+	return hex.EncodeToString(sum[:16])
+}
+
+// noop
+func (s *SegmentDispatcher) Close() error {
+	return nil
+}
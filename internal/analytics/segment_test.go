@@ -0,0 +1,126 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// providerRequest is a request received by a test provider endpoint.
+type providerRequest struct {
+	method string
+	header http.Header
+	query  url.Values
+	body   []byte
+}
+
+// newProviderEndpoint starts a server answering every request with status,
+// and returns its URL and the requests it receives.
+func newProviderEndpoint(t *testing.T, status int) (string, <-chan providerRequest) {
+	reqs := make(chan providerRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+		reqs <- providerRequest{method: r.Method, header: r.Header, query: r.URL.Query(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, reqs
+}
+
+// testEvent is a redirect event as the server tracks it.
+var testEvent = Event{
+	Name:      "pageview",
+	Domain:    "lil.test",
+	URL:       "https://lil.test/abc",
+	Referrer:  "https://news.example/post",
+	UserAgent: "Mozilla/5.0 (iPhone)",
+	UserIP:    "203.0.113.7",
+	Timestamp: "2024-05-01T12:00:00Z",
+	ShortCode: "abc",
+	TargetURL: "https://example.com/landing",
+	Platform:  "ios",
+}
+
+func TestSegmentSend(t *testing.T) {
+	endpoint, reqs := newProviderEndpoint(t, http.StatusOK)
+	d, err := NewSegmentDispatcher(SegmentConfig{WriteKey: "wk", Endpoint: endpoint, Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewSegmentDispatcher: %v", err)
+	}
+	if err := d.Send(context.Background(), testEvent); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	req := <-reqs
+	if user, _, ok := (&http.Request{Header: req.header}).BasicAuth(); !ok || user != "wk" {
+		t.Errorf("basic auth user = %q, want the write key", user)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatalf("decode body %s: %v", req.body, err)
+	}
+	want := map[string]interface{}{
+		"anonymousId": segmentAnonymousID(testEvent),
+		"event":       "Link Redirected",
+		"properties": map[string]interface{}{
+			"short_code": "abc",
+			"target_url": "https://example.com/landing",
+			"referrer":   "https://news.example/post",
+			"ua":         "Mozilla/5.0 (iPhone)",
+			"platform":   "ios",
+		},
+		"context": map[string]interface{}{
+			"ip":        "203.0.113.7",
+			"userAgent": "Mozilla/5.0 (iPhone)",
+		},
+		"timestamp": "2024-05-01T12:00:00Z",
+	}
+	if gotJSON, wantJSON := mustJSON(t, got), mustJSON(t, want); gotJSON != wantJSON {
+		t.Errorf("body = %s, want %s", gotJSON, wantJSON)
+	}
+
+	// The anonymous ID is stable per visitor without containing the IP
+	other := testEvent
+	other.UserIP = "203.0.113.8"
+	if id := segmentAnonymousID(testEvent); id == segmentAnonymousID(other) || strings.Contains(id, "203.0.113.7") {
+		t.Errorf("anonymous ID %q isn't a per visitor hash", id)
+	}
+}
+
+func TestSegmentSendFailure(t *testing.T) {
+	endpoint, _ := newProviderEndpoint(t, http.StatusUnauthorized)
+	d, err := NewSegmentDispatcher(SegmentConfig{WriteKey: "wk", Endpoint: endpoint, Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewSegmentDispatcher: %v", err)
+	}
+	if err := d.Send(context.Background(), testEvent); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Send = %v, want the failed status", err)
+	}
+}
+
+func TestSegmentConfig(t *testing.T) {
+	testProviderConfigs(t, "segment", []providerConfigTest{
+		{name: "valid", config: map[string]interface{}{"write_key": "wk"}},
+		{name: "no write key", config: map[string]interface{}{"endpoint": "https://segment.example"}, want: "write_key is required"},
+		{name: "bad timeout", config: map[string]interface{}{"write_key": "wk", "timeout": int64(-1)}, want: "timeout must be a positive number"},
+	})
+}
+
+// mustJSON encodes v with sorted keys, for comparing decoded payloads.
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("encode %v: %v", v, err)
+	}
+	return string(b)
+}
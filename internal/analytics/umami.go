@@ -0,0 +1,107 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type UmamiConfig struct {
+	Endpoint  string // Base URL of the Umami instance, events go to <Endpoint>/api/send
+	WebsiteID string
+	Timeout   time.Duration
+}
+
+type UmamiDispatcher struct {
+	config  UmamiConfig
+	sendURL string
+	client  *http.Client
+	logger  *slog.Logger
+}
+
+type umamiEvent struct {
+	Type    string       `json:"type"`
+	Payload umamiPayload `json:"payload"`
+}
+
+type umamiPayload struct {
+	Website  string `json:"website"`
+	Hostname string `json:"hostname"`
+	URL      string `json:"url"`
+	Referrer string `json:"referrer,omitempty"`
+}
+
+func NewUmamiDispatcher(config UmamiConfig, logger *slog.Logger) (*UmamiDispatcher, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("umami endpoint is required")
+	}
+	if config.WebsiteID == "" {
+		return nil, fmt.Errorf("umami website ID is required")
+	}
+	if config.Timeout == 0 {
+		return nil, fmt.Errorf("umami timeout is required")
+	}
+
+	return &UmamiDispatcher{
+		config:  config,
+		sendURL: strings.TrimSuffix(config.Endpoint, "/") + "/api/send",
+		client: &http.Client{
+			Timeout: config.Timeout,
+		},
+		logger: logger,
+	}, nil
+}
+
+func (u *UmamiDispatcher) Name() string {
+	return "umami"
+}
+
+func (u *UmamiDispatcher) Send(ctx context.Context, evt Event) error {
+	umEvent := umamiEvent{
+		Type: "event",
+		Payload: umamiPayload{
+			Website:  u.config.WebsiteID,
+			Hostname: evt.Domain,
+			URL:      "/" + evt.ShortCode,
+			Referrer: evt.Referrer,
+		},
+	}
+
+	jsonData, err := json.Marshal(umEvent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.sendURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Umami ignores requests without a browser user agent, and takes the
+	// visitor's location from the forwarded IP
+	req.Header.Set("User-Agent", evt.UserAgent)
+	req.Header.Set("X-Forwarded-For", evt.UserIP)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("umami request failed with status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// noop
+func (u *UmamiDispatcher) Close() error {
+	return nil
+}
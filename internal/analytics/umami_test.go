@@ -0,0 +1,73 @@
+package analytics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUmamiSend(t *testing.T) {
+	endpoint, reqs := newProviderEndpoint(t, http.StatusOK)
+	// A trailing slash on the instance URL doesn't double up in the path
+	d, err := NewUmamiDispatcher(UmamiConfig{Endpoint: endpoint + "/", WebsiteID: "site-1", Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewUmamiDispatcher: %v", err)
+	}
+	if d.sendURL != endpoint+"/api/send" {
+		t.Errorf("send URL = %s, want %s/api/send", d.sendURL, endpoint)
+	}
+	if err := d.Send(context.Background(), testEvent); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	req := <-reqs
+	for header, want := range map[string]string{
+		"User-Agent":      testEvent.UserAgent,
+		"X-Forwarded-For": testEvent.UserIP,
+		"Content-Type":    "application/json",
+	} {
+		if got := req.header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	want := `{"type":"event","payload":{"website":"site-1","hostname":"lil.test","url":"/abc","referrer":"https://news.example/post"}}`
+	if string(req.body) != want {
+		t.Errorf("body = %s, want %s", req.body, want)
+	}
+
+	// The referrer is left out for direct visits
+	direct := testEvent
+	direct.Referrer = ""
+	if err := d.Send(context.Background(), direct); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if req := <-reqs; strings.Contains(string(req.body), "referrer") {
+		t.Errorf("body = %s, want no referrer", req.body)
+	}
+}
+
+func TestUmamiSendFailure(t *testing.T) {
+	endpoint, _ := newProviderEndpoint(t, http.StatusBadRequest)
+	d, err := NewUmamiDispatcher(UmamiConfig{Endpoint: endpoint, WebsiteID: "site-1", Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewUmamiDispatcher: %v", err)
+	}
+	if err := d.Send(context.Background(), testEvent); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Send = %v, want the failed status", err)
+	}
+}
+
+func TestUmamiConfig(t *testing.T) {
+	testProviderConfigs(t, "umami", []providerConfigTest{
+		{name: "valid", config: map[string]interface{}{"endpoint": "https://umami.example", "website_id": "site-1"}},
+		{name: "no endpoint", config: map[string]interface{}{"website_id": "site-1"}, want: "endpoint is required"},
+		{name: "no website", config: map[string]interface{}{"endpoint": "https://umami.example"}, want: "website_id is required"},
+		{
+			name:   "timeout too long",
+			config: map[string]interface{}{"endpoint": "https://umami.example", "website_id": "site-1", "timeout": int64(3600)},
+			want:   "timeout must not exceed",
+		},
+	})
+}
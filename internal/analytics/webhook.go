@@ -3,6 +3,9 @@ package analytics
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log/slog"
@@ -10,10 +13,17 @@ import (
 	"time"
 )
 
+// SignatureHeader carries the signature of webhook requests when a secret is
+// configured.
+const SignatureHeader = "X-Lil-Signature"
+
 type WebhookConfig struct {
 	Endpoint string
 	Timeout  time.Duration
 	Headers  map[string]string
+
+	// Secret signs requests with an HMAC-SHA256 in SignatureHeader when set
+	Secret string
 }
 
 type WebhookDispatcher struct {
@@ -44,7 +54,16 @@ func (w *WebhookDispatcher) Name() string {
 }
 
 func (w *WebhookDispatcher) Send(ctx context.Context, event Event) error {
-	payload, err := json.Marshal(event)
+	return w.post(ctx, event)
+}
+
+// SendBatch posts the events as a JSON array.
+func (w *WebhookDispatcher) SendBatch(ctx context.Context, events []Event) error {
+	return w.post(ctx, events)
+}
+
+func (w *WebhookDispatcher) post(ctx context.Context, body interface{}) error {
+	payload, err := json.Marshal(body)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
@@ -64,6 +83,10 @@ func (w *WebhookDispatcher) Send(ctx context.Context, event Event) error {
 		req.Header.Set(k, v)
 	}
 
+	if w.config.Secret != "" {
+		req.Header.Set(SignatureHeader, w.signature(payload, time.Now()))
+	}
+
 	resp, err := w.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
@@ -77,6 +100,18 @@ func (w *WebhookDispatcher) Send(ctx context.Context, event Event) error {
 	return nil
 }
 
+// signature returns the SignatureHeader value for a request body sent at t,
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">". The
+// timestamp is signed along with the body so receivers can reject replays of
+// old requests.
+func (w *WebhookDispatcher) signature(body []byte, t time.Time) string {
+	ts := t.Unix()
+	mac := hmac.New(sha256.New, []byte(w.config.Secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
 // noop
 func (w *WebhookDispatcher) Close() error {
 	return nil
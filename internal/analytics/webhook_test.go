@@ -0,0 +1,108 @@
+package analytics
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by a test webhook endpoint.
+type webhookRequest struct {
+	signature string
+	body      []byte
+}
+
+func newWebhookEndpoint(t *testing.T) (string, <-chan webhookRequest) {
+	reqs := make(chan webhookRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading webhook body: %v", err)
+		}
+		reqs <- webhookRequest{signature: r.Header.Get(SignatureHeader), body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, reqs
+}
+
+// verifySignature checks header the way a receiver would, returning the
+// signed timestamp.
+func verifySignature(t *testing.T, secret, header string, body []byte) time.Time {
+	t.Helper()
+	ts, sig, ok := strings.Cut(header, ",")
+	if !ok || !strings.HasPrefix(ts, "t=") || !strings.HasPrefix(sig, "v1=") {
+		t.Fatalf("%s = %q, want t=<unix seconds>,v1=<signature>", SignatureHeader, header)
+	}
+	ts, sig = strings.TrimPrefix(ts, "t="), strings.TrimPrefix(sig, "v1=")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		t.Fatalf("signature timestamp %q: %v", ts, err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + string(body)))
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		t.Errorf("signature %q doesn't match the HMAC of %q", sig, ts+"."+string(body))
+	}
+	return time.Unix(unix, 0)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	const secret = "s3cret"
+	endpoint, reqs := newWebhookEndpoint(t)
+	d, err := NewWebhookDispatcher(WebhookConfig{Endpoint: endpoint, Timeout: time.Second, Secret: secret}, testLogger)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher: %v", err)
+	}
+	ctx := context.Background()
+	evt := Event{Name: "redirect", ShortCode: "a", TargetURL: "https://example.com/a"}
+
+	for _, tc := range []struct {
+		name string
+		send func() error
+		want interface{} // What the body decodes into
+	}{
+		{"single", func() error { return d.Send(ctx, evt) }, &Event{}},
+		{"batch", func() error { return d.SendBatch(ctx, []Event{evt, evt}) }, &[]Event{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := time.Now().Truncate(time.Second)
+			if err := tc.send(); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			req := <-reqs
+
+			signedAt := verifySignature(t, secret, req.signature, req.body)
+			if signedAt.Before(before) || signedAt.After(time.Now()) {
+				t.Errorf("signed at %v, want the time of sending", signedAt)
+			}
+			if err := json.Unmarshal(req.body, tc.want); err != nil {
+				t.Errorf("body %s doesn't decode into %T: %v", req.body, tc.want, err)
+			}
+		})
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	endpoint, reqs := newWebhookEndpoint(t)
+	d, err := NewWebhookDispatcher(WebhookConfig{Endpoint: endpoint, Timeout: time.Second}, testLogger)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher: %v", err)
+	}
+	if err := d.Send(context.Background(), Event{ShortCode: "a"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if req := <-reqs; req.signature != "" {
+		t.Errorf("%s = %q without a secret, want none", SignatureHeader, req.signature)
+	}
+}
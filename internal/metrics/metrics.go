@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"fmt"
+
 	"github.com/VictoriaMetrics/metrics"
 )
 
@@ -17,6 +19,75 @@ var (
 	// Counter for failed redirects (404s, expired URLs)
 	RedirectFailuresTotal = metrics.NewCounter(`lil_redirect_failures_total`)
 
+	// Counter for creates that found no free random code of a length within
+	// the allowed attempts, a sign the code space is filling up
+	CodeAttemptsExhaustedTotal = metrics.NewCounter(`lil_code_attempts_exhausted_total`)
+
+	// Counter for panics recovered in HTTP handlers
+	PanicsTotal = metrics.NewCounter(`lil_panics_total`)
+
 	// Gauge for number of URLs in store
 	URLsStoredGauge = metrics.NewGauge(`lil_urls_stored_total`, nil)
+
+	// Counters for lookups read from the database because the bounded cache
+	// didn't hold the URL, and for URLs evicted to make room
+	CacheMissesTotal    = metrics.NewCounter(`lil_cache_misses_total`)
+	CacheEvictionsTotal = metrics.NewCounter(`lil_cache_evictions_total`)
+
+	// Gauge for the size of the SQLite WAL file in bytes
+	WALSizeBytes = metrics.NewGauge(`lil_db_wal_size_bytes`, nil)
+
+	// Histogram of redirect handling latency
+	RedirectDuration = metrics.NewHistogram(`lil_redirect_duration_seconds`)
+
+	// Histogram of shorten request handling latency
+	CreateDuration = metrics.NewHistogram(`lil_create_duration_seconds`)
+
+	// Histogram of write buffer flush latency
+	FlushDuration = metrics.NewHistogram(`lil_db_flush_duration_seconds`)
+
+	// Histogram of link ages (time since creation), recomputed periodically
+	LinkAgeSeconds = metrics.NewHistogram(`lil_link_age_seconds`)
+
+	// Histogram of time left until expiry for links that expire, recomputed periodically
+	LinkTimeToExpirySeconds = metrics.NewHistogram(`lil_link_time_to_expiry_seconds`)
+
+	// Counter for write buffer batches lost because flushing them kept failing
+	FlushBatchesDroppedTotal = metrics.NewCounter(`lil_flush_batches_dropped_total`)
+
+	// Counter for store change events dropped because no consumer kept up
+	ChangeEventsDroppedTotal = metrics.NewCounter(`lil_store_change_events_dropped_total`)
+
+	// Counter for analytics events dropped because the event queue was full
+	AnalyticsEventsDroppedTotal = metrics.NewCounter(`lil_analytics_events_dropped_total`)
+
+	// Gauge for number of analytics events waiting in the queue
+	AnalyticsQueueDepth = metrics.NewGauge(`lil_analytics_queue_depth`, nil)
+
+	// Gauge for the highest analytics queue depth observed since startup
+	AnalyticsQueueDepthMax = metrics.NewGauge(`lil_analytics_queue_depth_max`, nil)
 )
+
+// GeneratedCodesByLength returns the counter of random short codes generated with the given length
+func GeneratedCodesByLength(length int) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`lil_generated_codes_total{length="%d"}`, length))
+}
+
+// RedirectsByPlatform returns the redirect counter for the given client platform
+func RedirectsByPlatform(platform string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`lil_redirects_by_platform_total{platform=%q}`, platform))
+}
+
+// AnalyticsCircuitState returns the gauge of an analytics provider's circuit
+// breaker state: 0 closed, 1 open, 2 half-open
+func AnalyticsCircuitState(provider string) *metrics.Gauge {
+	return metrics.GetOrCreateGauge(fmt.Sprintf(`lil_analytics_circuit_state{provider=%q}`, provider), nil)
+}
+
+// WatchWriteBuffer exports the number of URLs in the write buffer and of
+// batches waiting for the flush worker, read through the given functions on
+// every scrape.
+func WatchWriteBuffer(bufferLen, queuedBatches func() int) {
+	metrics.GetOrCreateGauge(`lil_write_buffer_length`, func() float64 { return float64(bufferLen()) })
+	metrics.GetOrCreateGauge(`lil_flush_queue_depth`, func() float64 { return float64(queuedBatches()) })
+}
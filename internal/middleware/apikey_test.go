@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// okHandler answers every request it gets with 200.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// rejectWith returns a handler answering with code, like the handlers the
+// server passes for rejected requests.
+func rejectWith(code int) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	handler := APIKey([]string{"first-key", "second-key"}, "admin", "hunter2", rejectWith(http.StatusUnauthorized))(okHandler)
+
+	tests := []struct {
+		name     string
+		header   map[string]string
+		user     string // Basic auth, when set
+		password string
+		want     int
+	}{
+		{name: "bearer key", header: map[string]string{"Authorization": "Bearer first-key"}, want: http.StatusOK},
+		{name: "lowercase bearer", header: map[string]string{"Authorization": "bearer second-key"}, want: http.StatusOK},
+		{name: "X-API-Key header", header: map[string]string{"X-API-Key": "second-key"}, want: http.StatusOK},
+		{name: "wrong key", header: map[string]string{"Authorization": "Bearer third-key"}, want: http.StatusUnauthorized},
+		{name: "key prefix", header: map[string]string{"X-API-Key": "first"}, want: http.StatusUnauthorized},
+		{name: "missing key", want: http.StatusUnauthorized},
+		{name: "empty bearer", header: map[string]string{"Authorization": "Bearer "}, want: http.StatusUnauthorized},
+		{name: "admin basic auth", user: "admin", password: "hunter2", want: http.StatusOK},
+		{name: "wrong admin password", user: "admin", password: "hunter3", want: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/urls", nil)
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			if tc.user != "" {
+				r.SetBasicAuth(tc.user, tc.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+			// Browsers are asked for the admin credentials
+			if challenged := w.Header().Get("WWW-Authenticate") != ""; challenged != (tc.want == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q with status %d", w.Header().Get("WWW-Authenticate"), w.Code)
+			}
+		})
+	}
+}
+
+func TestAPIKeyDisabled(t *testing.T) {
+	handler := APIKey(nil, "admin", "hunter2", rejectWith(http.StatusUnauthorized))(okHandler)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/urls", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d without keys configured, want 200", w.Code)
+	}
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import "net/http"
+
+// BodyLimit middleware caps request bodies at maxBytes. Requests declaring a
+// larger Content-Length are handed to onTooLarge without being read. Bodies
+// streamed past the limit fail to read with an *http.MaxBytesError, which
+// handlers are expected to answer the same way. It's a no-op when maxBytes
+// isn't positive.
+func BodyLimit(maxBytes int64, onTooLarge func(http.ResponseWriter, *http.Request)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if maxBytes <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				// The connection can't be reused with the body left unread
+				w.Header().Set("Connection", "close")
+				onTooLarge(w, r)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// Compress middleware gzips responses for clients sending "Accept-Encoding:
+// gzip". Bodies smaller than minSize bytes, responses with a Content-Encoding
+// already and content types that don't compress well, such as images, are sent
+// as they are. Strong ETags are weakened on compressed responses, and 304s
+// to clients accepting gzip, since the bytes differ from the uncompressed ones.
+func Compress(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, minSize: minSize}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// compressible reports whether a content type is worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until minSize bytes are
+// written or the handler is done, then sends it either gzipped or as is.
+type compressWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	// Informational responses go out straight away, the final one is held
+	// back with the body
+	if cw.decided || code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// start sends the headers and the buffered body, compressing them when
+// compress is set and the response is fit for it.
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	compress = compress && h.Get("Content-Encoding") == "" && bodyAllowed(status) && compressible(h.Get("Content-Type"))
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		cw.gz = gzipWriters.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+	// A 304 confirms the ETag the client got, likely with a compressed body
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") && (compress || status == http.StatusNotModified) {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.gz != nil {
+		_, err := cw.gz.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends what's written so far, for streamed responses.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.start(len(cw.buf) > 0)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close sends a response still held back, which is smaller than minSize, as
+// is and finishes a compressed one.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		// Handlers that wrote nothing, like redirects without a body,
+		// answer with their status alone
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return
+		}
+		cw.start(false)
+		return
+	}
+	if cw.gz != nil {
+		cw.gz.Close()
+		cw.gz.Reset(nil)
+		gzipWriters.Put(cw.gz)
+		cw.gz = nil
+	}
+}
+
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
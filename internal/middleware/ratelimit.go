@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTTL is how long a client's bucket is kept after its last request.
+// Buckets refill well within it, so dropping them afterwards is unnoticeable.
+const limiterIdleTTL = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimit middleware applies a token bucket per client, as identified by
+// key, refilling at limit requests per second up to burst. Requests over the
+// limit get a Retry-After header and are handed to onLimited. It's a no-op
+// when limit or burst isn't positive.
+func RateLimit(limit float64, burst int, key func(*http.Request) string, onLimited func(http.ResponseWriter, *http.Request)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 || burst <= 0 {
+			return next
+		}
+
+		var (
+			mu        sync.Mutex
+			clients   = make(map[string]*clientLimiter)
+			lastSweep = time.Now()
+		)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			k := key(r)
+
+			mu.Lock()
+			// Drop idle clients now and then so the map doesn't grow unbounded
+			if now.Sub(lastSweep) > limiterIdleTTL {
+				for ck, c := range clients {
+					if now.Sub(c.lastSeen) > limiterIdleTTL {
+						delete(clients, ck)
+					}
+				}
+				lastSweep = now
+			}
+			c, ok := clients[k]
+			if !ok {
+				c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+				clients[k] = c
+			}
+			c.lastSeen = now
+			res := c.limiter.ReserveN(now, 1)
+			delay := res.DelayFrom(now)
+			if delay > 0 {
+				// Give the token back, the request isn't going to wait for it
+				res.CancelAt(now)
+			}
+			mu.Unlock()
+
+			if delay > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				onLimited(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
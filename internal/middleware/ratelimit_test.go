@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	const (
+		limit = 20 // Per second, so a token every 50ms
+		burst = 3
+	)
+	byClient := func(r *http.Request) string { return r.Header.Get("X-Client") }
+	handler := RateLimit(limit, burst, byClient, rejectWith(http.StatusTooManyRequests))(okHandler)
+
+	send := func(client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/shorten", nil)
+		r.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < burst; i++ {
+		if w := send("a"); w.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status = %d, want 200", i+1, w.Code)
+		}
+	}
+	w := send("a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1 (rounded up to a second)", got)
+	}
+
+	// Buckets are per client
+	if w := send("b"); w.Code != http.StatusOK {
+		t.Errorf("other client: status = %d, want 200", w.Code)
+	}
+
+	// Limited requests don't take a token, so the bucket refills at the
+	// configured rate
+	time.Sleep(2 * time.Second / limit)
+	if w := send("a"); w.Code != http.StatusOK {
+		t.Errorf("after refilling: status = %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	handler := RateLimit(0, 0, func(*http.Request) string { return "" }, rejectWith(http.StatusTooManyRequests))(okHandler)
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/shorten", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d without a limit, want 200", i+1, w.Code)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+// Recover middleware catches panics in downstream handlers, logs them with a
+// stack trace and hands the response over to onPanic instead of letting
+// net/http drop the connection.
+func Recover(logger *slog.Logger, onPanic func(http.ResponseWriter, *http.Request)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				// Deliberate aborts are net/http's way of cutting a response short
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				metrics.PanicsTotal.Inc()
+				logger.Error("recovered from panic",
+					"panic", rec,
+					"method", r.Method,
+					"path", r.URL.Path,
+					"stack", string(debug.Stack()))
+				onPanic(w, r)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// Restrict middleware only lets through requests carrying one of tokens, sent
+// as "Authorization: Bearer <token>" or in the X-API-Key header, or coming from
+// one of networks. clientIP resolves the address checked against networks.
+// Other requests are handed to onForbidden. It's a no-op when neither tokens
+// nor networks are configured.
+func Restrict(tokens []string, networks []*net.IPNet, clientIP func(*http.Request) string, onForbidden func(http.ResponseWriter, *http.Request)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(tokens) == 0 && len(networks) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(tokens) > 0 {
+				if token := requestAPIKey(r); token != "" && validAPIKey(tokens, token) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if len(networks) > 0 && inNetworks(clientIP(r), networks) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			onForbidden(w, r)
+		})
+	}
+}
+
+func inNetworks(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRestrict(t *testing.T) {
+	_, office, _ := net.ParseCIDR("192.0.2.0/24")
+	_, monitor, _ := net.ParseCIDR("2001:db8::10/128")
+	networks := []*net.IPNet{office, monitor}
+	remoteIP := func(r *http.Request) string {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	}
+
+	tests := []struct {
+		name       string
+		tokens     []string
+		networks   []*net.IPNet
+		remoteAddr string
+		header     map[string]string
+		want       int
+	}{
+		{name: "bearer token", tokens: []string{"scrape"}, header: map[string]string{"Authorization": "Bearer scrape"}, want: http.StatusOK},
+		{name: "X-API-Key token", tokens: []string{"scrape"}, header: map[string]string{"X-API-Key": "scrape"}, want: http.StatusOK},
+		{name: "wrong token", tokens: []string{"scrape"}, header: map[string]string{"Authorization": "Bearer guess"}, want: http.StatusForbidden},
+		{name: "missing token", tokens: []string{"scrape"}, want: http.StatusForbidden},
+		{name: "address in CIDR", networks: networks, remoteAddr: "192.0.2.44:9000", want: http.StatusOK},
+		{name: "single IPv6 address", networks: networks, remoteAddr: "[2001:db8::10]:9000", want: http.StatusOK},
+		{name: "address outside CIDR", networks: networks, remoteAddr: "198.51.100.1:9000", want: http.StatusForbidden},
+		{name: "neighbour of single address", networks: networks, remoteAddr: "[2001:db8::11]:9000", want: http.StatusForbidden},
+		{
+			name:       "token from outside networks",
+			tokens:     []string{"scrape"},
+			networks:   networks,
+			remoteAddr: "198.51.100.1:9000",
+			header:     map[string]string{"Authorization": "Bearer scrape"},
+			want:       http.StatusOK,
+		},
+		{name: "network without token", tokens: []string{"scrape"}, networks: networks, remoteAddr: "192.0.2.44:9000", want: http.StatusOK},
+		{name: "unprotected", remoteAddr: "198.51.100.1:9000", want: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := Restrict(tc.tokens, tc.networks, remoteIP, rejectWith(http.StatusForbidden))(okHandler)
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.remoteAddr != "" {
+				r.RemoteAddr = tc.remoteAddr
+			}
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
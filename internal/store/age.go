@@ -0,0 +1,66 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	lilmetrics "github.com/mr-karan/lil/internal/metrics"
+)
+
+// linkAgeWorker periodically recomputes the link age and time-to-expiry
+// distributions. It scans the whole urls table, so it runs off the request
+// path at a configurable interval.
+func (s *Store) linkAgeWorker(interval time.Duration) {
+	defer s.bg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.updateLinkAgeMetrics()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.updateLinkAgeMetrics()
+		}
+	}
+}
+
+// updateLinkAgeMetrics fills fresh histograms from the table and swaps them
+// into the exported ones, so scrapes see a snapshot of the latest pass.
+func (s *Store) updateLinkAgeMetrics() {
+	rows, err := s.db.Query(`SELECT created_at, expires_at FROM urls`)
+	if err != nil {
+		s.logger.Error("failed to query link ages", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	var age, ttl metrics.Histogram
+	now := time.Now()
+	for rows.Next() {
+		var (
+			createdAt time.Time
+			expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&createdAt, &expiresAt); err != nil {
+			s.logger.Error("failed to scan link age", "error", err)
+			return
+		}
+		age.Update(now.Sub(createdAt).Seconds())
+		if expiresAt.Valid && expiresAt.Time.After(now) {
+			ttl.Update(expiresAt.Time.Sub(now).Seconds())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("failed to read link ages", "error", err)
+		return
+	}
+
+	lilmetrics.LinkAgeSeconds.Reset()
+	lilmetrics.LinkAgeSeconds.Merge(&age)
+	lilmetrics.LinkTimeToExpirySeconds.Reset()
+	lilmetrics.LinkTimeToExpirySeconds.Merge(&ttl)
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// aliasIndex maps aliases to the short codes they point to, and short codes
+// back to their aliases. Every alias is kept in memory, partial cache or not,
+// so misses can be checked for an alias without a query. Callers hold
+// Store.mu, for writing when changing it.
+type aliasIndex struct {
+	codes   map[string]string   // Alias -> short code
+	aliases map[string][]string // Short code -> aliases, in the order added
+}
+
+func newAliasIndex() aliasIndex {
+	return aliasIndex{
+		codes:   make(map[string]string),
+		aliases: make(map[string][]string),
+	}
+}
+
+func (a aliasIndex) add(alias, shortCode string) {
+	a.codes[alias] = shortCode
+	a.aliases[shortCode] = append(a.aliases[shortCode], alias)
+}
+
+// resolve returns the short code an alias points to.
+func (a aliasIndex) resolve(alias string) (string, bool) {
+	shortCode, ok := a.codes[alias]
+	return shortCode, ok
+}
+
+// of returns the aliases of a short code.
+func (a aliasIndex) of(shortCode string) []string {
+	return a.aliases[shortCode]
+}
+
+// rename points the aliases of a renamed short code at its new code.
+func (a aliasIndex) rename(oldCode, newCode string) {
+	aliases, ok := a.aliases[oldCode]
+	if !ok {
+		return
+	}
+	for _, alias := range aliases {
+		a.codes[alias] = newCode
+	}
+	a.aliases[newCode] = aliases
+	delete(a.aliases, oldCode)
+}
+
+// removeCode drops the aliases of a deleted short code.
+func (a aliasIndex) removeCode(shortCode string) {
+	for _, alias := range a.aliases[shortCode] {
+		delete(a.codes, alias)
+	}
+	delete(a.aliases, shortCode)
+}
+
+// loadAliases reads every stored alias into the alias index.
+func (s *Store) loadAliases() error {
+	rows, err := s.db.Query(`SELECT alias, short_code FROM aliases ORDER BY rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias, shortCode string
+		if err := rows.Scan(&alias, &shortCode); err != nil {
+			return err
+		}
+		s.aliases.add(alias, shortCode)
+	}
+	return rows.Err()
+}
+
+// lookupAliased is lookup falling back to the URL an alias points to when
+// shortCode isn't a URL's own code.
+func (s *Store) lookupAliased(ctx context.Context, shortCode string) (models.URLData, error) {
+	urlData, err := s.lookup(ctx, shortCode)
+	if !errors.Is(err, ErrNotExist) {
+		return urlData, err
+	}
+
+	s.mu.RLock()
+	target, ok := s.aliases.resolve(shortCode)
+	s.mu.RUnlock()
+	if !ok {
+		return models.URLData{}, err
+	}
+	return s.lookup(ctx, target)
+}
+
+// withAliases returns urlData with its aliases set from the alias index.
+func (s *Store) withAliases(urlData models.URLData) models.URLData {
+	s.mu.RLock()
+	aliases := s.aliases.of(urlData.ShortCode)
+	s.mu.RUnlock()
+	urlData.Aliases = append([]string(nil), aliases...)
+	return urlData
+}
+
+// AddAlias makes alias another code for the URL of shortCode, resolving to it
+// on redirects, and returns the URL with its aliases. Aliases follow the same
+// rules as custom slugs and share their namespace with short codes, so one
+// that's taken by either fails with ErrExists. They go along with renames and
+// are deleted with their URL.
+func (s *Store) AddAlias(ctx context.Context, shortCode, alias string) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	if err := s.ValidateSlug(alias); err != nil {
+		return models.URLData{}, err
+	}
+	alias = s.normalizeCode(alias)
+
+	// Serialized with updates so a rename can't move the URL from under it
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	urlData, err := s.lookup(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+	if s.exists(alias) {
+		return models.URLData{}, ErrExists
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.URLData{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The alias references the URL's row, so a URL still in the write buffer
+	// is written first. Its clicks are still pending and added by the next
+	// click flush.
+	s.mu.RLock()
+	buffered := s.cache.pinned(shortCode)
+	s.mu.RUnlock()
+	if buffered {
+		row := urlData
+		row.ClickCount = 0
+		args, err := urlArgs(row)
+		if err != nil {
+			return models.URLData{}, err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO urls (`+urlColumns+`) VALUES `+urlPlaceholders+` ON CONFLICT(short_code) DO NOTHING`, args...); err != nil {
+			return models.URLData{}, fmt.Errorf("insert buffered url: %w", err)
+		}
+		if err := insertTags(ctx, tx, shortCode, urlData.Tags); err != nil {
+			return models.URLData{}, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO aliases (alias, short_code, created_at) VALUES (?, ?, datetime('now'))
+	`, alias, shortCode); err != nil {
+		return models.URLData{}, fmt.Errorf("insert alias: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return models.URLData{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	s.mu.Lock()
+	s.aliases.add(alias, shortCode)
+	if buffered {
+		s.cache.unpin(shortCode)
+	}
+	s.mu.Unlock()
+
+	urlData = s.withAliases(urlData)
+	s.emitChange(OpUpdate, urlData)
+	return urlData, nil
+}
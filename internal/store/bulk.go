@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// CreateResult is the outcome of one entry of a CreateShortURLs batch.
+type CreateResult struct {
+	ShortCode string
+	Err       error
+}
+
+// CreateShortURLs creates a batch of short URLs and returns a result per
+// entry, in order. Entries without device URLs are written in a single
+// transaction, bypassing the write buffer, and fail together if it does.
+// Entries with device URLs are created one by one afterwards. A failed entry
+// doesn't stop the others.
+func (s *Store) CreateShortURLs(ctx context.Context, ps []CreateParams) []CreateResult {
+	results := make([]CreateResult, len(ps))
+
+	var (
+		batch    []models.URLData
+		indexes  []int // Position in ps of each batch entry
+		reserved = make(map[string]bool)
+	)
+	for i, p := range ps {
+		if len(p.DeviceURLs) > 0 {
+			continue
+		}
+		urlData, err := s.newURLData(p, reserved)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		reserved[urlData.ShortCode] = true
+		batch = append(batch, urlData)
+		indexes = append(indexes, i)
+	}
+
+	if len(batch) > 0 {
+		if err := s.insertBatch(ctx, batch); err != nil {
+			for _, i := range indexes {
+				results[i].Err = err
+			}
+		} else {
+			s.mu.Lock()
+			for _, urlData := range batch {
+				s.cache.set(urlData.ShortCode, urlData)
+			}
+			s.addStored(len(batch))
+			s.mu.Unlock()
+
+			for j, urlData := range batch {
+				results[indexes[j]].ShortCode = urlData.ShortCode
+				s.emitChange(OpCreate, urlData)
+			}
+		}
+	}
+
+	// Device URLs need their own transaction per entry
+	for i, p := range ps {
+		if len(p.DeviceURLs) == 0 {
+			continue
+		}
+		urlData, err := s.CreateShortURL(ctx, p)
+		results[i].ShortCode, results[i].Err = urlData.ShortCode, err
+	}
+
+	return results
+}
+
+// insertBatch writes URLs without device URLs in a single transaction.
+func (s *Store) insertBatch(ctx context.Context, batch []models.URLData) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO urls (`+urlColumns+`) VALUES `+urlPlaceholders)
+	if err != nil {
+		return fmt.Errorf("prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, urlData := range batch {
+		args, err := urlArgs(urlData)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("insert url %s: %w", urlData.ShortCode, err)
+		}
+		if err := insertTags(ctx, tx, urlData.ShortCode, urlData.Tags); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
+)
+
+// cacheSampleSize is the number of entries compared to pick one to evict.
+// Sampling approximates LRU without reordering a list on every read, so
+// lookups keep sharing the read lock.
+const cacheSampleSize = 5
+
+type cacheEntry struct {
+	urlData  models.URLData
+	lastUsed atomic.Int64 // Tick of the last access
+	pinned   bool         // Not in the database yet, so it can't be evicted
+}
+
+// urlCache holds URLs by short code. With a max size, the least recently used
+// of a sample of entries is evicted whenever it's exceeded. Without one every
+// URL is kept and, unless the cache is lazy, a miss means the URL doesn't
+// exist. A lazy cache starts out empty and is filled by lookups. Callers hold
+// Store.mu, for writing when calling set, setPinned, unpin or remove.
+type urlCache struct {
+	max     int
+	lazy    bool
+	entries map[string]*cacheEntry
+	clock   atomic.Int64
+}
+
+func newURLCache(max int, lazy bool) *urlCache {
+	return &urlCache{
+		max:     max,
+		lazy:    lazy,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// partial reports whether stored URLs may be missing from the cache, evicted
+// or not looked up yet, in which case misses have to be read from the
+// database.
+func (c *urlCache) partial() bool {
+	return c.max > 0 || c.lazy
+}
+
+// get returns a cached URL and marks it as recently used.
+func (c *urlCache) get(shortCode string) (models.URLData, bool) {
+	e, ok := c.entries[shortCode]
+	if !ok {
+		return models.URLData{}, false
+	}
+	e.lastUsed.Store(c.clock.Add(1))
+	return e.urlData, true
+}
+
+// has reports whether a URL is cached without marking it as used.
+func (c *urlCache) has(shortCode string) bool {
+	_, ok := c.entries[shortCode]
+	return ok
+}
+
+// set caches a URL, evicting others if that exceeds the max size.
+func (c *urlCache) set(shortCode string, urlData models.URLData) {
+	c.put(shortCode, urlData, false)
+}
+
+// setPinned caches a URL that can't be evicted until it's unpinned.
+func (c *urlCache) setPinned(shortCode string, urlData models.URLData) {
+	c.put(shortCode, urlData, true)
+}
+
+func (c *urlCache) put(shortCode string, urlData models.URLData, pin bool) {
+	e, ok := c.entries[shortCode]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[shortCode] = e
+	}
+	e.urlData = urlData
+	e.pinned = e.pinned || pin
+	e.lastUsed.Store(c.clock.Add(1))
+	if !ok {
+		c.evict()
+	}
+}
+
+// pinned reports whether a URL is cached but not in the database yet.
+func (c *urlCache) pinned(shortCode string) bool {
+	e, ok := c.entries[shortCode]
+	return ok && e.pinned
+}
+
+func (c *urlCache) unpin(shortCode string) {
+	if e, ok := c.entries[shortCode]; ok {
+		e.pinned = false
+	}
+}
+
+// remove drops a URL from the cache.
+func (c *urlCache) remove(shortCode string) {
+	delete(c.entries, shortCode)
+}
+
+// evict drops least recently used entries until the cache is within its max
+// size. When every entry is pinned the cache is left over size.
+func (c *urlCache) evict() {
+	for c.max > 0 && len(c.entries) > c.max {
+		var (
+			victim string
+			oldest int64
+			seen   int
+		)
+		// Map iteration starts at a random entry, which makes the sample
+		for shortCode, e := range c.entries {
+			if e.pinned {
+				continue
+			}
+			if used := e.lastUsed.Load(); seen == 0 || used < oldest {
+				victim, oldest = shortCode, used
+			}
+			if seen++; seen == cacheSampleSize {
+				break
+			}
+		}
+		if seen == 0 {
+			return
+		}
+		delete(c.entries, victim)
+		metrics.CacheEvictionsTotal.Inc()
+	}
+}
+
+// lookup returns the URL of a short code from the cache, reading it from the
+// database on a miss when the cache is partial.
+func (s *Store) lookup(ctx context.Context, shortCode string) (models.URLData, error) {
+	s.mu.RLock()
+	urlData, ok := s.cache.get(shortCode)
+	s.mu.RUnlock()
+	if ok {
+		return urlData, nil
+	}
+	if !s.cache.partial() {
+		return models.URLData{}, ErrNotExist
+	}
+
+	metrics.CacheMissesTotal.Inc()
+	return s.loadURL(ctx, shortCode)
+}
+
+// exists reports whether a short code is taken, by a URL or an alias.
+// Database errors count as taken so a code is never handed out twice.
+func (s *Store) exists(shortCode string) bool {
+	s.mu.RLock()
+	_, alias := s.aliases.resolve(shortCode)
+	ok := alias || s.cache.has(shortCode)
+	s.mu.RUnlock()
+	if ok || !s.cache.partial() {
+		return ok
+	}
+
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM urls WHERE short_code = ?)`, shortCode).Scan(&exists)
+	return err != nil || exists
+}
+
+// IsSlugAvailable reports whether a slug, normalized like a create does, isn't
+// taken yet. It doesn't validate the slug.
+func (s *Store) IsSlugAvailable(ctx context.Context, slug string) (bool, error) {
+	shortCode := s.normalizeCode(slug)
+	s.mu.RLock()
+	_, alias := s.aliases.resolve(shortCode)
+	cached := alias || s.cache.has(shortCode)
+	s.mu.RUnlock()
+	if cached || !s.cache.partial() {
+		return !cached, nil
+	}
+
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM urls WHERE short_code = ?)`, shortCode).Scan(&exists)
+	return !exists, err
+}
+
+// loadURL reads a URL missing from the cache from the database and caches it.
+func (s *Store) loadURL(ctx context.Context, shortCode string) (models.URLData, error) {
+	urlData, err := s.readURL(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cacheRead(urlData), nil
+}
+
+// readURL reads a URL from the database without caching it. Its click count
+// leaves out the clicks still pending.
+func (s *Store) readURL(ctx context.Context, shortCode string) (models.URLData, error) {
+	var hasDeviceURLs bool
+	urlData, err := scanURL(s.db.QueryRowContext(ctx, `
+		SELECT `+urlColumns+`,
+			EXISTS(SELECT 1 FROM device_urls d WHERE d.short_code = urls.short_code)
+		FROM urls
+		WHERE short_code = ?
+	`, shortCode), &hasDeviceURLs)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.URLData{}, ErrNotExist
+		}
+		return models.URLData{}, err
+	}
+	urlData.HasDeviceURLs = hasDeviceURLs
+
+	tags, err := s.tagsOf(ctx, []any{shortCode})
+	if err != nil {
+		return models.URLData{}, err
+	}
+	urlData.Tags = tags[shortCode]
+	return urlData, nil
+}
+
+// cacheRead caches a URL read with readURL, adding its pending clicks and
+// access, and returns it. When another lookup cached it in the meantime, that
+// version is returned instead. Callers hold mu for writing.
+func (s *Store) cacheRead(urlData models.URLData) models.URLData {
+	if cached, ok := s.cache.get(urlData.ShortCode); ok {
+		return cached
+	}
+	urlData.ClickCount += s.pendingClicks[urlData.ShortCode]
+	if at, ok := s.pendingAccess[urlData.ShortCode]; ok {
+		urlData.LastAccessedAt = &at
+	}
+	s.cache.set(urlData.ShortCode, urlData)
+	return urlData
+}
+
+// addStored adjusts the number of stored URLs, exported as a gauge. Callers
+// hold mu for writing.
+func (s *Store) addStored(n int) {
+	s.stored += n
+	metrics.URLsStoredGauge.Set(float64(s.stored))
+}
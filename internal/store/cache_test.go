@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
+)
+
+// With no more entries than the sample size the sample is the whole cache, so
+// eviction is exact LRU.
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newURLCache(cacheSampleSize-1, false)
+	for _, code := range []string{"a", "b", "c", "d"} {
+		c.set(code, models.URLData{ShortCode: code})
+	}
+	c.get("a")
+	c.set("e", models.URLData{ShortCode: "e"})
+
+	if c.has("b") {
+		t.Error("b is still cached, want it evicted as the least recently used")
+	}
+	for _, code := range []string{"a", "c", "d", "e"} {
+		if !c.has(code) {
+			t.Errorf("%s was evicted", code)
+		}
+	}
+}
+
+// In a larger cache only a sample is compared, which still keeps entries in
+// use: evicting one takes a sample made up of nothing but recently used
+// entries.
+func TestCacheSampledEvictionKeepsHotEntries(t *testing.T) {
+	const (
+		max     = 200
+		inserts = 1000
+	)
+	c := newURLCache(max, false)
+	hot := []string{"h1", "h2", "h3", "h4", "h5"}
+	for _, code := range hot {
+		c.set(code, models.URLData{ShortCode: code})
+	}
+
+	evictions := metrics.CacheEvictionsTotal.Get()
+	for i := 0; i < inserts; i++ {
+		for _, code := range hot {
+			if _, ok := c.get(code); !ok {
+				t.Fatalf("hot entry %s evicted after %d inserts", code, i)
+			}
+		}
+		code := fmt.Sprintf("cold%d", i)
+		c.set(code, models.URLData{ShortCode: code})
+		if len(c.entries) > max {
+			t.Fatalf("%d entries cached, want at most %d", len(c.entries), max)
+		}
+	}
+	if n := metrics.CacheEvictionsTotal.Get() - evictions; n != uint64(inserts+len(hot)-max) {
+		t.Errorf("%d evictions counted, want %d", n, inserts+len(hot)-max)
+	}
+}
+
+func TestCacheKeepsPinnedEntries(t *testing.T) {
+	c := newURLCache(2, false)
+	for _, code := range []string{"a", "b", "c"} {
+		c.setPinned(code, models.URLData{ShortCode: code})
+	}
+	if len(c.entries) != 3 {
+		t.Fatalf("%d entries cached, want the pinned ones kept over the max", len(c.entries))
+	}
+
+	c.unpin("a")
+	c.set("d", models.URLData{ShortCode: "d"})
+	if c.has("a") || !c.has("b") || !c.has("c") {
+		t.Errorf("cache holds %v, want the unpinned a evicted", c.entries)
+	}
+}
+
+// URLs evicted from a bounded cache are read back from the database on their
+// next lookup, which caches them again.
+func TestCacheMissReadsDatabase(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.CacheSize = 2
+	s := newTestStore(t, cfg)
+
+	for _, code := range []string{"a", "b", "c"} {
+		mustCreate(t, s, CreateParams{URL: "https://example.com/" + code, Slug: code, Tags: []string{"t"}})
+	}
+	// Written URLs are unpinned, so the cache shrinks back to its size
+	s.triggerFlush()
+	if _, err := s.GetRedirectData(ctx, "b"); err != nil {
+		t.Fatalf("GetRedirectData(b): %v", err)
+	}
+	if _, err := s.GetRedirectData(ctx, "c"); err != nil {
+		t.Fatalf("GetRedirectData(c): %v", err)
+	}
+	s.mu.Lock()
+	s.cache.evict()
+	s.mu.Unlock()
+	if s.cache.has("a") {
+		t.Fatal("a still cached, want it evicted for the test")
+	}
+
+	misses := metrics.CacheMissesTotal.Get()
+	for i := 0; i < 2; i++ {
+		urlData, err := s.GetRedirectData(ctx, "a")
+		if err != nil {
+			t.Fatalf("GetRedirectData(a) %d: %v", i+1, err)
+		}
+		if urlData.URL != "https://example.com/a" || len(urlData.Tags) != 1 || urlData.ClickCount != int64(i+1) {
+			t.Errorf("a = %s with tags %v and %d clicks, want it read from the database", urlData.URL, urlData.Tags, urlData.ClickCount)
+		}
+	}
+	if n := metrics.CacheMissesTotal.Get() - misses; n != 1 {
+		t.Errorf("%d cache misses, want only the first lookup to miss", n)
+	}
+	if _, err := s.GetRedirectData(ctx, "missing"); err != ErrNotExist {
+		t.Errorf("GetRedirectData(missing) = %v, want ErrNotExist", err)
+	}
+}
+
+// A lazy cache starts out empty, reading each URL from the database on its
+// first lookup and serving it from memory after that.
+func TestLazyCacheMissThenHit(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	s := newTestStore(t, cfg)
+	mustCreate(t, s, CreateParams{URL: "https://example.com/a", Slug: "a"})
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	cfg.LazyCache = true
+	s = newTestStore(t, cfg)
+	if n := s.Usage().Cache; n != 0 {
+		t.Fatalf("%d URLs cached at startup, want none", n)
+	}
+	if ok, err := s.IsSlugAvailable(ctx, "a"); err != nil || ok {
+		t.Errorf("IsSlugAvailable(a) = %v, %v before it's cached, want false", ok, err)
+	}
+
+	misses := metrics.CacheMissesTotal.Get()
+	for i := 0; i < 3; i++ {
+		urlData, err := s.GetRedirectData(ctx, "a")
+		if err != nil {
+			t.Fatalf("GetRedirectData(a) %d: %v", i+1, err)
+		}
+		if urlData.URL != "https://example.com/a" {
+			t.Errorf("a redirects to %s", urlData.URL)
+		}
+	}
+	if n := metrics.CacheMissesTotal.Get() - misses; n != 1 {
+		t.Errorf("%d cache misses, want only the first lookup to miss", n)
+	}
+	if !s.cache.has("a") {
+		t.Error("a isn't cached after its lookup")
+	}
+	if _, err := s.GetRedirectData(ctx, "missing"); err != ErrNotExist {
+		t.Errorf("GetRedirectData(missing) = %v, want ErrNotExist", err)
+	}
+}
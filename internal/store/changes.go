@@ -0,0 +1,52 @@
+package store
+
+import (
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
+)
+
+// Op identifies the kind of write a ChangeEvent describes.
+type Op string
+
+const (
+	OpCreate Op = "create"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// ChangeEvent describes a single write to the store. For deletes, URL holds
+// the record as it was before removal.
+type ChangeEvent struct {
+	Op  Op
+	URL models.URLData
+}
+
+// Changes returns the channel change events are published on, or nil when
+// Conf.ChangeEventsBuffer is zero. Events are published once the write is
+// visible to reads. The channel is never closed; consumers should stop
+// reading on their own shutdown signal.
+func (s *Store) Changes() <-chan ChangeEvent {
+	return s.changes
+}
+
+// emitChange publishes a change event. Unless Conf.BlockOnChangeEvents is set,
+// the event is dropped when the buffer is full so a slow consumer can't stall
+// writes.
+func (s *Store) emitChange(op Op, urlData models.URLData) {
+	if s.changes == nil {
+		return
+	}
+
+	evt := ChangeEvent{Op: op, URL: urlData}
+	if s.blockOnChanges {
+		s.changes <- evt
+		return
+	}
+
+	select {
+	case s.changes <- evt:
+	default:
+		metrics.ChangeEventsDroppedTotal.Inc()
+		s.logger.Warn("change events channel full, dropping event", "op", op, "short_code", urlData.ShortCode)
+	}
+}
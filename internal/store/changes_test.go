@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+// drainChanges returns the change events published so far.
+func drainChanges(s *Store) []ChangeEvent {
+	var evts []ChangeEvent
+	for {
+		select {
+		case evt := <-s.Changes():
+			evts = append(evts, evt)
+		default:
+			return evts
+		}
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.ChangeEventsBuffer = 10
+	s := newTestStore(t, cfg)
+
+	title, slug := "Renamed", "b"
+	type change struct {
+		op        Op
+		shortCode string
+	}
+	steps := []struct {
+		name  string
+		write func() error
+		want  []change
+	}{
+		{
+			name: "create",
+			write: func() error {
+				_, err := s.CreateShortURL(ctx, CreateParams{URL: "https://example.com", Slug: "a"})
+				return err
+			},
+			want: []change{{OpCreate, "a"}},
+		},
+		{
+			name: "update",
+			write: func() error {
+				_, err := s.UpdateURL(ctx, "a", UpdateParams{Title: &title})
+				return err
+			},
+			want: []change{{OpUpdate, "a"}},
+		},
+		{
+			name: "rename",
+			write: func() error {
+				_, err := s.UpdateURL(ctx, "a", UpdateParams{Slug: &slug})
+				return err
+			},
+			want: []change{{OpDelete, "a"}, {OpCreate, "b"}},
+		},
+		{
+			name:  "delete",
+			write: func() error { return s.DeleteURL(ctx, "b") },
+			want:  []change{{OpDelete, "b"}},
+		},
+		{
+			name: "failed write",
+			write: func() error {
+				_, err := s.UpdateURL(ctx, "b", UpdateParams{Title: &title})
+				if !errors.Is(err, ErrNotExist) {
+					t.Errorf("updating a deleted URL = %v, want ErrNotExist", err)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.write(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		evts := drainChanges(s)
+		if len(evts) != len(step.want) {
+			t.Fatalf("%s: published %d events, want %d", step.name, len(evts), len(step.want))
+		}
+		for i, evt := range evts {
+			if evt.Op != step.want[i].op || evt.URL.ShortCode != step.want[i].shortCode {
+				t.Errorf("%s: event %d is %s %s, want %s %s", step.name, i,
+					evt.Op, evt.URL.ShortCode, step.want[i].op, step.want[i].shortCode)
+			}
+		}
+	}
+	if newTestStore(t, testConf(t)).Changes() != nil {
+		t.Error("Changes isn't nil without a buffer")
+	}
+}
+
+func TestChangeEventsDropPolicy(t *testing.T) {
+	const writes = 5
+	ctx := context.Background()
+
+	t.Run("drop", func(t *testing.T) {
+		cfg := testConf(t)
+		cfg.ChangeEventsBuffer = 1
+		s := newTestStore(t, cfg)
+
+		dropped := metrics.ChangeEventsDroppedTotal.Get()
+		for i := 0; i < writes; i++ {
+			mustCreate(t, s, CreateParams{URL: "https://example.com"})
+		}
+		if n := len(drainChanges(s)); n != 1 {
+			t.Errorf("%d events were kept, want 1", n)
+		}
+		if n := metrics.ChangeEventsDroppedTotal.Get() - dropped; n != writes-1 {
+			t.Errorf("%d events were counted as dropped, want %d", n, writes-1)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		cfg := testConf(t)
+		cfg.ChangeEventsBuffer = 1
+		cfg.BlockOnChangeEvents = true
+		s := newTestStore(t, cfg)
+
+		dropped := metrics.ChangeEventsDroppedTotal.Get()
+		var (
+			wg       sync.WaitGroup
+			received int
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range writes {
+				<-s.Changes()
+				received++
+			}
+		}()
+		for i := 0; i < writes; i++ {
+			if _, err := s.CreateShortURL(ctx, CreateParams{URL: "https://example.com"}); err != nil {
+				t.Fatalf("CreateShortURL: %v", err)
+			}
+		}
+		wg.Wait()
+
+		if received != writes {
+			t.Errorf("consumer received %d events, want %d", received, writes)
+		}
+		if n := metrics.ChangeEventsDroppedTotal.Get() - dropped; n != 0 {
+			t.Errorf("%d events were dropped", n)
+		}
+	})
+}
+
+// Looking up an expired link leaves it alone, so only the redirect that
+// deletes it publishes a change.
+func TestPeekExpiredPublishesNothing(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.ChangeEventsBuffer = 10
+	s := newTestStore(t, cfg)
+
+	mustCreate(t, s, CreateParams{URL: "https://example.com", Slug: "brief", Expiry: time.Millisecond})
+	drainChanges(s)
+	time.Sleep(5 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.PeekRedirectData(ctx, "brief"); !errors.Is(err, ErrExpired) {
+			t.Fatalf("peek %d = %v, want ErrExpired", i+1, err)
+		}
+	}
+	if evts := drainChanges(s); len(evts) != 0 {
+		t.Errorf("peeking published %+v, want nothing", evts)
+	}
+	if _, err := s.GetURL(ctx, "brief"); err != nil {
+		t.Fatalf("GetURL after peeking: %v, want the link kept", err)
+	}
+
+	if _, err := s.GetRedirectData(ctx, "brief"); !errors.Is(err, ErrExpired) {
+		t.Fatalf("redirect = %v, want ErrExpired", err)
+	}
+	if evts := drainChanges(s); len(evts) != 1 || evts[0].Op != OpDelete {
+		t.Errorf("redirecting published %+v, want one delete", evts)
+	}
+}
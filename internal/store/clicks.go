@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// flushClicks adds the clicks counted since the last flush to the stored
+// counts and stores when each URL was last accessed. It runs on the flush
+// worker's tick. Counts for URLs that aren't in the database yet, as they're
+// still in the write buffer, are kept for the next flush.
+func (s *Store) flushClicks() {
+	s.clicksMu.Lock()
+	defer s.clicksMu.Unlock()
+
+	s.mu.Lock()
+	if len(s.pendingAccess) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	clicks, accessed := s.pendingClicks, s.pendingAccess
+	s.pendingClicks = make(map[string]int64, len(clicks))
+	s.pendingAccess = make(map[string]time.Time, len(accessed))
+	s.mu.Unlock()
+
+	unpersisted, err := s.doFlushClicks(clicks, accessed)
+	if err != nil {
+		s.logger.Error("failed to flush click counts", "error", err, "count", len(clicks))
+		unpersisted = slices.Collect(maps.Keys(accessed))
+	}
+
+	// Put back counts that weren't written, unless the URL is gone. With a
+	// partial cache an uncached URL may only have been evicted, so every count
+	// of a failed flush is kept. Clicks and accesses since count on top.
+	keepAll := err != nil && s.cache.partial()
+	if len(unpersisted) > 0 {
+		s.mu.Lock()
+		for _, shortCode := range unpersisted {
+			if !keepAll && !s.cache.has(shortCode) {
+				continue
+			}
+			if n, ok := clicks[shortCode]; ok {
+				s.pendingClicks[shortCode] += n
+			}
+			if _, ok := s.pendingAccess[shortCode]; !ok {
+				s.pendingAccess[shortCode] = accessed[shortCode]
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// doFlushClicks writes click deltas and access times in a single transaction
+// and returns the codes that matched no row.
+func (s *Store) doFlushClicks(clicks map[string]int64, accessed map[string]time.Time) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE urls SET click_count = click_count + ?, last_accessed_at = ? WHERE short_code = ?`)
+	if err != nil {
+		return nil, fmt.Errorf("prepare click update: %w", err)
+	}
+	defer stmt.Close()
+
+	var unpersisted []string
+	for shortCode, at := range accessed {
+		res, err := stmt.Exec(clicks[shortCode], at, shortCode)
+		if err != nil {
+			return nil, fmt.Errorf("update click count: %w", err)
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			unpersisted = append(unpersisted, shortCode)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+	return unpersisted, nil
+}
+
+// ResetClicks sets the click count of a short code, or the URL an alias points
+// to, back to zero, letting a link whose max clicks are used up redirect
+// again. It returns the URL with its reset count. Clicks counted while the
+// reset runs are dropped along with the rest.
+func (s *Store) ResetClicks(ctx context.Context, shortCode string) (models.URLData, error) {
+	urlData, err := s.lookupAliased(ctx, s.normalizeCode(shortCode))
+	if err != nil {
+		return models.URLData{}, err
+	}
+	shortCode = urlData.ShortCode
+
+	// Neither an update nor a click flush may write the old count back
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.clicksMu.Lock()
+	defer s.clicksMu.Unlock()
+
+	res, err := s.db.ExecContext(ctx, `UPDATE urls SET click_count = 0 WHERE short_code = ?`, shortCode)
+	if err != nil {
+		return models.URLData{}, fmt.Errorf("reset click count: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	s.mu.Lock()
+	// URLs still in the write buffer are only in the cache, and are written
+	// with no clicks
+	if affected == 0 && !s.cache.pinned(shortCode) {
+		s.mu.Unlock()
+		return models.URLData{}, ErrNotExist
+	}
+	delete(s.pendingClicks, shortCode)
+	if cached, ok := s.cache.get(shortCode); ok {
+		urlData = cached
+		urlData.ClickCount = 0
+		s.cache.set(shortCode, urlData)
+	} else {
+		urlData.ClickCount = 0
+	}
+	s.mu.Unlock()
+
+	s.emitChange(OpUpdate, urlData)
+	return s.withAliases(urlData), nil
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// hammer follows shortCode from n goroutines at once and returns how many
+// redirects succeeded and how many hit the click limit.
+func hammer(t *testing.T, s *Store, shortCode string, n int) (ok, limited int64) {
+	t.Helper()
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := s.GetRedirectData(context.Background(), shortCode)
+			switch {
+			case err == nil:
+				atomic.AddInt64(&ok, 1)
+			case errors.Is(err, ErrClickLimit):
+				atomic.AddInt64(&limited, 1)
+			default:
+				t.Errorf("GetRedirectData(%s): %v", shortCode, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return ok, limited
+}
+
+func TestMaxClicksConcurrent(t *testing.T) {
+	const redirects = 50
+
+	for _, maxClicks := range []int64{1, 3} {
+		t.Run(fmt.Sprintf("cached/max_clicks=%d", maxClicks), func(t *testing.T) {
+			s := newTestStore(t, testConf(t))
+			link := mustCreate(t, s, CreateParams{URL: "https://example.com", MaxClicks: maxClicks})
+
+			ok, limited := hammer(t, s, link.ShortCode, redirects)
+			if ok != maxClicks || limited != redirects-maxClicks {
+				t.Fatalf("max_clicks=%d: %d redirects succeeded and %d were limited, want %d and %d",
+					maxClicks, ok, limited, maxClicks, redirects-maxClicks)
+			}
+		})
+
+		t.Run(fmt.Sprintf("evicted/max_clicks=%d", maxClicks), func(t *testing.T) {
+			cfg := testConf(t)
+			cfg.CacheSize = 1
+			cfg.BufferSize = 0 // Buffered URLs are pinned and never evicted
+			s := newTestStore(t, cfg)
+
+			link := mustCreate(t, s, CreateParams{URL: "https://example.com", MaxClicks: maxClicks})
+			other := mustCreate(t, s, CreateParams{URL: "https://example.org"})
+			s.mu.RLock()
+			cached := s.cache.has(link.ShortCode)
+			s.mu.RUnlock()
+			if cached {
+				t.Fatalf("%s is still cached", link.ShortCode)
+			}
+
+			// Redirects for the other link keep evicting the limited one
+			// while it's being followed
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				hammer(t, s, other.ShortCode, redirects)
+			}()
+			ok, limited := hammer(t, s, link.ShortCode, redirects)
+			wg.Wait()
+
+			if ok != maxClicks || limited != redirects-maxClicks {
+				t.Fatalf("max_clicks=%d: %d redirects succeeded and %d were limited, want %d and %d",
+					maxClicks, ok, limited, maxClicks, redirects-maxClicks)
+			}
+		})
+	}
+}
+
+func TestClicksCountedForEvictedLinks(t *testing.T) {
+	const redirects = 100
+
+	cfg := testConf(t)
+	cfg.CacheSize = 1
+	cfg.BufferSize = 0
+	s := newTestStore(t, cfg)
+
+	a := mustCreate(t, s, CreateParams{URL: "https://example.com"})
+	b := mustCreate(t, s, CreateParams{URL: "https://example.org"})
+
+	var wg sync.WaitGroup
+	for _, code := range []string{a.ShortCode, b.ShortCode} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hammer(t, s, code, redirects)
+		}()
+	}
+	wg.Wait()
+
+	for _, code := range []string{a.ShortCode, b.ShortCode} {
+		urlData, err := s.GetURL(context.Background(), code)
+		if err != nil {
+			t.Fatalf("GetURL(%s): %v", code, err)
+		}
+		if urlData.ClickCount != redirects {
+			t.Errorf("%s has %d clicks, want %d", code, urlData.ClickCount, redirects)
+		}
+	}
+}
+
+func TestResetClicksDropsPendingClicks(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.BufferSize = 0
+	s := newTestStore(t, cfg)
+	link := mustCreate(t, s, CreateParams{URL: "https://example.com", Slug: "quota", MaxClicks: 3})
+
+	redirect := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := s.GetRedirectData(ctx, link.ShortCode); err != nil {
+				t.Fatalf("GetRedirectData: %v", err)
+			}
+		}
+	}
+
+	// Two clicks written, one still pending
+	redirect(2)
+	s.flushClicks()
+	redirect(1)
+
+	if _, err := s.ResetClicks(ctx, link.ShortCode); err != nil {
+		t.Fatalf("ResetClicks: %v", err)
+	}
+	// The pending click isn't added back by the next flush
+	s.flushClicks()
+	redirect(1)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s = newTestStore(t, cfg)
+	urlData, err := s.GetURL(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatalf("GetURL after reopening: %v", err)
+	}
+	if urlData.ClickCount != 1 {
+		t.Errorf("%d clicks stored, want the 1 after the reset", urlData.ClickCount)
+	}
+}
+
+func TestResetClicksDuringRedirects(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.BufferSize = 0
+	s := newTestStore(t, cfg)
+	link := mustCreate(t, s, CreateParams{URL: "https://example.com", MaxClicks: 1000})
+
+	// Clicks are counted and flushed while resetting, and whatever the
+	// outcome the cached and stored counts have to agree afterwards
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			s.flushClicks()
+		}
+	}()
+	hammer(t, s, link.ShortCode, 50)
+	if _, err := s.ResetClicks(ctx, link.ShortCode); err != nil {
+		t.Fatalf("ResetClicks: %v", err)
+	}
+	ok, _ := hammer(t, s, link.ShortCode, 10)
+	<-done
+
+	urlData, err := s.GetURL(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if urlData.ClickCount != ok {
+		t.Errorf("%d clicks after the reset, want %d", urlData.ClickCount, ok)
+	}
+	s.flushClicks()
+	stored, err := s.readURL(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatalf("readURL: %v", err)
+	}
+	if stored.ClickCount != ok {
+		t.Errorf("%d clicks stored after the reset, want %d", stored.ClickCount, ok)
+	}
+}
+
+func TestFlushClicksStoresLastAccess(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.BufferSize = 0 // Written right away
+	s := newTestStore(t, cfg)
+	link := mustCreate(t, s, CreateParams{URL: "https://example.com"})
+	unclicked := mustCreate(t, s, CreateParams{URL: "https://example.org"})
+
+	followed, err := s.GetRedirectData(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatalf("GetRedirectData: %v", err)
+	}
+	s.flushClicks()
+
+	row, err := s.readURL(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatalf("readURL: %v", err)
+	}
+	if row.ClickCount != 1 || row.LastAccessedAt == nil || !row.LastAccessedAt.Equal(*followed.LastAccessedAt) {
+		t.Errorf("stored %d clicks last accessed at %v, want 1 at %v", row.ClickCount, row.LastAccessedAt, followed.LastAccessedAt)
+	}
+	if row, err := s.readURL(ctx, unclicked.ShortCode); err != nil || row.LastAccessedAt != nil {
+		t.Errorf("unclicked URL stored as last accessed at %v (%v)", row.LastAccessedAt, err)
+	}
+}
@@ -0,0 +1,443 @@
+package store
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Strategies for SuggestSlugs.
+const (
+	SuggestNumeric = "numeric" // slug-2, slug-3, ...
+	SuggestRandom  = "random"  // slug-x7, slug-Qa, ...
+)
+
+// maxSuggestionProbes bounds the candidates probed per suggestion.
+const maxSuggestionProbes = 8
+
+// Default sets of characters random short codes are drawn from. They leave
+// out lookalikes (0/O/o, 1/l/I) so codes are easy to read out and type.
+// Case-insensitive stores use the lowercase one so generated codes are
+// already normalized.
+const (
+	alphabet          = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	lowercaseAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+// Slug rules used when Conf leaves them unset.
+const (
+	defaultSlugPattern   = `[A-Za-z0-9_-]+`
+	defaultMaxSlugLength = 64
+)
+
+// defaultMaxCodeAttempts is the number of random codes tried per create when
+// Conf.MaxCodeAttempts isn't set.
+const defaultMaxCodeAttempts = 10
+
+// platformPattern matches valid device platform names.
+var platformPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// defaultReservedSlugs would shadow or be confused with the server's own routes.
+var defaultReservedSlugs = []string{"api", "admin", "health", "metrics"}
+
+// codeRules holds the configured rules for generated codes, custom slugs,
+// destination hosts and device platforms. It's embedded in every store backend so they pick and
+// validate codes alike.
+type codeRules struct {
+	shortURLLen     int
+	minShortURLLen  int
+	maxShortURLLen  int
+	minEntropyBits  float64
+	caseInsensitive bool
+	alphabet        string         // Characters random codes are drawn from
+	slugPattern     *regexp.Regexp // SlugPattern anchored to match whole slugs
+	slugPatternSrc  string
+	minSlugLen      int
+	maxSlugLen      int
+	reservedSlugs   map[string]bool
+	maxAttempts     int
+	growCodeLength  bool
+	hosts           hostRules
+	platforms       map[string]bool // Platforms device URLs can be set for
+}
+
+// newCodeRules validates the code and slug settings of cfg, applying their
+// defaults.
+func newCodeRules(cfg Conf, logger *slog.Logger) (codeRules, error) {
+	if cfg.MinShortURLLength <= 0 {
+		cfg.MinShortURLLength = cfg.ShortURLLength
+	}
+	if cfg.MaxShortURLLength <= 0 {
+		cfg.MaxShortURLLength = cfg.ShortURLLength
+	}
+	if cfg.MinShortURLLength > cfg.ShortURLLength || cfg.MaxShortURLLength < cfg.ShortURLLength {
+		return codeRules{}, fmt.Errorf("short URL length %d must be within [%d, %d]", cfg.ShortURLLength, cfg.MinShortURLLength, cfg.MaxShortURLLength)
+	}
+
+	alphabet, err := codeAlphabet(cfg.Alphabet, cfg.CaseInsensitive)
+	if err != nil {
+		return codeRules{}, err
+	}
+
+	if cfg.MinEntropyBits > 0 {
+		if bits := entropyBits(len(alphabet), cfg.MinShortURLLength); bits < cfg.MinEntropyBits {
+			if cfg.RequireMinEntropy {
+				return codeRules{}, fmt.Errorf("%w: %.1f bits with length %d, need %.1f", ErrLowEntropy, bits, cfg.MinShortURLLength, cfg.MinEntropyBits)
+			}
+			logger.Warn("short codes are below the minimum entropy",
+				"entropy_bits", bits,
+				"min_entropy_bits", cfg.MinEntropyBits,
+				"length", cfg.MinShortURLLength)
+		}
+	}
+
+	if cfg.SlugPattern == "" {
+		cfg.SlugPattern = defaultSlugPattern
+	}
+	slugPattern, err := regexp.Compile(`^(?:` + cfg.SlugPattern + `)$`)
+	if err != nil {
+		return codeRules{}, fmt.Errorf("invalid slug pattern: %w", err)
+	}
+	if cfg.MinSlugLength <= 0 {
+		cfg.MinSlugLength = 1
+	}
+	if cfg.MaxSlugLength <= 0 {
+		cfg.MaxSlugLength = defaultMaxSlugLength
+	}
+	if cfg.ReservedSlugs == nil {
+		cfg.ReservedSlugs = defaultReservedSlugs
+	}
+	reservedSlugs := make(map[string]bool, len(cfg.ReservedSlugs))
+	for _, slug := range cfg.ReservedSlugs {
+		reservedSlugs[strings.ToLower(slug)] = true
+	}
+
+	if cfg.MaxCodeAttempts <= 0 {
+		cfg.MaxCodeAttempts = defaultMaxCodeAttempts
+	}
+
+	hosts, err := newHostRules(cfg)
+	if err != nil {
+		return codeRules{}, err
+	}
+
+	if cfg.DevicePlatforms == nil {
+		cfg.DevicePlatforms = DefaultDevicePlatforms
+	}
+	platforms := make(map[string]bool, len(cfg.DevicePlatforms))
+	for _, platform := range cfg.DevicePlatforms {
+		if !platformPattern.MatchString(platform) {
+			return codeRules{}, fmt.Errorf("invalid device platform %q", platform)
+		}
+		platforms[platform] = true
+	}
+
+	return codeRules{
+		shortURLLen:     cfg.ShortURLLength,
+		minShortURLLen:  cfg.MinShortURLLength,
+		maxShortURLLen:  cfg.MaxShortURLLength,
+		minEntropyBits:  cfg.MinEntropyBits,
+		caseInsensitive: cfg.CaseInsensitive,
+		alphabet:        alphabet,
+		slugPattern:     slugPattern,
+		slugPatternSrc:  cfg.SlugPattern,
+		minSlugLen:      cfg.MinSlugLength,
+		maxSlugLen:      cfg.MaxSlugLength,
+		reservedSlugs:   reservedSlugs,
+		maxAttempts:     cfg.MaxCodeAttempts,
+		growCodeLength:  cfg.GrowCodeLength,
+		hosts:           hosts,
+		platforms:       platforms,
+	}, nil
+}
+
+// randomCode draws a random code of the given length that isn't taken, trying
+// up to maxAttempts codes per length. When growCodeLength is set it moves on
+// to longer codes, up to maxShortURLLen, before giving up.
+func (r *codeRules) randomCode(length int, taken func(string) bool) (string, error) {
+	for ; length <= r.maxShortURLLen; length++ {
+		metrics.GeneratedCodesByLength(length).Inc()
+		for attempt := 0; attempt < r.maxAttempts; attempt++ {
+			if code := generateRandomString(r.alphabet, length); !taken(code) {
+				return code, nil
+			}
+		}
+		metrics.CodeAttemptsExhaustedTotal.Inc()
+		if !r.growCodeLength {
+			break
+		}
+	}
+	return "", ErrNoFreeCode
+}
+
+// ValidateSlug checks a custom slug against the configured length, pattern
+// and reserved words. Errors wrap ErrInvalidSlug and describe the problem.
+func (r *codeRules) ValidateSlug(slug string) error {
+	if n := utf8.RuneCountInString(slug); n < r.minSlugLen || n > r.maxSlugLen {
+		return fmt.Errorf("%w: must be between %d and %d characters", ErrInvalidSlug, r.minSlugLen, r.maxSlugLen)
+	}
+	if !r.slugPattern.MatchString(slug) {
+		return fmt.Errorf("%w: must match %s", ErrInvalidSlug, r.slugPatternSrc)
+	}
+	if r.reservedSlugs[strings.ToLower(slug)] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidSlug, slug)
+	}
+	return nil
+}
+
+// ValidateCreate runs the checks a create makes before picking a code,
+// without storing anything: the destination hosts, then the slug or the
+// requested code length.
+func (r *codeRules) ValidateCreate(p CreateParams) error {
+	if err := r.hosts.checkAll(p.URL, p.DeviceURLs); err != nil {
+		return err
+	}
+	if p.PasswordHash != "" {
+		if p.Password != "" {
+			return fmt.Errorf("%w: can't be combined with a password", ErrInvalidPasswordHash)
+		}
+		if err := ValidatePasswordHash(p.PasswordHash); err != nil {
+			return err
+		}
+	}
+	if p.Slug != "" {
+		return r.ValidateSlug(p.Slug)
+	}
+	if p.CodeLength != 0 && (p.CodeLength < r.minShortURLLen || p.CodeLength > r.maxShortURLLen) {
+		return fmt.Errorf("%w: must be between %d and %d", ErrInvalidCodeLength, r.minShortURLLen, r.maxShortURLLen)
+	}
+	return nil
+}
+
+// newURLData picks the short code for a create, generating one unless a slug
+// is given, and builds the record to store. taken reports whether a code is
+// already in use.
+func (r *codeRules) newURLData(p CreateParams, taken func(string) bool) (models.URLData, error) {
+	if err := r.ValidateCreate(p); err != nil {
+		return models.URLData{}, err
+	}
+
+	var shortCode string
+
+	if p.Slug != "" {
+		shortCode = r.normalizeCode(p.Slug)
+		if taken(shortCode) {
+			var ok bool
+			if shortCode, ok = r.suffixedSlug(shortCode, p.AutoSuffix, taken); !ok {
+				return models.URLData{}, ErrExists
+			}
+		}
+	} else {
+		length := r.shortURLLen
+		if p.CodeLength != 0 {
+			length = p.CodeLength
+		}
+
+		var err error
+		if shortCode, err = r.randomCode(length, taken); err != nil {
+			return models.URLData{}, err
+		}
+	}
+
+	// Calculate expiry time if provided
+	var expiresAt *time.Time
+	if p.Expiry > 0 {
+		t := time.Now().Add(p.Expiry)
+		expiresAt = &t
+	}
+
+	passwordHash := p.PasswordHash
+	if p.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(p.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return models.URLData{}, fmt.Errorf("hash password: %w", err)
+		}
+		passwordHash = string(hash)
+	}
+
+	now := time.Now().UTC()
+	return models.URLData{
+		URL:       p.URL,
+		Title:     p.Title,
+		ShortCode: shortCode,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: expiresAt,
+		StartsAt:  p.StartsAt,
+		Headers:   p.Headers,
+
+		AnalyticsProviders: p.AnalyticsProviders,
+		PasswordHash:       passwordHash,
+		RedirectStatus:     p.RedirectStatus,
+		Tags:               p.Tags,
+		UTM:                p.UTM,
+		MaxClicks:          p.MaxClicks,
+	}, nil
+}
+
+// codeAlphabet returns the characters random codes are drawn from: custom,
+// lowercased for case-insensitive stores, or the default. Custom alphabets
+// must consist of distinct URL-safe ASCII characters (letters, digits, "-",
+// "_", "." and "~") and have at least two of them.
+func codeAlphabet(custom string, caseInsensitive bool) (string, error) {
+	if custom == "" {
+		if caseInsensitive {
+			return lowercaseAlphabet, nil
+		}
+		return alphabet, nil
+	}
+
+	if caseInsensitive {
+		custom = strings.ToLower(custom)
+	}
+	if len(custom) < 2 {
+		return "", fmt.Errorf("invalid alphabet %q: needs at least two characters", custom)
+	}
+	seen := make(map[byte]bool, len(custom))
+	for i := 0; i < len(custom); i++ {
+		c := custom[i]
+		if !isUnreserved(c) {
+			return "", fmt.Errorf("invalid alphabet %q: %q isn't a URL-safe character", custom, c)
+		}
+		if seen[c] {
+			return "", fmt.Errorf("invalid alphabet %q: %q appears more than once", custom, c)
+		}
+		seen[c] = true
+	}
+	return custom, nil
+}
+
+// isUnreserved reports whether c can appear in a URL path unescaped.
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// normalizeCode returns the form of a short code used as the cache and
+// database key, which is lowercased when Conf.CaseInsensitive is set.
+func (r *codeRules) normalizeCode(shortCode string) string {
+	if r.caseInsensitive {
+		return strings.ToLower(shortCode)
+	}
+	return shortCode
+}
+
+// EntropyBits returns the bits of entropy of a random code of the given
+// length drawn from the store's alphabet.
+func (r *codeRules) EntropyBits(length int) float64 {
+	return entropyBits(len(r.alphabet), length)
+}
+
+// IsLowEntropy reports whether a code of this length falls below
+// Conf.MinEntropyBits. It's always false when the minimum isn't set.
+func (r *codeRules) IsLowEntropy(code string) bool {
+	return r.minEntropyBits > 0 && r.EntropyBits(len(code)) < r.minEntropyBits
+}
+
+func entropyBits(alphabetSize, length int) float64 {
+	return float64(length) * math.Log2(float64(alphabetSize))
+}
+
+// SuggestSlugs returns up to count unused variants of a taken slug, built
+// with the given strategy. Probing is bounded, so fewer than count may be
+// returned.
+func (s *Store) SuggestSlugs(slug, strategy string, count int) []string {
+	return s.suggestSlugs(slug, strategy, count, s.exists)
+}
+
+// suggestSlugs builds the suggestions for SuggestSlugs, skipping candidates
+// taken reports as in use.
+func (r *codeRules) suggestSlugs(slug, strategy string, count int, taken func(string) bool) []string {
+	slug = r.normalizeCode(slug)
+	suggestions := make([]string, 0, count)
+	for i := 0; len(suggestions) < count && i < count*maxSuggestionProbes; i++ {
+		var candidate string
+		if strategy == SuggestRandom {
+			candidate = slug + "-" + generateRandomString(r.alphabet, 2)
+		} else {
+			candidate = fmt.Sprintf("%s-%d", slug, i+2)
+		}
+
+		if !contains(suggestions, candidate) && r.ValidateSlug(candidate) == nil && !taken(candidate) {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+// bcryptHashPattern matches bcrypt hashes in their modular crypt format: the
+// version, a two digit cost and 53 characters of salt and hash.
+var bcryptHashPattern = regexp.MustCompile(`^\$2[abxy]?\$[0-9]{2}\$[./A-Za-z0-9]{53}$`)
+
+// ValidatePasswordHash checks that hash is a well-formed bcrypt hash, such as
+// one produced by htpasswd -B or another bcrypt library. Errors wrap
+// ErrInvalidPasswordHash and describe the problem.
+func ValidatePasswordHash(hash string) error {
+	if !bcryptHashPattern.MatchString(hash) {
+		return fmt.Errorf("%w: must be a bcrypt hash like $2b$10$ followed by 53 characters", ErrInvalidPasswordHash)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("%w: cost must be between %d and %d", ErrInvalidPasswordHash, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return nil
+}
+
+// suffixedSlug returns a free variant of a taken slug when auto is set,
+// trying numeric suffixes before random ones. Probing is bounded as it is for
+// suggestions.
+func (r *codeRules) suffixedSlug(slug string, auto bool, taken func(string) bool) (string, bool) {
+	if !auto {
+		return "", false
+	}
+	for _, strategy := range []string{SuggestNumeric, SuggestRandom} {
+		if suggestions := r.suggestSlugs(slug, strategy, 1, taken); len(suggestions) > 0 {
+			return suggestions[0], true
+		}
+	}
+	return "", false
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// generateRandomString creates a random string of specified length from
+// charset, which holds at most 256 characters. Characters are picked with
+// crypto/rand so upcoming codes can't be predicted, and random bytes that
+// would favor the start of charset are rejected to keep the picks uniform.
+func generateRandomString(charset string, length int) string {
+	// Largest multiple of len(charset) that fits in a byte
+	limit := 256 - 256%len(charset)
+
+	b := make([]byte, length)
+	buf := make([]byte, length+length/2)
+	for i := 0; i < length; {
+		if _, err := rand.Read(buf); err != nil {
+			panic(fmt.Sprintf("read random bytes: %v", err))
+		}
+		for _, r := range buf {
+			if int(r) >= limit {
+				continue
+			}
+			b[i] = charset[int(r)%len(charset)]
+			if i++; i == length {
+				break
+			}
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Random bytes past the largest multiple of the charset size are rejected,
+// so every character is drawn equally often. Without that the first
+// 256%len(charset) characters would come up about a quarter more often, which
+// a chi-square test over the default alphabet picks up easily.
+func TestGenerateRandomStringUniform(t *testing.T) {
+	const perChar = 2000
+	n := len(alphabet) * perChar
+	counts := make(map[rune]int, len(alphabet))
+	for _, c := range generateRandomString(alphabet, n) {
+		counts[c]++
+	}
+
+	var chiSquare float64
+	for _, c := range alphabet {
+		d := float64(counts[c] - perChar)
+		chiSquare += d * d / perChar
+	}
+	// With 55 degrees of freedom the statistic averages 55 with a standard
+	// deviation of about 10.5, so uniform picks stay well under 130 while
+	// modulo bias lands in the hundreds.
+	if chiSquare > 130 {
+		t.Errorf("chi-square = %.1f over %d characters, want picks uniform across %q", chiSquare, n, alphabet)
+	}
+	if len(counts) != len(alphabet) {
+		t.Errorf("drew %d distinct characters, want all %d of the alphabet", len(counts), len(alphabet))
+	}
+	for c := range counts {
+		if !strings.ContainsRune(alphabet, c) {
+			t.Errorf("drew %q, which isn't in the alphabet", c)
+		}
+	}
+}
+
+func TestDefaultAlphabetsAvoidLookalikes(t *testing.T) {
+	for _, set := range []string{alphabet, lowercaseAlphabet} {
+		if i := strings.IndexAny(set, "0Oo1lI"); i >= 0 {
+			t.Errorf("alphabet %q has the lookalike %q", set, set[i])
+		}
+		if _, err := codeAlphabet(set, false); err != nil {
+			t.Errorf("default alphabet rejected: %v", err)
+		}
+	}
+	if strings.Trim(lowercaseAlphabet, alphabet) != "" || strings.ToLower(lowercaseAlphabet) != lowercaseAlphabet {
+		t.Errorf("lowercase alphabet %q isn't the lowercase part of %q", lowercaseAlphabet, alphabet)
+	}
+
+	cfg := testConf(t)
+	cfg.ShortURLLength = 64
+	s := newTestStore(t, cfg)
+	code := mustCreate(t, s, CreateParams{URL: "https://example.com"}).ShortCode
+	if strings.Trim(code, alphabet) != "" {
+		t.Errorf("code %q has characters outside the default alphabet", code)
+	}
+}
+
+func TestCodeAlphabet(t *testing.T) {
+	tests := []struct {
+		custom          string
+		caseInsensitive bool
+		want            string // Empty when rejected
+	}{
+		{"", false, alphabet},
+		{"", true, lowercaseAlphabet},
+		{"0123456789", false, "0123456789"},
+		{"ABCdef", true, "abcdef"},
+		{"ab-_.~", false, "ab-_.~"},
+		{"a", false, ""},
+		{"abca", false, ""},
+		{"AaB", true, ""}, // Duplicates once lowercased
+		{"ab/c", false, ""},
+		{"abç", false, ""},
+	}
+	for _, tc := range tests {
+		got, err := codeAlphabet(tc.custom, tc.caseInsensitive)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("codeAlphabet(%q, %t) = %q, want it rejected", tc.custom, tc.caseInsensitive, got)
+		case tc.want != "" && err != nil:
+			t.Errorf("codeAlphabet(%q, %t) failed: %v", tc.custom, tc.caseInsensitive, err)
+		case got != tc.want:
+			t.Errorf("codeAlphabet(%q, %t) = %q, want %q", tc.custom, tc.caseInsensitive, got, tc.want)
+		}
+	}
+}
+
+func TestValidateSlug(t *testing.T) {
+	tests := []struct {
+		name string
+		conf func(*Conf)
+		slug string
+		want string // Part of the error, empty when valid
+	}{
+		{name: "letters digits dash underscore", slug: "Spring_Sale-2024"},
+		{name: "empty", slug: "", want: "between 1 and 64"},
+		{name: "longest", slug: strings.Repeat("a", 64)},
+		{name: "too long", slug: strings.Repeat("a", 65), want: "between 1 and 64"},
+		{name: "slash", slug: "a/b", want: "must match"},
+		{name: "space", slug: "a b", want: "must match"},
+		{name: "dot", slug: "a.b", want: "must match"},
+		{name: "unicode", slug: "café", want: "must match"},
+		{name: "query", slug: "a?b=c", want: "must match"},
+		{name: "reserved api", slug: "api", want: "reserved"},
+		{name: "reserved admin", slug: "admin", want: "reserved"},
+		{name: "reserved health", slug: "health", want: "reserved"},
+		{name: "reserved metrics", slug: "metrics", want: "reserved"},
+		{name: "reserved in any case", slug: "Metrics", want: "reserved"},
+		{name: "reserved word as a prefix", slug: "api-docs"},
+		{
+			name: "custom length",
+			conf: func(c *Conf) { c.MinSlugLength, c.MaxSlugLength = 3, 5 },
+			slug: "ab",
+			want: "between 3 and 5",
+		},
+		{
+			name: "custom pattern",
+			conf: func(c *Conf) { c.SlugPattern = `[a-z]+` },
+			slug: "Promo",
+			want: "must match [a-z]+",
+		},
+		{
+			name: "custom reserved words replace the defaults",
+			conf: func(c *Conf) { c.ReservedSlugs = []string{"login"} },
+			slug: "api",
+		},
+		{
+			name: "custom reserved word",
+			conf: func(c *Conf) { c.ReservedSlugs = []string{"login"} },
+			slug: "LOGIN",
+			want: "reserved",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Conf{ShortURLLength: 6}
+			if tc.conf != nil {
+				tc.conf(&cfg)
+			}
+			rules, err := newCodeRules(cfg, testLogger)
+			if err != nil {
+				t.Fatalf("newCodeRules: %v", err)
+			}
+			err = rules.ValidateSlug(tc.slug)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("ValidateSlug(%q) = %v, want it valid", tc.slug, err)
+			case tc.want != "" && (!errors.Is(err, ErrInvalidSlug) || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("ValidateSlug(%q) = %v, want ErrInvalidSlug about %q", tc.slug, err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// urlColumns lists the urls table columns read by scanURL and written with
+// urlArgs. All three must be kept in the same order.
+const urlColumns = `short_code, url, title, created_at, expires_at, headers, analytics_providers, starts_at, click_count, password_hash, redirect_status, updated_at, utm_source, utm_medium, utm_campaign, max_clicks, last_accessed_at`
+
+var (
+	urlColumnCount  = len(strings.Split(urlColumns, ","))
+	urlPlaceholders = "(" + strings.TrimSuffix(strings.Repeat("?,", urlColumnCount), ",") + ")"
+)
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanURL scans a row selected with urlColumns, followed by any extra
+// destinations selected after them.
+func scanURL(row rowScanner, extra ...any) (models.URLData, error) {
+	var (
+		urlData            models.URLData
+		title              sql.NullString
+		expiresAt          sql.NullTime
+		headers            sql.NullString
+		analyticsProviders sql.NullString
+		startsAt           sql.NullTime
+		passwordHash       sql.NullString
+		updatedAt          sql.NullTime
+		lastAccessedAt     sql.NullTime
+		utm                [3]sql.NullString // Source, medium and campaign
+	)
+	dest := append([]any{
+		&urlData.ShortCode,
+		&urlData.URL,
+		&title,
+		&urlData.CreatedAt,
+		&expiresAt,
+		&headers,
+		&analyticsProviders,
+		&startsAt,
+		&urlData.ClickCount,
+		&passwordHash,
+		&urlData.RedirectStatus,
+		&updatedAt,
+		&utm[0],
+		&utm[1],
+		&utm[2],
+		&urlData.MaxClicks,
+		&lastAccessedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return models.URLData{}, err
+	}
+
+	urlData.Title = title.String
+	urlData.PasswordHash = passwordHash.String
+	if expiresAt.Valid {
+		urlData.ExpiresAt = &expiresAt.Time
+	}
+	if startsAt.Valid {
+		urlData.StartsAt = &startsAt.Time
+	}
+	// Rows written before updated_at existed haven't changed since creation
+	urlData.UpdatedAt = urlData.CreatedAt
+	if updatedAt.Valid {
+		urlData.UpdatedAt = updatedAt.Time
+	}
+	if lastAccessedAt.Valid {
+		urlData.LastAccessedAt = &lastAccessedAt.Time
+	}
+	if utm[0].String != "" || utm[1].String != "" || utm[2].String != "" {
+		urlData.UTM = &models.UTM{Source: utm[0].String, Medium: utm[1].String, Campaign: utm[2].String}
+	}
+	if err := decodeJSON(headers, &urlData.Headers); err != nil {
+		return models.URLData{}, fmt.Errorf("decode headers for %s: %w", urlData.ShortCode, err)
+	}
+	if err := decodeJSON(analyticsProviders, &urlData.AnalyticsProviders); err != nil {
+		return models.URLData{}, fmt.Errorf("decode analytics providers for %s: %w", urlData.ShortCode, err)
+	}
+	return urlData, nil
+}
+
+// urlArgs returns the values of urlData for the columns in urlColumns.
+func urlArgs(urlData models.URLData) ([]any, error) {
+	headers, err := encodeJSON(urlData.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("encode headers: %w", err)
+	}
+	analyticsProviders, err := encodeJSON(urlData.AnalyticsProviders)
+	if err != nil {
+		return nil, fmt.Errorf("encode analytics providers: %w", err)
+	}
+	var utm models.UTM
+	if urlData.UTM != nil {
+		utm = *urlData.UTM
+	}
+	return []any{
+		urlData.ShortCode,
+		urlData.URL,
+		urlData.Title,
+		urlData.CreatedAt,
+		urlData.ExpiresAt,
+		headers,
+		analyticsProviders,
+		urlData.StartsAt,
+		urlData.ClickCount,
+		nullString(urlData.PasswordHash),
+		urlData.RedirectStatus,
+		urlData.UpdatedAt,
+		nullString(utm.Source),
+		nullString(utm.Medium),
+		nullString(utm.Campaign),
+		urlData.MaxClicks,
+		urlData.LastAccessedAt,
+	}, nil
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// encodeJSON serializes a map or list for storage in a TEXT column, storing
+// NULL when it's empty.
+func encodeJSON[T ~map[string]string | ~[]string](v T) (sql.NullString, error) {
+	if len(v) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// decodeJSON is the inverse of encodeJSON, leaving v untouched for NULL.
+func decodeJSON(ns sql.NullString, v any) error {
+	if !ns.Valid || ns.String == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(ns.String), v)
+}
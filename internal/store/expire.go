@@ -4,58 +4,100 @@ import (
 	"context"
 	"time"
 
-	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
 )
 
-// StartExpiryWorker starts a background goroutine that periodically checks and removes expired URLs
-func (s *Store) StartExpiryWorker(ctx context.Context) {
-	ticker := time.NewTicker(24 * time.Hour)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				if err := s.removeExpiredURLs(ctx); err != nil {
-					s.logger.Error("failed to remove expired URLs", "error", err)
-				}
+// expiryBatchSize bounds the rows deleted per statement, so a large backlog of
+// expired URLs doesn't hold the write lock for long.
+const expiryBatchSize = 500
+
+// expiryWorker periodically removes expired URLs, including ones that are
+// never requested again and so are never deleted by GetRedirectData.
+func (s *Store) expiryWorker(interval time.Duration) {
+	defer s.bg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.logger.Info("started URL expiry worker", "interval", interval.String())
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.removeExpiredURLs(context.Background()); err != nil {
+				s.logger.Error("failed to remove expired URLs", "error", err)
 			}
 		}
-	}()
-	s.logger.Info("started URL expiry worker")
+	}
 }
 
-// removeExpiredURLs removes all expired URLs from both the database and cache
+// removeExpiredURLs removes all expired URLs past their retention period from
+// both the database and cache, in batches of expiryBatchSize.
 func (s *Store) removeExpiredURLs(ctx context.Context) error {
-	// Query for expired URLs
+	total := 0
+	for {
+		n, err := s.removeExpiredBatch(ctx)
+		total += n
+		if err != nil {
+			return err
+		}
+		if n < expiryBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		s.logger.Info("removed expired URLs", "count", total)
+	}
+	return nil
+}
+
+// removeExpiredBatch deletes up to expiryBatchSize expired URLs and returns
+// how many were deleted.
+func (s *Store) removeExpiredBatch(ctx context.Context) (int, error) {
+	return s.deleteBatch(ctx, `expires_at IS NOT NULL AND expires_at <= ?`,
+		s.now().Add(-s.expiredRetention).UTC())
+}
+
+// deleteBatch deletes up to expiryBatchSize URLs matching the where condition
+// from both the database and cache, and returns how many were deleted.
+func (s *Store) deleteBatch(ctx context.Context, where string, args ...any) (int, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`DELETE FROM urls
-		 WHERE expires_at IS NOT NULL
-		 AND expires_at <= datetime('now')
-		 RETURNING short_code`)
+		`DELETE FROM urls WHERE short_code IN (
+			SELECT short_code FROM urls
+			WHERE `+where+`
+			LIMIT ?
+		) RETURNING short_code`, append(args, expiryBatchSize)...)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer rows.Close()
 
-	// Remove expired URLs from cache
+	// Remove deleted URLs from cache
+	var removed []models.URLData
 	s.mu.Lock()
 	for rows.Next() {
 		var shortCode string
 		if err := rows.Scan(&shortCode); err != nil {
 			s.mu.Unlock()
-			return err
+			return len(removed), err
 		}
-		delete(s.cache, shortCode)
+		urlData, ok := s.cache.get(shortCode)
+		if !ok {
+			urlData.ShortCode = shortCode
+		}
+		removed = append(removed, urlData)
+		s.cache.remove(shortCode)
+		s.aliases.removeCode(shortCode)
+		delete(s.pendingClicks, shortCode)
+		delete(s.pendingAccess, shortCode)
 	}
-	// Update metrics
-	metrics.URLsStoredGauge.Set(float64(len(s.cache)))
+	s.addStored(-len(removed))
 	s.mu.Unlock()
 
-	if err := rows.Err(); err != nil {
-		return err
+	for _, urlData := range removed {
+		s.emitChange(OpDelete, urlData)
 	}
 
-	return nil
+	return len(removed), rows.Err()
 }
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// setClock makes the store check expiry against the returned time, which
+// tests move forward.
+func setClock(s *Store) *time.Time {
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	return &now
+}
+
+// Expired URLs are kept for the retention period, answering with ErrExpired,
+// and deleted by the first reap past it.
+func TestExpiryReaperRetention(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.ExpiredRetention = time.Hour
+	cfg.ChangeEventsBuffer = 10
+	s := newTestStore(t, cfg)
+	now := setClock(s)
+	start := *now
+
+	mustCreate(t, s, CreateParams{URL: "https://example.com/brief", Slug: "brief", Expiry: time.Minute})
+	mustCreate(t, s, CreateParams{URL: "https://example.com/kept", Slug: "kept"})
+	// The reaper only deletes from the database
+	s.triggerFlush()
+	drainChanges(s)
+
+	steps := []struct {
+		name     string
+		at       time.Duration // Since the URL was created
+		redirect error
+		reaped   bool
+	}{
+		{name: "before expiry", at: 30 * time.Second},
+		{name: "just expired", at: time.Minute + time.Second, redirect: ErrExpired},
+		{name: "within retention", at: time.Minute + 59*time.Minute, redirect: ErrExpired},
+		{name: "past retention", at: time.Minute + time.Hour + time.Second, reaped: true},
+	}
+	for _, step := range steps {
+		*now = start.Add(step.at)
+		if !step.reaped {
+			if _, err := s.GetRedirectData(ctx, "brief"); !errors.Is(err, step.redirect) {
+				t.Errorf("%s: redirect = %v, want %v", step.name, err, step.redirect)
+			}
+		}
+
+		if err := s.removeExpiredURLs(ctx); err != nil {
+			t.Fatalf("%s: removeExpiredURLs: %v", step.name, err)
+		}
+		_, err := s.GetURL(ctx, "brief")
+		evts := drainChanges(s)
+		if step.reaped {
+			if !errors.Is(err, ErrNotExist) {
+				t.Errorf("%s: GetURL after reaping = %v, want ErrNotExist", step.name, err)
+			}
+			if len(evts) != 1 || evts[0].Op != OpDelete || evts[0].URL.ShortCode != "brief" {
+				t.Errorf("%s: changes = %+v, want brief deleted", step.name, evts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetURL after reaping = %v, want it kept", step.name, err)
+		}
+		if len(evts) != 0 {
+			t.Errorf("%s: changes = %+v, want none", step.name, evts)
+		}
+	}
+
+	if _, err := s.GetRedirectData(ctx, "kept"); err != nil {
+		t.Errorf("URL without expiry: %v", err)
+	}
+	s.mu.RLock()
+	stored := s.stored
+	s.mu.RUnlock()
+	if stored != 1 {
+		t.Errorf("%d URLs counted as stored, want 1", stored)
+	}
+}
+
+// A scheduled link only redirects between its start and its expiry.
+func TestActivationWindow(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, testConf(t))
+	now := setClock(s)
+	start := *now
+
+	startsAt := start.Add(time.Hour)
+	mustCreate(t, s, CreateParams{URL: "https://example.com/launch", Slug: "launch", StartsAt: &startsAt, Expiry: 2 * time.Hour})
+
+	steps := []struct {
+		name string
+		at   time.Duration
+		want error
+	}{
+		{"before the start", 30 * time.Minute, ErrNotYetActive},
+		{"at the start", time.Hour, nil},
+		{"during the window", 90 * time.Minute, nil},
+		{"after expiry", 2*time.Hour + time.Second, ErrExpired},
+		{"deleted by the expired redirect", 3 * time.Hour, ErrNotExist},
+	}
+	for _, step := range steps {
+		*now = start.Add(step.at)
+		if _, err := s.PeekRedirectData(ctx, "launch"); !errors.Is(err, step.want) {
+			t.Errorf("%s: peek = %v, want %v", step.name, err, step.want)
+		}
+		urlData, err := s.GetRedirectData(ctx, "launch")
+		if !errors.Is(err, step.want) {
+			t.Errorf("%s: redirect = %v, want %v", step.name, err, step.want)
+		}
+		if err == nil && urlData.URL != "https://example.com/launch" {
+			t.Errorf("%s: redirects to %s", step.name, urlData.URL)
+		}
+	}
+
+	// Not yet active links aren't expired, so the reaper leaves them alone
+	*now = start
+	startsAt = start.Add(time.Hour)
+	mustCreate(t, s, CreateParams{URL: "https://example.com/later", Slug: "later", StartsAt: &startsAt})
+	s.triggerFlush()
+	if err := s.removeExpiredURLs(ctx); err != nil {
+		t.Fatalf("removeExpiredURLs: %v", err)
+	}
+	if _, err := s.GetURL(ctx, "later"); err != nil {
+		t.Errorf("GetURL(later) after reaping: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// streamBatchSize is the number of rows StreamURLs reads per query.
+const streamBatchSize = 500
+
+// StreamURLs calls fn for every stored URL, oldest first, stopping at the
+// first error fn returns. Rows are read in batches of streamBatchSize so the
+// whole table is never held in memory, and no query is open while fn runs.
+// Device URLs aren't loaded, and URLs still in the write buffer are left out.
+func (s *Store) StreamURLs(ctx context.Context, fn func(models.URLData) error) error {
+	var lastRowID int64
+	for {
+		batch, err := s.urlsAfter(ctx, &lastRowID)
+		if err != nil {
+			return err
+		}
+
+		for _, urlData := range batch {
+			if err := fn(urlData); err != nil {
+				return err
+			}
+		}
+		if len(batch) < streamBatchSize {
+			return nil
+		}
+	}
+}
+
+// urlsAfter reads the next batch of URLs after the rowid in lastRowID and
+// advances it.
+func (s *Store) urlsAfter(ctx context.Context, lastRowID *int64) ([]models.URLData, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+urlColumns+`, rowid
+		FROM urls
+		WHERE rowid > ?
+		ORDER BY rowid
+		LIMIT ?
+	`, *lastRowID, streamBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch := make([]models.URLData, 0, streamBatchSize)
+	for rows.Next() {
+		urlData, err := scanURL(rows, lastRowID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add clicks that haven't been flushed yet
+		s.mu.RLock()
+		urlData.ClickCount += s.pendingClicks[urlData.ShortCode]
+		s.mu.RUnlock()
+
+		batch = append(batch, urlData)
+	}
+	return batch, rows.Err()
+}
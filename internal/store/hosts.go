@@ -0,0 +1,94 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// hostRules restricts the hosts URLs may point to. Patterns are host names,
+// or "*.example.com" to match any subdomain of example.com but not
+// example.com itself. Denied hosts are rejected even when allowed, and
+// without allowed hosts every host that isn't denied is.
+type hostRules struct {
+	allowed []string
+	denied  []string
+}
+
+func newHostRules(cfg Conf) (hostRules, error) {
+	allowed, err := hostPatterns(cfg.AllowedHosts)
+	if err != nil {
+		return hostRules{}, fmt.Errorf("invalid allowed hosts: %w", err)
+	}
+	denied, err := hostPatterns(cfg.DeniedHosts)
+	if err != nil {
+		return hostRules{}, fmt.Errorf("invalid denied hosts: %w", err)
+	}
+	return hostRules{allowed: allowed, denied: denied}, nil
+}
+
+// hostPatterns normalizes host patterns to lowercase without a trailing dot.
+func hostPatterns(patterns []string) ([]string, error) {
+	out := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		if p == "" || p == "*." || strings.Contains(strings.TrimPrefix(p, "*."), "*") {
+			return nil, fmt.Errorf("%q is not a host name or *.domain", p)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (h hostRules) empty() bool {
+	return len(h.allowed) == 0 && len(h.denied) == 0
+}
+
+// check returns ErrHostNotAllowed when the host of rawURL isn't allowed.
+func (h hostRules) check(rawURL string) error {
+	if h.empty() {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("%w: %q has no host", ErrHostNotAllowed, rawURL)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	if matchHost(h.denied, host) || (len(h.allowed) > 0 && !matchHost(h.allowed, host)) {
+		return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+	}
+	return nil
+}
+
+// checkAll checks a URL and its device URLs, skipping empty ones.
+func (h hostRules) checkAll(rawURL string, deviceURLs map[string]string) error {
+	if rawURL != "" {
+		if err := h.check(rawURL); err != nil {
+			return err
+		}
+	}
+	for _, deviceURL := range deviceURLs {
+		if deviceURL == "" {
+			continue
+		}
+		if err := h.check(deviceURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestHostRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		url     string
+		ok      bool
+	}{
+		{name: "no rules", url: "https://anything.example", ok: true},
+		{name: "allowed host", allowed: []string{"example.com"}, url: "https://example.com/page", ok: true},
+		{name: "allowed host with port and case", allowed: []string{"Example.com."}, url: "https://EXAMPLE.com:8443/page", ok: true},
+		{name: "host not allowed", allowed: []string{"example.com"}, url: "https://evil.example/page"},
+		{name: "exact host doesn't allow subdomains", allowed: []string{"example.com"}, url: "https://www.example.com"},
+		{name: "denied host", denied: []string{"evil.example"}, url: "https://evil.example/login"},
+		{name: "other host with a denylist", denied: []string{"evil.example"}, url: "https://example.com", ok: true},
+		{name: "wildcard subdomain", allowed: []string{"*.example.com"}, url: "https://docs.example.com", ok: true},
+		{name: "wildcard nested subdomain", allowed: []string{"*.example.com"}, url: "https://a.b.example.com", ok: true},
+		{name: "wildcard excludes the domain", allowed: []string{"*.example.com"}, url: "https://example.com"},
+		{name: "wildcard isn't a suffix match", allowed: []string{"*.example.com"}, url: "https://notexample.com"},
+		{
+			name:    "deny overrides wildcard allow",
+			allowed: []string{"*.example.com"},
+			denied:  []string{"login.example.com"},
+			url:     "https://login.example.com",
+		},
+		{
+			name:    "wildcard deny overrides exact allow",
+			allowed: []string{"files.example.com"},
+			denied:  []string{"*.example.com"},
+			url:     "https://files.example.com",
+		},
+		{name: "no host", allowed: []string{"example.com"}, url: "/relative"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := newHostRules(Conf{AllowedHosts: tc.allowed, DeniedHosts: tc.denied})
+			if err != nil {
+				t.Fatalf("newHostRules: %v", err)
+			}
+			err = rules.check(tc.url)
+			if tc.ok && err != nil {
+				t.Errorf("check(%s) = %v, want allowed", tc.url, err)
+			}
+			if !tc.ok && !errors.Is(err, ErrHostNotAllowed) {
+				t.Errorf("check(%s) = %v, want ErrHostNotAllowed", tc.url, err)
+			}
+		})
+	}
+}
+
+func TestHostRulesInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "*.", "*", "ex*ample.com", "*.*.example.com"} {
+		if _, err := newHostRules(Conf{AllowedHosts: []string{pattern}}); err == nil {
+			t.Errorf("allowed host %q accepted", pattern)
+		}
+	}
+}
+
+// Host rules are enforced by the store for every write, whatever the handler.
+func TestStoreEnforcesHostRules(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.AllowedHosts = []string{"*.example.com"}
+	cfg.DeniedHosts = []string{"login.example.com"}
+	s := newTestStore(t, cfg)
+
+	link := mustCreate(t, s, CreateParams{URL: "https://www.example.com"})
+	for _, p := range []CreateParams{
+		{URL: "https://evil.example"},
+		{URL: "https://login.example.com"},
+		{URL: "https://www.example.com", DeviceURLs: map[string]string{"ios": "https://evil.example/app"}},
+	} {
+		if _, err := s.CreateShortURL(ctx, p); !errors.Is(err, ErrHostNotAllowed) {
+			t.Errorf("CreateShortURL(%s, %v) = %v, want ErrHostNotAllowed", p.URL, p.DeviceURLs, err)
+		}
+	}
+
+	denied := "https://login.example.com/reset"
+	if _, err := s.UpdateURL(ctx, link.ShortCode, UpdateParams{URL: &denied}); !errors.Is(err, ErrHostNotAllowed) {
+		t.Errorf("UpdateURL to %s = %v, want ErrHostNotAllowed", denied, err)
+	}
+	allowed := "https://docs.example.com"
+	if _, err := s.UpdateURL(ctx, link.ShortCode, UpdateParams{URL: &allowed}); err != nil {
+		t.Errorf("UpdateURL to %s: %v", allowed, err)
+	}
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// columnMigrations adds columns introduced after the initial schema. SQLite
+// has no "ADD COLUMN IF NOT EXISTS", so each column is only added when it is
+// missing from the table. New entries must be appended at the end.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"urls", "headers", "TEXT"},
+	{"urls", "analytics_providers", "TEXT"},
+	{"urls", "starts_at", "DATETIME"},
+	{"urls", "click_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"urls", "password_hash", "TEXT"},
+	{"urls", "redirect_status", "INTEGER NOT NULL DEFAULT 0"},
+	{"urls", "updated_at", "DATETIME"},
+	{"urls", "utm_source", "TEXT"},
+	{"urls", "utm_medium", "TEXT"},
+	{"urls", "utm_campaign", "TEXT"},
+	{"urls", "max_clicks", "INTEGER NOT NULL DEFAULT 0"},
+	{"urls", "last_accessed_at", "DATETIME"},
+}
+
+// migrate brings an existing database up to date with the current schema.
+func migrate(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		exists, err := columnExists(db, m.table, m.column)
+		if err != nil {
+			return fmt.Errorf("inspect %s.%s: %w", m.table, m.column, err)
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", m.table, m.column, err)
+		}
+	}
+	if err := dropPlatformCheck(db); err != nil {
+		return fmt.Errorf("drop device platform check: %w", err)
+	}
+	return nil
+}
+
+// dropPlatformCheck rebuilds device_urls without the CHECK constraint that
+// limited platforms to android, ios, macos and web, which are configurable
+// now. SQLite can't drop a constraint, so the rows are copied to a new table.
+func dropPlatformCheck(db *sql.DB) error {
+	var schema string
+	if err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'device_urls'`).Scan(&schema); err != nil {
+		return err
+	}
+	if !strings.Contains(schema, "CHECK(platform") {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		CREATE TABLE device_urls_new (
+			short_code TEXT,
+			platform TEXT,
+			url TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE,
+			PRIMARY KEY (short_code, platform)
+		);
+		INSERT INTO device_urls_new (short_code, platform, url, created_at)
+			SELECT short_code, platform, url, created_at FROM device_urls;
+		DROP TABLE device_urls;
+		ALTER TABLE device_urls_new RENAME TO device_urls;
+	`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultOriginTimeout = 2 * time.Second
+
+// origin resolves codes missing locally from an upstream lil-compatible API,
+// for migrating links lazily as they're accessed.
+type origin struct {
+	url     string
+	apiKey  string
+	timeout time.Duration
+	client  *http.Client
+	group   singleflight.Group
+}
+
+// originResp is the response envelope expected from the origin, matching
+// the one returned by this service's own API.
+type originResp struct {
+	Status string         `json:"status"`
+	Data   models.URLData `json:"data"`
+}
+
+// fetch looks up a short code at the origin with GET <origin_url>/<short_code>.
+func (o *origin) fetch(ctx context.Context, shortCode string) (models.URLData, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.url, "/")+"/"+url.PathEscape(shortCode), nil)
+	if err != nil {
+		return models.URLData{}, fmt.Errorf("create origin request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if o.apiKey != "" {
+		req.Header.Set("X-API-Key", o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return models.URLData{}, fmt.Errorf("origin request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return models.URLData{}, ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return models.URLData{}, fmt.Errorf("origin request failed with status: %d", resp.StatusCode)
+	}
+
+	var out originResp
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return models.URLData{}, fmt.Errorf("decode origin response: %w", err)
+	}
+	if out.Data.URL == "" {
+		return models.URLData{}, fmt.Errorf("origin returned no URL for %s", shortCode)
+	}
+	return out.Data, nil
+}
+
+// readThrough fetches a short code missing from the cache from the origin and
+// imports it locally. Concurrent misses for the same code share one fetch,
+// which runs on its own context bounded by the origin timeout so a caller
+// giving up doesn't fail the others waiting on it.
+func (s *Store) readThrough(ctx context.Context, shortCode string) (models.URLData, error) {
+	ch := s.origin.group.DoChan(shortCode, func() (interface{}, error) {
+		// Another lookup may have imported it while this one was waiting
+		s.mu.RLock()
+		urlData, exists := s.cache.get(shortCode)
+		s.mu.RUnlock()
+		if exists {
+			return urlData, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.origin.timeout)
+		defer cancel()
+
+		urlData, err := s.origin.fetch(ctx, shortCode)
+		if err != nil {
+			return models.URLData{}, err
+		}
+		urlData.ShortCode = shortCode
+		if err := s.importURL(ctx, urlData); err != nil {
+			return models.URLData{}, err
+		}
+		s.logger.Info("imported url from origin", "short_code", shortCode)
+		return urlData, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return models.URLData{}, res.Err
+		}
+		return res.Val.(models.URLData), nil
+	case <-ctx.Done():
+		return models.URLData{}, ctx.Err()
+	}
+}
+
+// importURL persists a URL fetched from the origin as is, keeping its
+// original timestamps, and adds it to the cache.
+func (s *Store) importURL(ctx context.Context, urlData models.URLData) error {
+	if urlData.CreatedAt.IsZero() {
+		urlData.CreatedAt = time.Now().UTC()
+	}
+	if urlData.UpdatedAt.IsZero() {
+		urlData.UpdatedAt = urlData.CreatedAt
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	args, err := urlArgs(urlData)
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO urls (`+urlColumns+`) VALUES `+urlPlaceholders, args...)
+	if err != nil {
+		return fmt.Errorf("insert url: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	for platform, deviceURL := range urlData.DeviceURLs {
+		if deviceURL.CreatedAt.IsZero() {
+			deviceURL.CreatedAt = urlData.CreatedAt
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO device_urls (short_code, platform, url, created_at)
+			VALUES (?, ?, ?, ?)
+		`, urlData.ShortCode, platform, deviceURL.URL, deviceURL.CreatedAt); err != nil {
+			return fmt.Errorf("insert device url: %w", err)
+		}
+	}
+
+	if err := insertTags(ctx, tx, urlData.ShortCode, urlData.Tags); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	urlData.HasDeviceURLs = len(urlData.DeviceURLs) > 0
+	s.mu.Lock()
+	s.cache.set(urlData.ShortCode, urlData)
+	s.addStored(int(inserted))
+	s.mu.Unlock()
+
+	s.emitChange(OpCreate, urlData)
+	return nil
+}
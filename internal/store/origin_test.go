@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// fakeOrigin serves the links in urls like lil's GET /api/v1/urls/{shortCode},
+// requiring apiKey. Lookups for codes in hold wait until it's closed.
+type fakeOrigin struct {
+	*httptest.Server
+	apiKey string
+	urls   map[string]models.URLData
+	hold   map[string]chan struct{}
+	hits   atomic.Int64
+}
+
+func newFakeOrigin(t *testing.T, apiKey string, urls map[string]models.URLData) *fakeOrigin {
+	o := &fakeOrigin{apiKey: apiKey, urls: urls, hold: make(map[string]chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/urls/{shortCode}", func(w http.ResponseWriter, r *http.Request) {
+		o.hits.Add(1)
+		if r.Header.Get("X-API-Key") != o.apiKey {
+			http.Error(w, `{"status": "error"}`, http.StatusUnauthorized)
+			return
+		}
+		shortCode := r.PathValue("shortCode")
+		if ch, ok := o.hold[shortCode]; ok {
+			<-ch
+		}
+		urlData, ok := o.urls[shortCode]
+		if !ok {
+			http.Error(w, `{"status": "error"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(originResp{Status: "success", Data: urlData})
+	})
+	o.Server = httptest.NewServer(mux)
+	t.Cleanup(o.Close)
+	return o
+}
+
+func TestOriginReadThrough(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	origin := newFakeOrigin(t, "secret", map[string]models.URLData{
+		"old": {
+			ShortCode: "old",
+			URL:       "https://example.com/old",
+			Title:     "Old",
+			Tags:      []string{"migrated"},
+			CreatedAt: created,
+		},
+	})
+
+	cfg := testConf(t)
+	cfg.BufferSize = 0
+	cfg.OriginURL = origin.URL + "/api/v1/urls"
+	cfg.OriginAPIKey = "secret"
+	s := newTestStore(t, cfg)
+
+	// Fetched and imported on first access
+	urlData, err := s.GetRedirectData(ctx, "old")
+	if err != nil {
+		t.Fatalf("GetRedirectData(old): %v", err)
+	}
+	if urlData.URL != "https://example.com/old" {
+		t.Errorf("redirects to %s, want https://example.com/old", urlData.URL)
+	}
+
+	// Served locally from then on
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetRedirectData(ctx, "old"); err != nil {
+			t.Fatalf("GetRedirectData(old): %v", err)
+		}
+	}
+	if n := origin.hits.Load(); n != 1 {
+		t.Errorf("origin was asked %d times, want 1", n)
+	}
+	urlData, err = s.GetURL(ctx, "old")
+	if err != nil {
+		t.Fatalf("GetURL(old): %v", err)
+	}
+	if urlData.Title != "Old" || !slices.Equal(urlData.Tags, []string{"migrated"}) || !urlData.CreatedAt.Equal(created) || urlData.ClickCount != 4 {
+		t.Errorf("imported %+v, want the origin's title, tags and creation time with 4 clicks", urlData)
+	}
+
+	// Codes the origin doesn't know stay missing
+	if _, err := s.GetRedirectData(ctx, "unknown"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("GetRedirectData(unknown) = %v, want ErrNotExist", err)
+	}
+
+	// Imported links are stored, and outlive the origin
+	origin.Close()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	cfg.OriginURL = ""
+	s = newTestStore(t, cfg)
+	urlData, err = s.GetURL(ctx, "old")
+	if err != nil {
+		t.Fatalf("GetURL(old) after reopening: %v", err)
+	}
+	if urlData.URL != "https://example.com/old" || urlData.ClickCount != 4 {
+		t.Errorf("after reopening got %s with %d clicks, want https://example.com/old with 4", urlData.URL, urlData.ClickCount)
+	}
+}
+
+func TestOriginAPIKey(t *testing.T) {
+	origin := newFakeOrigin(t, "secret", map[string]models.URLData{
+		"old": {ShortCode: "old", URL: "https://example.com/old"},
+	})
+
+	cfg := testConf(t)
+	cfg.OriginURL = origin.URL + "/api/v1/urls"
+	cfg.OriginAPIKey = "wrong"
+	s := newTestStore(t, cfg)
+
+	_, err := s.GetRedirectData(context.Background(), "old")
+	if err == nil || errors.Is(err, ErrNotExist) {
+		t.Errorf("GetRedirectData(old) with the wrong key = %v, want the origin's refusal", err)
+	}
+}
+
+func TestOriginFetchOutlivesCaller(t *testing.T) {
+	origin := newFakeOrigin(t, "", map[string]models.URLData{
+		"slow": {ShortCode: "slow", URL: "https://example.com/slow"},
+	})
+	release := make(chan struct{})
+	origin.hold["slow"] = release
+
+	cfg := testConf(t)
+	cfg.OriginURL = origin.URL + "/api/v1/urls"
+	s := newTestStore(t, cfg)
+
+	// The first lookup starts the fetch and gives up on it
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := s.GetRedirectData(ctx, "slow")
+		first <- err
+	}()
+	for origin.hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Others join the fetch in flight
+	const waiters = 5
+	var (
+		wg  sync.WaitGroup
+		got atomic.Int64
+	)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.GetRedirectData(context.Background(), "slow"); err != nil {
+				t.Errorf("GetRedirectData(slow): %v", err)
+				return
+			}
+			got.Add(1)
+		}()
+	}
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled lookup = %v, want context.Canceled", err)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := got.Load(); n != waiters {
+		t.Errorf("%d of %d lookups waiting on the fetch succeeded", n, waiters)
+	}
+	if n := origin.hits.Load(); n != 1 {
+		t.Errorf("origin was asked %d times, want 1", n)
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// PurgeCriteria selects the URLs removed by Purge. Set fields are combined,
+// so a URL has to match all of them.
+type PurgeCriteria struct {
+	// Expired matches URLs past their expiry, whether or not they're still
+	// kept around for Conf.ExpiredRetention
+	Expired bool
+
+	Prefix string // Matches short codes starting with Prefix
+	Tag    string // Matches URLs with this tag
+}
+
+func (c PurgeCriteria) empty() bool {
+	return !c.Expired && c.Prefix == "" && c.Tag == ""
+}
+
+// matches reports whether urlData is selected by c.
+func (c PurgeCriteria) matches(urlData models.URLData, now time.Time) bool {
+	if c.Expired && (urlData.ExpiresAt == nil || urlData.ExpiresAt.After(now)) {
+		return false
+	}
+	if !strings.HasPrefix(urlData.ShortCode, c.Prefix) {
+		return false
+	}
+	if c.Tag != "" {
+		for _, tag := range urlData.Tags {
+			if tag == c.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// where returns the SQL condition selecting the URLs matched by c at now.
+func (c PurgeCriteria) where(now time.Time) (string, []any) {
+	var (
+		conds []string
+		args  []any
+	)
+	if c.Expired {
+		conds = append(conds, `expires_at IS NOT NULL AND expires_at <= ?`)
+		args = append(args, now.UTC())
+	}
+	if c.Prefix != "" {
+		conds = append(conds, `substr(short_code, 1, length(?)) = ?`)
+		args = append(args, c.Prefix, c.Prefix)
+	}
+	if c.Tag != "" {
+		conds = append(conds, `short_code IN (SELECT short_code FROM url_tags WHERE tag = ?)`)
+		args = append(args, c.Tag)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// Purge deletes every URL matching c and returns how many were deleted.
+// Criteria with no field set fail with ErrNoPurgeCriteria rather than
+// deleting everything. URLs still in the write buffer are written out first
+// so they're purged too.
+func (s *Store) Purge(ctx context.Context, c PurgeCriteria) (int, error) {
+	if c.empty() {
+		return 0, ErrNoPurgeCriteria
+	}
+	c.Prefix = s.normalizeCode(c.Prefix)
+
+	s.bufMu.Lock()
+	buffered := make([]models.URLData, len(s.writeBuf))
+	copy(buffered, s.writeBuf)
+	s.writeBuf = s.writeBuf[:0]
+	s.bufMu.Unlock()
+	if len(buffered) > 0 {
+		s.flushWithRetry(buffered)
+	}
+
+	where, args := c.where(s.now())
+	total := 0
+	for {
+		n, err := s.deleteBatch(ctx, where, args...)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < expiryBatchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		s.logger.Info("purged URLs", "count", total, "expired", c.Expired, "prefix", c.Prefix, "tag", c.Tag)
+	}
+	return total, nil
+}
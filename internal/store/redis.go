@@ -0,0 +1,911 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxInsertAttempts bounds the random codes tried when a generated code turns
+// out to be taken by another instance between the check and the write.
+const maxInsertAttempts = 5
+
+type RedisConf struct {
+	Address  string
+	Username string
+	Password string
+	DB       int
+
+	// KeyPrefix namespaces every key, defaulting to "lil:", so instances
+	// can share a Redis database with other applications.
+	KeyPrefix string
+}
+
+// RedisStore keeps URLs in Redis so several instances can share them. Each
+// URL is a JSON value under <prefix>url:<code>, expiring along with the link
+// (plus Conf.ExpiredRetention), indexed by creation time in the <prefix>urls
+// sorted set and in <prefix>tag:<tag> for each of its tags. Aliases hold the
+// code they point to under <prefix>alias:<alias>. Click counts live in the <prefix>clicks hash and are
+// incremented on every redirect rather than buffered. Index entries of
+// expired URLs are pruned as listing comes across them, so counts may include
+// them until then.
+type RedisStore struct {
+	client           *redis.Client
+	prefix           string
+	logger           *slog.Logger
+	expiredRetention time.Duration
+	codeRules
+}
+
+// redisRecord is the stored form of a URL. PasswordHash is kept out of the
+// API's JSON, so it's serialized separately.
+type redisRecord struct {
+	models.URLData
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// NewRedis connects to the Redis server in cfg.Redis.
+func NewRedis(cfg Conf, logger *slog.Logger) (*RedisStore, error) {
+	rules, err := newCodeRules(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Redis.KeyPrefix == "" {
+		cfg.Redis.KeyPrefix = "lil:"
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Address,
+		Username: cfg.Redis.Username,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+
+	s := &RedisStore{
+		client:           client,
+		prefix:           cfg.Redis.KeyPrefix,
+		logger:           logger,
+		expiredRetention: cfg.ExpiredRetention,
+		codeRules:        rules,
+	}
+
+	if n, err := client.ZCard(ctx, s.indexKey()).Result(); err == nil {
+		metrics.URLsStoredGauge.Set(float64(n))
+	}
+
+	return s, nil
+}
+
+func (s *RedisStore) urlKey(shortCode string) string {
+	return s.prefix + "url:" + shortCode
+}
+
+func (s *RedisStore) indexKey() string {
+	return s.prefix + "urls"
+}
+
+func (s *RedisStore) tagKey(tag string) string {
+	return s.prefix + "tag:" + tag
+}
+
+func (s *RedisStore) aliasKey(alias string) string {
+	return s.prefix + "alias:" + alias
+}
+
+func (s *RedisStore) clicksKey() string {
+	return s.prefix + "clicks"
+}
+
+// accessedKey is the hash of when each URL last redirected, as RFC 3339 times.
+func (s *RedisStore) accessedKey() string {
+	return s.prefix + "accessed"
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// CheckWritable confirms Redis accepts writes by setting a bookkeeping key.
+func (s *RedisStore) CheckWritable(ctx context.Context) error {
+	return s.client.Set(ctx, s.prefix+"health_check", time.Now().UTC().Format(time.RFC3339), 0).Err()
+}
+
+// SuggestSlugs returns up to count unused variants of a taken slug, built
+// with the given strategy.
+func (s *RedisStore) SuggestSlugs(slug, strategy string, count int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	return s.suggestSlugs(slug, strategy, count, func(candidate string) bool {
+		return s.taken(ctx, candidate)
+	})
+}
+
+// IsSlugAvailable reports whether a slug, normalized like a create does, isn't
+// taken yet. It doesn't validate the slug.
+func (s *RedisStore) IsSlugAvailable(ctx context.Context, slug string) (bool, error) {
+	shortCode := s.normalizeCode(slug)
+	n, err := s.client.Exists(ctx, s.urlKey(shortCode), s.aliasKey(shortCode)).Result()
+	return n == 0, err
+}
+
+// Usage is empty as Redis writes through without buffering or caching.
+func (s *RedisStore) Usage() Usage {
+	return Usage{}
+}
+
+// taken reports whether a code is used by a URL or an alias. Errors count as
+// taken.
+func (s *RedisStore) taken(ctx context.Context, shortCode string) bool {
+	n, err := s.client.Exists(ctx, s.urlKey(shortCode), s.aliasKey(shortCode)).Result()
+	return err != nil || n > 0
+}
+
+func (s *RedisStore) CreateShortURL(ctx context.Context, p CreateParams) (models.URLData, error) {
+	for attempt := 1; ; attempt++ {
+		urlData, err := s.newURLData(p, func(shortCode string) bool {
+			return s.taken(ctx, shortCode)
+		})
+		if err != nil {
+			return models.URLData{}, err
+		}
+
+		for platform, deviceURL := range p.DeviceURLs {
+			if !s.platforms[platform] || deviceURL == "" {
+				continue
+			}
+			if urlData.DeviceURLs == nil {
+				urlData.DeviceURLs = make(map[string]models.DeviceURLData)
+			}
+			urlData.DeviceURLs[platform] = models.DeviceURLData{
+				URL:       deviceURL,
+				Platform:  platform,
+				CreatedAt: urlData.CreatedAt,
+			}
+		}
+		urlData.HasDeviceURLs = len(urlData.DeviceURLs) > 0
+
+		// Another instance may have taken a random code, or a suffixed
+		// slug, since it was checked, in which case a new one is picked
+		err = s.insert(ctx, urlData)
+		if errors.Is(err, ErrExists) && (p.Slug == "" || p.AutoSuffix) && attempt < maxInsertAttempts {
+			continue
+		}
+		if err != nil {
+			return models.URLData{}, err
+		}
+		return urlData, nil
+	}
+}
+
+// CreateShortURLs creates a batch of short URLs and returns a result per
+// entry, in order. Entries are created one by one, so a failed entry doesn't
+// stop the others.
+func (s *RedisStore) CreateShortURLs(ctx context.Context, ps []CreateParams) []CreateResult {
+	results := make([]CreateResult, len(ps))
+	for i, p := range ps {
+		urlData, err := s.CreateShortURL(ctx, p)
+		results[i].ShortCode, results[i].Err = urlData.ShortCode, err
+	}
+	return results
+}
+
+// insert writes a new URL, returning ErrExists when its code is taken.
+func (s *RedisStore) insert(ctx context.Context, urlData models.URLData) error {
+	args := redis.SetArgs{Mode: "NX"}
+	if urlData.ExpiresAt != nil {
+		args.ExpireAt = urlData.ExpiresAt.Add(s.expiredRetention)
+	}
+	if err := s.write(ctx, urlData, args); err != nil {
+		return err
+	}
+
+	member := redis.Z{Score: float64(urlData.CreatedAt.UnixNano()), Member: urlData.ShortCode}
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, s.indexKey(), member)
+		for _, tag := range urlData.Tags {
+			pipe.ZAdd(ctx, s.tagKey(tag), member)
+		}
+		return nil
+	})
+	if err != nil {
+		s.client.Del(context.Background(), s.urlKey(urlData.ShortCode))
+		return fmt.Errorf("index url: %w", err)
+	}
+	metrics.URLsStoredGauge.Inc()
+	return nil
+}
+
+// get reads a URL without its click count.
+func (s *RedisStore) get(ctx context.Context, shortCode string) (models.URLData, error) {
+	b, err := s.client.Get(ctx, s.urlKey(shortCode)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return models.URLData{}, ErrNotExist
+		}
+		return models.URLData{}, err
+	}
+	return decodeRecord(b)
+}
+
+// getAliased is get falling back to the URL an alias points to when shortCode
+// isn't a URL's own code.
+func (s *RedisStore) getAliased(ctx context.Context, shortCode string) (models.URLData, error) {
+	urlData, err := s.get(ctx, shortCode)
+	if !errors.Is(err, ErrNotExist) {
+		return urlData, err
+	}
+	target, aliasErr := s.client.Get(ctx, s.aliasKey(shortCode)).Result()
+	if aliasErr != nil {
+		if errors.Is(aliasErr, redis.Nil) {
+			return models.URLData{}, err
+		}
+		return models.URLData{}, aliasErr
+	}
+	return s.get(ctx, target)
+}
+
+// write stores the record of a URL with the given SET options.
+func (s *RedisStore) write(ctx context.Context, urlData models.URLData, args redis.SetArgs) error {
+	rec := redisRecord{URLData: urlData, PasswordHash: urlData.PasswordHash}
+	rec.ClickCount = 0
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode url: %w", err)
+	}
+	if err := s.client.SetArgs(ctx, s.urlKey(urlData.ShortCode), b, args).Err(); err != nil {
+		if errors.Is(err, redis.Nil) {
+			if args.Mode == "NX" {
+				return ErrExists
+			}
+			return ErrNotExist
+		}
+		return fmt.Errorf("write url: %w", err)
+	}
+	return nil
+}
+
+// pointAliases sets the alias keys of a URL to its code, expiring along with
+// it.
+func (s *RedisStore) pointAliases(ctx context.Context, urlData models.URLData) error {
+	if len(urlData.Aliases) == 0 {
+		return nil
+	}
+	var args redis.SetArgs
+	if urlData.ExpiresAt != nil {
+		args.ExpireAt = urlData.ExpiresAt.Add(s.expiredRetention)
+	}
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, alias := range urlData.Aliases {
+			pipe.SetArgs(ctx, s.aliasKey(alias), urlData.ShortCode, args)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("point aliases: %w", err)
+	}
+	return nil
+}
+
+func decodeRecord(b []byte) (models.URLData, error) {
+	var rec redisRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return models.URLData{}, fmt.Errorf("decode url: %w", err)
+	}
+	urlData := rec.URLData
+	urlData.PasswordHash = rec.PasswordHash
+	urlData.HasDeviceURLs = len(urlData.DeviceURLs) > 0
+	if urlData.UpdatedAt.IsZero() {
+		urlData.UpdatedAt = urlData.CreatedAt
+	}
+	return urlData, nil
+}
+
+// VerifyPassword checks a password against the one protecting a short code
+// and returns ErrWrongPassword when it doesn't match. Links without a password
+// accept any password, including an empty one.
+func (s *RedisStore) VerifyPassword(ctx context.Context, shortCode, password string) error {
+	urlData, err := s.getAliased(ctx, s.normalizeCode(shortCode))
+	if err != nil {
+		return err
+	}
+	if urlData.PasswordHash == "" {
+		return nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(urlData.PasswordHash), []byte(password)); err != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// GetRedirectData returns the data to redirect a short code, or an alias, with
+// and counts a click for the URL. URLs whose clicks are used up fail with
+// ErrClickLimit.
+func (s *RedisStore) GetRedirectData(ctx context.Context, shortCode string) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	urlData, err := s.resolve(ctx, shortCode, true)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	now := time.Now()
+	var incr *redis.IntCmd
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.HIncrBy(ctx, s.clicksKey(), urlData.ShortCode, 1)
+		pipe.HSet(ctx, s.accessedKey(), urlData.ShortCode, now.UTC().Format(time.RFC3339Nano))
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("failed to count click", "error", err, "short_code", urlData.ShortCode)
+	}
+	clicks := incr.Val()
+	// The increment is atomic, so of concurrent redirects exactly the ones
+	// within the limit get through. The others take their click back.
+	if urlData.MaxClicks > 0 && clicks > urlData.MaxClicks {
+		if err := s.client.HIncrBy(context.Background(), s.clicksKey(), urlData.ShortCode, -1).Err(); err != nil {
+			s.logger.Error("failed to uncount click", "error", err, "short_code", urlData.ShortCode)
+		}
+		return models.URLData{}, ErrClickLimit
+	}
+	urlData.ClickCount = clicks
+	urlData.LastAccessedAt = &now
+
+	return urlData, nil
+}
+
+// ResetClicks sets the click count of a short code, or the URL an alias points
+// to, back to zero, letting a link whose max clicks are used up redirect
+// again. It returns the URL with its reset count.
+func (s *RedisStore) ResetClicks(ctx context.Context, shortCode string) (models.URLData, error) {
+	urlData, err := s.getAliased(ctx, s.normalizeCode(shortCode))
+	if err != nil {
+		return models.URLData{}, err
+	}
+	if err := s.client.HDel(ctx, s.clicksKey(), urlData.ShortCode).Err(); err != nil {
+		return models.URLData{}, fmt.Errorf("reset click count: %w", err)
+	}
+	urlData.ClickCount = 0
+	return urlData, nil
+}
+
+// PeekRedirectData is GetRedirectData without counting a click, for lookups
+// that don't follow the link. Expired links aren't deleted.
+func (s *RedisStore) PeekRedirectData(ctx context.Context, shortCode string) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	urlData, err := s.resolve(ctx, shortCode, false)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	clicks, err := s.client.HGet(ctx, s.clicksKey(), urlData.ShortCode).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return models.URLData{}, fmt.Errorf("get click count: %w", err)
+	}
+	urlData.ClickCount = clicks
+	if urlData.MaxClicks > 0 && clicks >= urlData.MaxClicks {
+		return models.URLData{}, ErrClickLimit
+	}
+
+	return urlData, nil
+}
+
+// resolve reads a URL, or the URL an alias points to, for a redirect, failing
+// for expired and not yet active links. Expired links are deleted when
+// deleteExpired is set.
+func (s *RedisStore) resolve(ctx context.Context, shortCode string, deleteExpired bool) (models.URLData, error) {
+	urlData, err := s.getAliased(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+	shortCode = urlData.ShortCode
+
+	if urlData.ExpiresAt != nil && time.Now().After(*urlData.ExpiresAt) {
+		// Retained expired URLs are left for Redis to expire
+		if !deleteExpired || s.expiredRetention > 0 {
+			return models.URLData{}, ErrExpired
+		}
+		if _, err := s.remove(ctx, shortCode); err != nil {
+			s.logger.Error("failed to delete expired url", "error", err)
+		}
+		return models.URLData{}, ErrExpired
+	}
+
+	if urlData.StartsAt != nil && time.Now().Before(*urlData.StartsAt) {
+		return models.URLData{}, ErrNotYetActive
+	}
+
+	return urlData, nil
+}
+
+// GetURL returns the stored data of a short code, including expired and not yet
+// active links, without counting a click.
+func (s *RedisStore) GetURL(ctx context.Context, shortCode string) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	urlData, err := s.get(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	clicks, err := s.client.HGet(ctx, s.clicksKey(), shortCode).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return models.URLData{}, fmt.Errorf("get click count: %w", err)
+	}
+	urlData.ClickCount = clicks
+
+	return urlData, nil
+}
+
+// GetURLs returns a page of URLs, newest first, along with the total number of
+// URLs. A non-empty tag only lists URLs with that tag.
+func (s *RedisStore) GetURLs(ctx context.Context, page, perPage int64, tag string) ([]models.URLData, int64, error) {
+	offset := (page - 1) * perPage
+
+	index := s.indexKey()
+	if tag != "" {
+		index = s.tagKey(tag)
+	}
+
+	total, err := s.client.ZCard(ctx, index).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	codes, err := s.client.ZRevRange(ctx, index, offset, offset+perPage-1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(codes) == 0 {
+		return nil, total, nil
+	}
+
+	urls, err := s.fetchURLs(ctx, index, codes)
+	if err != nil {
+		return nil, 0, err
+	}
+	return urls, total - int64(len(codes)-len(urls)), nil
+}
+
+// StreamURLs calls fn for every stored URL, oldest first, stopping at the
+// first error fn returns. URLs are read streamBatchSize at a time.
+func (s *RedisStore) StreamURLs(ctx context.Context, fn func(models.URLData) error) error {
+	for start := int64(0); ; start += streamBatchSize {
+		codes, err := s.client.ZRange(ctx, s.indexKey(), start, start+streamBatchSize-1).Result()
+		if err != nil {
+			return err
+		}
+		urls, err := s.fetchURLs(ctx, s.indexKey(), codes)
+		if err != nil {
+			return err
+		}
+
+		for _, urlData := range urls {
+			if err := fn(urlData); err != nil {
+				return err
+			}
+		}
+		if len(codes) < streamBatchSize {
+			return nil
+		}
+		// Pruned codes shift the rest of the index down
+		start -= int64(len(codes) - len(urls))
+	}
+}
+
+// Stats counts the stored URLs and clicks and returns the top most clicked
+// URLs. It reads every URL to count them, so it's as costly as an export.
+func (s *RedisStore) Stats(ctx context.Context, top int) (Stats, error) {
+	var st Stats
+	now := time.Now()
+	err := s.StreamURLs(ctx, func(urlData models.URLData) error {
+		st.URLs++
+		st.Clicks += urlData.ClickCount
+		st.countExpiry(urlData, now)
+		st.Top = append(st.Top, TopURL{
+			ShortCode:  urlData.ShortCode,
+			URL:        urlData.URL,
+			ClickCount: urlData.ClickCount,
+		})
+		// Only the top ones are kept, trimming every so often
+		if len(st.Top) >= 2*top+streamBatchSize {
+			st.sortTop()
+			st.Top = st.Top[:top]
+		}
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+
+	st.sortTop()
+	if len(st.Top) > top {
+		st.Top = st.Top[:top]
+	}
+	return st, nil
+}
+
+// BulkStats returns the click counts and last accesses of the given short
+// codes, keyed by the codes as given and leaving out those that don't exist.
+// Aliases aren't resolved.
+func (s *RedisStore) BulkStats(ctx context.Context, shortCodes []string) (map[string]ClickStats, error) {
+	stats := make(map[string]ClickStats, len(shortCodes))
+	if len(shortCodes) == 0 {
+		return stats, nil
+	}
+
+	normalized := make([]string, len(shortCodes))
+	exists := make([]*redis.IntCmd, len(shortCodes))
+	var clicks, accessed *redis.SliceCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, given := range shortCodes {
+			normalized[i] = s.normalizeCode(given)
+			exists[i] = pipe.Exists(ctx, s.urlKey(normalized[i]))
+		}
+		clicks = pipe.HMGet(ctx, s.clicksKey(), normalized...)
+		accessed = pipe.HMGet(ctx, s.accessedKey(), normalized...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, given := range shortCodes {
+		if exists[i].Val() == 0 {
+			continue
+		}
+		var st ClickStats
+		if v, ok := clicks.Val()[i].(string); ok {
+			st.ClickCount, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if v, ok := accessed.Val()[i].(string); ok {
+			if at, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				st.LastAccessedAt = &at
+			}
+		}
+		stats[given] = st
+	}
+	return stats, nil
+}
+
+// fetchURLs reads the URLs and click counts of the given codes, in order.
+// Codes whose URL has expired are left out and pruned from index, the sorted
+// set they were listed from.
+func (s *RedisStore) fetchURLs(ctx context.Context, index string, codes []string) ([]models.URLData, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(codes))
+	for i, code := range codes {
+		keys[i] = s.urlKey(code)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := s.client.HMGet(ctx, s.clicksKey(), codes...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		urls  []models.URLData
+		stale []interface{}
+	)
+	for i, v := range values {
+		raw, ok := v.(string)
+		if !ok {
+			// The URL expired, drop it from the index
+			stale = append(stale, codes[i])
+			continue
+		}
+		urlData, err := decodeRecord([]byte(raw))
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := clicks[i].(string); ok {
+			urlData.ClickCount, _ = strconv.ParseInt(n, 10, 64)
+		}
+		urls = append(urls, urlData)
+	}
+
+	if len(stale) > 0 {
+		if err := s.client.ZRem(ctx, index, stale...).Err(); err != nil {
+			return nil, fmt.Errorf("prune expired urls from index: %w", err)
+		}
+		if index == s.indexKey() {
+			metrics.URLsStoredGauge.Add(-float64(len(stale)))
+		}
+	}
+
+	return urls, nil
+}
+
+func (s *RedisStore) DeleteURL(ctx context.Context, shortCode string) error {
+	removed, err := s.remove(ctx, s.normalizeCode(shortCode))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ErrNotExist
+	}
+	return nil
+}
+
+// remove deletes a URL along with its index entries and click count,
+// reporting whether it existed.
+func (s *RedisStore) remove(ctx context.Context, shortCode string) (bool, error) {
+	urlData, err := s.get(ctx, shortCode)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return false, err
+	}
+
+	var del *redis.IntCmd
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, s.urlKey(shortCode))
+		pipe.ZRem(ctx, s.indexKey(), shortCode)
+		for _, tag := range urlData.Tags {
+			pipe.ZRem(ctx, s.tagKey(tag), shortCode)
+		}
+		for _, alias := range urlData.Aliases {
+			pipe.Del(ctx, s.aliasKey(alias))
+		}
+		pipe.HDel(ctx, s.clicksKey(), shortCode)
+		pipe.HDel(ctx, s.accessedKey(), shortCode)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if del.Val() == 0 {
+		return false, nil
+	}
+	metrics.URLsStoredGauge.Dec()
+	return true, nil
+}
+
+// Purge deletes every URL matching c and returns how many were deleted. The
+// index, or the tag's index when c.Tag is set, is scanned for matches before
+// they're removed one by one.
+func (s *RedisStore) Purge(ctx context.Context, c PurgeCriteria) (int, error) {
+	if c.empty() {
+		return 0, ErrNoPurgeCriteria
+	}
+	c.Prefix = s.normalizeCode(c.Prefix)
+
+	index := s.indexKey()
+	if c.Tag != "" {
+		index = s.tagKey(c.Tag)
+	}
+
+	var (
+		codes []string
+		now   = time.Now()
+	)
+	for start := int64(0); ; start += streamBatchSize {
+		batch, err := s.client.ZRange(ctx, index, start, start+streamBatchSize-1).Result()
+		if err != nil {
+			return 0, err
+		}
+		urls, err := s.fetchURLs(ctx, index, batch)
+		if err != nil {
+			return 0, err
+		}
+		for _, urlData := range urls {
+			if c.matches(urlData, now) {
+				codes = append(codes, urlData.ShortCode)
+			}
+		}
+		if len(batch) < streamBatchSize {
+			break
+		}
+		start -= int64(len(batch) - len(urls))
+	}
+
+	purged := 0
+	for _, shortCode := range codes {
+		removed, err := s.remove(ctx, shortCode)
+		if err != nil {
+			return purged, err
+		}
+		if removed {
+			purged++
+		}
+	}
+
+	if purged > 0 {
+		s.logger.Info("purged URLs", "count", purged, "expired", c.Expired, "prefix", c.Prefix, "tag", c.Tag)
+	}
+	return purged, nil
+}
+
+// UpdateURL applies the changes in p to a short URL and returns the updated
+// record. A rename writes the URL under its new code, failing with ErrExists
+// when it's taken, then moves the click count over, removes the old code and
+// points the aliases at the new one. Alias keys are given the URL's new
+// expiry.
+func (s *RedisStore) UpdateURL(ctx context.Context, shortCode string, p UpdateParams) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	old, err := s.get(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+	urlData, err := s.applyUpdate(old, p)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	if urlData.ShortCode != shortCode {
+		if s.taken(ctx, urlData.ShortCode) {
+			return models.URLData{}, ErrExists
+		}
+		if err := s.insert(ctx, urlData); err != nil {
+			return models.URLData{}, err
+		}
+		clicks, err := s.client.HGet(ctx, s.clicksKey(), shortCode).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return models.URLData{}, fmt.Errorf("get click count: %w", err)
+		}
+		if clicks > 0 {
+			if err := s.client.HIncrBy(ctx, s.clicksKey(), urlData.ShortCode, clicks).Err(); err != nil {
+				return models.URLData{}, fmt.Errorf("move click count: %w", err)
+			}
+		}
+		accessed, err := s.client.HGet(ctx, s.accessedKey(), shortCode).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return models.URLData{}, fmt.Errorf("get last access: %w", err)
+		}
+		if accessed != "" {
+			if err := s.client.HSet(ctx, s.accessedKey(), urlData.ShortCode, accessed).Err(); err != nil {
+				return models.URLData{}, fmt.Errorf("move last access: %w", err)
+			}
+		}
+		// Removing the old code deletes its alias keys, which are set
+		// again for the new one
+		if _, err := s.remove(ctx, shortCode); err != nil {
+			return models.URLData{}, fmt.Errorf("remove renamed url: %w", err)
+		}
+		if err := s.pointAliases(ctx, urlData); err != nil {
+			return models.URLData{}, err
+		}
+		urlData.ClickCount = clicks
+		return urlData, nil
+	}
+
+	// Without ExpireAt, SET clears the key's TTL along with a removed expiry
+	args := redis.SetArgs{Mode: "XX"}
+	if urlData.ExpiresAt != nil {
+		args.ExpireAt = urlData.ExpiresAt.Add(s.expiredRetention)
+	}
+	if err := s.write(ctx, urlData, args); err != nil {
+		return models.URLData{}, err
+	}
+	if err := s.retag(ctx, old, urlData.Tags); err != nil {
+		return models.URLData{}, err
+	}
+	if err := s.pointAliases(ctx, urlData); err != nil {
+		return models.URLData{}, err
+	}
+
+	clicks, err := s.client.HGet(ctx, s.clicksKey(), shortCode).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return models.URLData{}, fmt.Errorf("get click count: %w", err)
+	}
+	urlData.ClickCount = clicks
+
+	return urlData, nil
+}
+
+// retag moves a URL between the tag indexes it's in with its old tags and the
+// ones for tags.
+func (s *RedisStore) retag(ctx context.Context, old models.URLData, tags []string) error {
+	keep := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		keep[tag] = true
+	}
+	member := redis.Z{Score: float64(old.CreatedAt.UnixNano()), Member: old.ShortCode}
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, tag := range old.Tags {
+			if !keep[tag] {
+				pipe.ZRem(ctx, s.tagKey(tag), old.ShortCode)
+			}
+		}
+		for _, tag := range tags {
+			pipe.ZAdd(ctx, s.tagKey(tag), member)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("update tags: %w", err)
+	}
+	return nil
+}
+
+// AddAlias makes alias another code for the URL of shortCode and returns the
+// URL with its aliases. Aliases are kept under <prefix>alias:<alias>, expiring
+// along with their URL, and listed in its record.
+func (s *RedisStore) AddAlias(ctx context.Context, shortCode, alias string) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	if err := s.ValidateSlug(alias); err != nil {
+		return models.URLData{}, err
+	}
+	alias = s.normalizeCode(alias)
+
+	urlData, err := s.get(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+	if s.taken(ctx, alias) {
+		return models.URLData{}, ErrExists
+	}
+
+	args := redis.SetArgs{Mode: "NX"}
+	if urlData.ExpiresAt != nil {
+		args.ExpireAt = urlData.ExpiresAt.Add(s.expiredRetention)
+	}
+	if err := s.client.SetArgs(ctx, s.aliasKey(alias), shortCode, args).Err(); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return models.URLData{}, ErrExists
+		}
+		return models.URLData{}, fmt.Errorf("insert alias: %w", err)
+	}
+
+	urlData.Aliases = append(urlData.Aliases, alias)
+	if err := s.write(ctx, urlData, redis.SetArgs{Mode: "XX", KeepTTL: true}); err != nil {
+		s.client.Del(context.Background(), s.aliasKey(alias))
+		return models.URLData{}, err
+	}
+
+	clicks, err := s.client.HGet(ctx, s.clicksKey(), shortCode).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return models.URLData{}, fmt.Errorf("get click count: %w", err)
+	}
+	urlData.ClickCount = clicks
+	return urlData, nil
+}
+
+// GetDeviceURLs returns the device URLs of a short code by platform.
+func (s *RedisStore) GetDeviceURLs(ctx context.Context, shortCode string) (map[string]models.DeviceURLData, error) {
+	urlData, err := s.GetURL(ctx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	return deviceURLsOrEmpty(urlData), nil
+}
+
+// SetDeviceURLs replaces the device URLs of a short code with the given
+// platform -> url mapping, an empty one removing them all, and returns the new
+// ones. Unknown platforms fail with ErrInvalidPlatform.
+func (s *RedisStore) SetDeviceURLs(ctx context.Context, shortCode string, deviceURLs map[string]string) (map[string]models.DeviceURLData, error) {
+	if err := s.validateDeviceURLs(deviceURLs); err != nil {
+		return nil, err
+	}
+	if deviceURLs == nil {
+		deviceURLs = map[string]string{}
+	}
+	urlData, err := s.UpdateURL(ctx, shortCode, UpdateParams{DeviceURLs: deviceURLs})
+	if err != nil {
+		return nil, err
+	}
+	return deviceURLsOrEmpty(urlData), nil
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// StatsExpiringWindow is how soon a URL has to expire to count as expiring
+// in Stats.
+const StatsExpiringWindow = 24 * time.Hour
+
+// Stats is an overview of the stored URLs. It's approximate: URLs and clicks
+// that change while it's computed may or may not be counted.
+type Stats struct {
+	URLs     int64
+	Expiring int64 // Expire within StatsExpiringWindow
+	Expired  int64 // Past their expiry but not deleted yet
+	Clicks   int64
+	Top      []TopURL // Most clicked URLs, most clicked first
+}
+
+type TopURL struct {
+	ShortCode  string
+	URL        string
+	ClickCount int64
+}
+
+// Stats counts the stored URLs and clicks with a few aggregate queries and
+// returns the top most clicked URLs. URLs in the write buffer and clicks not
+// written yet are added from memory.
+func (s *Store) Stats(ctx context.Context, top int) (Stats, error) {
+	var st Stats
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COALESCE(SUM(expires_at > datetime('now') AND expires_at <= datetime('now', ?)), 0),
+			COALESCE(SUM(expires_at <= datetime('now')), 0),
+			COALESCE(SUM(click_count), 0)
+		FROM urls
+	`, fmt.Sprintf("+%d seconds", int64(StatsExpiringWindow.Seconds()))).Scan(&st.URLs, &st.Expiring, &st.Expired, &st.Clicks)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT short_code, url, click_count FROM urls
+		ORDER BY click_count DESC, short_code
+		LIMIT ?
+	`, top)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TopURL
+		if err := rows.Scan(&t.ShortCode, &t.URL, &t.ClickCount); err != nil {
+			return Stats{}, err
+		}
+		st.Top = append(st.Top, t)
+	}
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	now := time.Now()
+	s.bufMu.Lock()
+	for _, urlData := range s.writeBuf {
+		st.URLs++
+		st.countExpiry(urlData, now)
+		st.Top = append(st.Top, TopURL{ShortCode: urlData.ShortCode, URL: urlData.URL})
+	}
+	s.bufMu.Unlock()
+
+	s.mu.RLock()
+	ranked := make(map[string]bool, len(st.Top))
+	for i := range st.Top {
+		st.Top[i].ClickCount += s.pendingClicks[st.Top[i].ShortCode]
+		ranked[st.Top[i].ShortCode] = true
+	}
+	for shortCode, clicks := range s.pendingClicks {
+		st.Clicks += clicks
+		// Clicks not written yet may have moved other URLs into the top,
+		// which are ranked by their cached count
+		if e, ok := s.cache.entries[shortCode]; ok && !ranked[shortCode] {
+			st.Top = append(st.Top, TopURL{ShortCode: shortCode, URL: e.urlData.URL, ClickCount: e.urlData.ClickCount})
+		}
+	}
+	s.mu.RUnlock()
+	st.sortTop()
+	if len(st.Top) > top {
+		st.Top = st.Top[:top]
+	}
+
+	return st, nil
+}
+
+// ClickStats are the clicks of a URL in bulk stats.
+type ClickStats struct {
+	ClickCount     int64
+	LastAccessedAt *time.Time // Last redirect, nil when it never redirected
+}
+
+// BulkStats returns the click counts and last accesses of the given short
+// codes, keyed by the codes as given and leaving out those that don't exist.
+// Aliases aren't resolved. Cached URLs are read from memory and the rest in a
+// single query, with clicks not written yet added.
+func (s *Store) BulkStats(ctx context.Context, shortCodes []string) (map[string]ClickStats, error) {
+	stats := make(map[string]ClickStats, len(shortCodes))
+	uncached := make(map[string][]string) // Codes as given by normalized code
+
+	s.mu.RLock()
+	for _, given := range shortCodes {
+		shortCode := s.normalizeCode(given)
+		if urlData, ok := s.cache.get(shortCode); ok {
+			stats[given] = ClickStats{ClickCount: urlData.ClickCount, LastAccessedAt: urlData.LastAccessedAt}
+		} else {
+			uncached[shortCode] = append(uncached[shortCode], given)
+		}
+	}
+	s.mu.RUnlock()
+	if len(uncached) == 0 || !s.cache.partial() {
+		return stats, nil
+	}
+
+	args := make([]any, 0, len(uncached))
+	for shortCode := range uncached {
+		args = append(args, shortCode)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT short_code, click_count, last_accessed_at FROM urls
+		WHERE short_code IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	read := make(map[string]ClickStats, len(args))
+	for rows.Next() {
+		var (
+			shortCode      string
+			st             ClickStats
+			lastAccessedAt sql.NullTime
+		)
+		if err := rows.Scan(&shortCode, &st.ClickCount, &lastAccessedAt); err != nil {
+			return nil, err
+		}
+		if lastAccessedAt.Valid {
+			st.LastAccessedAt = &lastAccessedAt.Time
+		}
+		read[shortCode] = st
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	for shortCode, st := range read {
+		st.ClickCount += s.pendingClicks[shortCode]
+		if at, ok := s.pendingAccess[shortCode]; ok {
+			st.LastAccessedAt = &at
+		}
+		for _, given := range uncached[shortCode] {
+			stats[given] = st
+		}
+	}
+	s.mu.RUnlock()
+	return stats, nil
+}
+
+func (st *Stats) countExpiry(urlData models.URLData, now time.Time) {
+	switch {
+	case urlData.ExpiresAt == nil:
+	case !urlData.ExpiresAt.After(now):
+		st.Expired++
+	case !urlData.ExpiresAt.After(now.Add(StatsExpiringWindow)):
+		st.Expiring++
+	}
+}
+
+func (st *Stats) sortTop() {
+	sort.SliceStable(st.Top, func(i, j int) bool {
+		return st.Top[i].ClickCount > st.Top[j].ClickCount
+	})
+}
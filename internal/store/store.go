@@ -7,36 +7,137 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	rand "math/rand/v2"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mr-karan/lil/internal/metrics"
 	"github.com/mr-karan/lil/models"
+	"golang.org/x/crypto/bcrypt"
 	_ "modernc.org/sqlite"
 )
 
 //go:embed pragmas.sql
 var pragmas string
 
-var ErrNotExist = errors.New("the URL does not exist")
+// Statements of the redirect path, prepared in New.
+const (
+	deviceURLsQuery = `SELECT platform, url, created_at FROM device_urls WHERE short_code = ?`
+	deleteURLQuery  = `DELETE FROM urls WHERE short_code = ?`
+)
+
+var (
+	ErrNotExist = errors.New("the URL does not exist")
+	ErrExpired  = errors.New("the URL has expired")
+	ErrExists   = errors.New("short code already exists")
+
+	ErrNotYetActive = errors.New("the URL is not active yet")
+	ErrClickLimit   = errors.New("the URL has reached its click limit")
+
+	ErrInvalidCodeLength = errors.New("invalid short code length")
+	ErrInvalidSlug       = errors.New("invalid slug")
+	ErrNoFreeCode        = errors.New("no free short code found, consider a longer short URL length")
+
+	ErrWrongPassword       = errors.New("password is missing or incorrect")
+	ErrInvalidPasswordHash = errors.New("invalid password hash")
+	ErrLowEntropy          = errors.New("short code entropy is below the configured minimum")
+
+	ErrNoPurgeCriteria = errors.New("no purge criteria given")
+	ErrInvalidPlatform = errors.New("invalid device platform")
+	ErrHostNotAllowed  = errors.New("destination host is not allowed")
+)
+
+// DefaultDevicePlatforms are the platforms device URLs can be set for when
+// Conf.DevicePlatforms isn't set.
+var DefaultDevicePlatforms = []string{"android", "ios", "macos", "web"}
 
 type Store struct {
-	db          *sql.DB
-	cache       map[string]models.URLData
-	mu          sync.RWMutex
-	logger      *slog.Logger
-	shortURLLen int
+	db               *sql.DB
+	dbPath           string
+	cache            *urlCache
+	stored           int // Number of URLs stored, guarded by mu
+	mu               sync.RWMutex
+	logger           *slog.Logger
+	expiredRetention time.Duration
+	now              func() time.Time // Clock expiry and activation are checked against
+	codeRules
 
 	// Write buffer components
-	writeBuf    []models.URLData
-	bufMu       sync.Mutex
-	bufferSize  int
-	flushTicker *time.Ticker
-	done        chan struct{}
-	flushChan   chan []models.URLData
-	workerDone  chan struct{}
+	writeBuf       []models.URLData
+	bufMu          sync.Mutex
+	bufferSize     int
+	flushThreshold int
+	flushTicker    *time.Ticker
+	done           chan struct{}
+	flushChan      chan []models.URLData
+	workerDone     chan struct{}
+
+	// Clicks counted since the last flush and when each URL was last
+	// redirected, guarded by mu. A URL whose clicks were reset may be
+	// accessed without pending clicks.
+	pendingClicks map[string]int64
+	pendingAccess map[string]time.Time
+
+	// Serializes click flushes and resets, so a flush in flight can't add
+	// clicks counted before a reset back
+	clicksMu sync.Mutex
+
+	// Every alias, guarded by mu
+	aliases aliasIndex
+
+	// Serializes UpdateURL
+	updateMu sync.Mutex
+
+	// Statements of the redirect path, prepared once in New
+	deviceURLsStmt *sql.Stmt
+	deleteURLStmt  *sql.Stmt
+
+	// Upstream API missing codes are read through from, nil when disabled
+	origin *origin
+
+	// Background jobs stopped through done
+	bg sync.WaitGroup
+
+	// Change events published on every write
+	changes        chan ChangeEvent
+	blockOnChanges bool
+}
+
+// CreateParams holds the details of a short URL to be created.
+type CreateParams struct {
+	URL        string
+	Title      string
+	Slug       string
+	AutoSuffix bool // a taken Slug gets a suffix instead of failing with ErrExists
+	Expiry     time.Duration
+	StartsAt   *time.Time        // the URL doesn't redirect before this time
+	DeviceURLs map[string]string // platform -> url mapping
+	Headers    map[string]string // extra response headers sent on redirect
+	CodeLength int               // length of the generated code, defaults to Conf.ShortURLLength
+
+	// AnalyticsProviders restricts redirect events to the named providers
+	AnalyticsProviders []string
+
+	// Password protects the URL when set. Only its bcrypt hash is stored.
+	Password string
+
+	// PasswordHash protects the URL with a password already hashed with
+	// bcrypt, for links migrated from elsewhere. It's stored as is and can't
+	// be combined with Password.
+	PasswordHash string
+
+	// RedirectStatus is the status code redirects use, 302 when zero
+	RedirectStatus int
+
+	// Tags label the URL for filtering lists
+	Tags []string
+
+	// UTM parameters added to the destination on redirect
+	UTM *models.UTM
+
+	// MaxClicks limits the redirects the URL allows, unlimited when zero
+	MaxClicks int64
 }
 
 type Conf struct {
@@ -45,8 +146,114 @@ type Conf struct {
 	MaxIdleConns        int
 	ConnMaxLifetimeMins int
 	ShortURLLength      int
-	BufferSize          int // Number of URLs to buffer before flush
-	FlushInterval       time.Duration
+	MinShortURLLength   int // Shortest code length a create may ask for, defaults to ShortURLLength
+	MaxShortURLLength   int // Longest code length a create may ask for, defaults to ShortURLLength
+
+	// MinEntropyBits is the least entropy random codes should have given the
+	// alphabet and the shortest allowed code length. Falling short is logged
+	// as a warning, or fails startup when RequireMinEntropy is set. Zero
+	// disables the check.
+	MinEntropyBits    float64
+	RequireMinEntropy bool
+
+	// Alphabet is the set of characters random codes are drawn from. It
+	// defaults to letters and digits without lookalikes such as 0/O and 1/l,
+	// and is lowercased when CaseInsensitive is set.
+	Alphabet string
+
+	// MaxCodeAttempts bounds the random codes tried per create before giving
+	// up with ErrNoFreeCode, defaulting to 10. With GrowCodeLength set, a
+	// create that runs out of attempts retries with codes one character
+	// longer, up to MaxShortURLLength, instead of failing.
+	MaxCodeAttempts int
+	GrowCodeLength  bool
+
+	// CacheSize bounds the number of URLs held in memory, evicting the least
+	// recently used ones and reading misses from the database. Zero keeps
+	// every URL cached.
+	CacheSize int
+
+	// LazyCache starts with an empty cache instead of loading URLs at
+	// startup, reading them from the database on their first lookup. It
+	// keeps startup fast for large databases at the cost of a query per
+	// first redirect.
+	LazyCache bool
+
+	// BufferSize is the maximum number of URLs held in the write buffer. Zero
+	// disables the buffer, so creates are written before they return and
+	// database errors reach the caller, at the cost of a transaction each.
+	BufferSize     int
+	FlushThreshold int // Number of buffered URLs that triggers an async flush, defaults to BufferSize
+	FlushInterval  time.Duration
+
+	// ExpiredRetention keeps expired URLs around (answering with ErrExpired)
+	// for this long before the expiry worker deletes them. Zero deletes
+	// expired URLs as soon as they're accessed.
+	ExpiredRetention time.Duration
+	// ExpiryReapInterval is how often the expiry worker deletes expired URLs
+	// past their retention. Zero disables the worker, leaving expired URLs
+	// to be deleted when they're accessed.
+	ExpiryReapInterval time.Duration
+
+	// WALCheckpointInterval is how often the WAL is checkpointed and
+	// truncated. Zero leaves checkpointing to SQLite's wal_autocheckpoint.
+	WALCheckpointInterval time.Duration
+	// WALCheckpointSize skips the periodic checkpoint until the WAL file has
+	// grown to at least this many bytes.
+	WALCheckpointSize int64
+
+	// LinkAgeMetricsInterval is how often the link age and time-to-expiry
+	// histograms are recomputed. Each pass scans the urls table. Zero
+	// disables them.
+	LinkAgeMetricsInterval time.Duration
+
+	// OriginURL enables reading codes missing locally through from another
+	// lil-compatible API (GET <OriginURL>/<short_code>), importing them on
+	// first access. OriginAPIKey is sent in the X-API-Key header when set.
+	OriginURL     string
+	OriginAPIKey  string
+	OriginTimeout time.Duration // 2s when zero
+
+	// CaseInsensitive lowercases short codes on create and lookup, so AbC
+	// and abc are the same link. Random codes are then drawn from a
+	// lowercase alphabet. Existing codes with uppercase letters aren't
+	// rewritten and stop resolving.
+	CaseInsensitive bool
+
+	// Custom slugs must fully match SlugPattern, defaulting to letters,
+	// digits, "_" and "-", and be MinSlugLength to MaxSlugLength characters
+	// long (defaults 1 and 64). ReservedSlugs can't be used in any case and
+	// default to the paths the server routes itself.
+	SlugPattern   string
+	MinSlugLength int
+	MaxSlugLength int
+	ReservedSlugs []string
+
+	// AllowedHosts limits the hosts URLs and device URLs may point to, and
+	// DeniedHosts rejects hosts even when allowed. Entries are host names, or
+	// "*.example.com" for its subdomains. Creates and updates breaking them
+	// fail with ErrHostNotAllowed. Both empty allows every host.
+	AllowedHosts []string
+	DeniedHosts  []string
+
+	// DevicePlatforms are the platforms device URLs can be set for,
+	// defaulting to DefaultDevicePlatforms. Names are lowercase letters,
+	// digits, "_" and "-".
+	DevicePlatforms []string
+
+	// ChangeEventsBuffer enables publishing a ChangeEvent on every create,
+	// update and delete through Changes, buffering up to this many events.
+	// Change events are a hook for code built on the SQLite store, like a
+	// cache invalidator. The server doesn't consume them, so they aren't in
+	// its config, and RedisStore doesn't publish them.
+	ChangeEventsBuffer int
+	// BlockOnChangeEvents makes writes wait for buffer space instead of
+	// dropping change events when consumers fall behind.
+	BlockOnChangeEvents bool
+
+	// Redis configures the backend created with NewRedis, which ignores the
+	// SQLite, write buffer and origin settings above.
+	Redis RedisConf
 }
 
 func New(cfg Conf, logger *slog.Logger) (*Store, error) {
@@ -60,35 +267,100 @@ func New(cfg Conf, logger *slog.Logger) (*Store, error) {
 	db.SetMaxIdleConns(cfg.MaxIdleConns)
 	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetimeMins) * time.Minute)
 
+	rules, err := newCodeRules(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.FlushThreshold <= 0 || cfg.FlushThreshold > cfg.BufferSize {
+		cfg.FlushThreshold = cfg.BufferSize
+	}
+
 	// Create tables if they don't exist
 	if err := initDB(db); err != nil {
 		return nil, err
 	}
 
+	deviceURLsStmt, err := db.Prepare(deviceURLsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("prepare device urls query: %w", err)
+	}
+	deleteURLStmt, err := db.Prepare(deleteURLQuery)
+	if err != nil {
+		return nil, fmt.Errorf("prepare url delete: %w", err)
+	}
+
 	s := &Store{
-		db:          db,
-		cache:       make(map[string]models.URLData),
-		logger:      logger,
-		shortURLLen: cfg.ShortURLLength,
-		bufferSize:  cfg.BufferSize,
-		writeBuf:    make([]models.URLData, 0, cfg.BufferSize),
-		flushTicker: time.NewTicker(cfg.FlushInterval),
-		done:        make(chan struct{}),
-		flushChan:   make(chan []models.URLData, 100), // Buffer channel for pending flushes
-		workerDone:  make(chan struct{}),
-	}
-
-	// Start single flush worker
-	go s.flushWorker()
-
-	// Load all existing URLs into cache
+		db:               db,
+		dbPath:           cfg.DBPath,
+		cache:            newURLCache(cfg.CacheSize, cfg.LazyCache),
+		pendingClicks:    make(map[string]int64),
+		pendingAccess:    make(map[string]time.Time),
+		aliases:          newAliasIndex(),
+		logger:           logger,
+		expiredRetention: cfg.ExpiredRetention,
+		now:              time.Now,
+		codeRules:        rules,
+		bufferSize:       cfg.BufferSize,
+		flushThreshold:   cfg.FlushThreshold,
+		writeBuf:         make([]models.URLData, 0, cfg.BufferSize),
+		flushTicker:      time.NewTicker(cfg.FlushInterval),
+		done:             make(chan struct{}),
+		workerDone:       make(chan struct{}),
+		blockOnChanges:   cfg.BlockOnChangeEvents,
+		deviceURLsStmt:   deviceURLsStmt,
+		deleteURLStmt:    deleteURLStmt,
+	}
+	if cfg.ChangeEventsBuffer > 0 {
+		s.changes = make(chan ChangeEvent, cfg.ChangeEventsBuffer)
+	}
+	if cfg.OriginURL != "" {
+		if cfg.OriginTimeout <= 0 {
+			cfg.OriginTimeout = defaultOriginTimeout
+		}
+		s.origin = &origin{
+			url:     cfg.OriginURL,
+			apiKey:  cfg.OriginAPIKey,
+			timeout: cfg.OriginTimeout,
+			client:  &http.Client{Timeout: cfg.OriginTimeout},
+		}
+	}
+
+	// Start single flush worker. Without the write buffer creates are
+	// written synchronously, leaving only click counts to flush.
+	if s.bufferSize > 0 {
+		s.flushChan = make(chan []models.URLData, 100) // Buffer channel for pending flushes
+		go s.flushWorker()
+	} else {
+		go s.clickFlushWorker()
+	}
+
+	metrics.WatchWriteBuffer(func() int {
+		s.bufMu.Lock()
+		defer s.bufMu.Unlock()
+		return len(s.writeBuf)
+	}, func() int {
+		return len(s.flushChan)
+	})
+
+	if cfg.WALCheckpointInterval > 0 {
+		s.bg.Add(1)
+		go s.walCheckpointWorker(cfg.WALCheckpointInterval, cfg.WALCheckpointSize)
+	}
+	if cfg.LinkAgeMetricsInterval > 0 {
+		s.bg.Add(1)
+		go s.linkAgeWorker(cfg.LinkAgeMetricsInterval)
+	}
+	if cfg.ExpiryReapInterval > 0 {
+		s.bg.Add(1)
+		go s.expiryWorker(cfg.ExpiryReapInterval)
+	}
+
+	// Load existing URLs into cache
 	if err := s.loadCache(); err != nil {
 		return nil, err
 	}
 
-	// Initialize URLs stored gauge
-	metrics.URLsStoredGauge.Set(float64(len(s.cache)))
-
 	return s, nil
 }
 
@@ -105,12 +377,35 @@ func initDB(db *sql.DB) error {
 
 		CREATE TABLE IF NOT EXISTS device_urls (
 			short_code TEXT,
-			platform TEXT CHECK(platform IN ('android', 'ios', 'macos', 'web')),
+			platform TEXT,
 			url TEXT NOT NULL,
 			created_at DATETIME NOT NULL,
 			FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE,
 			PRIMARY KEY (short_code, platform)
 		);
+
+		CREATE TABLE IF NOT EXISTS url_tags (
+			short_code TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE,
+			PRIMARY KEY (short_code, tag)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_url_tags_tag ON url_tags(tag);
+
+		CREATE TABLE IF NOT EXISTS aliases (
+			alias TEXT PRIMARY KEY,
+			short_code TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (short_code) REFERENCES urls(short_code) ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_aliases_short_code ON aliases(short_code);
+
+		CREATE TABLE IF NOT EXISTS health_checks (
+			id INTEGER PRIMARY KEY CHECK(id = 1),
+			checked_at DATETIME NOT NULL
+		);
 	`); err != nil {
 		return err
 	}
@@ -120,39 +415,98 @@ func initDB(db *sql.DB) error {
 		return err
 	}
 
-	return nil
+	return migrate(db)
 }
 
+// loadCache caches the stored URLs, only the most recent ones when the cache
+// is bounded and none when it's lazy. Aliases are always loaded.
 func (s *Store) loadCache() error {
-	rows, err := s.db.Query(`SELECT short_code, url, title, created_at, expires_at FROM urls`)
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM urls`).Scan(&total); err != nil {
+		return err
+	}
+	s.addStored(total)
+
+	if s.cache.lazy {
+		return s.loadAliases()
+	}
+
+	limit := -1 // No limit
+	if s.cache.max > 0 {
+		limit = s.cache.max
+	}
+	rows, err := s.db.Query(`
+		SELECT `+urlColumns+`,
+			EXISTS(SELECT 1 FROM device_urls d WHERE d.short_code = urls.short_code)
+		FROM urls
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, limit)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var urlData models.URLData
-		var expiresAt sql.NullTime
-		err := rows.Scan(&urlData.ShortCode, &urlData.URL, &urlData.Title, &urlData.CreatedAt, &expiresAt)
+		var hasDeviceURLs bool
+		urlData, err := scanURL(rows, &hasDeviceURLs)
 		if err != nil {
 			return err
 		}
-		if expiresAt.Valid {
-			urlData.ExpiresAt = &expiresAt.Time
-		}
-		s.cache[urlData.ShortCode] = urlData
+		urlData.HasDeviceURLs = hasDeviceURLs
+		s.cache.set(urlData.ShortCode, urlData)
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	return rows.Err()
+
+	if err := s.loadTags(); err != nil {
+		return err
+	}
+	return s.loadAliases()
 }
 
 func (s *Store) Close() error {
 	s.flushTicker.Stop()
 	close(s.done)
-	close(s.flushChan)
 	<-s.workerDone // Wait for worker to finish
+	s.bg.Wait()
+
+	// Persist everything still pending, as the cache already serves it and
+	// it would otherwise vanish on restart. Clicks go last so counts for
+	// just flushed URLs find their rows.
+	if s.flushChan != nil {
+		s.drainFlushes()
+	}
+	s.flushClicks()
+	s.deviceURLsStmt.Close()
+	s.deleteURLStmt.Close()
 	return s.db.Close()
 }
 
+// drainFlushes synchronously writes the batches queued for the flush worker
+// and what's left in the write buffer. It's only called once the worker has
+// stopped.
+func (s *Store) drainFlushes() {
+	for {
+		select {
+		case urls := <-s.flushChan:
+			s.flushWithRetry(urls)
+			continue
+		default:
+		}
+		break
+	}
+
+	s.bufMu.Lock()
+	urls := s.writeBuf
+	s.writeBuf = nil
+	s.bufMu.Unlock()
+	if len(urls) > 0 {
+		s.flushWithRetry(urls)
+	}
+}
+
 func (s *Store) flushWorker() {
 	defer close(s.workerDone)
 
@@ -160,10 +514,8 @@ func (s *Store) flushWorker() {
 		select {
 		case <-s.flushTicker.C:
 			s.triggerFlush()
-		case urls, ok := <-s.flushChan:
-			if !ok {
-				return
-			}
+			s.flushClicks()
+		case urls := <-s.flushChan:
 			s.flushWithRetry(urls)
 		case <-s.done:
 			return
@@ -171,6 +523,24 @@ func (s *Store) flushWorker() {
 	}
 }
 
+// clickFlushWorker is the flush worker of a store without write buffer,
+// writing click counts on the flush ticker.
+func (s *Store) clickFlushWorker() {
+	defer close(s.workerDone)
+
+	for {
+		select {
+		case <-s.flushTicker.C:
+			s.flushClicks()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// triggerFlush writes out the write buffer. It runs on the flush worker, which
+// is the consumer of flushChan, so it writes the batch itself rather than
+// queueing it.
 func (s *Store) triggerFlush() {
 	s.bufMu.Lock()
 	if len(s.writeBuf) == 0 {
@@ -184,11 +554,18 @@ func (s *Store) triggerFlush() {
 	s.writeBuf = s.writeBuf[:0]
 	s.bufMu.Unlock()
 
-	// Send to flush channel
+	s.flushWithRetry(urls)
+}
+
+// queueFlush hands a full batch to the flush worker, waiting for room in
+// flushChan as backpressure. If ctx ends first the caller writes the batch
+// itself, so batches are never dropped.
+func (s *Store) queueFlush(ctx context.Context, urls []models.URLData) {
 	select {
 	case s.flushChan <- urls:
-	default:
-		s.logger.Warn("flush channel full, dropping batch", "count", len(urls))
+	case <-ctx.Done():
+		s.logger.Warn("flush channel full, writing batch inline", "count", len(urls))
+		s.flushWithRetry(urls)
 	}
 }
 
@@ -209,12 +586,54 @@ func (s *Store) flushWithRetry(urls []models.URLData) {
 			s.logger.Error("flush failed after retries",
 				"error", err,
 				"count", len(urls))
+			metrics.FlushBatchesDroppedTotal.Inc()
+			s.dropUnpersisted(urls)
 		}
 		return
 	}
 }
 
+// dropUnpersisted removes the URLs of a batch that couldn't be written from
+// the cache, so they stop resolving now rather than vanishing on restart.
+// URLs written since by an update are no longer pinned and are kept.
+func (s *Store) dropUnpersisted(urls []models.URLData) {
+	var dropped []models.URLData
+	s.mu.Lock()
+	for _, urlData := range urls {
+		if !s.cache.pinned(urlData.ShortCode) {
+			continue
+		}
+		s.cache.remove(urlData.ShortCode)
+		delete(s.pendingClicks, urlData.ShortCode)
+		delete(s.pendingAccess, urlData.ShortCode)
+		dropped = append(dropped, urlData)
+	}
+	s.addStored(-len(dropped))
+	s.mu.Unlock()
+
+	for _, urlData := range dropped {
+		s.logger.Error("dropped url that couldn't be persisted", "short_code", urlData.ShortCode, "url", urlData.URL)
+		s.emitChange(OpDelete, urlData)
+	}
+}
+
 func (s *Store) doFlush(urls []models.URLData) error {
+	start := time.Now()
+
+	// URLs renamed or deleted since they were buffered are skipped
+	s.mu.RLock()
+	live := make([]models.URLData, 0, len(urls))
+	for _, urlData := range urls {
+		if s.cache.has(urlData.ShortCode) {
+			live = append(live, urlData)
+		}
+	}
+	s.mu.RUnlock()
+	if len(live) == 0 {
+		return nil
+	}
+	urls = live
+
 	tx, err := s.db.Begin()
 	if err != nil {
 		return fmt.Errorf("begin transaction: %w", err)
@@ -223,34 +642,50 @@ func (s *Store) doFlush(urls []models.URLData) error {
 
 	// Build a single INSERT statement with multiple VALUES clauses
 	var sb strings.Builder
-	sb.WriteString(`INSERT INTO urls (short_code, url, title, created_at, expires_at) VALUES `)
+	sb.WriteString(`INSERT INTO urls (` + urlColumns + `) VALUES `)
 
-	vals := make([]interface{}, 0, len(urls)*5) // 5 fields per URL
+	vals := make([]interface{}, 0, len(urls)*urlColumnCount)
 
 	for i, urlData := range urls {
 		if i > 0 {
 			sb.WriteString(",")
 		}
-		sb.WriteString("(?,?,?,?,?)")
+		sb.WriteString(urlPlaceholders)
 
-		vals = append(vals,
-			urlData.ShortCode,
-			urlData.URL,
-			urlData.Title,
-			urlData.CreatedAt,
-			urlData.ExpiresAt,
-		)
+		args, err := urlArgs(urlData)
+		if err != nil {
+			return err
+		}
+		vals = append(vals, args...)
 	}
 
+	// Rows that already exist were written by an update after the batch
+	// was handed off, and are newer
+	sb.WriteString(` ON CONFLICT(short_code) DO NOTHING`)
+
 	// Execute single batch insert
 	if _, err := tx.Exec(sb.String(), vals...); err != nil {
 		return fmt.Errorf("batch insert: %w", err)
 	}
 
+	for _, urlData := range urls {
+		if err := insertTags(context.Background(), tx, urlData.ShortCode, urlData.Tags); err != nil {
+			return err
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("commit transaction: %w", err)
 	}
 
+	// Flushed URLs can be read back from the database once evicted
+	s.mu.Lock()
+	for _, urlData := range urls {
+		s.cache.unpin(urlData.ShortCode)
+	}
+	s.mu.Unlock()
+
+	metrics.FlushDuration.UpdateDuration(start)
 	s.logger.Info("flushed urls to database", "count", len(urls))
 	return nil
 }
@@ -259,70 +694,50 @@ func (s *Store) Ping(ctx context.Context) error {
 	return s.db.PingContext(ctx)
 }
 
-func (s *Store) CreateShortURL(ctx context.Context, url string, title string, slug string, expiry time.Duration, deviceURLs map[string]string) (string, error) {
-	var shortCode string
-
-	if slug != "" {
-		shortCode = slug
-	} else {
-		// Try to generate a unique short code
-		for {
-			shortCode = generateRandomString(s.shortURLLen)
-			s.mu.RLock()
-			_, exists := s.cache[shortCode]
-			s.mu.RUnlock()
-			if !exists {
-				break
-			}
-		}
-	}
-
-	// Check if shortCode already exists
-	s.mu.RLock()
-	_, exists := s.cache[shortCode]
-	s.mu.RUnlock()
-	if exists {
-		return "", fmt.Errorf("short code already exists")
-	}
-
-	// Calculate expiry time if provided
-	var expiresAt *time.Time
-	if expiry > 0 {
-		t := time.Now().Add(expiry)
-		expiresAt = &t
-	}
+// CheckWritable confirms the database accepts writes by updating a single
+// bookkeeping row. Unlike Ping, this catches a full disk or a read-only
+// filesystem, at the cost of a write per call.
+func (s *Store) CheckWritable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO health_checks (id, checked_at) VALUES (1, ?)
+		ON CONFLICT(id) DO UPDATE SET checked_at = excluded.checked_at
+	`, time.Now().UTC())
+	return err
+}
 
-	// Create URL data
-	urlData := models.URLData{
-		URL:       url,
-		Title:     title,
-		ShortCode: shortCode,
-		CreatedAt: time.Now().UTC(),
-		ExpiresAt: expiresAt,
+// CreateShortURL stores a new short URL and returns its record.
+func (s *Store) CreateShortURL(ctx context.Context, p CreateParams) (models.URLData, error) {
+	urlData, err := s.newURLData(p, nil)
+	if err != nil {
+		return models.URLData{}, err
 	}
+	shortCode := urlData.ShortCode
 
-	// If we have device URLs, we need to write everything immediately to maintain consistency
-	if len(deviceURLs) > 0 {
+	// If we have device URLs, or the write buffer is disabled, we need to
+	// write everything immediately to maintain consistency
+	if len(p.DeviceURLs) > 0 || s.bufferSize == 0 {
 		// Start a transaction
 		tx, err := s.db.BeginTx(ctx, nil)
 		if err != nil {
-			return "", fmt.Errorf("begin transaction: %w", err)
+			return models.URLData{}, fmt.Errorf("begin transaction: %w", err)
 		}
 		defer tx.Rollback()
 
+		args, err := urlArgs(urlData)
+		if err != nil {
+			return models.URLData{}, err
+		}
+
 		// Insert main URL
-		_, err = tx.ExecContext(ctx, `
-			INSERT INTO urls (short_code, url, title, created_at, expires_at)
-			VALUES (?, ?, ?, ?, ?)
-		`, shortCode, url, title, urlData.CreatedAt, expiresAt)
+		_, err = tx.ExecContext(ctx, `INSERT INTO urls (`+urlColumns+`) VALUES `+urlPlaceholders, args...)
 		if err != nil {
-			return "", fmt.Errorf("insert url: %w", err)
+			return models.URLData{}, fmt.Errorf("insert url: %w", err)
 		}
 
 		// Insert device URLs
 		urlData.DeviceURLs = make(map[string]models.DeviceURLData)
-		for platform, deviceURL := range deviceURLs {
-			if platform != "android" && platform != "ios" && platform != "macos" && platform != "web" {
+		for platform, deviceURL := range p.DeviceURLs {
+			if !s.platforms[platform] {
 				continue // Skip invalid platforms
 			}
 			// Skip empty URLs
@@ -339,97 +754,292 @@ func (s *Store) CreateShortURL(ctx context.Context, url string, title string, sl
 				VALUES (?, ?, ?, ?)
 			`, shortCode, platform, deviceURL, deviceURLData.CreatedAt)
 			if err != nil {
-				return "", fmt.Errorf("insert device url: %w", err)
+				return models.URLData{}, fmt.Errorf("insert device url: %w", err)
 			}
 			urlData.DeviceURLs[platform] = deviceURLData
 		}
+		urlData.HasDeviceURLs = len(urlData.DeviceURLs) > 0
+
+		if err := insertTags(ctx, tx, shortCode, urlData.Tags); err != nil {
+			return models.URLData{}, err
+		}
 
 		// Commit transaction
 		if err := tx.Commit(); err != nil {
-			return "", fmt.Errorf("commit transaction: %w", err)
+			return models.URLData{}, fmt.Errorf("commit transaction: %w", err)
 		}
 
 		// Update cache
 		s.mu.Lock()
-		s.cache[shortCode] = urlData
-		metrics.URLsStoredGauge.Set(float64(len(s.cache)))
+		s.cache.set(shortCode, urlData)
+		s.addStored(1)
 		s.mu.Unlock()
 	} else {
 		// No device URLs, use the buffer as before
+		var full []models.URLData
 		s.bufMu.Lock()
 		s.writeBuf = append(s.writeBuf, urlData)
-		if len(s.writeBuf) >= s.bufferSize {
-			// Buffer is full, flush it
-			s.flushChan <- s.writeBuf
+		switch {
+		case len(s.writeBuf) >= s.bufferSize:
+			// Buffer is at capacity, hand it to the flush worker once the
+			// lock is released so other writers aren't stalled
+			full = s.writeBuf
 			s.writeBuf = make([]models.URLData, 0, s.bufferSize)
+		case len(s.writeBuf) >= s.flushThreshold:
+			// High-water mark reached, hand the batch off without blocking.
+			// If the flush worker is busy, keep accepting writes into the
+			// remaining capacity and try again on the next create.
+			select {
+			case s.flushChan <- s.writeBuf:
+				s.writeBuf = make([]models.URLData, 0, s.bufferSize)
+			default:
+			}
 		}
 		s.bufMu.Unlock()
 
-		// Update cache immediately
+		// Update cache immediately, keeping the URL cached until it's in the
+		// database
 		s.mu.Lock()
-		s.cache[shortCode] = urlData
-		metrics.URLsStoredGauge.Set(float64(len(s.cache)))
+		s.cache.setPinned(shortCode, urlData)
+		s.addStored(1)
 		s.mu.Unlock()
+
+		if full != nil {
+			s.queueFlush(ctx, full)
+		}
 	}
 
-	return shortCode, nil
+	s.emitChange(OpCreate, urlData)
+
+	return urlData, nil
 }
 
+// newURLData picks the short code for a create and builds the record to
+// store. Codes in reserved are treated as taken, for batches whose URLs aren't
+// cached yet.
+func (s *Store) newURLData(p CreateParams, reserved map[string]bool) (models.URLData, error) {
+	return s.codeRules.newURLData(p, func(shortCode string) bool {
+		return reserved[shortCode] || s.exists(shortCode)
+	})
+}
+
+// VerifyPassword checks a password against the one protecting a short code
+// and returns ErrWrongPassword when it doesn't match. Links without a password
+// accept any password, including an empty one. The comparison is bcrypt's,
+// which takes constant time.
+func (s *Store) VerifyPassword(ctx context.Context, shortCode, password string) error {
+	shortCode = s.normalizeCode(shortCode)
+	urlData, err := s.lookupAliased(ctx, shortCode)
+	if err != nil {
+		return err
+	}
+	if urlData.PasswordHash == "" {
+		return nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(urlData.PasswordHash), []byte(password)); err != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// GetRedirectData returns the data to redirect a short code, or an alias, with
+// and counts a click for the URL. URLs whose clicks are used up fail with
+// ErrClickLimit.
 func (s *Store) GetRedirectData(ctx context.Context, shortCode string) (models.URLData, error) {
+	urlData, err := s.redirectData(ctx, shortCode, true)
+	if err != nil {
+		return models.URLData{}, err
+	}
+	shortCode = urlData.ShortCode
+
+	// Used up links are turned away under the read lock. The write lock is
+	// only taken to record the click, checking the limit again under it as
+	// other redirects may have counted clicks since the cache was read.
+	now := time.Now()
 	s.mu.RLock()
-	urlData, exists := s.cache[shortCode]
+	cached, ok := s.cache.get(shortCode)
 	s.mu.RUnlock()
+	if ok && cached.MaxClicks > 0 && cached.ClickCount >= cached.MaxClicks {
+		return models.URLData{}, ErrClickLimit
+	}
+	var row models.URLData
+	reread := !ok && urlData.MaxClicks > 0
+	if reread {
+		// A limited URL evicted since it was read is read again for its
+		// current count, which is cached and checked before letting go of
+		// the lock
+		if row, err = s.readURL(ctx, shortCode); err != nil {
+			return models.URLData{}, err
+		}
+	}
 
-	if !exists {
-		return models.URLData{}, ErrNotExist
+	s.mu.Lock()
+	cached, ok = s.cache.get(shortCode)
+	if !ok && reread {
+		cached, ok = s.cacheRead(row), true
+	}
+	if ok {
+		if cached.MaxClicks > 0 && cached.ClickCount >= cached.MaxClicks {
+			s.mu.Unlock()
+			return models.URLData{}, ErrClickLimit
+		}
+		cached.ClickCount++
+		cached.LastAccessedAt = &now
+		s.cache.set(shortCode, cached)
+		urlData.ClickCount = cached.ClickCount
+	} else {
+		// Evicted since it was read, which doesn't make the click count
+		// any less
+		urlData.ClickCount++
+	}
+	urlData.LastAccessedAt = &now
+	s.pendingClicks[shortCode]++
+	s.pendingAccess[shortCode] = now
+	s.mu.Unlock()
+
+	return urlData, nil
+}
+
+// PeekRedirectData is GetRedirectData without counting a click, for lookups
+// that don't follow the link. Expired, not yet active and used up links fail
+// the same way, but expired ones aren't deleted.
+func (s *Store) PeekRedirectData(ctx context.Context, shortCode string) (models.URLData, error) {
+	return s.redirectData(ctx, shortCode, false)
+}
+
+// redirectData reads a URL, or the URL an alias points to, for a redirect,
+// failing for expired, not yet active and used up links. Expired links are
+// deleted when deleteExpired is set.
+func (s *Store) redirectData(ctx context.Context, shortCode string, deleteExpired bool) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	urlData, err := s.lookupAliased(ctx, shortCode)
+	if errors.Is(err, ErrNotExist) && s.origin != nil {
+		urlData, err = s.readThrough(ctx, shortCode)
 	}
+	if err != nil {
+		return models.URLData{}, err
+	}
+	// Aliases resolve to the URL's own code
+	shortCode = urlData.ShortCode
+
+	if urlData.ExpiresAt != nil && s.now().After(*urlData.ExpiresAt) {
+		// Retained expired URLs are left for the expiry worker to delete
+		if !deleteExpired || s.expiredRetention > 0 {
+			return models.URLData{}, ErrExpired
+		}
 
-	if urlData.ExpiresAt != nil && time.Now().After(*urlData.ExpiresAt) {
-		// URL has expired, remove it
+		// URL has expired, remove it. This access still reports ErrExpired,
+		// later ones ErrNotExist.
 		s.mu.Lock()
-		delete(s.cache, shortCode)
-		metrics.URLsStoredGauge.Set(float64(len(s.cache)))
+		s.cache.remove(shortCode)
+		s.aliases.removeCode(shortCode)
 		s.mu.Unlock()
-		_, err := s.db.ExecContext(ctx, `DELETE FROM urls WHERE short_code = ?`, shortCode)
+		result, err := s.deleteURLStmt.ExecContext(ctx, shortCode)
 		if err != nil {
 			s.logger.Error("failed to delete expired url", "error", err)
+		} else if n, err := result.RowsAffected(); err == nil {
+			s.mu.Lock()
+			s.addStored(-int(n))
+			s.mu.Unlock()
 		}
-		return models.URLData{}, ErrNotExist
+		s.emitChange(OpDelete, urlData)
+		return models.URLData{}, ErrExpired
 	}
 
-	// Load device-specific URLs if not already loaded
-	if urlData.DeviceURLs == nil {
-		rows, err := s.db.QueryContext(ctx, `SELECT platform, url, created_at FROM device_urls WHERE short_code = ?`, shortCode)
+	if urlData.StartsAt != nil && s.now().Before(*urlData.StartsAt) {
+		return models.URLData{}, ErrNotYetActive
+	}
+
+	if urlData.MaxClicks > 0 && urlData.ClickCount >= urlData.MaxClicks {
+		return models.URLData{}, ErrClickLimit
+	}
+
+	// Load device-specific URLs if the link has any and they aren't loaded yet
+	if urlData.HasDeviceURLs && urlData.DeviceURLs == nil {
+		deviceURLs, err := s.loadDeviceURLs(ctx, shortCode)
 		if err != nil {
 			s.logger.Error("failed to load device urls", "error", err)
-			return urlData, nil
 		}
-		defer rows.Close()
+		urlData.DeviceURLs = deviceURLs
 
-		deviceURLs := make(map[string]models.DeviceURLData)
-		for rows.Next() {
-			var deviceURL models.DeviceURLData
-			err := rows.Scan(&deviceURL.Platform, &deviceURL.URL, &deviceURL.CreatedAt)
-			if err != nil {
-				s.logger.Error("failed to scan device url", "error", err)
-				continue
-			}
-			deviceURLs[deviceURL.Platform] = deviceURL
+		// Keep lazily loaded device URLs in the cache
+		s.mu.Lock()
+		if cached, ok := s.cache.get(shortCode); ok && cached.DeviceURLs == nil {
+			cached.DeviceURLs = deviceURLs
+			s.cache.set(shortCode, cached)
+		}
+		s.mu.Unlock()
+	}
+
+	return urlData, nil
+}
+
+// GetURL returns the stored data of a short code, including expired and not yet
+// active links. Unlike GetRedirectData it doesn't count a click or delete
+// expired links.
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+	urlData, err := s.lookup(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	if urlData.HasDeviceURLs && urlData.DeviceURLs == nil {
+		deviceURLs, err := s.loadDeviceURLs(ctx, shortCode)
+		if err != nil {
+			return models.URLData{}, fmt.Errorf("failed to load device urls: %w", err)
 		}
 		urlData.DeviceURLs = deviceURLs
 
-		// Update cache with device URLs
 		s.mu.Lock()
-		s.cache[shortCode] = urlData
+		if cached, ok := s.cache.get(shortCode); ok && cached.DeviceURLs == nil {
+			cached.DeviceURLs = deviceURLs
+			s.cache.set(shortCode, cached)
+		}
 		s.mu.Unlock()
 	}
 
-	return urlData, nil
+	return s.withAliases(urlData), nil
+}
+
+// loadDeviceURLs reads the device URLs of a short code from the database.
+func (s *Store) loadDeviceURLs(ctx context.Context, shortCode string) (map[string]models.DeviceURLData, error) {
+	rows, err := s.deviceURLsStmt.QueryContext(ctx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deviceURLs := make(map[string]models.DeviceURLData)
+	for rows.Next() {
+		var deviceURL models.DeviceURLData
+		err := rows.Scan(&deviceURL.Platform, &deviceURL.URL, &deviceURL.CreatedAt)
+		if err != nil {
+			s.logger.Error("failed to scan device url", "error", err)
+			continue
+		}
+		deviceURLs[deviceURL.Platform] = deviceURL
+	}
+	return deviceURLs, rows.Err()
 }
 
 func (s *Store) DeleteURL(ctx context.Context, shortCode string) error {
+	shortCode = s.normalizeCode(shortCode)
+
+	// Take the URL out of the write buffer so it isn't flushed after all.
+	// Batches already handed to the flush worker skip codes that are no
+	// longer cached.
+	s.bufMu.Lock()
+	for i, buffered := range s.writeBuf {
+		if buffered.ShortCode == shortCode {
+			s.writeBuf = append(s.writeBuf[:i], s.writeBuf[i+1:]...)
+			break
+		}
+	}
+	s.bufMu.Unlock()
+
 	// Delete from database
-	result, err := s.db.ExecContext(ctx, `DELETE FROM urls WHERE short_code = ?`, shortCode)
+	result, err := s.deleteURLStmt.ExecContext(ctx, shortCode)
 	if err != nil {
 		return err
 	}
@@ -439,89 +1049,139 @@ func (s *Store) DeleteURL(ctx context.Context, shortCode string) error {
 	if err != nil {
 		return err
 	}
-	if rowsAffected == 0 {
-		return ErrNotExist
-	}
 
-	// Delete from cache
+	// Delete from cache. A URL that wasn't flushed yet is only there.
 	s.mu.Lock()
-	delete(s.cache, shortCode)
-	metrics.URLsStoredGauge.Set(float64(len(s.cache)))
+	urlData, ok := s.cache.get(shortCode)
+	if rowsAffected == 0 && !s.cache.pinned(shortCode) {
+		s.mu.Unlock()
+		return ErrNotExist
+	}
+	s.cache.remove(shortCode)
+	s.aliases.removeCode(shortCode)
+	delete(s.pendingClicks, shortCode)
+	delete(s.pendingAccess, shortCode)
+	s.addStored(-1)
 	s.mu.Unlock()
 
+	if !ok {
+		urlData.ShortCode = shortCode
+	}
+	s.emitChange(OpDelete, urlData)
+
 	return nil
 }
 
-func (s *Store) GetURLs(ctx context.Context, page, perPage int64) ([]models.URLData, int64, error) {
+// GetURLs returns a page of URLs, newest first, along with the total number of
+// URLs. A non-empty tag only lists URLs with that tag. URLs still in the write
+// buffer are listed once they're flushed.
+func (s *Store) GetURLs(ctx context.Context, page, perPage int64, tag string) ([]models.URLData, int64, error) {
 	offset := (page - 1) * perPage
 
+	var (
+		where string
+		args  []any
+	)
+	if tag != "" {
+		where = `WHERE short_code IN (SELECT short_code FROM url_tags WHERE tag = ?)`
+		args = append(args, tag)
+	}
+
 	// Get total count
 	var total int64
-	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM urls`).Scan(&total)
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM urls `+where, args...).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// Get paginated URLs
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT short_code, url, title, created_at, expires_at
+		SELECT `+urlColumns+`
 		FROM urls
+		`+where+`
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
-	`, perPage, offset)
+	`, append(args, perPage, offset)...)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var urls []models.URLData
+	var (
+		urls  []models.URLData
+		codes []any
+	)
 	for rows.Next() {
-		var urlData models.URLData
-		var expiresAt sql.NullTime
-		err := rows.Scan(&urlData.ShortCode, &urlData.URL, &urlData.Title, &urlData.CreatedAt, &expiresAt)
+		urlData, err := scanURL(rows)
 		if err != nil {
 			return nil, 0, err
 		}
-		if expiresAt.Valid {
-			urlData.ExpiresAt = &expiresAt.Time
-		}
-
-		// Get device URLs for this short code
-		deviceRows, err := s.db.QueryContext(ctx, `
-			SELECT platform, url, created_at
-			FROM device_urls
-			WHERE short_code = ?
-		`, urlData.ShortCode)
-		if err != nil {
-			s.logger.Error("failed to get device urls", "error", err, "shortCode", urlData.ShortCode)
-			continue
-		}
-		defer deviceRows.Close()
 
-		urlData.DeviceURLs = make(map[string]models.DeviceURLData)
-		for deviceRows.Next() {
-			var deviceURL models.DeviceURLData
-			err := deviceRows.Scan(&deviceURL.Platform, &deviceURL.URL, &deviceURL.CreatedAt)
-			if err != nil {
-				s.logger.Error("failed to scan device url", "error", err)
-				continue
-			}
-			urlData.DeviceURLs[deviceURL.Platform] = deviceURL
-		}
-		deviceRows.Close() // Close before next iteration
+		// Add clicks that haven't been flushed yet
+		s.mu.RLock()
+		urlData.ClickCount += s.pendingClicks[urlData.ShortCode]
+		s.mu.RUnlock()
 
 		urls = append(urls, urlData)
+		codes = append(codes, urlData.ShortCode)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	if len(urls) == 0 {
+		return urls, total, nil
+	}
+
+	// Device URLs and tags of the whole page in one query each
+	deviceURLs, err := s.deviceURLsOf(ctx, codes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load device urls: %w", err)
+	}
+	tags, err := s.tagsOf(ctx, codes)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load tags: %w", err)
+	}
+	for i := range urls {
+		urls[i].Tags = tags[urls[i].ShortCode]
+		urls[i] = s.withAliases(urls[i])
+		urls[i].DeviceURLs = deviceURLs[urls[i].ShortCode]
+		if urls[i].DeviceURLs == nil {
+			urls[i].DeviceURLs = make(map[string]models.DeviceURLData)
+		}
 	}
 
-	return urls, total, rows.Err()
+	return urls, total, nil
 }
 
-// generateRandomString creates a random string of specified length
-func generateRandomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[rand.Int32N(int32(len(charset)))]
+// deviceURLsOf reads the device URLs of the given short codes, grouped by
+// short code.
+func (s *Store) deviceURLsOf(ctx context.Context, codes []any) (map[string]map[string]models.DeviceURLData, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT short_code, platform, url, created_at
+		FROM device_urls
+		WHERE short_code IN (`+strings.TrimSuffix(strings.Repeat("?,", len(codes)), ",")+`)
+	`, codes...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deviceURLs := make(map[string]map[string]models.DeviceURLData)
+	for rows.Next() {
+		var (
+			shortCode string
+			deviceURL models.DeviceURLData
+		)
+		if err := rows.Scan(&shortCode, &deviceURL.Platform, &deviceURL.URL, &deviceURL.CreatedAt); err != nil {
+			s.logger.Error("failed to scan device url", "error", err)
+			continue
+		}
+		if deviceURLs[shortCode] == nil {
+			deviceURLs[shortCode] = make(map[string]models.DeviceURLData)
+		}
+		deviceURLs[shortCode][deviceURL.Platform] = deviceURL
 	}
-	return string(b)
+	return deviceURLs, rows.Err()
 }
@@ -0,0 +1,426 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+	"github.com/mr-karan/lil/models"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testConf returns a config for a SQLite store in a temporary directory.
+// Buffered writes and clicks are only flushed on Close, so tests decide when
+// the database catches up.
+func testConf(t testing.TB) Conf {
+	return Conf{
+		DBPath:         filepath.Join(t.TempDir(), "urls.db"),
+		MaxOpenConns:   4,
+		MaxIdleConns:   4,
+		ShortURLLength: 6,
+		BufferSize:     100,
+		FlushInterval:  time.Hour,
+	}
+}
+
+// newTestStore opens a store with cfg, closing it when the test ends unless
+// the test closes it first.
+func newTestStore(t testing.TB, cfg Conf) *Store {
+	t.Helper()
+	s, err := New(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-s.done:
+		default:
+			s.Close()
+		}
+	})
+	return s
+}
+
+func mustCreate(t testing.TB, s interface {
+	CreateShortURL(context.Context, CreateParams) (models.URLData, error)
+}, p CreateParams) models.URLData {
+	t.Helper()
+	urlData, err := s.CreateShortURL(context.Background(), p)
+	if err != nil {
+		t.Fatalf("CreateShortURL(%+v): %v", p, err)
+	}
+	return urlData
+}
+
+func TestCloseKeepsBufferedWrites(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	s := newTestStore(t, cfg)
+
+	// Everything below stays in memory: the buffer isn't full and the flush
+	// interval doesn't come round during the test
+	mustCreate(t, s, CreateParams{URL: "https://example.com/a", Slug: "a", Tags: []string{"t"}})
+	mustCreate(t, s, CreateParams{URL: "https://example.com/b", Slug: "b"})
+	mustCreate(t, s, CreateParams{URL: "https://example.com/c", Slug: "c"})
+	if n := s.Usage().WriteBuffer; n != 3 {
+		t.Fatalf("%d URLs buffered, want 3", n)
+	}
+
+	clicks := map[string]int64{"a": 3, "b": 1}
+	for shortCode, n := range clicks {
+		for i := int64(0); i < n; i++ {
+			if _, err := s.GetRedirectData(ctx, shortCode); err != nil {
+				t.Fatalf("GetRedirectData(%s): %v", shortCode, err)
+			}
+		}
+	}
+	title, slug := "B", "renamed"
+	if _, err := s.UpdateURL(ctx, "b", UpdateParams{Title: &title, Slug: &slug}); err != nil {
+		t.Fatalf("UpdateURL(b): %v", err)
+	}
+	if _, err := s.GetRedirectData(ctx, "renamed"); err != nil {
+		t.Fatalf("GetRedirectData(renamed): %v", err)
+	}
+	if err := s.DeleteURL(ctx, "c"); err != nil {
+		t.Fatalf("DeleteURL(c): %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s = newTestStore(t, cfg)
+
+	want := []struct {
+		shortCode string
+		url       string
+		title     string
+		clicks    int64
+	}{
+		{"a", "https://example.com/a", "", 3},
+		{"renamed", "https://example.com/b", "B", 2},
+	}
+	for _, w := range want {
+		urlData, err := s.GetURL(ctx, w.shortCode)
+		if err != nil {
+			t.Fatalf("GetURL(%s) after reopening: %v", w.shortCode, err)
+		}
+		if urlData.URL != w.url || urlData.Title != w.title || urlData.ClickCount != w.clicks {
+			t.Errorf("%s after reopening = %s %q with %d clicks, want %s %q with %d",
+				w.shortCode, urlData.URL, urlData.Title, urlData.ClickCount, w.url, w.title, w.clicks)
+		}
+	}
+
+	a, _ := s.GetURL(ctx, "a")
+	if !slices.Equal(a.Tags, []string{"t"}) {
+		t.Errorf("a after reopening has tags %v, want [t]", a.Tags)
+	}
+	for _, gone := range []string{"b", "c"} {
+		if _, err := s.GetURL(ctx, gone); !errors.Is(err, ErrNotExist) {
+			t.Errorf("GetURL(%s) after reopening = %v, want ErrNotExist", gone, err)
+		}
+	}
+}
+
+func TestSyncCreateIsPersisted(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.BufferSize = 0
+	cfg.FlushInterval = 10 * time.Millisecond
+	s := newTestStore(t, cfg)
+	if s.flushChan != nil {
+		t.Error("flush channel made without write buffer")
+	}
+
+	created := mustCreate(t, s, CreateParams{URL: "https://example.com/sync", Tags: []string{"t"}})
+	var url string
+	if err := s.db.QueryRow(`SELECT url FROM urls WHERE short_code = ?`, created.ShortCode).Scan(&url); err != nil {
+		t.Fatalf("reading %s from the database right after creating it: %v", created.ShortCode, err)
+	}
+	if url != created.URL {
+		t.Errorf("stored URL = %s, want %s", url, created.URL)
+	}
+	if n := s.Usage().WriteBuffer; n != 0 {
+		t.Errorf("%d URLs buffered, want none", n)
+	}
+
+	// Clicks are still flushed on the interval
+	if _, err := s.GetRedirectData(ctx, created.ShortCode); err != nil {
+		t.Fatalf("GetRedirectData: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var clicks int64
+		if err := s.db.QueryRow(`SELECT click_count FROM urls WHERE short_code = ?`, created.ShortCode).Scan(&clicks); err != nil {
+			t.Fatalf("reading click count: %v", err)
+		}
+		if clicks == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("click count stored as %d, want 1", clicks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestSyncCreateReturnsDBError(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.BufferSize = 0
+	s := newTestStore(t, cfg)
+	if _, err := s.db.Exec(`CREATE TRIGGER fail_insert BEFORE INSERT ON urls BEGIN SELECT RAISE(ABORT, 'disk on fire'); END`); err != nil {
+		t.Fatalf("creating failing trigger: %v", err)
+	}
+
+	_, err := s.CreateShortURL(ctx, CreateParams{URL: "https://example.com", Slug: "doomed"})
+	if err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Fatalf("CreateShortURL = %v, want the database error", err)
+	}
+	if _, err := s.GetURL(ctx, "doomed"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("GetURL after the failed create = %v, want ErrNotExist", err)
+	}
+}
+
+// BenchmarkCreateAtBufferBoundary measures create latency as the write buffer
+// fills and is handed to the flush worker, flushing when it's full (the
+// default) or once it's half full. Besides the mean it reports the slowest
+// create, which is where a full buffer stalls.
+func BenchmarkCreateAtBufferBoundary(b *testing.B) {
+	const bufferSize = 100
+
+	for _, threshold := range []int{bufferSize, bufferSize / 2} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			cfg := testConf(b)
+			cfg.BufferSize = bufferSize
+			cfg.FlushThreshold = threshold
+			s := newTestStore(b, cfg)
+			ctx := context.Background()
+
+			var slowest time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := s.CreateShortURL(ctx, CreateParams{URL: "https://example.com"}); err != nil {
+					b.Fatalf("CreateShortURL: %v", err)
+				}
+				slowest = max(slowest, time.Since(start))
+			}
+			b.ReportMetric(float64(slowest.Nanoseconds()), "max-ns/op")
+		})
+	}
+}
+
+// BenchmarkRedirectStatements compares the statements GetRedirectData runs
+// against the database, the device URL lookup and the delete of expired
+// URLs, prepared once in New against parsing them on every call.
+func BenchmarkRedirectStatements(b *testing.B) {
+	cfg := testConf(b)
+	cfg.BufferSize = 0
+	s := newTestStore(b, cfg)
+	ctx := context.Background()
+	mustCreate(b, s, CreateParams{
+		URL:        "https://example.com",
+		Slug:       "devices",
+		DeviceURLs: map[string]string{"ios": "https://example.com/ios", "android": "https://example.com/android"},
+	})
+
+	drain := func(rows *sql.Rows, err error) {
+		if err != nil {
+			b.Fatalf("query: %v", err)
+		}
+		for rows.Next() {
+		}
+		if err := rows.Close(); err != nil {
+			b.Fatalf("rows: %v", err)
+		}
+	}
+	exec := func(_ sql.Result, err error) {
+		if err != nil {
+			b.Fatalf("exec: %v", err)
+		}
+	}
+
+	b.Run("device-urls/prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			drain(s.deviceURLsStmt.QueryContext(ctx, "devices"))
+		}
+	})
+	b.Run("device-urls/adhoc", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			drain(s.db.QueryContext(ctx, deviceURLsQuery, "devices"))
+		}
+	})
+	// Deleting a code that doesn't exist, so every iteration does the same work
+	b.Run("delete/prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			exec(s.deleteURLStmt.ExecContext(ctx, "missing"))
+		}
+	})
+	b.Run("delete/adhoc", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			exec(s.db.ExecContext(ctx, deleteURLQuery, "missing"))
+		}
+	})
+}
+
+// Creates fill the flush queue while the flush worker is stuck waiting for
+// the database, then block on it as backpressure or, once their context is
+// done, write their batch themselves. None of them may be lost or deadlock.
+func TestFlushQueueBackpressure(t *testing.T) {
+	cfg := testConf(t)
+	cfg.BufferSize = 1 // Every create hands the worker a batch
+	cfg.MaxOpenConns = 1
+	s := newTestStore(t, cfg)
+
+	// Holding the only connection stalls every flush
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("db.Conn: %v", err)
+	}
+
+	const (
+		writers   = 16
+		perWriter = 20
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			if w%4 == 0 {
+				// Gives up waiting for room in the queue
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+				defer cancel()
+			}
+			for i := 0; i < perWriter; i++ {
+				p := CreateParams{URL: fmt.Sprintf("https://example.com/%d/%d", w, i)}
+				if _, err := s.CreateShortURL(ctx, p); err != nil {
+					t.Errorf("CreateShortURL(%s): %v", p.URL, err)
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(s.flushChan) < cap(s.flushChan) {
+		if time.Now().After(deadline) {
+			t.Fatalf("flush queue at %d of %d, want it full", len(s.flushChan), cap(s.flushChan))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Writers with a deadline give up on the full queue and flush inline,
+	// which waits for the database too
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("creates still blocked 30s after the database freed up")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s = newTestStore(t, cfg)
+	var stored int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM urls`).Scan(&stored); err != nil {
+		t.Fatalf("count urls: %v", err)
+	}
+	if stored != writers*perWriter {
+		t.Errorf("%d URLs stored, want all %d created", stored, writers*perWriter)
+	}
+}
+
+// lockedBuffer collects log output written from any goroutine.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// A batch the database keeps rejecting is dropped after its retries, and its
+// URLs are evicted so they stop resolving rather than vanish on restart.
+func TestFailedFlushDropsUnpersisted(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.ChangeEventsBuffer = 10
+	var logs lockedBuffer
+	s, err := New(cfg, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	mustCreate(t, s, CreateParams{URL: "https://example.com/kept", Slug: "kept"})
+	s.triggerFlush()
+	if _, err := s.db.Exec(`CREATE TRIGGER fail_insert BEFORE INSERT ON urls BEGIN SELECT RAISE(ABORT, 'disk on fire'); END`); err != nil {
+		t.Fatalf("creating failing trigger: %v", err)
+	}
+	mustCreate(t, s, CreateParams{URL: "https://example.com/doomed", Slug: "doomed"})
+	if _, err := s.GetRedirectData(ctx, "doomed"); err != nil {
+		t.Fatalf("GetRedirectData(doomed) before flushing: %v", err)
+	}
+	drainChanges(s)
+
+	dropped := metrics.FlushBatchesDroppedTotal.Get()
+	s.triggerFlush()
+
+	if n := metrics.FlushBatchesDroppedTotal.Get() - dropped; n != 1 {
+		t.Errorf("%d batches counted as dropped, want 1", n)
+	}
+	for _, msg := range []string{"flush failed after retries", "disk on fire", "dropped url that couldn't be persisted"} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("logs don't report %q:\n%s", msg, logs.String())
+		}
+	}
+	if _, err := s.GetRedirectData(ctx, "doomed"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("GetRedirectData(doomed) after the failed flush = %v, want ErrNotExist", err)
+	}
+	if evts := drainChanges(s); len(evts) != 1 || evts[0].Op != OpDelete || evts[0].URL.ShortCode != "doomed" {
+		t.Errorf("changes = %+v, want doomed deleted", evts)
+	}
+	s.mu.RLock()
+	_, pending := s.pendingClicks["doomed"]
+	_, accessed := s.pendingAccess["doomed"]
+	s.mu.RUnlock()
+	if pending || accessed {
+		t.Error("clicks of the dropped URL still pending")
+	}
+	if _, err := s.GetRedirectData(ctx, "kept"); err != nil {
+		t.Errorf("GetRedirectData(kept): %v", err)
+	}
+}
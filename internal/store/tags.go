@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// insertTags adds the tags of a new short code within tx.
+func insertTags(ctx context.Context, tx *sql.Tx, shortCode string, tags []string) error {
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO url_tags (short_code, tag) VALUES (?, ?)`, shortCode, tag); err != nil {
+			return fmt.Errorf("insert tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// setTags replaces the tags of a short code within tx, an empty list removing
+// them all.
+func setTags(ctx context.Context, tx *sql.Tx, shortCode string, tags []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM url_tags WHERE short_code = ?`, shortCode); err != nil {
+		return fmt.Errorf("clear tags: %w", err)
+	}
+	return insertTags(ctx, tx, shortCode, tags)
+}
+
+// loadTags adds the stored tags to the cached URLs.
+func (s *Store) loadTags() error {
+	rows, err := s.db.Query(`SELECT short_code, tag FROM url_tags ORDER BY short_code, rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shortCode, tag string
+		if err := rows.Scan(&shortCode, &tag); err != nil {
+			return err
+		}
+		if urlData, ok := s.cache.get(shortCode); ok {
+			urlData.Tags = append(urlData.Tags, tag)
+			s.cache.set(shortCode, urlData)
+		}
+	}
+	return rows.Err()
+}
+
+// tagsOf reads the tags of the given short codes, grouped by short code.
+func (s *Store) tagsOf(ctx context.Context, codes []any) (map[string][]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT short_code, tag
+		FROM url_tags
+		WHERE short_code IN (`+strings.TrimSuffix(strings.Repeat("?,", len(codes)), ",")+`)
+		ORDER BY short_code, rowid
+	`, codes...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var shortCode, tag string
+		if err := rows.Scan(&shortCode, &tag); err != nil {
+			return nil, err
+		}
+		tags[shortCode] = append(tags[shortCode], tag)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// taggedCodes lists the short codes with tag, sorted.
+func taggedCodes(t *testing.T, s *Store, tag string) []string {
+	t.Helper()
+	urls, total, err := s.GetURLs(context.Background(), 1, 100, tag)
+	if err != nil {
+		t.Fatalf("GetURLs(%q): %v", tag, err)
+	}
+	if total != int64(len(urls)) {
+		t.Errorf("GetURLs(%q) total = %d with %d URLs", tag, total, len(urls))
+	}
+	codes := make([]string, 0, len(urls))
+	for _, urlData := range urls {
+		codes = append(codes, urlData.ShortCode)
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConf(t)
+	cfg.BufferSize = 0 // Lists are read from the database
+	s := newTestStore(t, cfg)
+
+	mustCreate(t, s, CreateParams{URL: "https://example.com/a", Slug: "a", Tags: []string{"x", "y"}})
+	mustCreate(t, s, CreateParams{URL: "https://example.com/b", Slug: "b", Tags: []string{"y"}})
+	mustCreate(t, s, CreateParams{URL: "https://example.com/c", Slug: "c"})
+
+	update := func(shortCode string, p UpdateParams) {
+		t.Helper()
+		if _, err := s.UpdateURL(ctx, shortCode, p); err != nil {
+			t.Fatalf("UpdateURL(%s): %v", shortCode, err)
+		}
+	}
+	tags := func(tags ...string) *[]string { return &tags }
+	str := func(v string) *string { return &v }
+
+	steps := []struct {
+		name   string
+		update func()
+		want   map[string][]string // Short codes by tag
+		tagsOf map[string][]string // Tags by short code
+	}{
+		{
+			name:   "created",
+			want:   map[string][]string{"x": {"a"}, "y": {"a", "b"}, "z": {}},
+			tagsOf: map[string][]string{"a": {"x", "y"}, "b": {"y"}, "c": nil},
+		},
+		{
+			name:   "other fields updated",
+			update: func() { update("a", UpdateParams{Title: str("A")}) },
+			want:   map[string][]string{"x": {"a"}, "y": {"a", "b"}},
+			tagsOf: map[string][]string{"a": {"x", "y"}},
+		},
+		{
+			name:   "tags replaced",
+			update: func() { update("a", UpdateParams{Tags: tags("z")}) },
+			want:   map[string][]string{"x": {}, "y": {"b"}, "z": {"a"}},
+			tagsOf: map[string][]string{"a": {"z"}},
+		},
+		{
+			name:   "tags added",
+			update: func() { update("c", UpdateParams{Tags: tags("y", "z")}) },
+			want:   map[string][]string{"y": {"b", "c"}, "z": {"a", "c"}},
+			tagsOf: map[string][]string{"c": {"y", "z"}},
+		},
+		{
+			name:   "tags removed",
+			update: func() { update("a", UpdateParams{Tags: tags()}) },
+			want:   map[string][]string{"z": {"c"}},
+			tagsOf: map[string][]string{"a": nil},
+		},
+		{
+			name:   "renamed",
+			update: func() { update("b", UpdateParams{Slug: str("b2")}) },
+			want:   map[string][]string{"y": {"b2", "c"}},
+			tagsOf: map[string][]string{"b2": {"y"}},
+		},
+	}
+
+	for _, step := range steps {
+		if step.update != nil {
+			step.update()
+		}
+		for tag, want := range step.want {
+			if got := taggedCodes(t, s, tag); !slices.Equal(got, want) {
+				t.Errorf("%s: URLs tagged %q = %v, want %v", step.name, tag, got, want)
+			}
+		}
+		for shortCode, want := range step.tagsOf {
+			urlData, err := s.GetURL(ctx, shortCode)
+			if err != nil {
+				t.Fatalf("%s: GetURL(%s): %v", step.name, shortCode, err)
+			}
+			if !slices.Equal(urlData.Tags, want) {
+				t.Errorf("%s: tags of %s = %v, want %v", step.name, shortCode, urlData.Tags, want)
+			}
+		}
+	}
+}
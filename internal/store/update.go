@@ -0,0 +1,286 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// UpdateParams holds the changes to a short URL. Nil fields are left as they
+// are.
+type UpdateParams struct {
+	URL   *string
+	Title *string
+
+	// Slug renames the short code, which must not be taken
+	Slug *string
+
+	// Expiry makes the URL expire this long from now, or never when zero
+	Expiry *time.Duration
+
+	// DeviceURLs replaces the device URLs when non-nil, an empty map
+	// removing them all
+	DeviceURLs map[string]string
+
+	// Tags replaces the tags when non-nil, an empty list removing them all
+	Tags *[]string
+}
+
+// applyUpdate returns urlData with the changes in p applied.
+func (r *codeRules) applyUpdate(urlData models.URLData, p UpdateParams) (models.URLData, error) {
+	var newURL string
+	if p.URL != nil {
+		newURL = *p.URL
+	}
+	if err := r.hosts.checkAll(newURL, p.DeviceURLs); err != nil {
+		return models.URLData{}, err
+	}
+
+	if p.Slug != nil {
+		if shortCode := r.normalizeCode(*p.Slug); shortCode != urlData.ShortCode {
+			if err := r.ValidateSlug(*p.Slug); err != nil {
+				return models.URLData{}, err
+			}
+			urlData.ShortCode = shortCode
+		}
+	}
+	if p.URL != nil {
+		urlData.URL = *p.URL
+	}
+	if p.Title != nil {
+		urlData.Title = *p.Title
+	}
+	if p.Tags != nil {
+		urlData.Tags = nil
+		if len(*p.Tags) > 0 {
+			urlData.Tags = *p.Tags
+		}
+	}
+	if p.Expiry != nil {
+		urlData.ExpiresAt = nil
+		if *p.Expiry > 0 {
+			t := time.Now().Add(*p.Expiry)
+			urlData.ExpiresAt = &t
+		}
+	}
+
+	now := time.Now().UTC()
+	if p.DeviceURLs != nil {
+		deviceURLs := make(map[string]models.DeviceURLData)
+		for platform, deviceURL := range p.DeviceURLs {
+			if !r.platforms[platform] || deviceURL == "" {
+				continue
+			}
+			deviceURLData := models.DeviceURLData{
+				URL:       deviceURL,
+				Platform:  platform,
+				CreatedAt: now,
+			}
+			// Unchanged device URLs keep their creation time
+			if existing, ok := urlData.DeviceURLs[platform]; ok && existing.URL == deviceURL {
+				deviceURLData.CreatedAt = existing.CreatedAt
+			}
+			deviceURLs[platform] = deviceURLData
+		}
+		urlData.DeviceURLs = deviceURLs
+		urlData.HasDeviceURLs = len(deviceURLs) > 0
+	}
+
+	urlData.UpdatedAt = now
+	return urlData, nil
+}
+
+// UpdateURL applies the changes in p to a short URL and returns the updated
+// record. Renaming it to a code that's taken fails with ErrExists. A renamed
+// URL keeps its click count, tags and device URLs, and publishes a delete of
+// the old code followed by a create of the new one.
+func (s *Store) UpdateURL(ctx context.Context, shortCode string, p UpdateParams) (models.URLData, error) {
+	shortCode = s.normalizeCode(shortCode)
+
+	// Updates are serialized so concurrent renames can't claim the same code
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	old, err := s.GetURL(ctx, shortCode)
+	if err != nil {
+		return models.URLData{}, err
+	}
+	urlData, err := s.applyUpdate(old, p)
+	if err != nil {
+		return models.URLData{}, err
+	}
+
+	renamed := urlData.ShortCode != shortCode
+	if renamed {
+		if s.exists(urlData.ShortCode) {
+			return models.URLData{}, ErrExists
+		}
+	}
+
+	// Take the URL out of the write buffer so its old version isn't flushed
+	// over this one. Batches already handed to the flush worker don't
+	// overwrite existing rows and skip codes that are no longer cached.
+	s.bufMu.Lock()
+	for i, buffered := range s.writeBuf {
+		if buffered.ShortCode == shortCode {
+			s.writeBuf = append(s.writeBuf[:i], s.writeBuf[i+1:]...)
+			break
+		}
+	}
+	s.bufMu.Unlock()
+
+	// Only clicks already flushed are written, the pending ones are added by
+	// the next click flush
+	s.mu.RLock()
+	urlData.ClickCount = s.clickCount(old) - s.pendingClicks[shortCode]
+	s.mu.RUnlock()
+
+	if err := s.writeUpdate(ctx, shortCode, urlData); err != nil {
+		return models.URLData{}, err
+	}
+
+	s.mu.Lock()
+	urlData.ClickCount = s.clickCount(old)
+	if renamed {
+		s.cache.remove(shortCode)
+		s.aliases.rename(shortCode, urlData.ShortCode)
+		if n, ok := s.pendingClicks[shortCode]; ok {
+			delete(s.pendingClicks, shortCode)
+			s.pendingClicks[urlData.ShortCode] += n
+		}
+		if at, ok := s.pendingAccess[shortCode]; ok {
+			delete(s.pendingAccess, shortCode)
+			s.pendingAccess[urlData.ShortCode] = at
+		}
+	}
+	s.cache.set(urlData.ShortCode, urlData)
+	// A URL updated while still buffered is in the database now
+	s.cache.unpin(urlData.ShortCode)
+	s.mu.Unlock()
+
+	if renamed {
+		s.emitChange(OpDelete, old)
+		s.emitChange(OpCreate, urlData)
+	} else {
+		s.emitChange(OpUpdate, urlData)
+	}
+
+	return s.withAliases(urlData), nil
+}
+
+// clickCount returns the current click count of a URL, which is the cached one
+// unless it was evicted since old was read. Callers hold mu.
+func (s *Store) clickCount(old models.URLData) int64 {
+	if cached, ok := s.cache.get(old.ShortCode); ok {
+		return cached.ClickCount
+	}
+	return old.ClickCount
+}
+
+// GetDeviceURLs returns the device URLs of a short code by platform.
+func (s *Store) GetDeviceURLs(ctx context.Context, shortCode string) (map[string]models.DeviceURLData, error) {
+	urlData, err := s.GetURL(ctx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	return deviceURLsOrEmpty(urlData), nil
+}
+
+// SetDeviceURLs replaces the device URLs of a short code with the given
+// platform -> url mapping, an empty one removing them all, and returns the new
+// ones. Unknown platforms fail with ErrInvalidPlatform, and the change is
+// published as an update of the URL.
+func (s *Store) SetDeviceURLs(ctx context.Context, shortCode string, deviceURLs map[string]string) (map[string]models.DeviceURLData, error) {
+	if err := s.validateDeviceURLs(deviceURLs); err != nil {
+		return nil, err
+	}
+	if deviceURLs == nil {
+		deviceURLs = map[string]string{}
+	}
+	urlData, err := s.UpdateURL(ctx, shortCode, UpdateParams{DeviceURLs: deviceURLs})
+	if err != nil {
+		return nil, err
+	}
+	return deviceURLsOrEmpty(urlData), nil
+}
+
+// validateDeviceURLs checks a platform -> url mapping only has known
+// platforms. Empty URLs are dropped when the mapping is applied.
+func (r *codeRules) validateDeviceURLs(deviceURLs map[string]string) error {
+	for platform := range deviceURLs {
+		if !r.platforms[platform] {
+			return fmt.Errorf("%w: %s", ErrInvalidPlatform, platform)
+		}
+	}
+	return nil
+}
+
+func deviceURLsOrEmpty(urlData models.URLData) map[string]models.DeviceURLData {
+	if urlData.DeviceURLs == nil {
+		return map[string]models.DeviceURLData{}
+	}
+	return urlData.DeviceURLs
+}
+
+// writeUpdate stores the updated record of shortCode in a single transaction,
+// replacing its device URLs and tags. The row is inserted if the URL was still
+// buffered.
+func (s *Store) writeUpdate(ctx context.Context, shortCode string, urlData models.URLData) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	args, err := urlArgs(urlData)
+	if err != nil {
+		return err
+	}
+
+	if urlData.ShortCode != shortCode {
+		// Aliases move to the new code, device URLs and tags of the old one go
+		// with it
+		if _, err := tx.ExecContext(ctx, `INSERT INTO urls (`+urlColumns+`) VALUES `+urlPlaceholders, args...); err != nil {
+			return fmt.Errorf("insert renamed url: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE aliases SET short_code = ? WHERE short_code = ?`, urlData.ShortCode, shortCode); err != nil {
+			return fmt.Errorf("move aliases: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM urls WHERE short_code = ?`, shortCode); err != nil {
+			return fmt.Errorf("delete renamed url: %w", err)
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO urls (`+urlColumns+`) VALUES `+urlPlaceholders+`
+			ON CONFLICT(short_code) DO UPDATE SET
+				url = excluded.url,
+				title = excluded.title,
+				expires_at = excluded.expires_at,
+				updated_at = excluded.updated_at
+		`, args...); err != nil {
+			return fmt.Errorf("update url: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM device_urls WHERE short_code = ?`, shortCode); err != nil {
+			return fmt.Errorf("delete device urls: %w", err)
+		}
+	}
+
+	for _, deviceURL := range urlData.DeviceURLs {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO device_urls (short_code, platform, url, created_at)
+			VALUES (?, ?, ?, ?)
+		`, urlData.ShortCode, deviceURL.Platform, deviceURL.URL, deviceURL.CreatedAt); err != nil {
+			return fmt.Errorf("insert device url: %w", err)
+		}
+	}
+	if err := setTags(ctx, tx, urlData.ShortCode, urlData.Tags); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
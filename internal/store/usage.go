@@ -0,0 +1,33 @@
+package store
+
+// Usage reports how full a store's in-memory queues are, for health checks.
+// Capacities are zero for queues the backend doesn't have or that are
+// unbounded.
+type Usage struct {
+	WriteBuffer    int // URLs waiting in the write buffer
+	WriteBufferCap int
+	FlushQueue     int // Batches waiting for the flush worker
+	FlushQueueCap  int
+	Cache          int // Cached URLs
+	CacheCap       int
+}
+
+// Usage returns the current fill of the write buffer, flush queue and cache.
+func (s *Store) Usage() Usage {
+	s.bufMu.Lock()
+	bufferLen := len(s.writeBuf)
+	s.bufMu.Unlock()
+
+	s.mu.RLock()
+	cacheLen := len(s.cache.entries)
+	s.mu.RUnlock()
+
+	return Usage{
+		WriteBuffer:    bufferLen,
+		WriteBufferCap: s.bufferSize,
+		FlushQueue:     len(s.flushChan),
+		FlushQueueCap:  cap(s.flushChan),
+		Cache:          cacheLen,
+		CacheCap:       s.cache.max,
+	}
+}
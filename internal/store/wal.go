@@ -0,0 +1,62 @@
+package store
+
+import (
+	"os"
+	"time"
+
+	"github.com/mr-karan/lil/internal/metrics"
+)
+
+// walCheckpointWorker periodically checkpoints the WAL back into the main
+// database file, truncating it so it doesn't grow without bound under
+// sustained batched writes. When maxWALSize is set, the checkpoint only runs
+// once the WAL has grown past it.
+func (s *Store) walCheckpointWorker(interval time.Duration, maxWALSize int64) {
+	defer s.bg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			size := s.walSize()
+			metrics.WALSizeBytes.Set(float64(size))
+			if maxWALSize > 0 && size < maxWALSize {
+				continue
+			}
+			s.checkpointWAL()
+		}
+	}
+}
+
+// checkpointWAL runs a TRUNCATE checkpoint and logs its outcome.
+func (s *Store) checkpointWAL() {
+	var busy, logPages, checkpointed int
+	if err := s.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logPages, &checkpointed); err != nil {
+		s.logger.Error("failed to checkpoint wal", "error", err)
+		return
+	}
+	metrics.WALSizeBytes.Set(float64(s.walSize()))
+
+	if busy != 0 {
+		s.logger.Warn("wal checkpoint could not complete, database busy",
+			"log_pages", logPages,
+			"checkpointed_pages", checkpointed)
+		return
+	}
+	s.logger.Info("checkpointed wal",
+		"log_pages", logPages,
+		"checkpointed_pages", checkpointed)
+}
+
+// walSize returns the size of the WAL file in bytes, or 0 if it doesn't exist.
+func (s *Store) walSize() int64 {
+	fi, err := os.Stat(s.dbPath + "-wal")
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
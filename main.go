@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/knadh/koanf/v2"
@@ -14,9 +19,33 @@ import (
 )
 
 type App struct {
-	store     *store.Store
+	store     Store
 	logger    *slog.Logger
 	analytics *analytics.Manager
+
+	// Static headers added to every redirect response
+	redirectHeaders map[string]string
+	// Query parameters forwarded from the short URL to the target
+	forwardParams []string
+	// Page scheduled links redirect to before they're active
+	comingSoonURL string
+	// Verify the database is writable in the readiness check
+	readinessWriteCheck bool
+	// Respond to deletes with 200 and a JSON envelope instead of 204
+	mutationResponseBody bool
+	// Number of alternative slugs offered when a slug is taken, and how
+	// they're generated
+	slugSuggestions        int
+	slugSuggestionStrategy string
+	// Serve QR codes with an ETag to revalidate instead of caching them for good
+	qrRevalidate bool
+	// Proxies whose forwarding headers are trusted for the client IP
+	trustedProxies []*net.IPNet
+	// Base URLs links are served from, picked by request host
+	domains publicDomains
+	// Fractions of the write buffer, flush queue and analytics queue at which
+	// the detailed health check reports saturation, 0 disabling the check
+	saturation saturationThresholds
 }
 
 var (
@@ -25,27 +54,120 @@ var (
 )
 
 func main() {
+	initConfig()
+
+	logger, err := initLogger(ko.String("log.format"), ko.String("log.level"), ko.Bool("app.enable_debug_logs"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid log configuration: %v\n", err)
+		os.Exit(1)
+	}
+
 	app := &App{
-		logger: initLogger(ko.Bool("app.enable_debug_logs")),
+		logger:                 logger,
+		redirectHeaders:        ko.StringMap("app.redirect_headers"),
+		forwardParams:          ko.Strings("app.forward_query_params"),
+		comingSoonURL:          ko.String("app.coming_soon_url"),
+		readinessWriteCheck:    ko.Bool("app.readiness_write_check"),
+		mutationResponseBody:   ko.Bool("app.mutation_response_body"),
+		slugSuggestions:        ko.Int("app.slug_suggestions.count"),
+		slugSuggestionStrategy: ko.String("app.slug_suggestions.strategy"),
+		qrRevalidate:           ko.Bool("app.qr.revalidate"),
+		saturation: saturationThresholds{
+			writeBuffer:    floatOr("app.health.write_buffer", 0.9),
+			flushQueue:     floatOr("app.health.flush_queue", 0.9),
+			analyticsQueue: floatOr("app.health.analytics_queue", 0.9),
+		},
+	}
+
+	if err := checkForwardParams(app.forwardParams); err != nil {
+		app.logger.Error("Invalid forwarded query parameters", "error", err)
+		os.Exit(1)
+	}
+
+	trustedProxies, err := parseCIDRs(ko.Strings("server.trusted_proxies"))
+	if err != nil {
+		app.logger.Error("Invalid trusted proxies", "error", err)
+		os.Exit(1)
 	}
+	app.trustedProxies = trustedProxies
 
-	// Initialize SQLite store.
-	store, err := store.New(store.Conf{
+	metricsNetworks, err := parseCIDRs(ko.Strings("metrics.allowed_networks"))
+	if err != nil {
+		app.logger.Error("Invalid metrics allowed networks", "error", err)
+		os.Exit(1)
+	}
+
+	domains, err := newPublicDomains(append([]string{ko.String("app.public_url")}, ko.Strings("app.public_urls")...))
+	if err != nil {
+		app.logger.Error("Invalid public URLs", "error", err)
+		os.Exit(1)
+	}
+	app.domains = domains
+
+	storeConf := store.Conf{
 		DBPath:              ko.MustString("db.path"),
 		MaxOpenConns:        ko.MustInt("db.max_open_conns"),
 		MaxIdleConns:        ko.MustInt("db.max_idle_conns"),
 		ConnMaxLifetimeMins: ko.MustInt("db.conn_max_lifetime_mins"),
 		ShortURLLength:      ko.MustInt("app.short_url_length"),
-		BufferSize:          ko.MustInt("db.buffer_size"),
+		MinShortURLLength:   ko.Int("app.min_short_url_length"),
+		MaxShortURLLength:   ko.Int("app.max_short_url_length"),
+		MinEntropyBits:      ko.Float64("app.min_entropy_bits"),
+		RequireMinEntropy:   ko.Bool("app.require_min_entropy"),
+		Alphabet:            ko.String("app.code_alphabet"),
+		MaxCodeAttempts:     ko.Int("app.max_code_attempts"),
+		GrowCodeLength:      ko.Bool("app.grow_code_length"),
+		CacheSize:           ko.Int("db.cache_size"),
+		LazyCache:           ko.Bool("db.lazy_cache"),
+		BufferSize:          ko.Int("db.buffer_size"),
+		FlushThreshold:      ko.Int("db.flush_threshold"),
 		FlushInterval:       ko.MustDuration("db.flush_interval"),
-	}, app.logger)
+		ExpiredRetention:    ko.Duration("app.expired_retention"),
+		ExpiryReapInterval:  durationOr("app.expiry_reap_interval", 24*time.Hour),
+
+		WALCheckpointInterval: ko.Duration("db.wal_checkpoint_interval"),
+		WALCheckpointSize:     ko.Int64("db.wal_checkpoint_size"),
+
+		LinkAgeMetricsInterval: ko.Duration("app.link_age_metrics_interval"),
+
+		OriginURL:     ko.String("origin.url"),
+		OriginAPIKey:  ko.String("origin.api_key"),
+		OriginTimeout: durationOr("origin.timeout", 2*time.Second),
+
+		CaseInsensitive: ko.Bool("app.case_insensitive_codes"),
+
+		SlugPattern:   ko.String("app.slugs.pattern"),
+		MinSlugLength: ko.Int("app.slugs.min_length"),
+		MaxSlugLength: ko.Int("app.slugs.max_length"),
+		ReservedSlugs: stringsOrNil("app.slugs.reserved"),
+
+		AllowedHosts: ko.Strings("app.hosts.allowed"),
+		DeniedHosts:  ko.Strings("app.hosts.denied"),
+
+		DevicePlatforms: stringsOrNil("app.device_platforms"),
+
+		Redis: store.RedisConf{
+			Address:   ko.String("db.redis.address"),
+			Username:  ko.String("db.redis.username"),
+			Password:  ko.String("db.redis.password"),
+			DB:        ko.Int("db.redis.db"),
+			KeyPrefix: ko.String("db.redis.key_prefix"),
+		},
+	}
+
+	// Initialize the configured store backend.
+	switch backend := ko.String("db.backend"); backend {
+	case "", "sqlite":
+		app.store, err = store.New(storeConf, app.logger)
+	case "redis":
+		app.store, err = store.NewRedis(storeConf, app.logger)
+	default:
+		err = fmt.Errorf("unknown backend %q", backend)
+	}
 	if err != nil {
-		app.logger.Error("Failed to initialize SQLite store", "error", err)
+		app.logger.Error("Failed to initialize store", "error", err)
 		os.Exit(1)
 	}
-	defer store.Close()
-
-	app.store = store
 
 	// Initialize analytics manager.
 	providers := make(map[string]map[string]interface{})
@@ -58,9 +180,16 @@ func main() {
 	}
 
 	analyticsConfig := analytics.Config{
-		Enabled:    ko.Bool("analytics.enabled"),
-		NumWorkers: ko.MustInt("analytics.num_workers"),
-		Providers:  providers,
+		Enabled:          ko.Bool("analytics.enabled"),
+		NumWorkers:       ko.MustInt("analytics.num_workers"),
+		QueueSize:        ko.Int("analytics.queue_size"),
+		BatchSize:        ko.Int("analytics.batch_size"),
+		BatchInterval:    ko.Duration("analytics.batch_interval"),
+		RetryAttempts:    ko.Int("analytics.retry_attempts"),
+		RetryBaseDelay:   ko.Duration("analytics.retry_base_delay"),
+		CircuitThreshold: ko.Int("analytics.circuit_threshold"),
+		CircuitCooldown:  ko.Duration("analytics.circuit_cooldown"),
+		Providers:        providers,
 	}
 
 	analyticsManager, err := analytics.NewManager(analyticsConfig, app.logger)
@@ -76,41 +205,128 @@ func main() {
 	// Initialize router and start server
 	mux := http.NewServeMux()
 
+	// Each route group gets its own timeout so slow management calls don't
+	// share the tight budget of the redirect path.
+	apiTimeout := middleware.Timeout(durationOr("server.timeouts.api", 5*time.Second))
+	redirectTimeout := middleware.Timeout(durationOr("server.timeouts.redirect", time.Second))
+	bulkTimeout := middleware.Timeout(durationOr("server.timeouts.bulk", 30*time.Second))
+
+	// Bodies of write routes are capped, bulk ones with their own larger limit
+	apiBody := middleware.BodyLimit(int64Or("server.body_limits.api", 1<<20), app.sendBodyTooLarge)
+	bulkBody := middleware.BodyLimit(int64Or("server.body_limits.bulk", 32<<20), app.sendBodyTooLarge)
+
+	// Management routes need an API key when api.keys is set
+	adminUser, adminPassword := ko.String("admin.username"), ko.String("admin.password")
+	requireKey := middleware.APIKey(ko.Strings("api.keys"), adminUser, adminPassword, func(w http.ResponseWriter, r *http.Request) {
+		app.sendErrorResponse(w, "Invalid or missing API key", http.StatusUnauthorized, nil)
+	})
+
+	// Per client rate limit on creating URLs
+	createLimit := middleware.RateLimit(ko.Float64("api.rate_limit.shorten.rate"), ko.Int("api.rate_limit.shorten.burst"),
+		func(r *http.Request) string { return clientIP(r, app.trustedProxies) },
+		func(w http.ResponseWriter, r *http.Request) {
+			app.sendErrorResponse(w, "Too many requests", http.StatusTooManyRequests, nil)
+		})
+
 	// API routes
-	mux.HandleFunc("GET /api/v1", app.handleIndex)
-	mux.HandleFunc("GET /api/v1/health", app.handleHealthCheck)
-	mux.HandleFunc("POST /api/v1/shorten", app.handleShortenURL)
-	mux.HandleFunc("GET /api/v1/urls", app.handleGetURLs)
-	mux.HandleFunc("DELETE /api/v1/urls/{shortCode}", app.handleDeleteURL)
-	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("GET /api/v1", apiTimeout(http.HandlerFunc(app.handleIndex)))
+	mux.Handle("GET /api/v1/health", apiTimeout(http.HandlerFunc(app.handleHealthCheck)))
+	mux.Handle("GET /api/v1/health/detailed", apiTimeout(http.HandlerFunc(app.handleDetailedHealthCheck)))
+	mux.Handle("GET /api/v1/ready", apiTimeout(http.HandlerFunc(app.handleReadiness)))
+	mux.Handle("GET /api/v1/expand/{shortCode}", apiTimeout(http.HandlerFunc(app.handleExpand)))
+	mux.Handle("POST /api/v1/shorten", requireKey(apiBody(createLimit(apiTimeout(http.HandlerFunc(app.handleShortenURL))))))
+	mux.Handle("POST /api/v1/urls/bulk", requireKey(bulkBody(bulkTimeout(http.HandlerFunc(app.handleBulkShortenURL)))))
+	mux.Handle("GET /api/v1/urls", requireKey(apiTimeout(http.HandlerFunc(app.handleGetURLs))))
+	mux.Handle("POST /api/v1/urls/import", requireKey(bulkBody(bulkTimeout(http.HandlerFunc(app.handleImport)))))
+	mux.Handle("GET /api/v1/urls/export", requireKey(bulkTimeout(http.HandlerFunc(app.handleExportCSV))))
+	mux.Handle("POST /api/v1/urls/purge", requireKey(apiBody(bulkTimeout(http.HandlerFunc(app.handlePurge)))))
+	mux.Handle("GET /api/v1/stats", requireKey(apiTimeout(http.HandlerFunc(app.handleStats))))
+	mux.Handle("POST /api/v1/urls/stats", requireKey(apiBody(apiTimeout(http.HandlerFunc(app.handleBulkStats)))))
+	mux.Handle("GET /api/v1/urls/{shortCode}", requireKey(apiTimeout(http.HandlerFunc(app.handleGetURL))))
+	mux.Handle("GET /api/v1/urls/{shortCode}/devices", requireKey(apiTimeout(http.HandlerFunc(app.handleGetDeviceURLs))))
+	mux.Handle("PUT /api/v1/urls/{shortCode}/devices", requireKey(apiBody(apiTimeout(http.HandlerFunc(app.handleSetDeviceURLs)))))
+	mux.Handle("POST /api/v1/urls/{shortCode}/aliases", requireKey(apiBody(apiTimeout(http.HandlerFunc(app.handleAddAlias)))))
+	mux.Handle("POST /api/v1/urls/{shortCode}/reset-clicks", requireKey(apiTimeout(http.HandlerFunc(app.handleResetClicks))))
+	mux.Handle("GET /api/v1/urls/{shortCode}/qr", requireKey(apiTimeout(http.HandlerFunc(app.handleQRCode))))
+	mux.Handle("PATCH /api/v1/urls/{shortCode}", requireKey(apiBody(apiTimeout(http.HandlerFunc(app.handleUpdateURL)))))
+	mux.Handle("DELETE /api/v1/urls/{shortCode}", requireKey(apiTimeout(http.HandlerFunc(app.handleDeleteURL))))
+	mux.HandleFunc("GET /openapi.json", app.handleOpenAPI)
+	// Metrics are public unless tokens or networks are configured
+	metricsGuard := app.restrict(ko.Strings("metrics.tokens"), metricsNetworks)
+	mux.Handle("GET /metrics", metricsGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		metrics.WritePrometheus(w, true)
-	})
+	})))
 
 	// Admin UI routes with basic auth
 	adminHandler := getAdminUI()
-	if username, password := ko.String("admin.username"), ko.String("admin.password"); username != "" && password != "" {
-		adminHandler = middleware.BasicAuth(username, password)(adminHandler)
+	if adminUser != "" && adminPassword != "" {
+		adminHandler = middleware.BasicAuth(adminUser, adminPassword)(adminHandler)
 	}
 	mux.Handle("GET /admin/", adminHandler)
 	mux.Handle("GET /admin/...", adminHandler)
 
 	// Short URL redirect handler (catch-all)
-	mux.HandleFunc("GET /{shortCode}", app.handleRedirect)
+	mux.Handle("GET /{shortCode}", redirectTimeout(http.HandlerFunc(app.handleRedirect)))
+	// Password prompts post the password back to the short URL
+	mux.Handle("POST /{shortCode}", apiBody(redirectTimeout(http.HandlerFunc(app.handleRedirect))))
+
+	// Turn panics in any handler into a clean 500 response
+	handler := middleware.Recover(app.logger, func(w http.ResponseWriter, r *http.Request) {
+		app.sendErrorResponse(w, "Internal server error", http.StatusInternalServerError, nil)
+	})(mux)
+	if ko.Bool("server.compression.enabled") {
+		handler = middleware.Compress(ko.Int("server.compression.min_size"))(handler)
+	}
+	if ko.Bool("server.access_log") {
+		handler = middleware.AccessLog(app.logger, func(r *http.Request) string {
+			return clientIP(r, app.trustedProxies)
+		})(handler)
+	}
 
 	server := &http.Server{
 		Addr:         ko.MustString("server.address"),
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  ko.MustDuration("server.read_timeout"),
 		WriteTimeout: ko.MustDuration("server.write_timeout"),
 		IdleTimeout:  ko.MustDuration("server.idle_timeout"),
 	}
 
-	// Start URL expiry worker
-	app.store.StartExpiryWorker(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		app.logger.Info("starting server", "address", server.Addr, "build", buildString)
+		serverErr <- server.ListenAndServe()
+	}()
 
-	app.logger.Info("starting server", "address", server.Addr, "build", buildString)
-	if err := server.ListenAndServe(); err != nil {
+	select {
+	case err := <-serverErr:
 		app.logger.Error("server failed to start", "error", err)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	timeout := durationOr("server.shutdown_timeout", 15*time.Second)
+	app.logger.Info("shutting down", "timeout", timeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	app.shutdown(shutdownCtx, server)
+	app.logger.Info("shutdown complete")
+}
+
+// shutdown stops accepting connections and lets in-flight requests finish
+// before flushing analytics and the store they write to.
+func (app *App) shutdown(ctx context.Context, server *http.Server) {
+	if err := server.Shutdown(ctx); err != nil {
+		app.logger.Error("failed to drain requests", "error", err)
+	}
+	if err := app.analytics.Shutdown(ctx); err != nil {
+		app.logger.Error("failed to flush analytics", "error", err)
+	}
+	if err := app.store.Close(); err != nil {
+		app.logger.Error("failed to close store", "error", err)
 	}
 }
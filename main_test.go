@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/lil/internal/analytics"
+	"github.com/mr-karan/lil/internal/store"
+)
+
+// closeRecorder notes when the store is closed, leaving the closing to the
+// test's cleanup.
+type closeRecorder struct {
+	Store
+	closed func()
+}
+
+func (s closeRecorder) Close() error {
+	s.closed()
+	return nil
+}
+
+// A request in flight when shutdown starts completes, and its analytics event
+// is sent before the store is closed.
+func TestShutdownOrder(t *testing.T) {
+	app := newTestApp(t)
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "go"})
+
+	var (
+		mu    sync.Mutex
+		steps []string
+	)
+	step := func(name string) {
+		mu.Lock()
+		steps = append(steps, name)
+		mu.Unlock()
+	}
+	app.store = closeRecorder{Store: app.store, closed: func() { step("store closed") }}
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		step("event sent")
+	}))
+	defer webhook.Close()
+	m, err := analytics.NewManager(analytics.Config{
+		Enabled:   true,
+		Providers: map[string]map[string]interface{}{"webhook": {"endpoint": webhook.URL}},
+	}, testLogger)
+	if err != nil {
+		t.Fatalf("analytics.NewManager: %v", err)
+	}
+	app.analytics = m
+
+	// The redirect holds until released, so it's in flight when shutdown
+	// starts
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{shortCode}", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		app.handleRedirect(w, r)
+		step("request done")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp := make(chan int, 1)
+	go func() {
+		res, err := client.Get(srv.URL + "/go")
+		if err != nil {
+			t.Errorf("in-flight request: %v", err)
+			resp <- 0
+			return
+		}
+		res.Body.Close()
+		resp <- res.StatusCode
+	}()
+	<-started
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		app.shutdown(context.Background(), srv.Config)
+		close(shutdownDone)
+	}()
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown finished with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	if code := <-resp; code != http.StatusFound {
+		t.Errorf("in-flight request: status = %d, want 302", code)
+	}
+	select {
+	case <-shutdownDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shutdown didn't finish")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"request done", "event sent", "store closed"}; !slices.Equal(steps, want) {
+		t.Errorf("shutdown steps = %q, want %q", steps, want)
+	}
+}
@@ -3,12 +3,54 @@ package models
 import "time"
 
 type URLData struct {
-	URL        string                   `json:"url"`
-	Title      string                   `json:"title,omitempty"`
-	ShortCode  string                   `json:"short_code"`
-	CreatedAt  time.Time                `json:"created_at"`
-	ExpiresAt  *time.Time               `json:"expires_at"`
-	DeviceURLs map[string]DeviceURLData `json:"device_urls,omitempty"`
+	URL        string     `json:"url"`
+	Title      string     `json:"title,omitempty"`
+	ShortCode  string     `json:"short_code"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"` // last change to the link, CreatedAt until then
+	ExpiresAt  *time.Time `json:"expires_at"`
+	StartsAt   *time.Time `json:"starts_at"`
+	ClickCount int64      `json:"click_count"`
+
+	// MaxClicks is the number of redirects the link allows, unlimited when
+	// zero. Once they're used up the link stops redirecting.
+	MaxClicks int64 `json:"max_clicks,omitempty"`
+
+	// RedirectStatus is the HTTP status redirects answer with, 302 when zero
+	RedirectStatus int                      `json:"redirect_status,omitempty"`
+	DeviceURLs     map[string]DeviceURLData `json:"device_urls,omitempty"`
+	Headers        map[string]string        `json:"headers,omitempty"`
+	Tags           []string                 `json:"tags,omitempty"`
+
+	// UTM parameters added to the destination on redirect
+	UTM *UTM `json:"utm,omitempty"`
+
+	// Aliases are other codes redirecting to the same destination
+	Aliases []string `json:"aliases,omitempty"`
+
+	// AnalyticsProviders restricts redirect events to the named providers.
+	// Events go to every configured provider when empty.
+	AnalyticsProviders []string `json:"analytics_providers,omitempty"`
+
+	// PasswordHash is the bcrypt hash of the password protecting the link,
+	// empty when it's public. It's never serialized.
+	PasswordHash string `json:"-"`
+
+	// LastAccessedAt is when the link last redirected, nil when it never
+	// did. It's reported by bulk stats rather than serialized.
+	LastAccessedAt *time.Time `json:"-"`
+
+	// HasDeviceURLs is set when the link has at least one device URL, letting
+	// redirects for plain links skip loading device URLs altogether.
+	HasDeviceURLs bool `json:"-"`
+}
+
+// UTM holds the utm_source, utm_medium and utm_campaign query parameters of
+// a link. Empty fields aren't added.
+type UTM struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
 }
 
 type DeviceURLData struct {
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the HTTP API. It's maintained by hand, so routes
+// added to main must be added to it too.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (app *App) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(openAPISpec)
+}
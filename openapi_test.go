@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// uiRoutes serve the admin UI rather than the API and aren't in the spec.
+var uiRoutes = map[string]bool{
+	"GET /admin/":    true,
+	"GET /admin/...": true,
+}
+
+// registeredRoutes returns the patterns main registers on its mux, like
+// "GET /api/v1/urls", by reading them from main.go.
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parse main.go: %v", err)
+	}
+
+	var routes []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc") {
+			return true
+		}
+		if x, ok := sel.X.(*ast.Ident); !ok || x.Name != "mux" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			t.Errorf("route pattern at %v isn't a string literal", call.Pos())
+			return true
+		}
+		pattern, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			t.Fatalf("unquote %s: %v", lit.Value, err)
+		}
+		routes = append(routes, pattern)
+		return true
+	})
+	if len(routes) == 0 {
+		t.Fatal("no routes found in main.go")
+	}
+	return routes
+}
+
+func specOperations(t *testing.T) map[string]map[string]bool {
+	t.Helper()
+
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("decode openapi.json: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("openapi version = %q, want 3.x", spec.OpenAPI)
+	}
+
+	ops := make(map[string]map[string]bool, len(spec.Paths))
+	for path, item := range spec.Paths {
+		ops[path] = make(map[string]bool)
+		for method := range item {
+			ops[path][strings.ToUpper(method)] = true
+		}
+	}
+	return ops
+}
+
+func TestOpenAPIHasEveryRoute(t *testing.T) {
+	ops := specOperations(t)
+
+	for _, route := range registeredRoutes(t) {
+		if uiRoutes[route] {
+			continue
+		}
+		method, path, ok := strings.Cut(route, " ")
+		if !ok {
+			t.Errorf("route %q has no method", route)
+			continue
+		}
+		if !ops[path][method] {
+			t.Errorf("route %q is missing from openapi.json", route)
+		}
+	}
+}
+
+func TestOpenAPIHasNoUnknownRoutes(t *testing.T) {
+	registered := make(map[string]bool)
+	for _, route := range registeredRoutes(t) {
+		registered[route] = true
+	}
+
+	for path, methods := range specOperations(t) {
+		for method := range methods {
+			// GET routes answer HEAD requests as well
+			if method == "HEAD" && registered["GET "+path] {
+				continue
+			}
+			if !registered[method+" "+path] {
+				t.Errorf("openapi.json documents %s %s, which isn't registered", method, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// maxPasswordLength is the longest password bcrypt accepts.
+const maxPasswordLength = 72
+
+var passwordPromptTmpl = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 15vh; }
+form { display: flex; flex-direction: column; gap: 0.75rem; width: 18rem; }
+input, button { font-size: 1rem; padding: 0.5rem; }
+.error { color: #b91c1c; }
+</style>
+</head>
+<body>
+<form method="post">
+<label for="password">This link is password protected.</label>
+{{if .Wrong}}<span class="error">Incorrect password, try again.</span>{{end}}
+<input id="password" name="password" type="password" autocomplete="current-password" required autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// passwordParam is the form and query value protected links read the
+// password from.
+const passwordParam = "password"
+
+// linkPassword returns the password supplied for a protected link, read from
+// the X-Link-Password header or the password form or query value.
+func linkPassword(r *http.Request) string {
+	if password := r.Header.Get("X-Link-Password"); password != "" {
+		return password
+	}
+	return r.FormValue(passwordParam)
+}
+
+// sendPasswordPrompt responds to a request for a protected link without the
+// right password. Browsers get a form that posts the password back to the
+// short URL, API clients a 401.
+func (app *App) sendPasswordPrompt(w http.ResponseWriter, r *http.Request) {
+	wrong := linkPassword(r) != ""
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		msg := "Password required"
+		if wrong {
+			msg = "Invalid password"
+		}
+		app.sendErrorResponse(w, msg, http.StatusUnauthorized, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := passwordPromptTmpl.Execute(w, struct{ Wrong bool }{wrong}); err != nil {
+		app.logger.Error("Failed to render password prompt", "error", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mr-karan/lil/internal/store"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Bounds and default of the QR image size in pixels.
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+func (app *App) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	shortCode := r.PathValue("shortCode")
+	if shortCode == "" {
+		app.sendErrorResponse(w, "Invalid short code", http.StatusBadRequest, nil)
+		return
+	}
+
+	size := defaultQRSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil {
+			app.sendErrorResponse(w, "Invalid size", http.StatusBadRequest, nil)
+			return
+		}
+		size = min(max(size, minQRSize), maxQRSize)
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "png"
+	case "png", "svg":
+	default:
+		app.sendErrorResponse(w, "Format must be png or svg", http.StatusBadRequest, nil)
+		return
+	}
+
+	urlData, err := app.store.GetURL(r.Context(), shortCode)
+	if err != nil {
+		if err == store.ErrNotExist {
+			app.sendErrorResponse(w, "URL not found", http.StatusNotFound, nil)
+			return
+		}
+		app.logger.Error("Failed to get URL", "error", err, "shortCode", shortCode)
+		app.sendStoreError(w, "Internal server error", err)
+		return
+	}
+
+	content := app.domains.forRequest(r) + "/" + urlData.ShortCode
+
+	// Without revalidation the image only depends on the host and the code,
+	// so clients can cache it for good. Otherwise they check back with the
+	// ETag, which changes along with the encoded URL. Either way it's only
+	// cached by the client that had the API key to fetch it, and per host.
+	cacheControl, etag := "private, max-age=31536000, immutable", ""
+	w.Header().Add("Vary", "Host")
+	if app.qrRevalidate {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d", content, format, size)))
+		cacheControl, etag = "private, no-cache", `"`+hex.EncodeToString(sum[:16])+`"`
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("Cache-Control", cacheControl)
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	q, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		app.logger.Error("Failed to generate QR code", "error", err, "shortCode", shortCode)
+		app.sendErrorResponse(w, "Internal server error", http.StatusInternalServerError, nil)
+		return
+	}
+
+	var img []byte
+	contentType := "image/png"
+	if format == "svg" {
+		img, contentType = qrSVG(q, size), "image/svg+xml"
+	} else if img, err = q.PNG(size); err != nil {
+		app.logger.Error("Failed to encode QR code", "error", err, "shortCode", shortCode)
+		app.sendErrorResponse(w, "Internal server error", http.StatusInternalServerError, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Write(img)
+}
+
+// qrSVG renders a QR code as an SVG image of size pixels, drawing each dark
+// module as a unit square of a single path.
+func qrSVG(q *qrcode.QRCode, size int) []byte {
+	bitmap := q.Bitmap()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mr-karan/lil/internal/middleware"
+	"github.com/mr-karan/lil/internal/store"
+)
+
+func TestQRCodeCaching(t *testing.T) {
+	for _, tc := range []struct {
+		revalidate   bool
+		cacheControl string
+	}{
+		{false, "private, max-age=31536000, immutable"},
+		{true, "private, no-cache"},
+	} {
+		app := newTestApp(t)
+		app.qrRevalidate = tc.revalidate
+		mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "qr"})
+
+		get := func(etag string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/urls/qr/qr", nil)
+			r.SetPathValue("shortCode", "qr")
+			if etag != "" {
+				r.Header.Set("If-None-Match", etag)
+			}
+			w := httptest.NewRecorder()
+			app.handleQRCode(w, r)
+			return w
+		}
+		check := func(w *httptest.ResponseRecorder, wantCode int) {
+			t.Helper()
+			if w.Code != wantCode {
+				t.Fatalf("revalidate=%v: status = %d, want %d", tc.revalidate, w.Code, wantCode)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tc.cacheControl {
+				t.Errorf("revalidate=%v: Cache-Control = %q, want %q", tc.revalidate, got, tc.cacheControl)
+			}
+			if got := w.Header().Get("Vary"); got != "Host" {
+				t.Errorf("revalidate=%v: Vary = %q, want Host", tc.revalidate, got)
+			}
+		}
+
+		w := get("")
+		check(w, http.StatusOK)
+		etag := w.Header().Get("ETag")
+		if tc.revalidate != (etag != "") {
+			t.Errorf("revalidate=%v: ETag = %q", tc.revalidate, etag)
+		}
+		if tc.revalidate {
+			check(get(etag), http.StatusNotModified)
+		}
+	}
+}
+
+func TestQRCodeRevalidateBehindCompress(t *testing.T) {
+	app := newTestApp(t)
+	app.qrRevalidate = true
+	mustCreate(t, app, store.CreateParams{URL: "https://example.com", Slug: "qr"})
+	handler := middleware.Compress(0)(http.HandlerFunc(app.handleQRCode))
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/urls/qr/qr?format=svg", nil)
+		r.SetPathValue("shortCode", "qr")
+		r.Header.Set("Accept-Encoding", "gzip")
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status = %d, Content-Encoding = %q, want a gzipped 200", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag of the gzipped SVG = %q, want a weak one", etag)
+	}
+	if vary := w.Header().Values("Vary"); !slices.Contains(vary, "Accept-Encoding") || !slices.Contains(vary, "Host") {
+		t.Errorf("Vary = %q, want Accept-Encoding and Host", vary)
+	}
+
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Errorf("status = %d revalidating with %s, want 304", w.Code, etag)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	"github.com/mr-karan/lil/internal/store"
+	"github.com/mr-karan/lil/models"
+)
+
+// Store is the storage backend the handlers work against, picked with
+// db.backend.
+type Store interface {
+	CreateShortURL(ctx context.Context, p store.CreateParams) (models.URLData, error)
+	CreateShortURLs(ctx context.Context, ps []store.CreateParams) []store.CreateResult
+	GetRedirectData(ctx context.Context, shortCode string) (models.URLData, error)
+	PeekRedirectData(ctx context.Context, shortCode string) (models.URLData, error)
+	GetURL(ctx context.Context, shortCode string) (models.URLData, error)
+	GetURLs(ctx context.Context, page, perPage int64, tag string) ([]models.URLData, int64, error)
+	StreamURLs(ctx context.Context, fn func(models.URLData) error) error
+	UpdateURL(ctx context.Context, shortCode string, p store.UpdateParams) (models.URLData, error)
+	GetDeviceURLs(ctx context.Context, shortCode string) (map[string]models.DeviceURLData, error)
+	SetDeviceURLs(ctx context.Context, shortCode string, deviceURLs map[string]string) (map[string]models.DeviceURLData, error)
+	AddAlias(ctx context.Context, shortCode, alias string) (models.URLData, error)
+	DeleteURL(ctx context.Context, shortCode string) error
+	Purge(ctx context.Context, c store.PurgeCriteria) (int, error)
+	Stats(ctx context.Context, top int) (store.Stats, error)
+	BulkStats(ctx context.Context, shortCodes []string) (map[string]store.ClickStats, error)
+	ResetClicks(ctx context.Context, shortCode string) (models.URLData, error)
+	VerifyPassword(ctx context.Context, shortCode, password string) error
+
+	ValidateSlug(slug string) error
+	ValidateCreate(p store.CreateParams) error
+	IsSlugAvailable(ctx context.Context, slug string) (bool, error)
+	SuggestSlugs(slug, strategy string, count int) []string
+	EntropyBits(length int) float64
+	IsLowEntropy(code string) bool
+
+	Ping(ctx context.Context) error
+	Usage() store.Usage
+	CheckWritable(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ Store = (*store.Store)(nil)
+	_ Store = (*store.RedisStore)(nil)
+)
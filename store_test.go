@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mileusna/useragent"
+	"github.com/mr-karan/lil/internal/store"
+	"github.com/mr-karan/lil/models"
+)
+
+// backends open each store backend with cfg for a test. SQLite gets a
+// database in a temporary directory and Redis runs in process on miniredis.
+var backends = map[string]func(t *testing.T, cfg store.Conf) Store{
+	"sqlite": func(t *testing.T, cfg store.Conf) Store {
+		cfg.DBPath = filepath.Join(t.TempDir(), "urls.db")
+		s, err := store.New(cfg, testLogger)
+		if err != nil {
+			t.Fatalf("store.New: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	},
+	"redis": func(t *testing.T, cfg store.Conf) Store {
+		cfg.Redis.Address = miniredis.RunT(t).Addr()
+		s, err := store.NewRedis(cfg, testLogger)
+		if err != nil {
+			t.Fatalf("store.NewRedis: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	},
+}
+
+// forEachBackend runs test against a fresh store of every backend. SQLite
+// buffers writes like it does by default unless conf changes that.
+func forEachBackend(t *testing.T, test func(t *testing.T, s Store), conf ...func(*store.Conf)) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			cfg := store.Conf{
+				MaxOpenConns:   4,
+				MaxIdleConns:   4,
+				ShortURLLength: 6,
+				BufferSize:     100,
+				FlushInterval:  time.Hour,
+			}
+			for _, fn := range conf {
+				fn(&cfg)
+			}
+			test(t, open(t, cfg))
+		})
+	}
+}
+
+func createURL(t *testing.T, s Store, p store.CreateParams) models.URLData {
+	t.Helper()
+	urlData, err := s.CreateShortURL(context.Background(), p)
+	if err != nil {
+		t.Fatalf("CreateShortURL(%+v): %v", p, err)
+	}
+	return urlData
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestStoreCreateAndRedirect(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		generated := createURL(t, s, store.CreateParams{URL: "https://example.com/generated"})
+		if len(generated.ShortCode) != 6 {
+			t.Errorf("generated code %q, want 6 characters", generated.ShortCode)
+		}
+		createURL(t, s, store.CreateParams{URL: "https://example.com/a", Slug: "a", Title: "A"})
+		if _, err := s.CreateShortURL(ctx, store.CreateParams{URL: "https://example.com/b", Slug: "a"}); !errors.Is(err, store.ErrExists) {
+			t.Errorf("creating a taken slug = %v, want ErrExists", err)
+		}
+		if ok, err := s.IsSlugAvailable(ctx, "a"); err != nil || ok {
+			t.Errorf("IsSlugAvailable(a) = %v, %v, want false", ok, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			urlData, err := s.GetRedirectData(ctx, "a")
+			if err != nil {
+				t.Fatalf("GetRedirectData(a): %v", err)
+			}
+			if urlData.URL != "https://example.com/a" {
+				t.Errorf("a redirects to %s", urlData.URL)
+			}
+		}
+		if _, err := s.PeekRedirectData(ctx, "a"); err != nil {
+			t.Fatalf("PeekRedirectData(a): %v", err)
+		}
+		urlData, err := s.GetURL(ctx, "a")
+		if err != nil {
+			t.Fatalf("GetURL(a): %v", err)
+		}
+		if urlData.Title != "A" || urlData.ClickCount != 3 {
+			t.Errorf("GetURL(a) = %q with %d clicks, want \"A\" with 3", urlData.Title, urlData.ClickCount)
+		}
+
+		if _, err := s.GetRedirectData(ctx, "missing"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("GetRedirectData(missing) = %v, want ErrNotExist", err)
+		}
+		if _, err := s.GetURL(ctx, "missing"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("GetURL(missing) = %v, want ErrNotExist", err)
+		}
+
+		results := s.CreateShortURLs(ctx, []store.CreateParams{
+			{URL: "https://example.com/c", Slug: "c"},
+			{URL: "https://example.com/dup", Slug: "a"},
+		})
+		if len(results) != 2 || results[0].Err != nil || results[0].ShortCode != "c" || !errors.Is(results[1].Err, store.ErrExists) {
+			t.Errorf("CreateShortURLs = %+v, want c created and a taken", results)
+		}
+
+		// Deleted right after it's created, which with SQLite is before
+		// it's flushed
+		if err := s.DeleteURL(ctx, generated.ShortCode); err != nil {
+			t.Fatalf("DeleteURL(%s): %v", generated.ShortCode, err)
+		}
+		if _, err := s.GetRedirectData(ctx, generated.ShortCode); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("redirecting a deleted URL = %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestStoreRedirectLimits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		createURL(t, s, store.CreateParams{URL: "https://example.com", Slug: "limited", MaxClicks: 2})
+		for i := 0; i < 2; i++ {
+			if _, err := s.GetRedirectData(ctx, "limited"); err != nil {
+				t.Fatalf("redirect %d: %v", i+1, err)
+			}
+		}
+		if _, err := s.GetRedirectData(ctx, "limited"); !errors.Is(err, store.ErrClickLimit) {
+			t.Errorf("redirect past max_clicks = %v, want ErrClickLimit", err)
+		}
+
+		createURL(t, s, store.CreateParams{URL: "https://example.com", Slug: "later", StartsAt: ptr(time.Now().Add(time.Hour))})
+		if _, err := s.GetRedirectData(ctx, "later"); !errors.Is(err, store.ErrNotYetActive) {
+			t.Errorf("redirect before starts_at = %v, want ErrNotYetActive", err)
+		}
+
+		createURL(t, s, store.CreateParams{URL: "https://example.com", Slug: "locked", Password: "hunter2"})
+		if err := s.VerifyPassword(ctx, "locked", "wrong"); !errors.Is(err, store.ErrWrongPassword) {
+			t.Errorf("VerifyPassword with the wrong password = %v, want ErrWrongPassword", err)
+		}
+		if err := s.VerifyPassword(ctx, "locked", "hunter2"); err != nil {
+			t.Errorf("VerifyPassword: %v", err)
+		}
+	})
+}
+
+// Expired links are kept for the retention period, so every backend answers
+// with ErrExpired rather than Redis expiring the key first.
+func TestStoreExpiredLinks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		createURL(t, s, store.CreateParams{URL: "https://example.com", Slug: "brief", Expiry: time.Millisecond})
+		time.Sleep(5 * time.Millisecond)
+
+		for i := 0; i < 2; i++ {
+			if _, err := s.GetRedirectData(ctx, "brief"); !errors.Is(err, store.ErrExpired) {
+				t.Errorf("redirect %d after expiry = %v, want ErrExpired", i+1, err)
+			}
+		}
+		if _, err := s.PeekRedirectData(ctx, "brief"); !errors.Is(err, store.ErrExpired) {
+			t.Errorf("peek after expiry = %v, want ErrExpired", err)
+		}
+		if _, err := s.GetURL(ctx, "brief"); err != nil {
+			t.Errorf("GetURL of a retained expired link: %v", err)
+		}
+	}, func(cfg *store.Conf) {
+		cfg.ExpiredRetention = time.Hour
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		createURL(t, s, store.CreateParams{URL: "https://example.com/a", Slug: "a", Tags: []string{"x"}})
+		createURL(t, s, store.CreateParams{URL: "https://example.com/b", Slug: "b"})
+		if _, err := s.GetRedirectData(ctx, "a"); err != nil {
+			t.Fatalf("GetRedirectData(a): %v", err)
+		}
+
+		urlData, err := s.UpdateURL(ctx, "a", store.UpdateParams{Title: ptr("Title"), Tags: ptr([]string{"y", "z"})})
+		if err != nil {
+			t.Fatalf("UpdateURL(a): %v", err)
+		}
+		if urlData.URL != "https://example.com/a" || urlData.Title != "Title" || !slices.Equal(urlData.Tags, []string{"y", "z"}) {
+			t.Errorf("updated to %+v", urlData)
+		}
+
+		if _, err := s.UpdateURL(ctx, "a", store.UpdateParams{Slug: ptr("b")}); !errors.Is(err, store.ErrExists) {
+			t.Errorf("renaming to a taken code = %v, want ErrExists", err)
+		}
+		if _, err := s.UpdateURL(ctx, "missing", store.UpdateParams{Title: ptr("x")}); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("updating a missing code = %v, want ErrNotExist", err)
+		}
+
+		urlData, err = s.UpdateURL(ctx, "a", store.UpdateParams{Slug: ptr("renamed")})
+		if err != nil {
+			t.Fatalf("renaming a: %v", err)
+		}
+		if urlData.ShortCode != "renamed" || urlData.ClickCount != 1 || !slices.Equal(urlData.Tags, []string{"y", "z"}) {
+			t.Errorf("renamed to %s with %d clicks and tags %v, want renamed with 1 click and [y z]", urlData.ShortCode, urlData.ClickCount, urlData.Tags)
+		}
+		if _, err := s.GetRedirectData(ctx, "a"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("redirecting the old code = %v, want ErrNotExist", err)
+		}
+
+		deviceURLs, err := s.SetDeviceURLs(ctx, "renamed", map[string]string{"ios": "https://apps.apple.com/app"})
+		if err != nil {
+			t.Fatalf("SetDeviceURLs: %v", err)
+		}
+		if deviceURLs["ios"].URL != "https://apps.apple.com/app" {
+			t.Errorf("SetDeviceURLs = %v", deviceURLs)
+		}
+		if _, err := s.SetDeviceURLs(ctx, "renamed", map[string]string{"windows": "https://example.com"}); !errors.Is(err, store.ErrInvalidPlatform) {
+			t.Errorf("SetDeviceURLs with an unknown platform = %v, want ErrInvalidPlatform", err)
+		}
+		if deviceURLs, err := s.GetDeviceURLs(ctx, "renamed"); err != nil || len(deviceURLs) != 1 {
+			t.Errorf("GetDeviceURLs = %v, %v, want the ios URL", deviceURLs, err)
+		}
+	})
+}
+
+func TestStoreAliases(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		createURL(t, s, store.CreateParams{URL: "https://example.com/a", Slug: "a"})
+		createURL(t, s, store.CreateParams{URL: "https://example.com/b", Slug: "b"})
+
+		urlData, err := s.AddAlias(ctx, "a", "alias")
+		if err != nil {
+			t.Fatalf("AddAlias: %v", err)
+		}
+		if !slices.Equal(urlData.Aliases, []string{"alias"}) {
+			t.Errorf("aliases = %v, want [alias]", urlData.Aliases)
+		}
+		for _, taken := range []string{"a", "b", "alias"} {
+			if _, err := s.AddAlias(ctx, "a", taken); !errors.Is(err, store.ErrExists) {
+				t.Errorf("AddAlias(%s) = %v, want ErrExists", taken, err)
+			}
+		}
+
+		urlData, err = s.GetRedirectData(ctx, "alias")
+		if err != nil {
+			t.Fatalf("GetRedirectData(alias): %v", err)
+		}
+		if urlData.ShortCode != "a" || urlData.URL != "https://example.com/a" {
+			t.Errorf("alias resolves to %s -> %s, want a -> https://example.com/a", urlData.ShortCode, urlData.URL)
+		}
+		if urlData, err := s.GetURL(ctx, "a"); err != nil || urlData.ClickCount != 1 {
+			t.Errorf("GetURL(a) = %d clicks, %v, want the alias's click", urlData.ClickCount, err)
+		}
+
+		if err := s.DeleteURL(ctx, "a"); err != nil {
+			t.Fatalf("DeleteURL(a): %v", err)
+		}
+		if _, err := s.GetRedirectData(ctx, "alias"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("redirecting an alias of a deleted URL = %v, want ErrNotExist", err)
+		}
+		if err := s.DeleteURL(ctx, "a"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("deleting twice = %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestStoreListing(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		for _, p := range []store.CreateParams{
+			{URL: "https://example.com/1", Slug: "one", Tags: []string{"odd"}},
+			{URL: "https://example.com/2", Slug: "two"},
+			{URL: "https://example.com/3", Slug: "three", Tags: []string{"odd"}},
+		} {
+			createURL(t, s, p)
+			// Listing is ordered by creation time
+			time.Sleep(time.Millisecond)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := s.GetRedirectData(ctx, "two"); err != nil {
+				t.Fatalf("GetRedirectData(two): %v", err)
+			}
+		}
+
+		codes := func(urls []models.URLData) []string {
+			out := make([]string, 0, len(urls))
+			for _, urlData := range urls {
+				out = append(out, urlData.ShortCode)
+			}
+			return out
+		}
+
+		urls, total, err := s.GetURLs(ctx, 1, 2, "")
+		if err != nil {
+			t.Fatalf("GetURLs: %v", err)
+		}
+		if total != 3 || !slices.Equal(codes(urls), []string{"three", "two"}) {
+			t.Errorf("first page = %v of %d, want [three two] of 3", codes(urls), total)
+		}
+		urls, total, err = s.GetURLs(ctx, 1, 10, "odd")
+		if err != nil {
+			t.Fatalf("GetURLs(odd): %v", err)
+		}
+		if total != 2 || !slices.Equal(codes(urls), []string{"three", "one"}) {
+			t.Errorf("tagged odd = %v of %d, want [three one] of 2", codes(urls), total)
+		}
+
+		var streamed []string
+		if err := s.StreamURLs(ctx, func(urlData models.URLData) error {
+			streamed = append(streamed, urlData.ShortCode)
+			return nil
+		}); err != nil {
+			t.Fatalf("StreamURLs: %v", err)
+		}
+		sort.Strings(streamed)
+		if !slices.Equal(streamed, []string{"one", "three", "two"}) {
+			t.Errorf("streamed %v", streamed)
+		}
+
+		st, err := s.Stats(ctx, 1)
+		if err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if st.URLs != 3 || st.Clicks != 2 || len(st.Top) != 1 || st.Top[0].ShortCode != "two" {
+			t.Errorf("Stats = %+v, want 3 URLs, 2 clicks and two on top", st)
+		}
+
+		// Updated tags move URLs between tag listings
+		if _, err := s.UpdateURL(ctx, "two", store.UpdateParams{Tags: ptr([]string{"odd"})}); err != nil {
+			t.Fatalf("tagging two: %v", err)
+		}
+		if _, err := s.UpdateURL(ctx, "one", store.UpdateParams{Tags: ptr([]string{})}); err != nil {
+			t.Fatalf("untagging one: %v", err)
+		}
+		urls, total, err = s.GetURLs(ctx, 1, 10, "odd")
+		if err != nil {
+			t.Fatalf("GetURLs(odd): %v", err)
+		}
+		if total != 2 || !slices.Equal(codes(urls), []string{"three", "two"}) {
+			t.Errorf("tagged odd after retagging = %v of %d, want [three two] of 2", codes(urls), total)
+		}
+
+		purged, err := s.Purge(ctx, store.PurgeCriteria{Tag: "odd"})
+		if err != nil {
+			t.Fatalf("Purge: %v", err)
+		}
+		if purged != 2 {
+			t.Errorf("purged %d URLs, want 2", purged)
+		}
+		if _, err := s.GetURL(ctx, "two"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("GetURL of a purged URL = %v, want ErrNotExist", err)
+		}
+		if _, err := s.GetURL(ctx, "one"); err != nil {
+			t.Errorf("GetURL of an untagged URL after purging: %v", err)
+		}
+		if _, err := s.Purge(ctx, store.PurgeCriteria{}); !errors.Is(err, store.ErrNoPurgeCriteria) {
+			t.Errorf("Purge without criteria = %v, want ErrNoPurgeCriteria", err)
+		}
+	}, func(cfg *store.Conf) {
+		// SQLite only lists URLs once they're written to the database
+		cfg.BufferSize = 0
+	})
+}
+
+func TestStoreHealth(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if err := s.Ping(ctx); err != nil {
+			t.Errorf("Ping: %v", err)
+		}
+		if err := s.CheckWritable(ctx); err != nil {
+			t.Errorf("CheckWritable: %v", err)
+		}
+		if err := s.ValidateSlug("not a slug!"); !errors.Is(err, store.ErrInvalidSlug) {
+			t.Errorf("ValidateSlug of an invalid slug = %v, want ErrInvalidSlug", err)
+		}
+		if suggestions := s.SuggestSlugs("taken", "", 3); len(suggestions) == 0 {
+			t.Error("SuggestSlugs returned nothing")
+		}
+	})
+}
+
+func TestStoreBulkStats(t *testing.T) {
+	test := func(t *testing.T, s Store) {
+		ctx := context.Background()
+		createURL(t, s, store.CreateParams{URL: "https://example.com/a", Slug: "a"})
+		createURL(t, s, store.CreateParams{URL: "https://example.com/b", Slug: "b"})
+		createURL(t, s, store.CreateParams{URL: "https://example.com/unclicked", Slug: "unclicked"})
+		before := time.Now()
+		clicks := map[string]int{"a": 3, "b": 1}
+		for shortCode, n := range clicks {
+			for i := 0; i < n; i++ {
+				if _, err := s.GetRedirectData(ctx, shortCode); err != nil {
+					t.Fatalf("GetRedirectData(%s): %v", shortCode, err)
+				}
+			}
+		}
+		after := time.Now()
+
+		stats, err := s.BulkStats(ctx, []string{"a", "unclicked", "missing", "b", "a"})
+		if err != nil {
+			t.Fatalf("BulkStats: %v", err)
+		}
+		want := map[string]int64{"a": 3, "b": 1, "unclicked": 0}
+		if len(stats) != len(want) {
+			t.Errorf("BulkStats = %v, want counts %v", stats, want)
+		}
+		for shortCode, n := range want {
+			st, ok := stats[shortCode]
+			if !ok || st.ClickCount != n {
+				t.Errorf("click count of %s = %d (found %v), want %d", shortCode, st.ClickCount, ok, n)
+			}
+			switch at := st.LastAccessedAt; {
+			case n == 0 && at != nil:
+				t.Errorf("%s never redirected but was last accessed at %v", shortCode, at)
+			case n > 0 && (at == nil || at.Before(before) || at.After(after)):
+				t.Errorf("%s last accessed at %v, want between %v and %v", shortCode, at, before, after)
+			}
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) { forEachBackend(t, test) })
+	// Evicted URLs are read from the database along with the clicks that
+	// aren't written yet
+	t.Run("evicted", func(t *testing.T) {
+		forEachBackend(t, test, func(cfg *store.Conf) {
+			cfg.CacheSize = 1
+			cfg.BufferSize = 0
+		})
+	})
+}
+
+func TestStoreResetClicks(t *testing.T) {
+	test := func(t *testing.T, s Store) {
+		ctx := context.Background()
+		createURL(t, s, store.CreateParams{URL: "https://example.com/quota", Slug: "quota", MaxClicks: 2})
+		if _, err := s.AddAlias(ctx, "quota", "quota-alias"); err != nil {
+			t.Fatalf("AddAlias: %v", err)
+		}
+
+		useUp := func() {
+			t.Helper()
+			for i := 0; i < 2; i++ {
+				if _, err := s.GetRedirectData(ctx, "quota"); err != nil {
+					t.Fatalf("redirect %d: %v", i+1, err)
+				}
+			}
+			if _, err := s.GetRedirectData(ctx, "quota"); !errors.Is(err, store.ErrClickLimit) {
+				t.Fatalf("redirect past max_clicks = %v, want ErrClickLimit", err)
+			}
+		}
+		reset := func(shortCode string) {
+			t.Helper()
+			urlData, err := s.ResetClicks(ctx, shortCode)
+			if err != nil {
+				t.Fatalf("ResetClicks(%s): %v", shortCode, err)
+			}
+			if urlData.ShortCode != "quota" || urlData.ClickCount != 0 {
+				t.Errorf("ResetClicks(%s) = %s with %d clicks, want quota with 0", shortCode, urlData.ShortCode, urlData.ClickCount)
+			}
+			if urlData, err := s.GetURL(ctx, "quota"); err != nil || urlData.ClickCount != 0 {
+				t.Errorf("GetURL after reset = %d clicks, %v, want 0", urlData.ClickCount, err)
+			}
+		}
+
+		useUp()
+		reset("quota")
+		useUp()
+		reset("quota-alias")
+		useUp()
+
+		if _, err := s.ResetClicks(ctx, "missing"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("ResetClicks(missing) = %v, want ErrNotExist", err)
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) { forEachBackend(t, test) })
+	t.Run("evicted", func(t *testing.T) {
+		forEachBackend(t, test, func(cfg *store.Conf) {
+			cfg.CacheSize = 1
+			cfg.BufferSize = 0
+		})
+	})
+}
+
+// With two characters and one-character codes the keyspace fills after two
+// creates. Enough attempts are allowed that a free code is always found while
+// there is one.
+func TestStoreCodeExhaustion(t *testing.T) {
+	tiny := func(cfg *store.Conf) {
+		cfg.Alphabet = "ab"
+		cfg.ShortURLLength = 1
+		cfg.MaxCodeAttempts = 64
+	}
+
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		codes := []string{
+			createURL(t, s, store.CreateParams{URL: "https://example.com/1"}).ShortCode,
+			createURL(t, s, store.CreateParams{URL: "https://example.com/2"}).ShortCode,
+		}
+		slices.Sort(codes)
+		if !slices.Equal(codes, []string{"a", "b"}) {
+			t.Errorf("codes = %v, want the whole keyspace [a b]", codes)
+		}
+		if _, err := s.CreateShortURL(ctx, store.CreateParams{URL: "https://example.com/3"}); !errors.Is(err, store.ErrNoFreeCode) {
+			t.Errorf("create with the keyspace full = %v, want ErrNoFreeCode", err)
+		}
+		// Custom slugs don't need a free random code
+		createURL(t, s, store.CreateParams{URL: "https://example.com/4", Slug: "custom"})
+	}, tiny)
+
+	t.Run("growing", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, s Store) {
+			createURL(t, s, store.CreateParams{URL: "https://example.com/1"})
+			createURL(t, s, store.CreateParams{URL: "https://example.com/2"})
+			if got := createURL(t, s, store.CreateParams{URL: "https://example.com/3"}); len(got.ShortCode) != 2 {
+				t.Errorf("code = %q once one-character codes ran out, want two characters", got.ShortCode)
+			}
+		}, tiny, func(cfg *store.Conf) {
+			cfg.GrowCodeLength = true
+			cfg.MaxShortURLLength = 2
+		})
+	})
+}
+
+func TestStoreCaseInsensitiveCodes(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		created := createURL(t, s, store.CreateParams{URL: "https://example.com/promo", Slug: "SpringPromo"})
+		if created.ShortCode != "springpromo" {
+			t.Errorf("created code %q, want the slug lowercased", created.ShortCode)
+		}
+		generated := createURL(t, s, store.CreateParams{URL: "https://example.com/generated"})
+		if generated.ShortCode != strings.ToLower(generated.ShortCode) {
+			t.Errorf("generated code %q isn't lowercase", generated.ShortCode)
+		}
+
+		for _, code := range []string{"springpromo", "SPRINGPROMO", "sPrInGpRoMo"} {
+			urlData, err := s.GetRedirectData(ctx, code)
+			if err != nil {
+				t.Fatalf("GetRedirectData(%s): %v", code, err)
+			}
+			if urlData.URL != "https://example.com/promo" {
+				t.Errorf("%s redirects to %s", code, urlData.URL)
+			}
+		}
+		if _, err := s.GetURL(ctx, "SpringPROMO"); err != nil {
+			t.Errorf("GetURL(SpringPROMO): %v", err)
+		}
+
+		if _, err := s.CreateShortURL(ctx, store.CreateParams{URL: "https://example.com/other", Slug: "SPRINGpromo"}); !errors.Is(err, store.ErrExists) {
+			t.Errorf("creating a slug differing only in case = %v, want ErrExists", err)
+		}
+		if ok, err := s.IsSlugAvailable(ctx, "SPRINGPROMO"); err != nil || ok {
+			t.Errorf("IsSlugAvailable(SPRINGPROMO) = %v, %v, want false", ok, err)
+		}
+
+		title := "Promo"
+		if _, err := s.UpdateURL(ctx, "SPRINGPROMO", store.UpdateParams{Title: &title}); err != nil {
+			t.Fatalf("UpdateURL(SPRINGPROMO): %v", err)
+		}
+		if err := s.DeleteURL(ctx, "SpringPromo"); err != nil {
+			t.Fatalf("DeleteURL(SpringPromo): %v", err)
+		}
+		if _, err := s.GetRedirectData(ctx, "springpromo"); !errors.Is(err, store.ErrNotExist) {
+			t.Errorf("redirect after deleting = %v, want ErrNotExist", err)
+		}
+	}, func(cfg *store.Conf) {
+		cfg.CaseInsensitive = true
+	})
+}
+
+// Platforms beyond the defaults can be configured, stored and resolved.
+func TestStoreCustomPlatforms(t *testing.T) {
+	platforms := func(c *store.Conf) {
+		c.DevicePlatforms = []string{"android", "ios", "windows", "linux", "web"}
+		c.BufferSize = 0 // Write straight to the database
+	}
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		link := createURL(t, s, store.CreateParams{
+			URL:        "https://example.com",
+			DeviceURLs: map[string]string{"windows": "https://example.com/windows", "web": "https://example.com/web"},
+		})
+		if _, err := s.SetDeviceURLs(ctx, link.ShortCode, map[string]string{
+			"windows": "https://example.com/windows",
+			"linux":   "https://example.com/linux",
+			"web":     "https://example.com/web",
+		}); err != nil {
+			t.Fatalf("SetDeviceURLs: %v", err)
+		}
+
+		urlData, err := s.GetRedirectData(ctx, link.ShortCode)
+		if err != nil {
+			t.Fatalf("GetRedirectData: %v", err)
+		}
+		for userAgent, want := range map[string]string{
+			windowsUA: "https://example.com/windows",
+			"Mozilla/5.0 (X11; Linux x86_64) Gecko/20100101 Firefox/125.0": "https://example.com/linux",
+			macUA: "https://example.com/web",
+		} {
+			if got := resolveTargetURL(urlData, useragent.Parse(userAgent)); got != want {
+				t.Errorf("resolveTargetURL(%q) = %s, want %s", userAgent, got, want)
+			}
+		}
+
+		// Defaults that aren't configured are skipped on create and rejected
+		// when set
+		skipped := createURL(t, s, store.CreateParams{
+			URL:        "https://example.com",
+			DeviceURLs: map[string]string{"macos": "https://example.com/mac"},
+		})
+		if len(skipped.DeviceURLs) != 0 {
+			t.Errorf("created device URLs = %v, want macos skipped", skipped.DeviceURLs)
+		}
+		if _, err := s.SetDeviceURLs(ctx, link.ShortCode, map[string]string{"macos": "https://example.com/mac"}); !errors.Is(err, store.ErrInvalidPlatform) {
+			t.Errorf("SetDeviceURLs with macos = %v, want ErrInvalidPlatform", err)
+		}
+	}, platforms)
+}
+
+func TestStoreUpdatedAt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		created := createURL(t, s, store.CreateParams{URL: "https://example.com", Slug: "a"})
+		if !created.UpdatedAt.Equal(created.CreatedAt) {
+			t.Errorf("new link updated_at = %s, want its created_at %s", created.UpdatedAt, created.CreatedAt)
+		}
+		// Load it into the cache, which has to follow the update
+		if _, err := s.GetRedirectData(ctx, "a"); err != nil {
+			t.Fatalf("GetRedirectData: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		updated, err := s.UpdateURL(ctx, "a", store.UpdateParams{Title: ptr("Title")})
+		if err != nil {
+			t.Fatalf("UpdateURL: %v", err)
+		}
+		if !updated.UpdatedAt.After(created.UpdatedAt) {
+			t.Errorf("updated_at = %s after an update, want later than %s", updated.UpdatedAt, created.UpdatedAt)
+		}
+
+		got, err := s.GetURL(ctx, "a")
+		if err != nil {
+			t.Fatalf("GetURL: %v", err)
+		}
+		urls, _, err := s.GetURLs(ctx, 1, 10, "")
+		if err != nil || len(urls) != 1 {
+			t.Fatalf("GetURLs = %d URLs, %v", len(urls), err)
+		}
+		for name, urlData := range map[string]models.URLData{"get": got, "list": urls[0]} {
+			if !urlData.CreatedAt.Equal(created.CreatedAt) {
+				t.Errorf("%s: created_at = %s, want it unchanged at %s", name, urlData.CreatedAt, created.CreatedAt)
+			}
+			if !urlData.UpdatedAt.Equal(updated.UpdatedAt) {
+				t.Errorf("%s: updated_at = %s, want %s", name, urlData.UpdatedAt, updated.UpdatedAt)
+			}
+		}
+	})
+}
+
+func TestStoreAutoSuffix(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		createURL(t, s, store.CreateParams{URL: "https://example.com", Slug: "promo"})
+
+		if _, err := s.CreateShortURL(ctx, store.CreateParams{URL: "https://example.com/other", Slug: "promo"}); !errors.Is(err, store.ErrExists) {
+			t.Errorf("taken slug without auto_suffix = %v, want ErrExists", err)
+		}
+
+		// Numeric suffixes come first, then random ones once they're taken
+		codes := map[string]bool{"promo": true}
+		for i := 2; i <= 10; i++ {
+			urlData := createURL(t, s, store.CreateParams{URL: "https://example.com/other", Slug: "promo", AutoSuffix: true})
+			if codes[urlData.ShortCode] {
+				t.Fatalf("auto_suffix reused %s", urlData.ShortCode)
+			}
+			codes[urlData.ShortCode] = true
+			if i <= 9 && urlData.ShortCode != fmt.Sprintf("promo-%d", i) {
+				t.Errorf("suffixed slug %d = %s, want promo-%d", i, urlData.ShortCode, i)
+			}
+			if i == 10 && !strings.HasPrefix(urlData.ShortCode, "promo-") {
+				t.Errorf("random suffixed slug = %s, want promo- and a suffix", urlData.ShortCode)
+			}
+			if got, err := s.GetRedirectData(ctx, urlData.ShortCode); err != nil || got.URL != "https://example.com/other" {
+				t.Errorf("GetRedirectData(%s) = %s, %v", urlData.ShortCode, got.URL, err)
+			}
+		}
+		if got, err := s.GetRedirectData(ctx, "promo"); err != nil || got.URL != "https://example.com" {
+			t.Errorf("original slug now redirects to %s, %v", got.URL, err)
+		}
+	})
+}
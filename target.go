@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mr-karan/lil/models"
+)
+
+// normalizeTargetURL checks a destination URL is an absolute http or https
+// URL and returns it in normalized form. URLs without a scheme, such as
+// "example.com/page", are taken as https. The returned error is meant for the
+// client.
+func normalizeTargetURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("URL is required")
+	}
+
+	u, err := url.Parse(raw)
+	// A host with a port and no scheme, like "example.com:8080/page", parses
+	// as an opaque URL with the host as its scheme
+	if err == nil && (u.Scheme == "" || (u.Opaque != "" && strings.Contains(u.Scheme, "."))) && !strings.HasPrefix(raw, "/") {
+		u, err = url.Parse("https://" + raw)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Invalid URL %q", raw)
+	}
+
+	if u.Scheme == "" {
+		return "", fmt.Errorf("URL %q must be absolute", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("URL scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("URL %q has no host", raw)
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	return u.String(), nil
+}
+
+// normalizeDeviceURLs applies normalizeTargetURL to each device URL. Empty
+// ones are left for the store to drop.
+func normalizeDeviceURLs(deviceURLs map[string]string) (map[string]string, error) {
+	if deviceURLs == nil {
+		return nil, nil
+	}
+
+	out := make(map[string]string, len(deviceURLs))
+	for platform, deviceURL := range deviceURLs {
+		if deviceURL == "" {
+			out[platform] = ""
+			continue
+		}
+		normalized, err := normalizeTargetURL(deviceURL)
+		if err != nil {
+			return nil, fmt.Errorf("Device URL for %s: %w", platform, err)
+		}
+		out[platform] = normalized
+	}
+	return out, nil
+}
+
+// normalizeUTM trims the UTM parameters of a request, returning nil when none
+// are set.
+func normalizeUTM(utm *models.UTM) *models.UTM {
+	if utm == nil {
+		return nil
+	}
+	out := models.UTM{
+		Source:   strings.TrimSpace(utm.Source),
+		Medium:   strings.TrimSpace(utm.Medium),
+		Campaign: strings.TrimSpace(utm.Campaign),
+	}
+	if out == (models.UTM{}) {
+		return nil
+	}
+	return &out
+}
+
+// appendUTM adds the set UTM parameters to target's query string. Parameters
+// target already has are left as they are, so a destination's own tracking
+// wins.
+func appendUTM(target string, utm *models.UTM) string {
+	if utm == nil {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	query := u.Query()
+	added := false
+	for _, p := range []struct{ name, value string }{
+		{"utm_source", utm.Source},
+		{"utm_medium", utm.Medium},
+		{"utm_campaign", utm.Campaign},
+	} {
+		if p.value == "" || query.Has(p.name) {
+			continue
+		}
+		query.Set(p.name, p.value)
+		added = true
+	}
+	if !added {
+		return target
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
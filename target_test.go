@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mr-karan/lil/models"
+)
+
+func TestNormalizeTargetURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // Empty when rejected
+	}{
+		{"https://example.com/page?q=1", "https://example.com/page?q=1"},
+		{"http://Example.COM/Path", "http://example.com/Path"},
+		{"  https://example.com  ", "https://example.com"},
+		{"example.com/page", "https://example.com/page"},
+		{"example.com:8080/page", "https://example.com:8080/page"},
+		{"www.example.com", "https://www.example.com"},
+		{"javascript:alert(document.cookie)", ""},
+		{"JavaScript:alert(1)", ""},
+		{"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", ""},
+		{"file:///etc/passwd", ""},
+		{"ftp://example.com/file", ""},
+		{"/relative/path", ""},
+		{"https://", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		got, err := normalizeTargetURL(tc.raw)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("normalizeTargetURL(%q) = %q, want it rejected", tc.raw, got)
+		case tc.want != "" && err != nil:
+			t.Errorf("normalizeTargetURL(%q) failed: %v", tc.raw, err)
+		case got != tc.want:
+			t.Errorf("normalizeTargetURL(%q) = %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestShortenRejectsUnsafeSchemes(t *testing.T) {
+	app := newTestApp(t)
+	for _, target := range []string{"javascript:alert(1)", "data:text/html,<script>alert(1)</script>", "file:///etc/passwd"} {
+		w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{"url": "`+target+`"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("shortening %s: status = %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestAppendUTM(t *testing.T) {
+	campaign := &models.UTM{Source: "newsletter", Medium: "email", Campaign: "spring sale"}
+	tests := []struct {
+		name   string
+		target string
+		utm    *models.UTM
+		want   string
+	}{
+		{name: "no UTM", target: "https://example.com/p?a=1", want: "https://example.com/p?a=1"},
+		{name: "no query", target: "https://example.com/p", utm: campaign, want: "https://example.com/p?utm_campaign=spring+sale&utm_medium=email&utm_source=newsletter"},
+		{name: "existing query", target: "https://example.com/p?a=1&b=two", utm: campaign, want: "https://example.com/p?a=1&b=two&utm_campaign=spring+sale&utm_medium=email&utm_source=newsletter"},
+		{name: "existing UTM kept", target: "https://example.com/p?utm_source=site", utm: campaign, want: "https://example.com/p?utm_campaign=spring+sale&utm_medium=email&utm_source=site"},
+		{name: "only set fields", target: "https://example.com/p", utm: &models.UTM{Source: "x"}, want: "https://example.com/p?utm_source=x"},
+		{name: "all already present", target: "https://example.com/p?utm_source=a", utm: &models.UTM{Source: "x"}, want: "https://example.com/p?utm_source=a"},
+		{name: "fragment kept", target: "https://example.com/p#section", utm: &models.UTM{Source: "x"}, want: "https://example.com/p?utm_source=x#section"},
+	}
+	for _, tc := range tests {
+		if got := appendUTM(tc.target, tc.utm); got != tc.want {
+			t.Errorf("%s: appendUTM(%s) = %s, want %s", tc.name, tc.target, got, tc.want)
+		}
+	}
+
+	if got := normalizeUTM(&models.UTM{Source: "  ", Medium: ""}); got != nil {
+		t.Errorf("normalizeUTM of blank fields = %+v, want nil", got)
+	}
+}
+
+// Device URLs get the link's UTM parameters like its base URL.
+func TestRedirectAppendsUTM(t *testing.T) {
+	app := newTestApp(t)
+	w := serve(app.handleShortenURL, http.MethodPost, "/api/v1/shorten", `{
+		"url": "https://example.com/p?ref=home",
+		"slug": "promo",
+		"device_urls": {"ios": "https://apps.example/app?utm_source=store"},
+		"utm": {"source": " newsletter ", "campaign": "launch"}
+	}`)
+	decodeData(t, w, http.StatusOK, nil)
+
+	for userAgent, want := range map[string]string{
+		macUA:    "https://example.com/p?ref=home&utm_campaign=launch&utm_source=newsletter",
+		iphoneUA: "https://apps.example/app?utm_campaign=launch&utm_source=store",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/promo", nil)
+		r.Header.Set("User-Agent", userAgent)
+		r.SetPathValue("shortCode", "promo")
+		w := httptest.NewRecorder()
+		app.handleRedirect(w, r)
+		if got := w.Header().Get("Location"); got != want {
+			t.Errorf("redirect for %q to %s, want %s", userAgent, got, want)
+		}
+	}
+}